@@ -0,0 +1,89 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/coreos/go-systemd/v22/unit"
+	"github.com/jstaf/onedriver/fs"
+	"github.com/jstaf/onedriver/ui"
+	"github.com/jstaf/onedriver/ui/systemd"
+)
+
+// swapped out during tests so no systemd is needed
+var unitState = func(unitName string) (active bool, enabled bool) {
+	active, _ = systemd.UnitIsActive(unitName)
+	enabled, _ = systemd.UnitIsEnabled(unitName)
+	return active, enabled
+}
+
+// MountInfo is what the launcher shows about one of the known mounts.
+type MountInfo struct {
+	Mountpoint string
+	// Account is the account signed in to the mount, empty if it is unknown.
+	Account string
+	// Active and Enabled are the state of the mount's systemd unit.
+	Active  bool
+	Enabled bool
+	// CachedBytes is the size of the file content cached on disk.
+	CachedBytes int64
+}
+
+// ListAccounts returns everything worth knowing about each of the mounts in
+// onedriver's top-level cache directory.
+func ListAccounts(cacheDir string) []MountInfo {
+	mounts := make([]MountInfo, 0)
+	for _, escaped := range ui.GetKnownMounts(cacheDir) {
+		info := MountInfo{Mountpoint: unit.UnitNamePathUnescape(escaped)}
+		info.Account, _ = ui.GetAccountName(cacheDir, escaped)
+		info.Active, info.Enabled = unitState(
+			systemd.TemplateUnit(systemd.OnedriverServiceTemplate, escaped),
+		)
+		info.CachedBytes, _ = fs.ContentSize(filepath.Join(cacheDir, escaped))
+		mounts = append(mounts, info)
+	}
+	return mounts
+}
+
+// PrintAccounts writes the known mounts to out as a table.
+func PrintAccounts(out io.Writer, mounts []MountInfo) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MOUNTPOINT\tACCOUNT\tACTIVE\tENABLED\tCACHED")
+	for _, mount := range mounts {
+		account := mount.Account
+		if account == "" {
+			account = "unknown"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			ui.EscapeHome(mount.Mountpoint),
+			account,
+			yesNo(mount.Active),
+			yesNo(mount.Enabled),
+			formatSize(mount.CachedBytes),
+		)
+	}
+	return w.Flush()
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// formatSize formats a number of bytes for humans.
+func formatSize(size int64) string {
+	const kib = 1024
+	if size < kib {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(kib), 0
+	for n := size / kib; n >= kib; n /= kib {
+		div *= kib
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,67 @@
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-systemd/v22/unit"
+	"github.com/jstaf/onedriver/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Each known mount should be listed with the account signed in to it and the
+// state of its service.
+func TestListAccounts(t *testing.T) {
+	cacheDir := t.TempDir()
+	seed := func(mountpoint, tokens string) {
+		dir := filepath.Join(cacheDir, unit.UnitNamePathEscape(mountpoint))
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, fs.ContentDir), 0700))
+		require.NoError(t, ioutil.WriteFile(
+			filepath.Join(dir, "auth_tokens.json"), []byte(tokens), 0600))
+	}
+	seed("/home/test/OneDrive", `{"account": "personal@outlook.com"}`)
+	seed("/home/test/Work Drive", `{"account": "someone@work.com"}`)
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(cacheDir, unit.UnitNamePathEscape("/home/test/Work Drive"),
+			fs.ContentDir, "some-id"),
+		make([]byte, 2048), 0600,
+	))
+	// not a mount, it was never signed in to
+	require.NoError(t, os.Mkdir(filepath.Join(cacheDir, "something-else"), 0700))
+
+	oldState := unitState
+	unitState = func(unitName string) (bool, bool) {
+		return strings.Contains(unitName, "Work"), true
+	}
+	defer func() { unitState = oldState }()
+
+	mounts := ListAccounts(cacheDir)
+	require.Len(t, mounts, 2)
+	assert.Equal(t, MountInfo{
+		Mountpoint: "/home/test/OneDrive",
+		Account:    "personal@outlook.com",
+		Active:     false,
+		Enabled:    true,
+	}, mounts[0])
+	assert.Equal(t, MountInfo{
+		Mountpoint:  "/home/test/Work Drive",
+		Account:     "someone@work.com",
+		Active:      true,
+		Enabled:     true,
+		CachedBytes: 2048,
+	}, mounts[1])
+
+	var out bytes.Buffer
+	require.NoError(t, PrintAccounts(&out, mounts))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, []string{"/home/test/OneDrive", "personal@outlook.com", "no", "yes", "0", "B"},
+		strings.Fields(lines[1]))
+	assert.Equal(t, []string{"/home/test/Work", "Drive", "someone@work.com", "yes", "yes", "2.0", "KiB"},
+		strings.Fields(lines[2]))
+}
@@ -0,0 +1,126 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/unit"
+	"github.com/jstaf/onedriver/fs"
+	"github.com/jstaf/onedriver/fs/graph"
+)
+
+// what statfs reports as the type of a FUSE filesystem
+const fuseSuperMagic = 0x65735546
+
+// swapped out during tests
+var (
+	statfs  = syscall.Statfs
+	getUser = graph.GetUser
+)
+
+// CheckResult is the outcome of one of the checks run by Check. Err is nil if
+// it passed.
+type CheckResult struct {
+	Name string
+	Err  error
+}
+
+// Check goes further than Healthcheck to find out if a mount can be trusted:
+// the filesystem has to answer a statfs, the auth tokens it uses have to be
+// accepted by the server, and it has to have fetched changes from the server
+// within maxDeltaAge. cacheDir is onedriver's top-level cache directory.
+func Check(mountpoint string, cacheDir string, maxDeltaAge time.Duration) []CheckResult {
+	absMountPath, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return []CheckResult{{Name: "mountpoint", Err: err}}
+	}
+	instance := filepath.Join(cacheDir, unit.UnitNamePathEscape(absMountPath))
+	return []CheckResult{
+		{Name: "filesystem", Err: checkStatfs(absMountPath)},
+		{Name: "auth", Err: checkAuth(filepath.Join(instance, "auth_tokens.json"), maxDeltaAge)},
+		{Name: "sync", Err: checkDelta(instance, maxDeltaAge)},
+	}
+}
+
+// checkStatfs makes sure a mountpoint has a FUSE filesystem mounted on it
+// that responds.
+func checkStatfs(mountpoint string) error {
+	done := make(chan error, 1)
+	go func() {
+		var st syscall.Statfs_t
+		err := statfs(mountpoint, &st)
+		if err == nil && st.Type != fuseSuperMagic {
+			err = errors.New("nothing is mounted there")
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(healthcheckStatTimeout):
+		return errors.New("timed out waiting for statfs, the mount is hung")
+	}
+}
+
+// checkAuth makes sure the server accepts the mount's auth tokens. Tokens are
+// never refreshed here, the mount does that itself and would lose track of
+// them. Expired tokens only fail the check if the mount should have refreshed
+// them by now.
+func checkAuth(path string, maxAge time.Duration) error {
+	auth := &graph.Auth{}
+	if err := auth.FromFile(path); err != nil {
+		return fmt.Errorf("could not read auth tokens: %w", err)
+	}
+	expiredFor := time.Since(time.Unix(auth.ExpiresAt, 0))
+	if expiredFor > maxAge {
+		return fmt.Errorf("auth tokens expired %s ago and were never refreshed",
+			expiredFor.Round(time.Second))
+	} else if expiredFor >= 0 {
+		// about to be refreshed by the mount
+		return nil
+	}
+	if _, err := getUser(auth); err != nil {
+		return fmt.Errorf("server did not accept auth tokens: %w", err)
+	}
+	return nil
+}
+
+// checkDelta makes sure a mount has fetched changes from the server recently.
+func checkDelta(instance string, maxAge time.Duration) error {
+	status, err := fs.ReadStatus(instance)
+	if err != nil {
+		return fmt.Errorf("could not read status: %w", err)
+	}
+	if status.ReauthRequired {
+		return errors.New("re-authentication required, run \"onedriver --auth-only\"")
+	}
+	if status.SyncBroken != "" {
+		return fmt.Errorf("sync is broken: %s", status.SyncBroken)
+	}
+	if status.LastDelta.IsZero() {
+		return errors.New("changes have never been fetched from the server")
+	}
+	if since := time.Since(status.LastDelta); since > maxAge {
+		return fmt.Errorf("changes were last fetched from the server %s ago",
+			since.Round(time.Second))
+	}
+	return nil
+}
+
+// PrintCheck writes one line per check, and returns true if all of them passed.
+func PrintCheck(out io.Writer, results []CheckResult) bool {
+	passed := true
+	for _, result := range results {
+		if result.Err != nil {
+			passed = false
+			fmt.Fprintf(out, "FAIL %s: %s\n", result.Name, result.Err)
+		} else {
+			fmt.Fprintf(out, "ok   %s\n", result.Name)
+		}
+	}
+	return passed
+}
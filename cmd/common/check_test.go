@@ -0,0 +1,74 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/unit"
+	"github.com/jstaf/onedriver/fs"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Every check should have to pass for a mount to be trusted, and the one that
+// failed should be named.
+func TestCheck(t *testing.T) {
+	oldStatfs, oldGetUser := statfs, getUser
+	defer func() { statfs, getUser = oldStatfs, oldGetUser }()
+	mounted := true
+	statfs = func(path string, st *syscall.Statfs_t) error {
+		if mounted {
+			st.Type = fuseSuperMagic
+		}
+		return nil
+	}
+	var userErr error
+	getUser = func(auth *graph.Auth) (graph.User, error) {
+		return graph.User{}, userErr
+	}
+
+	const cacheDir = "tmp/check/cache"
+	const mountpoint = "tmp/check/mount"
+	now := time.Now()
+	writeTestStatus(t, cacheDir, mountpoint, fs.Status{Updated: now, LastDelta: now})
+	writeTokens := func(expiresAt time.Time) {
+		absMountPath, _ := filepath.Abs(mountpoint)
+		contents, _ := json.Marshal(graph.Auth{
+			AccessToken: "token",
+			ExpiresAt:   expiresAt.Unix(),
+		})
+		require.NoError(t, ioutil.WriteFile(filepath.Join(cacheDir,
+			unit.UnitNamePathEscape(absMountPath), "auth_tokens.json"), contents, 0600))
+	}
+	writeTokens(now.Add(time.Hour))
+
+	failed := func() string {
+		var out strings.Builder
+		if PrintCheck(&out, Check(mountpoint, cacheDir, time.Minute)) {
+			return ""
+		}
+		return out.String()
+	}
+	assert.Empty(t, failed(), "Healthy mount failed its check.")
+
+	mounted = false
+	assert.Contains(t, failed(), "FAIL filesystem")
+	mounted = true
+
+	userErr = errors.New("invalid token")
+	assert.Contains(t, failed(), "FAIL auth")
+	userErr = nil
+	writeTokens(now.Add(-time.Hour))
+	assert.Contains(t, failed(), "FAIL auth", "Tokens that were never refreshed passed.")
+	writeTokens(now.Add(time.Hour))
+
+	writeTestStatus(t, cacheDir, mountpoint, fs.Status{Updated: now, LastDelta: now.Add(-time.Hour)})
+	assert.Contains(t, failed(), "FAIL sync", "Mount that stopped fetching changes passed.")
+}
@@ -1,9 +1,13 @@
 package common
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/jstaf/onedriver/fs"
+	"github.com/jstaf/onedriver/fs/graph"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -18,3 +22,39 @@ func TestXDGVolumeInfo(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, expected, driveName)
 }
+
+// A configured label should be used instead of the account name, without asking
+// the server for it.
+func TestXDGVolumeInfoCustomLabel(t *testing.T) {
+	content, err := xdgVolumeInfoContent("Work files", nil)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), ".xdg-volume-info")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	driveName, err := GetXDGVolumeInfoName(path)
+	require.NoError(t, err)
+	assert.Equal(t, "Work files", driveName)
+}
+
+// An existing .xdg-volume-info should only be written again if it has a different
+// label, or was uploaded when it should be local-only (or the other way around).
+func TestVolumeInfoOutdated(t *testing.T) {
+	content := TemplateXDGVolumeInfo("Work files")
+	data := []byte(content)
+	existing := fs.NewInodeDriveItem(&graph.DriveItem{
+		ID:   "volume-info",
+		Name: ".xdg-volume-info",
+		File: &graph.File{Hashes: graph.Hashes{QuickXorHash: graph.QuickXORHash(&data)}},
+	})
+	assert.False(t, volumeInfoOutdated(existing, content, false))
+	assert.True(t, volumeInfoOutdated(existing, TemplateXDGVolumeInfo("Home"), false),
+		"Label change was not noticed.")
+	assert.True(t, volumeInfoOutdated(existing, content, true),
+		"Uploaded copy was kept when it should be local-only.")
+
+	local, err := fs.NewInodeJSON([]byte(fmt.Sprintf(
+		`{"id":"volume-info","name":".xdg-volume-info","file":{"hashes":{"quickXorHash":%q}},"KeepLocal":true}`,
+		graph.QuickXORHash(&data))))
+	require.NoError(t, err)
+	assert.False(t, volumeInfoOutdated(local, content, true))
+	assert.True(t, volumeInfoOutdated(local, content, false))
+}
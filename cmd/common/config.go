@@ -1,13 +1,19 @@
 package common
 
 import (
+	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/coreos/go-systemd/v22/unit"
 	"github.com/imdario/mergo"
+	"github.com/jstaf/onedriver/fs"
 	"github.com/jstaf/onedriver/fs/graph"
 	"github.com/jstaf/onedriver/ui"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	yaml "gopkg.in/yaml.v3"
 )
@@ -16,6 +22,37 @@ type Config struct {
 	CacheDir         string `yaml:"cacheDir"`
 	LogLevel         string `yaml:"log"`
 	graph.AuthConfig `yaml:"auth"`
+	fs.Options       `yaml:",inline"`
+
+	// VolumeLabel is the drive name shown in file manager sidebars, instead of
+	// the account name (usually an email address).
+	VolumeLabel string `yaml:"volumeLabel,omitempty"`
+	// VolumeInfoLocalOnly keeps .xdg-volume-info (which holds the drive name)
+	// on this computer instead of uploading it.
+	VolumeInfoLocalOnly bool `yaml:"volumeInfoLocalOnly,omitempty"`
+	// LogBufferLines keeps this many of the most recent log messages that are
+	// below the log level in memory, and writes them out when an error is
+	// logged. 0 turns this off.
+	LogBufferLines int `yaml:"logBufferLines,omitempty"`
+	// LogOutput is where logs go, either "stderr" (the default) or "file".
+	LogOutput string `yaml:"logOutput,omitempty"`
+	// LogFile is the file logs are written to as JSON when LogOutput is "file",
+	// onedriver.log in the mount's cache directory if unset.
+	LogFile string `yaml:"logFile,omitempty"`
+	// LogMaxSize is how many megabytes the log file can grow to before it is
+	// rotated, 10 if unset.
+	LogMaxSize int `yaml:"logMaxSize,omitempty"`
+	// LogMaxAge is how many days rotated log files are kept, 7 if unset.
+	LogMaxAge int `yaml:"logMaxAge,omitempty"`
+	// GraphURL is the Microsoft Graph endpoint to use instead of the default
+	// one, like https://graph.microsoft.us/v1.0 for the US government cloud.
+	GraphURL string `yaml:"graphURL,omitempty"`
+	// UserAgent is sent as the User-Agent of every request instead of Go's
+	// default.
+	UserAgent string `yaml:"userAgent,omitempty"`
+	// MetricsAddr is the address Prometheus metrics are served on, like
+	// localhost:9101. Metrics are off if unset.
+	MetricsAddr string `yaml:"metricsAddr,omitempty"`
 }
 
 // DefaultConfigPath returns the default config location for onedriver
@@ -58,9 +95,67 @@ func LoadConfig(path string) *Config {
 	}
 
 	config.CacheDir = ui.UnescapeHome(config.CacheDir)
+	config.LogFile = ui.UnescapeHome(config.LogFile)
 	return config
 }
 
+// Validate checks that the config contains sensible values.
+func (c Config) Validate() error {
+	if c.LogLevel != "" {
+		if _, err := zerolog.ParseLevel(c.LogLevel); err != nil {
+			return err
+		}
+	}
+	if c.LogBufferLines < 0 {
+		return fmt.Errorf("logBufferLines cannot be negative, got %d", c.LogBufferLines)
+	}
+	switch c.LogOutput {
+	case "", "stderr", "file":
+	default:
+		return fmt.Errorf("logOutput must be \"stderr\" or \"file\", got %q", c.LogOutput)
+	}
+	if c.LogMaxSize < 0 {
+		return fmt.Errorf("logMaxSize cannot be negative, got %d", c.LogMaxSize)
+	}
+	if c.LogMaxAge < 0 {
+		return fmt.Errorf("logMaxAge cannot be negative, got %d", c.LogMaxAge)
+	}
+	if c.GraphURL != "" {
+		u, err := url.Parse(c.GraphURL)
+		if err != nil {
+			return fmt.Errorf("invalid graphURL: %w", err)
+		}
+		if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("graphURL must be an http(s) url, got %q", c.GraphURL)
+		}
+	}
+	return c.Options.Validate()
+}
+
+// OpenLogFile opens the rotating log file the config asks for when logging to
+// a file. Unless the config names one, each mountpoint gets its own log file in
+// its cache directory.
+func (c Config) OpenLogFile(mountpoint string) (*RotatingFile, error) {
+	path := c.LogFile
+	if path == "" {
+		dir := c.CacheDir
+		if mountpoint != "" {
+			absMountPath, _ := filepath.Abs(mountpoint)
+			dir = filepath.Join(dir, unit.UnitNamePathEscape(absMountPath))
+		}
+		path = filepath.Join(dir, "onedriver.log")
+	}
+	maxSize := c.LogMaxSize
+	if maxSize == 0 {
+		maxSize = defaultLogMaxSize
+	}
+	maxAge := c.LogMaxAge
+	if maxAge == 0 {
+		maxAge = defaultLogMaxAge
+	}
+	return NewRotatingFile(path, int64(maxSize)*1024*1024, time.Duration(maxAge)*24*time.Hour)
+}
+
 // Write config to a file
 func (c Config) WriteConfig(path string) error {
 	out, err := yaml.Marshal(c)
@@ -0,0 +1,68 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/coreos/go-systemd/v22/unit"
+	"github.com/jstaf/onedriver/ui"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// ConfigProfile is a portable snapshot of a user's onedriver setup that can be
+// copied between machines. Auth tokens are never part of a profile, each
+// machine has to sign in separately.
+type ConfigProfile struct {
+	Config Config `yaml:"config"`
+	// Mounts lists the mountpoints onedriver is set up for, with the user's home
+	// directory replaced by "~". Nothing about the accounts behind them is
+	// recorded.
+	Mounts []string `yaml:"mounts,omitempty"`
+}
+
+// NewConfigProfile creates a profile from the effective config and the mounts
+// found in its cache directory.
+func NewConfigProfile(config *Config) *ConfigProfile {
+	profile := &ConfigProfile{Config: *config}
+	profile.Config.CacheDir = ui.EscapeHome(config.CacheDir)
+	profile.Config.LogFile = ui.EscapeHome(config.LogFile)
+	for _, escaped := range ui.GetKnownMounts(config.CacheDir) {
+		profile.Mounts = append(profile.Mounts, ui.EscapeHome(unit.UnitNamePathUnescape(escaped)))
+	}
+	return profile
+}
+
+// Dump serializes a profile to YAML.
+func (p *ConfigProfile) Dump() ([]byte, error) {
+	return yaml.Marshal(p)
+}
+
+// LoadConfigProfile reads and validates a profile. Unknown keys are treated as
+// an error so that typos do not silently get ignored.
+func LoadConfigProfile(path string) (*ConfigProfile, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(contents))
+	decoder.KnownFields(true)
+	profile := &ConfigProfile{}
+	if err = decoder.Decode(profile); err != nil {
+		return nil, fmt.Errorf("could not parse profile: %w", err)
+	}
+	if err = profile.Config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config in profile: %w", err)
+	}
+	for i, mount := range profile.Mounts {
+		mount = ui.UnescapeHome(mount)
+		if !filepath.IsAbs(mount) {
+			return nil, fmt.Errorf("mountpoint %q is not an absolute path", mount)
+		}
+		profile.Mounts[i] = filepath.Clean(mount)
+	}
+	profile.Config.CacheDir = ui.UnescapeHome(profile.Config.CacheDir)
+	profile.Config.LogFile = ui.UnescapeHome(profile.Config.LogFile)
+	return profile, nil
+}
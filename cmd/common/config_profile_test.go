@@ -0,0 +1,65 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreos/go-systemd/v22/unit"
+	"github.com/jstaf/onedriver/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A dumped profile should load back into the same config, and should never
+// contain any auth tokens.
+func TestConfigProfileRoundTrip(t *testing.T) {
+	t.Parallel()
+	cacheDir, _ := filepath.Abs("tmp/config_profile/cache")
+	mount := "/home/someone/OneDrive"
+	instance := filepath.Join(cacheDir, unit.UnitNamePathEscape(mount))
+	require.NoError(t, os.MkdirAll(instance, 0700))
+	const secret = "super-secret-access-token"
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(instance, "auth_tokens.json"),
+		[]byte(`{"access_token": "`+secret+`"}`),
+		0600,
+	))
+
+	config := &Config{
+		CacheDir: cacheDir,
+		LogLevel: "info",
+		Options: fs.Options{
+			DeltaJitter:          0.2,
+			DeletedWithChanges:   fs.DeletedWithChangesKeep,
+			TrustCacheExtensions: []string{".mkv"},
+		},
+	}
+	dumped, err := NewConfigProfile(config).Dump()
+	require.NoError(t, err)
+	assert.NotContains(t, string(dumped), secret, "Auth tokens leaked into profile.")
+
+	path := "tmp/config_profile/profile.yml"
+	require.NoError(t, ioutil.WriteFile(path, dumped, 0600))
+	profile, err := LoadConfigProfile(path)
+	require.NoError(t, err)
+	assert.Equal(t, *config, profile.Config)
+	assert.Equal(t, []string{mount}, profile.Mounts)
+}
+
+// Profiles with invalid values or unknown keys should be rejected.
+func TestConfigProfileInvalid(t *testing.T) {
+	t.Parallel()
+	require.NoError(t, os.MkdirAll("tmp/config_profile_invalid", 0700))
+	for name, contents := range map[string]string{
+		"jitter":  "config:\n  deltaJitter: 5\n",
+		"unknown": "config:\n  notARealOption: true\n",
+		"mount":   "mounts:\n  - relative/path\n",
+	} {
+		path := filepath.Join("tmp/config_profile_invalid", name+".yml")
+		require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+		_, err := LoadConfigProfile(path)
+		assert.Error(t, err, "Invalid profile %q was accepted.", name)
+	}
+}
@@ -46,3 +46,24 @@ func TestWriteConfig(t *testing.T) {
 	conf := LoadConfig(filepath.Join(configTestDir, "config-test.yml"))
 	assert.NoError(t, conf.WriteConfig("tmp/nested/config.yml"))
 }
+
+// Only http(s) urls should be accepted as the Graph endpoint.
+func TestValidateGraphURL(t *testing.T) {
+	t.Parallel()
+	assert.NoError(t, Config{}.Validate())
+	assert.NoError(t, Config{GraphURL: "https://graph.microsoft.us/v1.0"}.Validate())
+	assert.Error(t, Config{GraphURL: "graph.microsoft.us/v1.0"}.Validate())
+	assert.Error(t, Config{GraphURL: "ftp://graph.microsoft.us/v1.0"}.Validate())
+	assert.Error(t, Config{GraphURL: "https://"}.Validate())
+	assert.Error(t, Config{GraphURL: "https://graph.microsoft.us/%zz"}.Validate())
+}
+
+// Logs can only go to stderr or a file.
+func TestValidateLogOutput(t *testing.T) {
+	t.Parallel()
+	assert.NoError(t, Config{LogOutput: "stderr"}.Validate())
+	assert.NoError(t, Config{LogOutput: "file", LogMaxSize: 1, LogMaxAge: 1}.Validate())
+	assert.Error(t, Config{LogOutput: "syslog"}.Validate())
+	assert.Error(t, Config{LogMaxSize: -1}.Validate())
+	assert.Error(t, Config{LogMaxAge: -1}.Validate())
+}
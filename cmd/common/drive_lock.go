@@ -0,0 +1,47 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// DriveLockDir is where the locks that stop a drive from being mounted twice
+// are kept.
+func DriveLockDir() string {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = os.TempDir()
+	}
+	return filepath.Join(runtimeDir, "onedriver")
+}
+
+// LockDrive makes sure no other onedriver process is serving the same drive,
+// since two mounts of a drive would each upload every change made through the
+// other. The lock is held until the returned file is closed or the process
+// exits, so a crashed onedriver never leaves a drive locked.
+func LockDrive(lockDir, driveID, mountpoint string) (*os.File, error) {
+	if err := os.MkdirAll(lockDir, 0700); err != nil {
+		return nil, err
+	}
+	// drive IDs can contain "!" but never "/", this is just to be safe
+	name := strings.ReplaceAll(driveID, "/", "_") + ".lock"
+	lock, err := os.OpenFile(filepath.Join(lockDir, name), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		other, _ := ioutil.ReadAll(lock)
+		lock.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("drive %s is already mounted at %s", driveID, other)
+		}
+		return nil, err
+	}
+	lock.Truncate(0)
+	lock.WriteString(mountpoint)
+	return lock, nil
+}
@@ -0,0 +1,30 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A drive that is already mounted somewhere should not be mounted again until
+// the first mount goes away.
+func TestLockDrive(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	first, err := LockDrive(dir, "b!drive", "/home/test/OneDrive")
+	require.NoError(t, err)
+
+	_, err = LockDrive(dir, "b!drive", "/home/test/OneDrive2")
+	require.Error(t, err, "Second mount of the same drive was allowed.")
+	assert.Contains(t, err.Error(), "/home/test/OneDrive")
+
+	other, err := LockDrive(dir, "b!other", "/home/test/Other")
+	require.NoError(t, err, "Different drives should not block each other.")
+	other.Close()
+
+	first.Close()
+	second, err := LockDrive(dir, "b!drive", "/home/test/OneDrive2")
+	require.NoError(t, err, "Drive was still locked after the first mount went away.")
+	second.Close()
+}
@@ -0,0 +1,60 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/unit"
+	"github.com/jstaf/onedriver/fs"
+)
+
+// HealthcheckMaxOffline is how long a mount can be offline (or go without
+// updating its status) before it is considered unhealthy.
+const HealthcheckMaxOffline = 5 * time.Minute
+
+// a hung FUSE mount will block stat() forever, so give up after this long
+const healthcheckStatTimeout = 5 * time.Second
+
+// Healthcheck checks that the onedriver instance serving a mountpoint is
+// responsive and has not been offline for longer than maxOffline. cacheDir is
+// onedriver's top-level cache directory. A nil error means the mount is healthy.
+func Healthcheck(mountpoint string, cacheDir string, maxOffline time.Duration) error {
+	absMountPath, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(absMountPath)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			return fmt.Errorf("mountpoint is not accessible: %w", err)
+		}
+	case <-time.After(healthcheckStatTimeout):
+		return errors.New("timed out accessing mountpoint")
+	}
+
+	status, err := fs.ReadStatus(filepath.Join(cacheDir, unit.UnitNamePathEscape(absMountPath)))
+	if err != nil {
+		return fmt.Errorf("could not read status of mountpoint: %w", err)
+	}
+	if since := time.Since(status.Updated); since > maxOffline {
+		return fmt.Errorf("status has not been updated in %s", since.Round(time.Second))
+	}
+	if status.ReauthRequired {
+		return errors.New("re-authentication required, run \"onedriver --auth-only\"")
+	}
+	if status.Offline {
+		if since := time.Since(status.OfflineSince); since > maxOffline {
+			return fmt.Errorf("mount has been offline for %s", since.Round(time.Second))
+		}
+	}
+	return nil
+}
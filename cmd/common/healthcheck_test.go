@@ -0,0 +1,69 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/unit"
+	"github.com/jstaf/onedriver/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writes a fake status file for a mountpoint, as the filesystem would
+func writeTestStatus(t *testing.T, cacheDir string, mountpoint string, status fs.Status) {
+	absMountPath, _ := filepath.Abs(mountpoint)
+	instance := filepath.Join(cacheDir, unit.UnitNamePathEscape(absMountPath))
+	require.NoError(t, os.MkdirAll(instance, 0700))
+	contents, _ := json.Marshal(status)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(instance, fs.StatusFile), contents, 0600))
+}
+
+// Healthy mounts should pass the health check, stale or long-offline ones
+// should not.
+func TestHealthcheck(t *testing.T) {
+	t.Parallel()
+	const cacheDir = "tmp/healthcheck/cache"
+	mountpoint := "tmp/healthcheck/mount"
+	require.NoError(t, os.MkdirAll(mountpoint, 0700))
+	now := time.Now()
+
+	writeTestStatus(t, cacheDir, mountpoint, fs.Status{Updated: now})
+	assert.NoError(t, Healthcheck(mountpoint, cacheDir, time.Minute))
+
+	// briefly offline is still fine
+	writeTestStatus(t, cacheDir, mountpoint, fs.Status{
+		Offline:      true,
+		OfflineSince: now.Add(-10 * time.Second),
+		Updated:      now,
+	})
+	assert.NoError(t, Healthcheck(mountpoint, cacheDir, time.Minute))
+
+	writeTestStatus(t, cacheDir, mountpoint, fs.Status{
+		Offline:      true,
+		OfflineSince: now.Add(-time.Hour),
+		Updated:      now,
+	})
+	assert.Error(t, Healthcheck(mountpoint, cacheDir, time.Minute),
+		"Mount that has been offline for too long was considered healthy.")
+
+	writeTestStatus(t, cacheDir, mountpoint, fs.Status{
+		Offline:        true,
+		OfflineSince:   now,
+		ReauthRequired: true,
+		Updated:        now,
+	})
+	assert.Error(t, Healthcheck(mountpoint, cacheDir, time.Minute),
+		"Mount that needs to be re-authenticated was considered healthy.")
+
+	writeTestStatus(t, cacheDir, mountpoint, fs.Status{Updated: now.Add(-time.Hour)})
+	assert.Error(t, Healthcheck(mountpoint, cacheDir, time.Minute),
+		"Mount with a stale status was considered healthy.")
+
+	assert.Error(t, Healthcheck("tmp/healthcheck/does-not-exist", cacheDir, time.Minute),
+		"Nonexistent mountpoint was considered healthy.")
+}
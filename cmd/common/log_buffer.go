@@ -0,0 +1,69 @@
+package common
+
+import (
+	"io"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// LogBuffer only writes log messages at or above a level, but keeps the most
+// recent messages below that level in memory. They get written right before the
+// next error, so the lead-up to an error ends up in the log without logging
+// everything all of the time.
+type LogBuffer struct {
+	sync.Mutex
+	out   io.Writer
+	level zerolog.Level
+	lines [][]byte // ring buffer of held back messages
+	next  int      // where the next held back message goes
+}
+
+// NewLogBuffer creates a LogBuffer that writes messages at or above level to out
+// and holds on to the last size messages below it. The global log level has to
+// be low enough for those messages to be created in the first place.
+func NewLogBuffer(out io.Writer, level zerolog.Level, size int) *LogBuffer {
+	return &LogBuffer{
+		out:   out,
+		level: level,
+		lines: make([][]byte, size),
+	}
+}
+
+// Write writes a message without a level, these are always written.
+func (b *LogBuffer) Write(p []byte) (int, error) {
+	return b.WriteLevel(zerolog.NoLevel, p)
+}
+
+// WriteLevel writes or holds back a message depending on its level.
+func (b *LogBuffer) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	if level < b.level {
+		if len(b.lines) > 0 {
+			// zerolog reuses its buffers once we return
+			b.lines[b.next] = append(b.lines[b.next][:0], p...)
+			b.next = (b.next + 1) % len(b.lines)
+		}
+		return len(p), nil
+	}
+	if level >= zerolog.ErrorLevel && level != zerolog.NoLevel {
+		b.flush()
+	}
+	return b.out.Write(p)
+}
+
+// flush writes out the held back messages, oldest first.
+func (b *LogBuffer) flush() {
+	for i := range b.lines {
+		line := b.lines[(b.next+i)%len(b.lines)]
+		if len(line) == 0 {
+			continue
+		}
+		b.out.Write(line)
+	}
+	for i := range b.lines {
+		b.lines[i] = b.lines[i][:0]
+	}
+	b.next = 0
+}
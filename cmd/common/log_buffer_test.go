@@ -0,0 +1,40 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// Messages below the log level should only show up in the log ahead of an error.
+func TestLogBufferFlushesOnError(t *testing.T) {
+	t.Parallel()
+	var out bytes.Buffer
+	logger := zerolog.New(NewLogBuffer(&out, zerolog.InfoLevel, 3)).Level(zerolog.TraceLevel)
+
+	logger.Trace().Msg("trace 1")
+	logger.Debug().Msg("debug 2")
+	logger.Info().Msg("info")
+	assert.NotContains(t, out.String(), "debug 2", "Held back messages were written early.")
+
+	logger.Trace().Msg("trace 3")
+	logger.Trace().Msg("trace 4")
+	logger.Error().Msg("error")
+	logger.Trace().Msg("trace 5")
+	logger.Warn().Msg("warn")
+
+	var messages []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var event struct {
+			Message string `json:"message"`
+		}
+		assert.NoError(t, json.Unmarshal([]byte(line), &event))
+		messages = append(messages, event.Message)
+	}
+	// trace 1 fell out of the buffer, trace 5 is still waiting for an error
+	assert.Equal(t, []string{"info", "debug 2", "trace 3", "trace 4", "error", "warn"}, messages)
+}
@@ -0,0 +1,134 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLogMaxSize = 10 // megabytes
+	defaultLogMaxAge  = 7  // days
+	// rotated log files get the time they were rotated at in their name
+	logRotationFormat = "2006-01-02T15-04-05.000"
+)
+
+// RotatingFile is a log file that gets moved out of the way once it grows too
+// big. Moved out files are deleted once they are older than the maximum age.
+type RotatingFile struct {
+	sync.Mutex
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	file    *os.File
+	size    int64
+}
+
+// NewRotatingFile opens a log file for appending, creating it and the
+// directories it is in if needed. The file is rotated once it would grow past
+// maxSize bytes, and rotated files are kept for maxAge.
+func NewRotatingFile(path string, maxSize int64, maxAge time.Duration) (*RotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	r := &RotatingFile{path: path, maxSize: maxSize, maxAge: maxAge}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	r.prune()
+	return r, nil
+}
+
+// open opens the log file and picks up where it left off.
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = stat.Size()
+	return nil
+}
+
+// Write writes to the log file, rotating it first if p would not fit.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			// better to keep logging to an oversized file than to lose messages
+			fmt.Fprintf(os.Stderr, "could not rotate log file %s: %s\n", r.path, err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current log file out of the way and starts a new one.
+func (r *RotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	r.file = nil
+	renameErr := os.Rename(r.path, r.rotatedPath(time.Now()))
+	if err := r.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	r.prune()
+	return nil
+}
+
+// rotatedPath is where the log file gets moved to when rotated at the given time,
+// like onedriver-2006-01-02T15-04-05.000.log for onedriver.log.
+func (r *RotatingFile) rotatedPath(at time.Time) string {
+	ext := filepath.Ext(r.path)
+	return strings.TrimSuffix(r.path, ext) + "-" + at.Format(logRotationFormat) + ext
+}
+
+// prune deletes rotated log files that are older than the maximum age.
+func (r *RotatingFile) prune() {
+	ext := filepath.Ext(r.path)
+	prefix := strings.TrimSuffix(r.path, ext) + "-"
+	rotated, _ := filepath.Glob(prefix + "*" + ext)
+	for _, path := range rotated {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(path, prefix), ext)
+		at, err := time.ParseInLocation(logRotationFormat, stamp, time.Local)
+		if err != nil {
+			// not one of ours
+			continue
+		}
+		if time.Since(at) > r.maxAge {
+			// logging about it here would end up right back in Write()
+			if err := os.Remove(path); err != nil {
+				fmt.Fprintf(os.Stderr, "could not delete old log file %s: %s\n", path, err)
+			}
+		}
+	}
+}
+
+// Close closes the log file, anything written afterwards is lost.
+func (r *RotatingFile) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
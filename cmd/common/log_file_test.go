@@ -0,0 +1,52 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The log file should be moved out of the way once it is full, and old rotated
+// files should be cleaned up.
+func TestRotatingFile(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "onedriver-log-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "logs", "onedriver.log")
+
+	// left over from long ago
+	expired := filepath.Join(dir, "logs",
+		"onedriver-"+time.Now().Add(-48*time.Hour).Format(logRotationFormat)+".log")
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+	require.NoError(t, ioutil.WriteFile(expired, []byte("old\n"), 0600))
+	unrelated := filepath.Join(dir, "logs", "onedriver-notes.log")
+	require.NoError(t, ioutil.WriteFile(unrelated, []byte("mine\n"), 0600))
+
+	logFile, err := NewRotatingFile(path, 100, 24*time.Hour)
+	require.NoError(t, err)
+	defer logFile.Close()
+	assert.NoFileExists(t, expired, "Expired log file was not deleted.")
+	assert.FileExists(t, unrelated, "Files that aren't rotated logs should be left alone.")
+
+	logger := zerolog.New(logFile)
+	for i := 0; i < 5; i++ {
+		logger.Info().Int("i", i).Msg("filling up the log file")
+	}
+	rotated, err := filepath.Glob(filepath.Join(dir, "logs", "onedriver-*T*.log"))
+	require.NoError(t, err)
+	assert.NotEmpty(t, rotated, "Log file was never rotated.")
+
+	stat, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, stat.Size(), int64(100), "Log file grew past its maximum size.")
+	contents, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(contents), `"level":"info"`, "Log file should be JSON.")
+}
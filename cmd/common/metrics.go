@@ -0,0 +1,27 @@
+package common
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/jstaf/onedriver/fs/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+// StartMetrics serves metrics for Prometheus to scrape on addr under /metrics,
+// in the background. Nothing is served if addr is empty. The returned listener
+// can be closed to stop serving.
+func StartMetrics(addr string) (net.Listener, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	log.Info().Str("addr", listener.Addr().String()).Msg("Serving metrics.")
+	go http.Serve(listener, mux)
+	return listener, nil
+}
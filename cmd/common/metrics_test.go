@@ -0,0 +1,33 @@
+package common
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/jstaf/onedriver/fs/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Metrics should only be served when an address is configured, in a format
+// Prometheus understands.
+func TestStartMetrics(t *testing.T) {
+	listener, err := StartMetrics("")
+	require.NoError(t, err)
+	assert.Nil(t, listener, "Metrics should not be served without an address.")
+
+	ops := metrics.NewCounter("onedriver_test_metrics_total", "Only used by tests.", "op")
+	ops.Inc("Lookup")
+	listener, err = StartMetrics("127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), "# TYPE onedriver_test_metrics_total counter\n")
+	assert.Contains(t, string(body), `onedriver_test_metrics_total{op="Lookup"} 1`)
+}
@@ -0,0 +1,79 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+
+	"github.com/coreos/go-systemd/v22/unit"
+	"github.com/jstaf/onedriver/fs"
+)
+
+// MonitorSocket is where the onedriver instance serving a mountpoint listens
+// for monitors.
+func MonitorSocket(mountpoint string) string {
+	absMountPath, _ := filepath.Abs(mountpoint)
+	return filepath.Join(DriveLockDir(), unit.UnitNamePathEscape(absMountPath)+".sock")
+}
+
+// Monitor connects to the onedriver instance serving a mountpoint and prints its
+// status followed by everything that happens in the filesystem until the
+// connection is closed.
+func Monitor(mountpoint string, out io.Writer) error {
+	conn, err := net.Dial("unix", MonitorSocket(mountpoint))
+	if err != nil {
+		return fmt.Errorf("could not connect to onedriver, is %s mounted? %w", mountpoint, err)
+	}
+	defer conn.Close()
+
+	decoder := json.NewDecoder(conn)
+	for {
+		var msg fs.MonitorMessage
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if msg.Status != nil {
+			printMonitorStatus(out, msg.Status)
+		}
+		if msg.Event != nil {
+			printMonitorEvent(out, msg.Event)
+		}
+	}
+}
+
+func printMonitorStatus(out io.Writer, status *fs.Status) {
+	state := "online"
+	if status.Offline {
+		state = "offline since " + status.OfflineSince.Format("15:04:05")
+	}
+	if status.ReauthRequired {
+		state += ", reauthentication required"
+	}
+	if status.SyncBroken != "" {
+		state += ", sync broken (" + status.SyncBroken + ")"
+	}
+	if status.QuotaFull {
+		state += ", OneDrive is full"
+	}
+	fmt.Fprintf(out, "%s status: %s, %d pending uploads, %d problems\n",
+		status.Updated.Format("15:04:05"), state, status.PendingUploads, len(status.Problems))
+	for _, problem := range status.Problems {
+		fmt.Fprintf(out, "    %s: %s\n", problem.Path, problem.Message)
+	}
+}
+
+func printMonitorEvent(out io.Writer, event *fs.Event) {
+	line := event.Time.Format("15:04:05") + " " + event.Type
+	if event.Path != "" {
+		line += " " + event.Path
+	}
+	if event.Message != "" {
+		line += ": " + event.Message
+	}
+	fmt.Fprintln(out, line)
+}
@@ -0,0 +1,29 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jstaf/onedriver/fs"
+	"github.com/stretchr/testify/assert"
+)
+
+// Monitor output should be one readable line per event.
+func TestPrintMonitorEvent(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2023, 1, 2, 15, 4, 5, 0, time.Local)
+	var out bytes.Buffer
+	printMonitorEvent(&out, &fs.Event{
+		Time:    now,
+		Type:    fs.EventUploadFailed,
+		Path:    "/Documents/notes.txt",
+		Message: "HTTP 503 - serviceNotAvailable",
+	})
+	printMonitorEvent(&out, &fs.Event{Time: now, Type: fs.EventDelta, Message: "Applied 2 changes."})
+	assert.Equal(t, []string{
+		"15:04:05 uploadFailed /Documents/notes.txt: HTTP 503 - serviceNotAvailable",
+		"15:04:05 delta: Applied 2 changes.",
+	}, strings.Split(strings.TrimSpace(out.String()), "\n"))
+}
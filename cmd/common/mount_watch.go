@@ -0,0 +1,47 @@
+package common
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// MountWatchInterval is how often the mount table is checked for our mount.
+const MountWatchInterval = 10 * time.Second
+
+// unmounter is the part of a fuse.Server needed to shut it down.
+type unmounter interface {
+	Unmount() error
+}
+
+// UnmountOnLostMountpoint shuts the filesystem down once its mount disappears,
+// like when the mountpoint is deleted or whatever it was on gets unmounted. The
+// kernel never tells us when this happens, and the filesystem keeps working
+// fine internally (so the heartbeat can't notice either), so otherwise we'd keep
+// running with nothing able to reach us. Blocks until the mount is gone and
+// returns whatever went wrong shutting down.
+func UnmountOnLostMountpoint(mountpoint string, interval time.Duration, server unmounter) error {
+	watchMountpoint(mountpoint, interval)
+	log.Error().
+		Str("mountpoint", mountpoint).
+		Msg("Mountpoint disappeared, was it deleted or unmounted? Shutting down.")
+	if err := server.Unmount(); err != nil {
+		return fmt.Errorf("could not unmount after losing the mountpoint: %w", err)
+	}
+	return nil
+}
+
+// watchMountpoint blocks until our mount at mountpoint is no longer in the mount
+// table. It only starts watching once the mount shows up.
+func watchMountpoint(mountpoint string, interval time.Duration) {
+	seen := false
+	for {
+		mounted := hasOnedriverMount(mountpoint)
+		if seen && !mounted {
+			return
+		}
+		seen = seen || mounted
+		time.Sleep(interval)
+	}
+}
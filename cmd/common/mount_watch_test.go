@@ -0,0 +1,91 @@
+package common
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeServer struct {
+	unmounted chan struct{}
+	err       error
+}
+
+func (s *fakeServer) Unmount() error {
+	close(s.unmounted)
+	return s.err
+}
+
+// Once our mount disappears from the mount table, the filesystem should be
+// unmounted so that onedriver exits instead of serving nothing forever.
+func TestUnmountOnLostMountpoint(t *testing.T) {
+	fakeMounts(t, "onedriver /home/test/OneDrive fuse.onedriver rw,nosuid,nodev 0 0\n")
+	server := &fakeServer{unmounted: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		done <- UnmountOnLostMountpoint("/home/test/OneDrive", 10*time.Millisecond, server)
+	}()
+
+	select {
+	case <-server.unmounted:
+		t.Fatal("Unmounted while the mount was still there.")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// what the mount table looks like once the mountpoint's parent is unmounted
+	require.NoError(t, ioutil.WriteFile(mountsFile,
+		[]byte("proc /proc proc rw,nosuid,nodev,noexec,relatime 0 0\n"), 0644))
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lost mountpoint was not noticed.")
+	}
+	select {
+	case <-server.unmounted:
+	default:
+		t.Fatal("Filesystem was not unmounted.")
+	}
+}
+
+// fusermount usually can't unmount a mount that is already gone, that has to be
+// reported so the filesystem can be shut down some other way.
+func TestUnmountOnLostMountpointFails(t *testing.T) {
+	fakeMounts(t, "onedriver /home/test/OneDrive fuse.onedriver rw,nosuid,nodev 0 0\n")
+	server := &fakeServer{
+		unmounted: make(chan struct{}),
+		err:       errors.New("fusermount3: entry for /home/test/OneDrive not found in /etc/mtab"),
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- UnmountOnLostMountpoint("/home/test/OneDrive", 10*time.Millisecond, server)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, ioutil.WriteFile(mountsFile, []byte(""), 0644))
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, server.err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lost mountpoint was not noticed.")
+	}
+}
+
+// The mount may not be up yet when watching starts, that's not a lost mount.
+func TestWatchMountpointWaitsForMount(t *testing.T) {
+	fakeMounts(t, "")
+	done := make(chan struct{})
+	go func() {
+		watchMountpoint("/home/test/OneDrive", 10*time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("A mount that never showed up was treated as lost.")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,36 @@
+package common
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/rs/zerolog/log"
+)
+
+// StartProfiler serves the net/http/pprof endpoints on addr in the background so
+// that CPU and heap profiles can be captured from a running instance. Nothing is
+// served if addr is empty. The returned listener can be closed to stop serving.
+func StartProfiler(addr string) (net.Listener, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// use our own mux so profiling is never exposed anywhere else by accident
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	log.Warn().
+		Str("addr", listener.Addr().String()).
+		Msg("Profiling enabled, do not leave this running on a shared machine.")
+	go http.Serve(listener, mux)
+	return listener, nil
+}
@@ -0,0 +1,32 @@
+package common
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The pprof endpoints should only be served when profiling is enabled.
+func TestStartProfiler(t *testing.T) {
+	listener, err := StartProfiler("")
+	require.NoError(t, err)
+	assert.Nil(t, listener, "Profiler should not start without an address.")
+
+	listener, err = StartProfiler("127.0.0.1:0")
+	require.NoError(t, err)
+	// don't reuse connections, or we'd never notice the profiler going away
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	url := "http://" + listener.Addr().String() + "/debug/pprof/"
+	for _, endpoint := range []string{"", "heap", "goroutine"} {
+		resp, err := client.Get(url + endpoint)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "Could not fetch "+url+endpoint)
+	}
+
+	listener.Close()
+	_, err = client.Get(url)
+	assert.Error(t, err, "Profiler was still reachable after being stopped.")
+}
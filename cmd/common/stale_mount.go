@@ -0,0 +1,84 @@
+package common
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/rs/zerolog/log"
+)
+
+// these are swapped out during tests so no real mounts are needed
+var (
+	mountsFile     = "/proc/mounts"
+	statMountpoint = os.Stat
+	lazyUnmount    = func(mountpoint string) error {
+		return exec.Command("fusermount3", "-uz", mountpoint).Run()
+	}
+)
+
+// RecoverStaleMount lazily unmounts what's left of a onedriver instance that
+// died without unmounting its mountpoint, which otherwise fails every access
+// with "transport endpoint is not connected" until someone runs
+// "fusermount3 -uz". Mounts that belong to something else or are still being
+// served are left alone. Returns true if an unmount was attempted.
+func RecoverStaleMount(mountpoint string) (bool, error) {
+	absMountPath, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return false, err
+	}
+	if _, err := statMountpoint(absMountPath); !errors.Is(err, syscall.ENOTCONN) {
+		return false, nil
+	}
+	if !hasOnedriverMount(absMountPath) {
+		return false, nil
+	}
+	log.Warn().
+		Str("mountpoint", absMountPath).
+		Msg("Found a stale onedriver mount at the mountpoint, attempting a lazy unmount.")
+	return true, lazyUnmount(absMountPath)
+}
+
+// hasOnedriverMount checks if there is a onedriver FUSE mount at the mountpoint.
+func hasOnedriverMount(mountpoint string) bool {
+	file, err := os.Open(mountsFile)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// device mountpoint type options dump pass
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		if fields[2] == "fuse.onedriver" && unescapeMountPath(fields[1]) == mountpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// unescapeMountPath undoes the octal escapes (like "\040" for a space) the
+// kernel uses for whitespace and backslashes in /proc/mounts.
+func unescapeMountPath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+4 <= len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
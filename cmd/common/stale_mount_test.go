@@ -0,0 +1,63 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMounts points the stale mount checks at a fake /proc/mounts and a
+// mountpoint that always fails with ENOTCONN. Returns the mountpoints that were
+// unmounted.
+func fakeMounts(t *testing.T, mounts string) *[]string {
+	file := filepath.Join(t.TempDir(), "mounts")
+	require.NoError(t, ioutil.WriteFile(file, []byte(mounts), 0644))
+
+	unmounted := make([]string, 0)
+	oldFile, oldStat, oldUnmount := mountsFile, statMountpoint, lazyUnmount
+	mountsFile = file
+	statMountpoint = func(path string) (os.FileInfo, error) {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: syscall.ENOTCONN}
+	}
+	lazyUnmount = func(mountpoint string) error {
+		unmounted = append(unmounted, mountpoint)
+		return nil
+	}
+	t.Cleanup(func() {
+		mountsFile, statMountpoint, lazyUnmount = oldFile, oldStat, oldUnmount
+	})
+	return &unmounted
+}
+
+// A dead onedriver mount should be lazily unmounted so we can mount again.
+func TestRecoverStaleMount(t *testing.T) {
+	unmounted := fakeMounts(t,
+		"proc /proc proc rw,nosuid,nodev,noexec,relatime 0 0\n"+
+			"onedriver /home/test/One\\040Drive fuse.onedriver rw,nosuid,nodev 0 0\n")
+
+	attempted, err := RecoverStaleMount("/home/test/One Drive")
+	require.NoError(t, err)
+	assert.True(t, attempted, "Recovery was not attempted for a stale mount.")
+	assert.Equal(t, []string{"/home/test/One Drive"}, *unmounted)
+}
+
+// Other filesystems mounted at the mountpoint are none of our business.
+func TestRecoverStaleMountOtherFilesystem(t *testing.T) {
+	unmounted := fakeMounts(t, "sshfs /home/test/OneDrive fuse.sshfs rw,nosuid,nodev 0 0\n")
+
+	attempted, err := RecoverStaleMount("/home/test/OneDrive")
+	require.NoError(t, err)
+	assert.False(t, attempted)
+	assert.Empty(t, *unmounted)
+}
+
+func TestUnescapeMountPath(t *testing.T) {
+	assert.Equal(t, "/home/test/One Drive", unescapeMountPath("/home/test/One\\040Drive"))
+	assert.Equal(t, "/a\\b", unescapeMountPath("/a\\134b"))
+	assert.Equal(t, "/trailing\\", unescapeMountPath("/trailing\\"))
+}
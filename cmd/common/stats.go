@@ -0,0 +1,55 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/unit"
+	"github.com/jstaf/onedriver/fs"
+)
+
+// how long to wait on a running onedriver instance for its status
+const statsTimeout = 5 * time.Second
+
+// Stats is the status of a running onedriver instance along with how much disk
+// space its cache uses, meant to be consumed by scripts.
+type Stats struct {
+	fs.Status
+	// CachedBytes is the size of all file content cached on disk.
+	CachedBytes int64 `json:"cachedBytes"`
+}
+
+// GetStats asks the onedriver instance serving a mountpoint for its status
+// through its monitor socket. cacheDir is onedriver's top-level cache directory.
+func GetStats(mountpoint string, cacheDir string) (*Stats, error) {
+	absMountPath, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("unix", MonitorSocket(absMountPath), statsTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to onedriver, is %s mounted? %w", mountpoint, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(statsTimeout))
+
+	// the status is always the first thing sent to a new monitor
+	var msg fs.MonitorMessage
+	if err := json.NewDecoder(conn).Decode(&msg); err != nil {
+		return nil, fmt.Errorf("could not read status: %w", err)
+	}
+	if msg.Status == nil {
+		return nil, fmt.Errorf("onedriver did not send its status")
+	}
+
+	stats := &Stats{Status: *msg.Status}
+	stats.CachedBytes, err = fs.ContentSize(
+		filepath.Join(cacheDir, unit.UnitNamePathEscape(absMountPath)))
+	if err != nil {
+		return nil, fmt.Errorf("could not measure cache size: %w", err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,58 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/unit"
+	"github.com/jstaf/onedriver/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Stats should combine the running instance's status with the size of its cache.
+func TestGetStats(t *testing.T) {
+	t.Parallel()
+	mountpoint, err := filepath.Abs(filepath.Join(t.TempDir(), "mnt"))
+	require.NoError(t, err)
+	cacheDir := t.TempDir()
+	contentDir := filepath.Join(cacheDir, unit.UnitNamePathEscape(mountpoint), fs.ContentDir)
+	require.NoError(t, os.MkdirAll(contentDir, 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(contentDir, "a"), make([]byte, 1000), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(contentDir, "b"), make([]byte, 234), 0600))
+
+	_, err = GetStats(mountpoint, cacheDir)
+	assert.Error(t, err, "Stats should fail when nothing is mounted.")
+
+	// pretend to be the onedriver instance serving the mountpoint
+	require.NoError(t, os.MkdirAll(DriveLockDir(), 0700))
+	listener, err := net.Listen("unix", MonitorSocket(mountpoint))
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		json.NewEncoder(conn).Encode(fs.MonitorMessage{Status: &fs.Status{
+			Inodes:         42,
+			PendingUploads: 3,
+			ActiveUploads:  1,
+			Updated:        time.Now(),
+		}})
+	}()
+
+	stats, err := GetStats(mountpoint, cacheDir)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1234, stats.CachedBytes)
+	assert.Equal(t, 42, stats.Inodes)
+	assert.Equal(t, 3, stats.PendingUploads)
+	assert.Equal(t, 1, stats.ActiveUploads)
+	assert.False(t, stats.Offline)
+}
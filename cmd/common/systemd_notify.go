@@ -0,0 +1,51 @@
+package common
+
+import (
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+	"github.com/rs/zerolog/log"
+)
+
+// NotifyStatusInterval is how often the status shown by systemd is checked for
+// changes.
+const NotifyStatusInterval = 5 * time.Second
+
+// NotifySystemd tells systemd that the filesystem is ready to serve files, so
+// that units with Type=notify (and anything ordered after them) only count as
+// started once the mount can actually be used. Afterwards it keeps the status
+// systemd shows for the unit in line with whether the filesystem is online,
+// checking every interval. Returns right away if systemd isn't listening,
+// otherwise it never returns.
+func NotifySystemd(offline func() bool, interval time.Duration) {
+	wasOffline := offline()
+	sent, err := daemon.SdNotify(false, daemon.SdNotifyReady+"\n"+systemdStatus(wasOffline))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not tell systemd that the filesystem is ready.")
+		return
+	}
+	if !sent {
+		// not started by systemd, or not as Type=notify
+		return
+	}
+	log.Debug().Msg("Told systemd that the filesystem is ready.")
+	for {
+		time.Sleep(interval)
+		isOffline := offline()
+		if isOffline == wasOffline {
+			continue
+		}
+		wasOffline = isOffline
+		if _, err := daemon.SdNotify(false, systemdStatus(isOffline)); err != nil {
+			log.Warn().Err(err).Msg("Could not update status shown by systemd.")
+		}
+	}
+}
+
+// systemdStatus is the STATUS= line shown by "systemctl status".
+func systemdStatus(offline bool) string {
+	if offline {
+		return "STATUS=Offline, the filesystem is read-only until connectivity is re-established."
+	}
+	return "STATUS=Online."
+}
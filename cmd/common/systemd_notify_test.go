@@ -0,0 +1,59 @@
+package common
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Under systemd, readiness should be signalled once and the unit's status should
+// follow the filesystem going offline and back online.
+func TestNotifySystemd(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	read := func() string {
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		require.NoError(t, err, "Nothing was sent to systemd.")
+		return string(buf[:n])
+	}
+
+	var offline int32
+	go NotifySystemd(func() bool { return atomic.LoadInt32(&offline) == 1 }, 10*time.Millisecond)
+	ready := read()
+	assert.Contains(t, strings.Split(ready, "\n"), "READY=1")
+	assert.Contains(t, ready, "STATUS=Online.")
+
+	atomic.StoreInt32(&offline, 1)
+	assert.Contains(t, read(), "STATUS=Offline")
+	atomic.StoreInt32(&offline, 0)
+	assert.Equal(t, "STATUS=Online.", read())
+}
+
+// Without systemd listening, there is nothing to do.
+func TestNotifySystemdNoSocket(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	done := make(chan struct{})
+	go func() {
+		NotifySystemd(func() bool { return false }, time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Kept running without systemd.")
+	}
+}
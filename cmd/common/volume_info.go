@@ -0,0 +1,90 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jstaf/onedriver/fs"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// XDGVolumeInfo returns a startup task that creates .xdg-volume-info for a nice
+// little onedriver logo in the corner of the mountpoint, and shows the drive's
+// name in the nautilus sidebar. The name is the account name unless a label is
+// given, an existing file is rewritten if it has a different label. Without a
+// label, whatever name the drive was given in the launcher is left alone. With
+// localOnly, the file is never uploaded to the server, and a copy that was
+// uploaded before is deleted there.
+func XDGVolumeInfo(label string, localOnly bool) fs.StartupTask {
+	return func(filesystem *fs.Filesystem, auth *graph.Auth) error {
+		child, _ := filesystem.GetPath("/.xdg-volume-info", auth)
+		if child != nil && label == "" && child.KeepLocal() == localOnly {
+			return nil
+		}
+		xdgVolumeInfo, err := xdgVolumeInfoContent(label, auth)
+		if err != nil {
+			return fmt.Errorf("could not create .xdg-volume-info: %w", err)
+		}
+		if child != nil {
+			if !volumeInfoOutdated(child, xdgVolumeInfo, localOnly) {
+				return nil
+			}
+			if localOnly && !child.KeepLocal() {
+				log.Info().Msg("Deleting .xdg-volume-info from the server, it is local-only now.")
+				if err := graph.Remove(child.ID(), auth); err != nil {
+					return fmt.Errorf("could not delete .xdg-volume-info from the server: %w", err)
+				}
+			}
+			filesystem.DeleteID(child.ID())
+		}
+		log.Info().Bool("localOnly", localOnly).Msg("Creating .xdg-volume-info")
+
+		root, _ := filesystem.GetPath("/", auth) // cannot fail
+		if localOnly {
+			_, err = filesystem.CreateLocalFile(root.ID(), ".xdg-volume-info", []byte(xdgVolumeInfo))
+			return err
+		}
+
+		// just upload directly and shove it in the cache
+		resp, err := graph.Put(
+			graph.ResourcePath("/.xdg-volume-info")+":/content",
+			auth,
+			strings.NewReader(xdgVolumeInfo),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to write .xdg-volume-info: %w", err)
+		}
+		inode := fs.NewInode(".xdg-volume-info", 0644, root)
+		if json.Unmarshal(resp, &inode) == nil {
+			filesystem.InsertID(inode.ID(), inode)
+		}
+		return nil
+	}
+}
+
+// volumeInfoOutdated returns true if an existing .xdg-volume-info has to be
+// written again to have content, and be kept local or not.
+func volumeInfoOutdated(existing *fs.Inode, content string, localOnly bool) bool {
+	if existing.KeepLocal() != localOnly {
+		return true
+	}
+	data := []byte(content)
+	existing.RLock()
+	defer existing.RUnlock()
+	return !existing.VerifyChecksum(graph.QuickXORHash(&data))
+}
+
+// xdgVolumeInfoContent returns the contents of .xdg-volume-info. The account
+// name is only fetched when no label is given.
+func xdgVolumeInfoContent(label string, auth *graph.Auth) (string, error) {
+	if label == "" {
+		user, err := graph.GetUser(auth)
+		if err != nil {
+			return "", err
+		}
+		label = user.UserPrincipalName
+	}
+	return TemplateXDGVolumeInfo(label), nil
+}
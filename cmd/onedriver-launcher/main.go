@@ -434,13 +434,42 @@ func newMountRow(config common.Config, mount string) (*gtk.ListBoxRow, *gtk.Swit
 	popover.Add(popoverBox)
 	popover.SetPosition(gtk.POS_BOTTOM)
 
+	// shows how the mount is doing, click for details like failed uploads
+	statusBtn, _ := gtk.ButtonNew()
+	statusBtn.SetRelief(gtk.RELIEF_NONE)
+	statusIcon, _ := gtk.ImageNew()
+	statusBtn.SetImage(statusIcon)
+	updateStatus := func() {
+		status := ui.GetMountStatus(config.CacheDir, escapedMount)
+		if !mountToggle.GetActive() || status.IconName == "" {
+			statusBtn.SetVisible(false)
+			return
+		}
+		statusIcon.SetFromIconName(status.IconName, gtk.ICON_SIZE_BUTTON)
+		statusBtn.SetTooltipText(status.Summary)
+		statusBtn.SetVisible(true)
+	}
+	statusBtn.Connect("clicked", func() {
+		status := ui.GetMountStatus(config.CacheDir, escapedMount)
+		ui.Dialog(status.Details(), gtk.MESSAGE_INFO, nil)
+	})
+	statusTimer := glib.TimeoutAdd(5000, func() bool {
+		updateStatus()
+		return true
+	})
+	row.Connect("destroy", func() {
+		glib.SourceRemove(statusTimer)
+	})
+
 	// add all widgets to row in the right order
 	box.PackEnd(mountpointSettingsBtn, false, false, 0)
 	box.PackEnd(mountToggle, false, false, 0)
+	box.PackEnd(statusBtn, false, false, 0)
 
 	// name is used by "row-activated" callback
 	row.SetName(mount)
 	row.ShowAll()
+	updateStatus()
 	return row, mountToggle
 }
 
@@ -2,12 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strings"
 	"syscall"
 	"time"
 
@@ -16,6 +17,7 @@ import (
 	"github.com/jstaf/onedriver/cmd/common"
 	"github.com/jstaf/onedriver/fs"
 	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/jstaf/onedriver/ui/systemd"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	flag "github.com/spf13/pflag"
@@ -38,7 +40,8 @@ Valid options:
 }
 
 func main() {
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: "15:04:05"})
+	console := zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: "15:04:05"}
+	log.Logger = log.Output(console)
 
 	// setup cli parsing
 	authOnly := flag.BoolP("auth-only", "a", false,
@@ -57,9 +60,57 @@ func main() {
 	wipeCache := flag.BoolP("wipe-cache", "w", false,
 		"Delete the existing onedriver cache directory and then exit. "+
 			"This is equivalent to resetting the program.")
+	resync := flag.Bool("resync", false,
+		"Forget everything known about the drive mounted at the mountpoint, "+
+			"then exit. The next mount rebuilds it from the server, keeping "+
+			"downloaded files and the login.")
 	versionFlag := flag.BoolP("version", "v", false, "Display program version.")
 	debugOn := flag.BoolP("debug", "d", false, "Enable FUSE debug logging. "+
 		"This logs communication between onedriver and the kernel.")
+	dumpProfile := flag.Bool("dump-profile", false,
+		"Print the current configuration and a list of mountpoints as a profile "+
+			"that can be loaded on another machine with --load-profile, then exit. "+
+			"Auth tokens are never included.")
+	loadProfile := flag.String("load-profile", "",
+		"Validate a profile created with --dump-profile and save it as the "+
+			"configuration file, then exit.")
+	enableMounts := flag.Bool("enable-mounts", false,
+		"Used with --load-profile. Also enable the systemd units for each of "+
+			"the profile's mountpoints.")
+	shareLink := flag.String("share", "",
+		"Mount only the folder behind this sharing link instead of your own "+
+			"OneDrive. The mount is read-only unless the link allows editing.")
+	healthcheck := flag.Bool("healthcheck", false,
+		"Check that the mountpoint is responsive and has not been offline for "+
+			"too long, then exit. Exits non-zero if the mount is unhealthy.")
+	check := flag.Bool("check", false,
+		"Check that the mountpoint answers, that the server accepts its login, and "+
+			"that it has fetched changes from the server recently, then exit. Prints "+
+			"what failed and exits non-zero if anything did.")
+	syncFlag := flag.Bool("sync", false,
+		"Upload all changes the mount at the given mountpoint is holding onto "+
+			"because of the manualSync option, then exit.")
+	refreshDir := flag.String("refresh-dir", "",
+		"Fetch the contents of this directory in a mounted OneDrive from the "+
+			"server again, for changes that have not shown up yet, then exit.")
+	monitor := flag.Bool("monitor", false,
+		"Show what the onedriver instance serving the specified mountpoint is doing "+
+			"(uploads, downloads, changes from the server, and problems) as it happens.")
+	stats := flag.Bool("stats", false,
+		"Print the status of the mount at the given mountpoint as JSON, including "+
+			"how much disk space its cache uses and how many uploads are pending, then exit.")
+	listAccounts := flag.Bool("list-accounts", false,
+		"List the mounts onedriver knows about, who they are signed in as, "+
+			"whether their services are running, and how much they have cached, then exit.")
+	uid := flag.Int("uid", -1,
+		"Make the files in the mount belong to this user id instead of the user "+
+			"running onedriver. Needs root or CAP_CHOWN.")
+	gid := flag.Int("gid", -1,
+		"Make the files in the mount belong to this group id instead of the group "+
+			"of the user running onedriver. Needs root or CAP_CHOWN.")
+	profileAddr := flag.String("profile", "",
+		"Serve pprof profiling endpoints on this address (for example localhost:6060).")
+	flag.CommandLine.MarkHidden("profile")
 	help := flag.BoolP("help", "h", false, "Displays this help message.")
 	flag.Usage = usage
 	flag.Parse()
@@ -73,6 +124,11 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *loadProfile != "" {
+		applyProfile(*loadProfile, *configPath, *enableMounts)
+		os.Exit(0)
+	}
+
 	config := common.LoadConfig(*configPath)
 	// command line options override config options
 	if *cacheDir != "" {
@@ -81,8 +137,32 @@ func main() {
 	if *logLevel != "" {
 		config.LogLevel = *logLevel
 	}
+	if *uid >= 0 {
+		owner := uint32(*uid)
+		config.UID = &owner
+	}
+	if *gid >= 0 {
+		group := uint32(*gid)
+		config.GID = &group
+	}
+
+	if err := config.Validate(); err != nil {
+		log.Fatal().Err(err).Str("path", *configPath).Msg("Invalid configuration.")
+	}
 
 	zerolog.SetGlobalLevel(common.StringToLevel(config.LogLevel))
+	graph.SetGraphURL(config.GraphURL)
+	graph.SetUserAgent(config.UserAgent)
+	graph.SetRetries(config.Retries())
+
+	if *dumpProfile {
+		out, err := common.NewConfigProfile(config).Dump()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not create profile.")
+		}
+		os.Stdout.Write(out)
+		os.Exit(0)
+	}
 
 	// wipe cache if desired
 	if *wipeCache {
@@ -91,6 +171,112 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *resync {
+		if len(flag.Args()) == 0 {
+			fmt.Fprintf(os.Stderr, "No mountpoint provided, exiting.\n")
+			os.Exit(1)
+		}
+		absMountPath, _ := filepath.Abs(flag.Arg(0))
+		cachePath := filepath.Join(config.CacheDir, unit.UnitNamePathEscape(absMountPath))
+		if err := fs.Resync(cachePath); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not resync: %s\n", err)
+			if errors.Is(err, fs.ErrUnsyncedChanges) {
+				fmt.Fprintf(os.Stderr, "Mount the drive until they are uploaded and try again.\n")
+			}
+			os.Exit(1)
+		}
+		log.Info().Str("path", cachePath).Msg("Drive will be resynced on the next mount.")
+		os.Exit(0)
+	}
+
+	if *healthcheck {
+		if len(flag.Args()) == 0 {
+			fmt.Fprintf(os.Stderr, "No mountpoint provided, exiting.\n")
+			os.Exit(1)
+		}
+		err := common.Healthcheck(flag.Arg(0), config.CacheDir, common.HealthcheckMaxOffline)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unhealthy: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("healthy")
+		os.Exit(0)
+	}
+
+	if *check {
+		if len(flag.Args()) == 0 {
+			fmt.Fprintf(os.Stderr, "No mountpoint provided, exiting.\n")
+			os.Exit(1)
+		}
+		results := common.Check(flag.Arg(0), config.CacheDir, common.HealthcheckMaxOffline)
+		if !common.PrintCheck(os.Stdout, results) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *syncFlag {
+		if len(flag.Args()) == 0 {
+			fmt.Fprintf(os.Stderr, "No mountpoint provided, exiting.\n")
+			os.Exit(1)
+		}
+		if err := fs.RequestSync(flag.Arg(0)); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not sync: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *refreshDir != "" {
+		if err := fs.RequestRefresh(*refreshDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not refresh %s: %s\n", *refreshDir, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *monitor {
+		if len(flag.Args()) == 0 {
+			fmt.Fprintf(os.Stderr, "No mountpoint provided, exiting.\n")
+			os.Exit(1)
+		}
+		if err := common.Monitor(flag.Arg(0), os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *stats {
+		if len(flag.Args()) == 0 {
+			fmt.Fprintf(os.Stderr, "No mountpoint provided, exiting.\n")
+			os.Exit(1)
+		}
+		result, err := common.GetStats(flag.Arg(0), config.CacheDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		out, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(out))
+		os.Exit(0)
+	}
+
+	if *listAccounts {
+		if err := common.PrintAccounts(os.Stdout, common.ListAccounts(config.CacheDir)); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if _, err := common.StartProfiler(*profileAddr); err != nil {
+		log.Fatal().Err(err).Str("addr", *profileAddr).Msg("Could not start profiler.")
+	}
+	if _, err := common.StartMetrics(config.MetricsAddr); err != nil {
+		log.Fatal().Err(err).Str("addr", config.MetricsAddr).Msg("Could not serve metrics.")
+	}
+
 	// determine and validate mountpoint
 	if len(flag.Args()) == 0 {
 		flag.Usage()
@@ -98,7 +284,32 @@ func main() {
 		os.Exit(1)
 	}
 
+	// only the mount itself logs to the file, the one-shot commands above run
+	// next to it and would otherwise write to its log
+	var logOut io.Writer = console
+	if config.LogOutput == "file" {
+		// JSON is easier to search through than what the console gets
+		logFile, err := config.OpenLogFile(flag.Arg(0))
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not open log file.")
+		}
+		defer logFile.Close()
+		logOut = logFile
+		log.Logger = log.Output(logOut)
+	}
+	level := common.StringToLevel(config.LogLevel)
+	if config.LogBufferLines > 0 && level > zerolog.TraceLevel {
+		// everything gets logged, but only errors let the extra detail through
+		log.Logger = log.Output(common.NewLogBuffer(logOut, level, config.LogBufferLines))
+		level = zerolog.TraceLevel
+	}
+	zerolog.SetGlobalLevel(level)
+
 	mountpoint := flag.Arg(0)
+	if _, err := common.RecoverStaleMount(mountpoint); err != nil {
+		log.Error().Err(err).Str("mountpoint", mountpoint).
+			Msg("Could not unmount stale mount.")
+	}
 	st, err := os.Stat(mountpoint)
 	if err != nil || !st.IsDir() {
 		log.Fatal().
@@ -114,7 +325,10 @@ func main() {
 	cachePath := filepath.Join(config.CacheDir, unit.UnitNamePathEscape(absMountPath))
 
 	// authenticate/re-authenticate if necessary
-	os.MkdirAll(cachePath, 0700)
+	os.MkdirAll(config.CacheDir, 0700)
+	if err := fs.PrepareCacheDir(cachePath, config.Options); err != nil {
+		log.Fatal().Err(err).Str("path", cachePath).Msg("Could not create cache directory.")
+	}
 	authPath := filepath.Join(cachePath, "auth_tokens.json")
 	if *authOnly {
 		os.Remove(authPath)
@@ -122,25 +336,81 @@ func main() {
 		os.Exit(0)
 	}
 
+	if err := fs.CheckOwner(config.Options); err != nil {
+		log.Fatal().Err(err).Msg("Cannot change who owns the files in the mount.")
+	}
+
 	// create the filesystem
 	log.Info().Msgf("onedriver %s", common.Version())
 	auth := graph.Authenticate(config.AuthConfig, authPath, *headless)
-	filesystem := fs.NewFilesystem(auth, cachePath)
+	var mountOptions []string
+	if *shareLink != "" {
+		item, writable, err := graph.GetSharedItem(*shareLink, auth)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not resolve sharing link.")
+		}
+		log.Info().
+			Str("name", item.Name).
+			Bool("writable", writable).
+			Msg("Mounting shared item.")
+		graph.UseSharedItem(item)
+		if !writable {
+			mountOptions = append(mountOptions, "ro")
+		}
+	}
+	filesystem := fs.NewFilesystem(auth, cachePath, config.Options)
+	if driveID := filesystem.DriveID(); driveID != "" {
+		lock, err := common.LockDrive(common.DriveLockDir(), driveID, absMountPath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Refusing to mount the same drive twice, " +
+				"changes would be uploaded once by each mount.")
+		}
+		defer lock.Close()
+	}
 	go filesystem.DeltaLoop(30 * time.Second)
-	xdgVolumeInfo(filesystem, auth)
+	go filesystem.RemoveOrphanedContent(fs.OrphanGracePeriod)
+	go filesystem.Heartbeat()
+	go filesystem.BandwidthScheduleLoop(fs.BandwidthScheduleInterval)
 
-	server, err := fuse.NewServer(filesystem, mountpoint, &fuse.MountOptions{
+	if config.UID != nil || config.GID != nil {
+		// the files are meant for someone else, who can't see them unless they're
+		// let in. The kernel then has to check file permissions for us.
+		mountOptions = append(mountOptions, "default_permissions")
+	}
+	var rawFS fuse.RawFileSystem = filesystem
+	if config.MetricsAddr != "" {
+		rawFS = fs.Metered(filesystem)
+	}
+	fuseOptions := &fuse.MountOptions{
 		Name:          "onedriver",
 		FsName:        "onedriver",
-		DisableXAttrs: true,
 		MaxBackground: 1024,
 		Debug:         *debugOn,
-	})
+		AllowOther:    config.UID != nil || config.GID != nil,
+		Options:       mountOptions,
+	}
+	server, err := fuse.NewServer(rawFS, mountpoint, fuseOptions)
+	if err != nil {
+		// the mountpoint may have gone stale while we were starting up
+		if attempted, recoverErr := common.RecoverStaleMount(mountpoint); attempted && recoverErr == nil {
+			log.Info().Msg("Retrying mount after unmounting stale mount.")
+			server, err = fuse.NewServer(rawFS, mountpoint, fuseOptions)
+		}
+	}
 	if err != nil {
 		log.Fatal().Err(err).Msgf("Mount failed. Is the mountpoint already in use? "+
 			"(Try running \"fusermount3 -uz %s\")\n", mountpoint)
 	}
 
+	socket := common.MonitorSocket(absMountPath)
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err == nil {
+		if listener, err := filesystem.ServeMonitor(socket); err != nil {
+			log.Error().Err(err).Str("socket", socket).Msg("Could not listen for monitors.")
+		} else {
+			defer listener.Close()
+		}
+	}
+
 	// setup signal handler for graceful unmount on signals like sigint
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -151,36 +421,57 @@ func main() {
 		Str("cachePath", cachePath).
 		Str("mountpoint", absMountPath).
 		Msg("Serving filesystem.")
-	server.Serve()
+	stopped := make(chan struct{}, 2)
+	go func() {
+		server.Serve()
+		stopped <- struct{}{}
+	}()
+	go func() {
+		// nothing here is needed to use the filesystem, so wait until it's up
+		if server.WaitMount() != nil {
+			return
+		}
+		go common.NotifySystemd(filesystem.IsOffline, common.NotifyStatusInterval)
+		filesystem.RunStartupTasks(fs.CreateTrash,
+			common.XDGVolumeInfo(config.VolumeLabel, config.VolumeInfoLocalOnly))
+
+		err := common.UnmountOnLostMountpoint(absMountPath, common.MountWatchInterval, server)
+		if err != nil {
+			// the kernel may still have the old mount around somewhere, nothing
+			// would ever make Serve() return
+			log.Error().Err(err).Msg("Shutting down without a clean unmount.")
+			stopped <- struct{}{}
+		}
+	}()
+	<-stopped
+	filesystem.Shutdown()
 }
 
-// xdgVolumeInfo createx .xdg-volume-info for a nice little onedrive logo in the
-// corner of the mountpoint and shows the account name in the nautilus sidebar
-func xdgVolumeInfo(filesystem *fs.Filesystem, auth *graph.Auth) {
-	if child, _ := filesystem.GetPath("/.xdg-volume-info", auth); child != nil {
-		return
-	}
-	log.Info().Msg("Creating .xdg-volume-info")
-	user, err := graph.GetUser(auth)
+// applyProfile saves the config from a profile, optionally setting up each of
+// its mounts to start automatically.
+func applyProfile(path string, configPath string, enableMounts bool) {
+	profile, err := common.LoadConfigProfile(path)
 	if err != nil {
-		log.Error().Err(err).Msg("Could not create .xdg-volume-info")
-		return
-	}
-	xdgVolumeInfo := common.TemplateXDGVolumeInfo(user.UserPrincipalName)
-
-	// just upload directly and shove it in the cache
-	// (since the fs isn't mounted yet)
-	resp, err := graph.Put(
-		graph.ResourcePath("/.xdg-volume-info")+":/content",
-		auth,
-		strings.NewReader(xdgVolumeInfo),
-	)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to write .xdg-volume-info")
+		log.Fatal().Err(err).Str("path", path).Msg("Could not load profile.")
+	}
+	if err = profile.Config.WriteConfig(configPath); err != nil {
+		log.Fatal().Err(err).Str("path", configPath).Msg("Could not save config.")
 	}
-	root, _ := filesystem.GetPath("/", auth) // cannot fail
-	inode := fs.NewInode(".xdg-volume-info", 0644, root)
-	if json.Unmarshal(resp, &inode) == nil {
-		filesystem.InsertID(inode.ID(), inode)
+	log.Info().Str("path", configPath).Msg("Saved config from profile.")
+
+	for _, mount := range profile.Mounts {
+		if !enableMounts {
+			log.Info().Str("mountpoint", mount).
+				Msg("Skipping mountpoint, use --enable-mounts to set it up.")
+			continue
+		}
+		os.MkdirAll(mount, 0700)
+		unitName := systemd.TemplateUnit(systemd.OnedriverServiceTemplate,
+			unit.UnitNamePathEscape(mount))
+		if err := systemd.UnitSetEnabled(unitName, true); err != nil {
+			log.Error().Err(err).Str("unit", unitName).Msg("Could not enable mountpoint.")
+			continue
+		}
+		log.Info().Str("unit", unitName).Msg("Enabled mountpoint.")
 	}
 }
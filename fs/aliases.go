@@ -0,0 +1,89 @@
+package fs
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// pathAliases translates between the names of aliased items on the server and
+// the names they are shown as in the mount. All keys are lowercase paths on the
+// server.
+type pathAliases struct {
+	local  map[string]string // server path of an item -> name in the mount
+	server map[string]string // server path of an alias -> name on the server
+}
+
+// validateAliases checks that a set of aliases is unambiguous, no two items in
+// a folder may end up with the same name in the mount.
+func validateAliases(aliases map[string]string) error {
+	seen := make(map[string]string)
+	for serverPath, name := range aliases {
+		if !path.IsAbs(serverPath) || path.Clean(serverPath) != serverPath || serverPath == "/" {
+			return fmt.Errorf("pathAliases key %q must be the absolute path of an item", serverPath)
+		}
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") ||
+			isNameRestricted(name) {
+			return fmt.Errorf("invalid pathAliases name %q for %q", name, serverPath)
+		}
+		key := strings.ToLower(path.Join(path.Dir(serverPath), name))
+		if other, exists := seen[key]; exists {
+			return fmt.Errorf("pathAliases %q and %q both appear as %q", other, serverPath, name)
+		}
+		seen[key] = serverPath
+	}
+	return nil
+}
+
+// newPathAliases sets up lookups for aliases that have already been validated.
+func newPathAliases(aliases map[string]string) pathAliases {
+	p := pathAliases{
+		local:  make(map[string]string),
+		server: make(map[string]string),
+	}
+	for serverPath, name := range aliases {
+		p.local[strings.ToLower(serverPath)] = name
+		aliasPath := strings.ToLower(path.Join(path.Dir(serverPath), name))
+		p.server[aliasPath] = path.Base(serverPath)
+	}
+	return p
+}
+
+// localName returns the name an item is shown as in the mount.
+func (p pathAliases) localName(inode *Inode) string {
+	if len(p.local) > 0 {
+		if name, exists := p.local[strings.ToLower(inode.Path())]; exists {
+			return name
+		}
+	}
+	return inode.Name()
+}
+
+// serverName translates the name of an item in a folder in the mount to its
+// name on the server. Returns "" for items that were renamed by an alias, these
+// can only be accessed by their new name.
+func (p pathAliases) serverName(dir *Inode, name string) string {
+	if len(p.local) == 0 || dir == nil {
+		return name
+	}
+	key := strings.ToLower(path.Join(dir.Path(), name))
+	if serverName, exists := p.server[key]; exists {
+		return serverName
+	}
+	if _, exists := p.local[key]; exists {
+		return ""
+	}
+	return name
+}
+
+// shadowed returns true if an item has the same name as an alias in its folder
+// and should be left out of directory listings so the alias is not ambiguous.
+func (p pathAliases) shadowed(inode *Inode) bool {
+	if len(p.local) == 0 {
+		return false
+	}
+	key := strings.ToLower(inode.Path())
+	_, aliased := p.local[key]
+	_, shadowed := p.server[key]
+	return shadowed && !aliased
+}
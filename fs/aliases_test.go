@@ -0,0 +1,68 @@
+package fs
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// An aliased item should only be reachable by its new name in the mount, and
+// should read the same as the original.
+func TestPathAliases(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_path_aliases"), Options{
+		PathAliases: map[string]string{"/alias_target.txt": "Aliased.txt"},
+	})
+	inode := NewInode("alias_target.txt", 0644|fuse.S_IFREG, nil)
+	nodeID, err := cache.InsertPath("/alias_target.txt", nil, inode)
+	require.NoError(t, err)
+	content := []byte("i go by a different name now")
+	inode.setContent(cache, content)
+
+	out := &fuse.EntryOut{}
+	root := &fuse.InHeader{NodeId: 1}
+	require.Equal(t, fuse.OK, cache.Lookup(nil, root, "aliased.txt", out),
+		"Could not look up item by its alias.")
+	assert.Equal(t, nodeID, out.NodeId, "Alias resolved to the wrong item.")
+	assert.Equal(t, fuse.ENOENT, cache.Lookup(nil, root, "alias_target.txt", out),
+		"Aliased item should not be visible under its original name.")
+
+	found, err := cache.GetPath("/Aliased.txt", nil)
+	require.NoError(t, err)
+	assert.Equal(t, inode.ID(), found.ID(), "GetPath did not resolve the alias.")
+
+	buf := make([]byte, 4096)
+	result, status := cache.Read(
+		context.Background().Done(),
+		&fuse.ReadIn{InHeader: fuse.InHeader{NodeId: nodeID}, Size: uint32(len(buf))},
+		buf,
+	)
+	require.Equal(t, fuse.OK, status, "Read failed.")
+	data, _ := result.Bytes(buf)
+	assert.Equal(t, content, data, "Read through an alias returned the wrong content.")
+
+	assert.Equal(t, "Aliased.txt", cache.aliases.localName(inode),
+		"Aliased item is listed under the wrong name.")
+}
+
+// Aliases that would leave two items with the same name in a folder should be
+// rejected.
+func TestPathAliasesValidate(t *testing.T) {
+	t.Parallel()
+	assert.NoError(t, validateAliases(map[string]string{
+		"/Pictures":          "photos",
+		"/Documents/Reports": "reports",
+	}))
+	assert.Error(t, validateAliases(map[string]string{
+		"/Pictures": "media",
+		"/Videos":   "Media",
+	}), "Two aliases with the same name in one folder should be rejected.")
+	assert.Error(t, validateAliases(map[string]string{"/Pictures": "a/b"}),
+		"Alias names cannot contain a \"/\".")
+	assert.Error(t, validateAliases(map[string]string{"Pictures": "photos"}),
+		"Aliased paths must be absolute.")
+}
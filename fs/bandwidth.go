@@ -0,0 +1,106 @@
+package fs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// BandwidthScheduleInterval is how often the bandwidth schedule is checked for a
+// window that started or ended.
+const BandwidthScheduleInterval = 30 * time.Second
+
+// BandwidthWindow is a time of day during which different upload and download
+// limits apply than the usual ones.
+type BandwidthWindow struct {
+	// Start and End are local times like "22:00". A window that ends before it
+	// starts lasts past midnight.
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+	// UploadLimitKB and DownloadLimitKB are the limits during the window in
+	// KB/s, 0 is unlimited.
+	UploadLimitKB   uint64 `yaml:"uploadLimitKB"`
+	DownloadLimitKB uint64 `yaml:"downloadLimitKB"`
+}
+
+// parseTimeOfDay parses a time like "22:00" into how long after midnight it is.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day like \"22:00\"", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// validateSchedule checks that every window of a bandwidth schedule has a
+// usable start and end.
+func validateSchedule(windows []BandwidthWindow) error {
+	for _, window := range windows {
+		start, err := parseTimeOfDay(window.Start)
+		if err != nil {
+			return fmt.Errorf("invalid bandwidthSchedule start: %w", err)
+		}
+		end, err := parseTimeOfDay(window.End)
+		if err != nil {
+			return fmt.Errorf("invalid bandwidthSchedule end: %w", err)
+		}
+		if start == end {
+			return fmt.Errorf("bandwidthSchedule window from %s to %s is empty",
+				window.Start, window.End)
+		}
+	}
+	return nil
+}
+
+// contains returns true if now falls within the window. The window must be
+// valid.
+func (w BandwidthWindow) contains(now time.Time) bool {
+	start, _ := parseTimeOfDay(w.Start)
+	end, _ := parseTimeOfDay(w.End)
+	hour, minute, second := now.Clock()
+	sinceMidnight := time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute +
+		time.Duration(second)*time.Second
+	if start < end {
+		return sinceMidnight >= start && sinceMidnight < end
+	}
+	return sinceMidnight >= start || sinceMidnight < end
+}
+
+// bandwidthLimits returns the upload and download limits in KB/s at a given
+// time. The first window of the schedule that now falls within wins, outside
+// of all of them the usual limits apply.
+func (o Options) bandwidthLimits(now time.Time) (uploadKB uint64, downloadKB uint64) {
+	for _, window := range o.BandwidthSchedule {
+		if window.contains(now) {
+			return window.UploadLimitKB, window.DownloadLimitKB
+		}
+	}
+	return o.UploadLimitKB, o.DownloadLimitKB
+}
+
+// BandwidthScheduleLoop changes the transfer limits whenever a window of the
+// bandwidth schedule starts or ends, and should be called as a goroutine.
+// Transfers already in progress pick up the new limits right away. Returns
+// immediately if there is no schedule.
+func (f *Filesystem) BandwidthScheduleLoop(interval time.Duration) {
+	if len(f.opts.BandwidthSchedule) == 0 {
+		return
+	}
+	// NewFilesystem already applied the limits for the time it started at
+	uploadKB, downloadKB := f.opts.bandwidthLimits(time.Now())
+	for {
+		time.Sleep(interval)
+		up, down := f.opts.bandwidthLimits(time.Now())
+		if up == uploadKB && down == downloadKB {
+			continue
+		}
+		uploadKB, downloadKB = up, down
+		log.Info().
+			Uint64("uploadLimitKB", uploadKB).
+			Uint64("downloadLimitKB", downloadKB).
+			Msg("Bandwidth schedule changed the transfer limits.")
+		f.auth.SetUploadLimit(uploadKB * 1024)
+		f.auth.SetDownloadLimit(downloadKB * 1024)
+	}
+}
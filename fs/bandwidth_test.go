@@ -0,0 +1,63 @@
+package fs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The limits in effect should change as the time of day crosses into and out of
+// a window, including windows that last past midnight.
+func TestBandwidthSchedule(t *testing.T) {
+	t.Parallel()
+	opts := Options{
+		UploadLimitKB:   100,
+		DownloadLimitKB: 500,
+		BandwidthSchedule: []BandwidthWindow{
+			{Start: "22:00", End: "06:00"},
+			{Start: "12:00", End: "13:30", UploadLimitKB: 50, DownloadLimitKB: 200},
+		},
+	}
+	assert.NoError(t, opts.Validate())
+
+	at := func(clock string) time.Time {
+		when, _ := time.ParseInLocation("2006-01-02 15:04:05", "2021-06-01 "+clock, time.Local)
+		return when
+	}
+	tests := []struct {
+		clock      string
+		uploadKB   uint64
+		downloadKB uint64
+	}{
+		{"21:59:59", 100, 500},
+		{"22:00:00", 0, 0},
+		{"00:00:00", 0, 0},
+		{"05:59:59", 0, 0},
+		{"06:00:00", 100, 500},
+		{"11:59:59", 100, 500},
+		{"12:00:00", 50, 200},
+		{"13:29:59", 50, 200},
+		{"13:30:00", 100, 500},
+	}
+	for _, test := range tests {
+		up, down := opts.bandwidthLimits(at(test.clock))
+		assert.Equal(t, test.uploadKB, up, "Wrong upload limit at %s.", test.clock)
+		assert.Equal(t, test.downloadKB, down, "Wrong download limit at %s.", test.clock)
+	}
+}
+
+// Windows that can't be parsed or don't last any time at all should be rejected.
+func TestBandwidthScheduleInvalid(t *testing.T) {
+	t.Parallel()
+	for _, window := range []BandwidthWindow{
+		{Start: "10pm", End: "06:00"},
+		{Start: "22:00", End: "24:00"},
+		{Start: "", End: "06:00"},
+		{Start: "08:00", End: "08:00"},
+	} {
+		opts := Options{BandwidthSchedule: []BandwidthWindow{window}}
+		assert.Error(t, opts.Validate(), "Window from %q to %q was accepted.",
+			window.Start, window.End)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -21,22 +22,75 @@ import (
 type Filesystem struct {
 	fuse.RawFileSystem
 
-	metadata  sync.Map
-	db        *bolt.DB
-	content   *LoopbackCache
-	auth      *graph.Auth
-	root      string // the id of the filesystem's root item
-	deltaLink string
-	uploads   *UploadManager
+	metadata   sync.Map
+	db         *bolt.DB
+	content    *LoopbackCache
+	thumbnails *LoopbackCache
+	auth       *graph.Auth
+	root       string       // the id of the filesystem's root item
+	driveID    atomic.Value // string, the id of the drive the root item is on
+	deltaLink  string
+	enumerate  bool // the next delta sequence is a full enumeration of the drive
+	uploads    *UploadManager
+	opts       Options
+	aliases    pathAliases
+	negative   *negativeLookups
+	recent     *recentUploads
+	cacheDir   string
+	uid        uint32 // who the files in the mount belong to
+	gid        uint32
+	server     *fuse.Server // serves the filesystem, nil until mounted
 
 	sync.RWMutex
-	offline    bool
-	lastNodeID uint64
-	inodes     []string
+	offline      bool
+	offlineSince time.Time
+	lastDelta    time.Time // when changes were last fetched from the server
+	inodes       []string  // inodes[nodeID-1] is the ID of the item with that nodeID
+	// problems fetching deltas that are not just being offline
+	syncBroken    string // why sync is broken, empty if it isn't
+	deltaFailures int    // delta fetches in a row that failed with an error from the server
+	quotaFull     bool   // uploads are failing because the drive is full
+
+	// full serializations are coalesced and rate limited by RequestSerialize()
+	serializeM        sync.Mutex
+	serializePending  bool
+	serializeInterval time.Duration
+	lastSerialize     time.Time
+	serializations    uint32 // number of times SerializeAll() has run
+
+	// recent sync problems, reported in the status file. problemsM is also
+	// held while writing the status file.
+	problemsM sync.Mutex
+	problems  []StatusProblem
+
+	// ids of folders whose children are being refetched in the background
+	refreshing sync.Map
+
+	// everyone connected to the monitor socket
+	monitors monitors
+
+	// deltas that were skipped because their parent was not cached yet
+	skipped skippedDeltas
+	// deltas that could not be applied
+	failed failedDeltas
+	// wakes up the delta loop when the server says something changed
+	deltaWake chan struct{}
+
+	// when the items in .onedriver/shared were last fetched
+	sharedM       sync.Mutex
+	sharedFetched time.Time
+
+	// sizes of the files copied on the server whose copy_file_range calls are
+	// not done yet, by serverCopy
+	serverCopies sync.Map
+
+	heartbeat heartbeat
 
 	// tracks currently open directories
 	opendirsM sync.RWMutex
 	opendirs  map[uint64][]*Inode
+	// the names opendirs are listed under, resolved when they were opened
+	opendirNames map[uint64][]string
 }
 
 // boltdb buckets
@@ -45,18 +99,57 @@ var (
 	bucketMetadata = []byte("metadata")
 	bucketDelta    = []byte("delta")
 	bucketVersion  = []byte("version")
+
+	// deltas fetched during an in-progress page sequence
+	bucketDeltaPending = []byte("deltaPending")
+	// deltas that could not be applied and will be retried
+	bucketDeltaFailed = []byte("deltaFailed")
 )
 
 // so we can tell what format the db has
 const fsVersion = "1"
 
+// PrepareCacheDir creates a mount's cache directory with the permissions from
+// the options if it does not exist yet. Existing directories are left alone,
+// since they may have been set up with specific ownership, but there is a
+// warning if everyone can read them.
+func PrepareCacheDir(cacheDir string, options Options) error {
+	created, err := createCacheDir(cacheDir, options.cacheDirMode())
+	if err != nil || created {
+		return err
+	}
+	st, err := os.Stat(cacheDir)
+	if err != nil {
+		return err
+	}
+	if st.Mode().Perm()&0004 != 0 {
+		log.Warn().
+			Str("path", cacheDir).
+			Str("mode", fmt.Sprintf("%#o", st.Mode().Perm())).
+			Msg("Cache directory can be read by anyone, but contains your auth tokens and files.")
+	}
+	return nil
+}
+
+// createCacheDir creates the cache directory with the given permissions, if it
+// does not exist yet.
+func createCacheDir(cacheDir string, mode os.FileMode) (bool, error) {
+	if _, err := os.Stat(cacheDir); !os.IsNotExist(err) {
+		return false, err
+	}
+	if err := os.Mkdir(cacheDir, mode); err != nil {
+		return false, err
+	}
+	// the umask may have taken away some of the permissions
+	return true, os.Chmod(cacheDir, mode)
+}
+
+const defaultCacheDirMode = 0700
+
 // NewFilesystem creates a new filesystem
-func NewFilesystem(auth *graph.Auth, cacheDir string) *Filesystem {
-	// prepare cache directory
-	if _, err := os.Stat(cacheDir); err != nil {
-		if err = os.Mkdir(cacheDir, 0700); err != nil {
-			log.Fatal().Err(err).Msg("Could not create cache directory.")
-		}
+func NewFilesystem(auth *graph.Auth, cacheDir string, options Options) *Filesystem {
+	if _, err := createCacheDir(cacheDir, options.cacheDirMode()); err != nil {
+		log.Fatal().Err(err).Msg("Could not create cache directory.")
 	}
 	db, err := bolt.Open(
 		filepath.Join(cacheDir, "onedriver.db"),
@@ -67,10 +160,13 @@ func NewFilesystem(auth *graph.Auth, cacheDir string) *Filesystem {
 		log.Fatal().Err(err).Msg("Could not open DB. Is it already in use by another mount?")
 	}
 
-	content := NewLoopbackCache(filepath.Join(cacheDir, "content"))
+	content := NewLoopbackCache(filepath.Join(cacheDir, ContentDir))
 	db.Update(func(tx *bolt.Tx) error {
 		tx.CreateBucketIfNotExists(bucketMetadata)
 		tx.CreateBucketIfNotExists(bucketDelta)
+		tx.CreateBucketIfNotExists(bucketDirty)
+		tx.CreateBucketIfNotExists(bucketHashes)
+		tx.CreateBucketIfNotExists(bucketMangled)
 		versionBucket, _ := tx.CreateBucketIfNotExists(bucketVersion)
 
 		// migrate old content bucket to the local filesystem
@@ -100,13 +196,30 @@ func NewFilesystem(auth *graph.Auth, cacheDir string) *Filesystem {
 		return versionBucket.Put([]byte("version"), []byte(fsVersion))
 	})
 
+	uploadKB, downloadKB := options.bandwidthLimits(time.Now())
+	auth.SetUploadLimit(uploadKB * 1024)
+	auth.SetDownloadLimit(downloadKB * 1024)
+
 	// ok, ready to start fs
+	uid, gid := options.owner()
 	fs := &Filesystem{
 		RawFileSystem: fuse.NewDefaultRawFileSystem(),
 		content:       content,
+		thumbnails:    NewLoopbackCache(filepath.Join(cacheDir, "thumbnails")),
 		db:            db,
 		auth:          auth,
+		opts:          options,
+		cacheDir:      cacheDir,
+		uid:           uid,
+		gid:           gid,
 		opendirs:      make(map[uint64][]*Inode),
+		opendirNames:  make(map[uint64][]string),
+		aliases:       newPathAliases(options.PathAliases),
+		negative:      newNegativeLookups(options.negativeLookupTTL()),
+		recent:        newRecentUploads(options.uploadGraceTTL()),
+		deltaWake:     make(chan struct{}, 1),
+
+		serializeInterval: minSerializeInterval,
 	}
 
 	rootItem, err := graph.GetItem("root", auth)
@@ -116,6 +229,7 @@ func NewFilesystem(auth *graph.Auth, cacheDir string) *Filesystem {
 			// no network, load from db if possible and go to read-only state
 			fs.Lock()
 			fs.offline = true
+			fs.offlineSince = time.Now()
 			fs.Unlock()
 			if root = fs.GetID("root"); root == nil {
 				log.Fatal().Msg(
@@ -142,30 +256,35 @@ func NewFilesystem(auth *graph.Auth, cacheDir string) *Filesystem {
 	}
 	// root inode is inode 1
 	fs.root = root.ID()
+	if root.DriveItem.Parent != nil {
+		fs.driveID.Store(root.DriveItem.Parent.DriveID)
+	}
 	fs.InsertID(fs.root, root)
 
 	fs.uploads = NewUploadManager(2*time.Second, db, fs, auth)
 
 	if !fs.IsOffline() {
-		// .Trash-UID is used by "gio trash" for user trash, create it if it
-		// does not exist
-		trash := fmt.Sprintf(".Trash-%d", os.Getuid())
-		if child, _ := fs.GetChild(fs.root, trash, auth); child == nil {
-			item, err := graph.Mkdir(trash, fs.root, auth)
-			if err != nil {
-				log.Error().Err(err).
-					Msg("Could not create trash folder. " +
-						"Trashing items through the file browser may result in errors.")
-			} else {
-				fs.InsertID(item.ID, NewInodeDriveItem(item))
-			}
+		if options.FullEnumeration {
+			// without a token, the first delta sequence lists the entire drive
+			fs.deltaLink = graph.IDPath("root") + "/delta"
+			fs.enumerate = true
+		} else {
+			// using token=latest because we don't care about existing items -
+			// they'll be downloaded on-demand by the cache
+			fs.deltaLink = graph.IDPath("root") + "/delta?token=latest"
 		}
-
-		// using token=latest because we don't care about existing items - they'll
-		// be downloaded on-demand by the cache
-		fs.deltaLink = "/me/drive/root/delta?token=latest"
 	}
 
+	// if we were killed partway through a sequence of delta pages, pick up
+	// where we left off instead of starting the sequence over
+	fs.db.View(func(tx *bolt.Tx) error {
+		if link := tx.Bucket(bucketDelta).Get([]byte("nextLink")); link != nil {
+			log.Info().Msg("Resuming interrupted delta fetch.")
+			fs.deltaLink = string(link)
+		}
+		return nil
+	})
+
 	// deltaloop is started manually
 	return fs
 }
@@ -177,11 +296,17 @@ func (f *Filesystem) IsOffline() bool {
 	return f.offline
 }
 
+// DriveID returns the ID of the drive the filesystem's root item is on.
+func (f *Filesystem) DriveID() string {
+	driveID, _ := f.driveID.Load().(string)
+	return driveID
+}
+
 // TranslateID returns the DriveItemID for a given NodeID
 func (f *Filesystem) TranslateID(nodeID uint64) string {
 	f.RLock()
 	defer f.RUnlock()
-	if nodeID > f.lastNodeID || nodeID == 0 {
+	if nodeID == 0 || nodeID > uint64(len(f.inodes)) {
 		return ""
 	}
 	return f.inodes[nodeID-1]
@@ -199,21 +324,22 @@ func (f *Filesystem) GetNodeID(nodeID uint64) *Inode {
 // InsertNodeID assigns a numeric inode ID used by the kernel if one is not
 // already assigned.
 func (f *Filesystem) InsertNodeID(inode *Inode) uint64 {
-	nodeID := inode.NodeID()
-	if nodeID == 0 {
-		// lock ordering is to satisfy deadlock detector
-		inode.Lock()
-		f.Lock()
-
-		f.lastNodeID++
-		f.inodes = append(f.inodes, inode.DriveItem.ID)
-		nodeID = f.lastNodeID
-		inode.nodeID = nodeID
+	if nodeID := inode.NodeID(); nodeID != 0 {
+		return nodeID
+	}
 
-		f.Unlock()
-		inode.Unlock()
+	// lock ordering is to satisfy deadlock detector
+	inode.Lock()
+	defer inode.Unlock()
+	if inode.nodeID != 0 {
+		// someone else beat us to it while we were waiting for the lock
+		return inode.nodeID
 	}
-	return nodeID
+	f.Lock()
+	f.inodes = append(f.inodes, inode.DriveItem.ID)
+	inode.nodeID = uint64(len(f.inodes))
+	f.Unlock()
+	return inode.nodeID
 }
 
 // GetID gets an inode from the cache by ID. No API fetching is performed.
@@ -233,6 +359,7 @@ func (f *Filesystem) GetID(id string) *Inode {
 			return err
 		})
 		if found != nil {
+			f.trackRemote(found)
 			f.InsertNodeID(found)
 			f.metadata.Store(id, found) // move to memory for next time
 		}
@@ -247,22 +374,33 @@ func (f *Filesystem) GetID(id string) *Inode {
 // filesystem. Returns the Inode's numeric NodeID.
 func (f *Filesystem) InsertID(id string, inode *Inode) uint64 {
 	f.metadata.Store(id, inode)
+	f.trackRemote(inode)
 	nodeID := f.InsertNodeID(inode)
 
-	if id != inode.ID() {
-		// we update the inode IDs here in case they do not match/changed
+	if oldID := inode.ID(); id != oldID {
+		// we update the inode IDs here in case they do not match/changed. The
+		// content moves under the same lock, so it can't be opened by an ID it
+		// isn't stored under (see openContent).
+		dir := inode.IsDir()
 		inode.Lock()
 		inode.DriveItem.ID = id
+		if !dir {
+			f.content.Move(oldID, id)
+			f.moveContentHash(oldID, id)
+		}
 		inode.Unlock()
 
 		f.Lock()
-		if nodeID <= f.lastNodeID {
+		// only update the mapping if the nodeID is actually ours, an inode that
+		// got its nodeID somewhere else would otherwise clobber another item's
+		if nodeID <= uint64(len(f.inodes)) && f.inodes[nodeID-1] == oldID {
 			f.inodes[nodeID-1] = id
 		} else {
 			log.Error().
 				Uint64("nodeID", nodeID).
-				Uint64("lastNodeID", f.lastNodeID).
-				Msg("NodeID exceeded maximum node ID! Ignoring ID change.")
+				Str("oldID", oldID).
+				Str("id", id).
+				Msg("NodeID does not belong to this item! Ignoring ID change.")
 		}
 		f.Unlock()
 	}
@@ -282,6 +420,12 @@ func (f *Filesystem) InsertID(id string, inode *Inode) uint64 {
 		return nodeID
 	}
 
+	f.negative.invalidate(parentID)
+	if f.updatePath(inode, parent.Path()) {
+		// everything cached under a moved folder got a new path with it
+		f.RequestSerialize()
+	}
+
 	// check if the item has already been added to the parent
 	// Lock order is super key here, must go parent->child or the deadlock
 	// detector screams at us.
@@ -303,6 +447,42 @@ func (f *Filesystem) InsertID(id string, inode *Inode) uint64 {
 	return nodeID
 }
 
+// updatePath sets the path of an item's parent, and updates the paths of the
+// item's cached descendants if it changed. The server only includes paths in
+// some responses, and never sends anything for the contents of a folder that
+// was moved. Returns true if any descendants were updated.
+func (f *Filesystem) updatePath(inode *Inode, parentPath string) bool {
+	inode.Lock()
+	if inode.DriveItem.Parent == nil || samePath(inode.DriveItem.Parent.Path, parentPath) {
+		inode.Unlock()
+		return false
+	}
+	inode.DriveItem.Parent.Path = parentPath
+	children := make([]string, len(inode.children))
+	copy(children, inode.children)
+	inode.Unlock()
+
+	if len(children) == 0 {
+		return false
+	}
+	path := inode.Path()
+	for _, childID := range children {
+		if child := f.GetID(childID); child != nil {
+			f.updatePath(child, path)
+		}
+	}
+	return true
+}
+
+// samePath compares paths with or without the "/drive/root:" prefix the server
+// uses.
+func samePath(a, b string) bool {
+	trim := func(p string) string {
+		return strings.TrimSuffix(strings.TrimPrefix(p, "/drive/root:"), "/")
+	}
+	return trim(a) == trim(b)
+}
+
 // InsertChild adds an item as a child of a specified parent ID.
 func (f *Filesystem) InsertChild(parentID string, child *Inode) uint64 {
 	child.Lock()
@@ -316,26 +496,134 @@ func (f *Filesystem) InsertChild(parentID string, child *Inode) uint64 {
 // DeleteID deletes an item from the cache, and removes it from its parent. Must
 // be called before InsertID if being used to rename/move an item.
 func (f *Filesystem) DeleteID(id string) {
-	if inode := f.GetID(id); inode != nil {
-		parent := f.GetID(inode.ParentID())
-		parent.Lock()
-		for i, childID := range parent.children {
-			if childID == id {
-				parent.children = append(parent.children[:i], parent.children[i+1:]...)
-				if inode.IsDir() {
-					parent.subdir--
-				}
-				break
+	f.detachID(id)
+	f.metadata.Delete(id)
+	f.uploads.CancelUpload(id)
+}
+
+// detachID removes an item from its parent so it can no longer be found by
+// path, but leaves it in the cache so it can still be looked up by ID.
+func (f *Filesystem) detachID(id string) {
+	inode := f.GetID(id)
+	if inode == nil {
+		return
+	}
+	parent := f.GetID(inode.ParentID())
+	if parent == nil {
+		return
+	}
+	parent.Lock()
+	for i, childID := range parent.children {
+		if childID == id {
+			parent.children = append(parent.children[:i], parent.children[i+1:]...)
+			if inode.IsDir() {
+				parent.subdir--
 			}
+			break
 		}
-		parent.Unlock()
 	}
-	f.metadata.Delete(id)
-	f.uploads.CancelUpload(id)
+	parent.Unlock()
+}
+
+// mergeServerChildren adds a directory's server-side children to its locally
+// known ones. It is used when a local-only directory is adopted by a directory of
+// the same name on the server, so that the local-only children are kept instead
+// of being replaced by a fresh fetch. Local children win name collisions, since
+// they will replace the server copy once uploaded.
+func (f *Filesystem) mergeServerChildren(id string, auth *graph.Auth) error {
+	fetched, err := graph.GetItemChildren(id, auth)
+	if err != nil {
+		return err
+	}
+	local, _ := f.GetChildrenID(id, auth)
+	for _, item := range fetched {
+		item = f.resolveShortcut(item)
+		if existing, exists := local[strings.ToLower(item.Name)]; exists {
+			if existing.ID() != item.ID {
+				log.Warn().
+					Str("id", item.ID).
+					Str("localID", existing.ID()).
+					Str("name", item.Name).
+					Msg("Local-only child conflicts with server child, keeping local copy.")
+				f.reportProblem(existing.Path(),
+					"A different item with the same name exists on the server, "+
+						"kept the local copy.")
+			}
+			continue
+		}
+		f.InsertChild(id, f.newServerInode(item))
+	}
+	return nil
+}
+
+// reconcileSubdirs recomputes the subdirectory count of each of the given
+// directories from the children they actually have. The count is normally kept
+// up to date incrementally, but a batch of deltas can move things around enough
+// for it to drift, which would give NLink() the wrong answer.
+func (f *Filesystem) reconcileSubdirs(ids ...string) {
+	checked := make(map[string]bool)
+	for _, id := range ids {
+		if checked[id] {
+			continue
+		}
+		checked[id] = true
+		inode := f.GetID(id)
+		if inode == nil || !inode.IsDir() {
+			continue
+		}
+
+		inode.RLock()
+		children := make([]string, len(inode.children))
+		copy(children, inode.children)
+		inode.RUnlock()
+
+		var subdir uint32
+		for _, childID := range children {
+			if child := f.GetID(childID); child != nil && child.IsDir() {
+				subdir++
+			}
+		}
+
+		inode.Lock()
+		if inode.subdir != subdir {
+			log.Debug().
+				Str("id", id).
+				Uint32("old", inode.subdir).
+				Uint32("new", subdir).
+				Msg("Corrected subdirectory count.")
+			inode.subdir = subdir
+		}
+		inode.Unlock()
+	}
+}
+
+// deleteDescendants removes everything below a directory from the cache, so
+// that nothing is left behind once the directory itself is gone. Does not
+// touch the server.
+func (f *Filesystem) deleteDescendants(id string) {
+	inode := f.GetID(id)
+	if inode == nil {
+		return
+	}
+	inode.RLock()
+	children := make([]string, len(inode.children))
+	copy(children, inode.children)
+	inode.RUnlock()
+
+	for _, childID := range children {
+		if child := f.GetID(childID); child != nil && child.IsDir() {
+			f.deleteDescendants(childID)
+		}
+		f.DeleteID(childID)
+		f.deleteContent(childID)
+	}
 }
 
 // GetChild fetches a named child of an item. Wraps GetChildrenID.
 func (f *Filesystem) GetChild(id string, name string, auth *graph.Auth) (*Inode, error) {
+	if virtual := f.virtualChild(id, name, auth); virtual != nil {
+		return virtual, nil
+	}
 	children, err := f.GetChildrenID(id, auth)
 	if err != nil {
 		return nil, err
@@ -396,15 +684,25 @@ func (f *Filesystem) GetChildrenID(id string, auth *graph.Auth) (map[string]*Ino
 					"Pretending there are no children.")
 			return children, nil
 		}
+		if stale, ok := f.staleChildren(id, err, auth); ok {
+			return stale, nil
+		}
 		// something else happened besides being offline
 		return nil, err
 	}
 
+	f.negative.invalidate(id)
+	parentPath := inode.Path()
 	inode.Lock()
 	inode.children = make([]string, 0)
+	inode.subdir = 0
 	for _, item := range fetched {
+		if f.opts.isIgnored(filepath.Join(parentPath, item.Name)) {
+			continue
+		}
 		// we will always have an id after fetching from the server
-		child := NewInodeDriveItem(item)
+		child := f.newServerInode(f.resolveShortcut(item))
+		f.trackRemote(child)
 		f.InsertNodeID(child)
 		f.metadata.Store(child.DriveItem.ID, child)
 
@@ -417,11 +715,89 @@ func (f *Filesystem) GetChildrenID(id string, auth *graph.Auth) (map[string]*Ino
 			inode.subdir++
 		}
 	}
+	f.relinkResynced(inode, children)
 	inode.Unlock()
 
+	if !f.skipped.empty() {
+		// items moved into any of the new children on the server can now be
+		// moved here too, which the delta loop does on its next pass
+		f.wakeDeltaLoop()
+	}
 	return children, nil
 }
 
+// the default for Options.ChildrenRetrySeconds
+const defaultChildrenRetry = 10 * time.Second
+
+// staleChildren is a fallback for when a folder's children could not be fetched
+// because of a temporary server problem. Instead of failing the listing, it
+// returns the children the folder had when it was last serialized and keeps
+// retrying the fetch in the background. ok is false if there is nothing to fall
+// back to.
+func (f *Filesystem) staleChildren(id string, err error, auth *graph.Auth) (children map[string]*Inode, ok bool) {
+	if !graph.IsTransient(err) {
+		return nil, false
+	}
+	var childIDs []string
+	f.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(bucketMetadata).Get([]byte(id)); data != nil {
+			if cached, err := NewInodeJSON(data); err == nil {
+				childIDs = cached.children
+			}
+		}
+		return nil
+	})
+	if childIDs == nil {
+		return nil, false
+	}
+
+	log.Warn().Err(err).Str("id", id).
+		Msg("Could not fetch children, serving them from cache until we can.")
+	children = make(map[string]*Inode)
+	for _, childID := range childIDs {
+		if child := f.GetID(childID); child != nil {
+			children[strings.ToLower(child.Name())] = child
+		}
+	}
+	go f.refreshChildren(id, auth)
+	return children, true
+}
+
+// refreshChildren keeps trying to fetch a folder's children until it succeeds,
+// fails for good, or we go offline.
+func (f *Filesystem) refreshChildren(id string, auth *graph.Auth) {
+	if _, running := f.refreshing.LoadOrStore(id, true); running {
+		return
+	}
+	defer f.refreshing.Delete(id)
+
+	interval := defaultChildrenRetry
+	if f.opts.ChildrenRetrySeconds > 0 {
+		interval = time.Duration(f.opts.ChildrenRetrySeconds) * time.Second
+	}
+	for {
+		time.Sleep(interval)
+		if f.IsOffline() {
+			return
+		}
+		if _, err := f.GetChildrenID(id, auth); err != nil {
+			log.Error().Err(err).Str("id", id).Msg("Could not refresh children.")
+			return
+		}
+		inode := f.GetID(id)
+		if inode == nil {
+			return
+		}
+		inode.RLock()
+		fetched := inode.children != nil
+		inode.RUnlock()
+		if fetched {
+			log.Info().Str("id", id).Msg("Refreshed children that were served from cache.")
+			return
+		}
+	}
+}
+
 // GetChildrenPath grabs all DriveItems that are the children of the resource at
 // the path. If items are not found, they are fetched.
 func (f *Filesystem) GetChildrenPath(path string, auth *graph.Auth) (map[string]*Inode, error) {
@@ -446,14 +822,26 @@ func (f *Filesystem) GetPath(path string, auth *graph.Auth) (*Inode, error) {
 	split := strings.Split(path, "/")[1:] //omit leading "/"
 	var inode *Inode
 	for i := 0; i < len(split); i++ {
+		if virtual := f.virtualChild(lastID, split[i], auth); virtual != nil {
+			inode = virtual
+			lastID = inode.ID()
+			continue
+		}
+
 		// fetches children
 		children, err := f.GetChildrenID(lastID, auth)
 		if err != nil {
 			return nil, err
 		}
 
+		// aliased items can still be found by their name on the server here
+		name := split[i]
+		if serverName := f.aliases.serverName(f.GetID(lastID), name); serverName != "" {
+			name = serverName
+		}
+
 		var exists bool // if we use ":=", item is shadowed
-		inode, exists = children[split[i]]
+		inode, exists = children[strings.ToLower(name)]
 		if !exists {
 			// the item still doesn't exist after fetching from server. it
 			// doesn't exist
@@ -532,10 +920,28 @@ func (f *Filesystem) MoveID(oldID string, newID string) error {
 	// now actually perform the metadata+content move
 	f.DeleteID(oldID)
 	f.InsertID(newID, inode)
+	f.moveDirty(oldID, newID)
+	inode.RLock()
+	localOnly := inode.mode != 0 || inode.conflictBehavior != "" || inode.durable
+	inode.RUnlock()
+	if localOnly {
+		// local-only metadata was only stored under the old ID
+		f.serializeID(newID)
+	}
 	if inode.IsDir() {
-		return nil
+		// children still point at the old ID
+		inode.RLock()
+		children := make([]string, len(inode.children))
+		copy(children, inode.children)
+		inode.RUnlock()
+		for _, childID := range children {
+			if child := f.GetID(childID); child != nil {
+				child.Lock()
+				child.DriveItem.Parent.ID = newID
+				child.Unlock()
+			}
+		}
 	}
-	f.content.Move(oldID, newID)
 	return nil
 }
 
@@ -557,18 +963,60 @@ func (f *Filesystem) MovePath(oldParent, newParent, oldName, newName string, aut
 	return nil
 }
 
+// minSerializeInterval is the least amount of time between two full
+// serializations requested with RequestSerialize().
+const minSerializeInterval = 30 * time.Second
+
+// RequestSerialize schedules a SerializeAll(). Requests made while one is
+// already scheduled are coalesced into it, and serializations are spaced at
+// least serializeInterval apart so busy drives don't churn the disk.
+func (f *Filesystem) RequestSerialize() {
+	f.serializeM.Lock()
+	defer f.serializeM.Unlock()
+	if f.serializePending {
+		// the scheduled serialization will pick up whatever changed
+		return
+	}
+	f.serializePending = true
+	wait := f.serializeInterval - time.Since(f.lastSerialize)
+	if wait < 0 {
+		wait = 0
+	}
+	time.AfterFunc(wait, func() {
+		f.serializeM.Lock()
+		f.serializePending = false
+		f.lastSerialize = time.Now()
+		f.serializeM.Unlock()
+		f.SerializeAll()
+	})
+}
+
+// Shutdown saves all inode metadata and closes the cache's database. Queued
+// uploads are already on disk and are picked up again on the next mount. The
+// filesystem must not be used afterwards.
+func (f *Filesystem) Shutdown() {
+	f.SerializeAll()
+	if err := f.db.Close(); err != nil {
+		log.Error().Err(err).Msg("Could not close cache database.")
+	}
+}
+
 // SerializeAll dumps all inode metadata currently in the cache to disk. This
 // metadata is only used later if an item could not be found in memory AND the
 // cache is offline. Old metadata is not removed, only overwritten (to avoid an
 // offline session from wiping all metadata on a subsequent serialization).
 func (f *Filesystem) SerializeAll() {
 	log.Debug().Msg("Serializing cache metadata to disk.")
+	atomic.AddUint32(&f.serializations, 1)
 
 	allItems := make(map[string][]byte)
 	f.metadata.Range(func(k interface{}, v interface{}) bool {
 		// cannot occur within bolt transaction because acquiring the inode lock
 		// with AsJSON locks out other boltdb transactions
 		id := fmt.Sprint(k)
+		if isVirtualID(id) {
+			return true
+		}
 		allItems[id] = v.(*Inode).AsJSON()
 		return true
 	})
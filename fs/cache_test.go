@@ -2,17 +2,26 @@
 package fs
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestRootGet(t *testing.T) {
 	t.Parallel()
-	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_root_get"))
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_root_get"), Options{})
 	root, err := cache.GetPath("/", auth)
 	require.NoError(t, err)
 	assert.Equal(t, "/", root.Path(), "Root path did not resolve correctly.")
@@ -20,7 +29,7 @@ func TestRootGet(t *testing.T) {
 
 func TestRootChildrenUpdate(t *testing.T) {
 	t.Parallel()
-	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_root_children_update"))
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_root_children_update"), Options{})
 	children, err := cache.GetChildrenPath("/", auth)
 	require.NoError(t, err)
 
@@ -31,7 +40,7 @@ func TestRootChildrenUpdate(t *testing.T) {
 
 func TestSubdirGet(t *testing.T) {
 	t.Parallel()
-	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_subdir_get"))
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_subdir_get"), Options{})
 	documents, err := cache.GetPath("/Documents", auth)
 	require.NoError(t, err)
 	assert.Equal(t, "Documents", documents.Name(), "Failed to fetch \"/Documents\".")
@@ -39,7 +48,7 @@ func TestSubdirGet(t *testing.T) {
 
 func TestSubdirChildrenUpdate(t *testing.T) {
 	t.Parallel()
-	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_subdir_children_update"))
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_subdir_children_update"), Options{})
 	children, err := cache.GetChildrenPath("/Documents", auth)
 	require.NoError(t, err)
 
@@ -55,7 +64,7 @@ func TestSubdirChildrenUpdate(t *testing.T) {
 
 func TestSamePointer(t *testing.T) {
 	t.Parallel()
-	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_same_pointer"))
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_same_pointer"), Options{})
 	item, _ := cache.GetPath("/Documents", auth)
 	item2, _ := cache.GetPath("/Documents", auth)
 	if item != item2 {
@@ -63,3 +72,136 @@ func TestSamePointer(t *testing.T) {
 	}
 	assert.NotNil(t, item)
 }
+
+// Inserting items and translating their nodeIDs from many goroutines at once
+// should never panic or hand out the same nodeID twice.
+func TestNodeIDConcurrent(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_node_id_concurrent"), Options{})
+	cache.RLock()
+	before := len(cache.inodes)
+	cache.RUnlock()
+
+	const workers = 16
+	const perWorker = 200
+	shared := NewInode("node_id_shared.txt", 0644|fuse.S_IFREG, nil)
+	sharedIDs := make([]uint64, workers)
+	inodes := make([][]*Inode, workers)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			sharedIDs[w] = cache.InsertNodeID(shared)
+			for i := 0; i < perWorker; i++ {
+				inode := NewInode(fmt.Sprintf("node_id_%d_%d.txt", w, i), 0644|fuse.S_IFREG, nil)
+				id := inode.ID()
+				if i%2 == 0 {
+					// exercise the path where an item's ID changes on insert
+					id = fmt.Sprintf("node-id-%d-%d", w, i)
+				}
+				nodeID := cache.InsertID(id, inode)
+				cache.TranslateID(nodeID + 1) // may not exist yet, must not panic
+				inodes[w] = append(inodes[w], inode)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for w := 0; w < workers; w++ {
+		assert.Equal(t, sharedIDs[0], sharedIDs[w], "Item was given more than one nodeID.")
+		for _, inode := range inodes[w] {
+			require.Equal(t, inode.ID(), cache.TranslateID(inode.NodeID()),
+				"NodeID mapped to the wrong item.")
+		}
+	}
+	cache.RLock()
+	defer cache.RUnlock()
+	assert.Equal(t, before+workers*perWorker+1, len(cache.inodes),
+		"Wrong number of nodeIDs handed out.")
+}
+
+// Lots of serialization requests in a row should only result in a couple of
+// actual serializations, without losing the last one.
+func TestRequestSerializeCoalesces(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_request_serialize"), Options{})
+	cache.serializeInterval = 500 * time.Millisecond
+
+	for i := 0; i < 100; i++ {
+		cache.RequestSerialize()
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(2 * cache.serializeInterval)
+	count := atomic.LoadUint32(&cache.serializations)
+	assert.GreaterOrEqual(t, count, uint32(1), "Requested serialization never ran.")
+	assert.LessOrEqual(t, count, uint32(2), "Serialization requests were not coalesced.")
+
+	cache.RequestSerialize()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadUint32(&cache.serializations) > count
+	}, retrySeconds, 100*time.Millisecond, "Serialization after a quiet period never ran.")
+}
+
+// A temporary server problem while fetching a folder's children should not break
+// the listing if we still know what the folder contained last time.
+func TestStaleChildrenFallback(t *testing.T) {
+	t.Parallel()
+	dbPath := filepath.Join(testDBLoc, "test_stale_children")
+	cache := NewFilesystem(auth, dbPath, Options{ChildrenRetrySeconds: 1})
+	_, err := cache.GetChildrenID(cache.root, auth)
+	require.NoError(t, err)
+	cache.SerializeAll()
+
+	// restart, so the root's children are no longer in memory
+	require.NoError(t, cache.db.Close())
+	cache = NewFilesystem(auth, dbPath, Options{ChildrenRetrySeconds: 1})
+
+	_, ok := cache.staleChildren(cache.root, errors.New("HTTP 400 - invalidRequest: nope"), auth)
+	assert.False(t, ok, "Only temporary errors should fall back to cached children.")
+
+	blip := errors.New("HTTP 503 - serviceNotAvailable: try again later")
+	children, ok := cache.staleChildren(cache.root, blip, auth)
+	require.True(t, ok, "Did not fall back to cached children.")
+	assert.Contains(t, children, "onedriver_tests")
+
+	root := cache.GetID(cache.root)
+	assert.Eventually(t, func() bool {
+		root.RLock()
+		defer root.RUnlock()
+		return root.children != nil
+	}, retrySeconds, 100*time.Millisecond, "Children were never refreshed in the background.")
+}
+
+// The cache directory should be created with the configured permissions, and an
+// existing cache directory that anyone can read should be warned about.
+func TestPrepareCacheDir(t *testing.T) {
+	assert.Error(t, Options{CacheDirMode: "0999"}.Validate())
+	assert.Error(t, Options{CacheDirMode: "0600"}.Validate(),
+		"onedriver can't use a cache directory it can't enter.")
+	require.NoError(t, Options{CacheDirMode: "0750"}.Validate())
+
+	dir := filepath.Join(t.TempDir(), "cache")
+	require.NoError(t, PrepareCacheDir(dir, Options{CacheDirMode: "0750"}))
+	st, err := os.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), st.Mode().Perm())
+
+	var out bytes.Buffer
+	oldLogger := log.Logger
+	defer func() { log.Logger = oldLogger }()
+	log.Logger = zerolog.New(&out)
+
+	require.NoError(t, PrepareCacheDir(dir, Options{}))
+	assert.Empty(t, out.String(), "Only readable by its group, should not warn.")
+	st, err = os.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), st.Mode().Perm(),
+		"An existing cache directory's permissions should be left alone.")
+
+	require.NoError(t, os.Chmod(dir, 0755))
+	require.NoError(t, PrepareCacheDir(dir, Options{}))
+	assert.Contains(t, out.String(), `"level":"warn"`)
+	assert.Contains(t, out.String(), "read by anyone")
+}
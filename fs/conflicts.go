@@ -0,0 +1,191 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// xattrConflictBehavior overrides what happens when a file is changed on the
+// server and locally at the same time. Its value is one of the Conflict*
+// constants.
+const xattrConflictBehavior = xattrPrefix + "conflict_behavior"
+
+const (
+	// ConflictReplace lets whichever side changed last replace the other's
+	// version. This is the default.
+	ConflictReplace = "replace"
+	// ConflictRename keeps the server's version under the original name and
+	// moves the local version to a conflict copy.
+	ConflictRename = "rename"
+	// ConflictKeepLocal keeps the local version under the original name and
+	// moves the server's version to a conflict copy.
+	ConflictKeepLocal = "keep-local"
+)
+
+// validConflictBehavior checks if a value can be used as a conflict behavior.
+func validConflictBehavior(behavior string) bool {
+	switch behavior {
+	case ConflictReplace, ConflictRename, ConflictKeepLocal:
+		return true
+	}
+	return false
+}
+
+// ConflictBehavior returns what happens to this item when it is changed on the
+// server while we have a local copy of it.
+func (i *Inode) ConflictBehavior() string {
+	i.RLock()
+	defer i.RUnlock()
+	if i.conflictBehavior == "" {
+		return ConflictReplace
+	}
+	return i.conflictBehavior
+}
+
+// conflictCopyName is the name the losing version of a conflicting item is kept
+// under, like "notes (conflict 2021-06-01 150405).txt".
+func conflictCopyName(name string, now time.Time) string {
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s (conflict %s)%s",
+		strings.TrimSuffix(name, ext), now.Format("2006-01-02 150405"), ext)
+}
+
+// keepConflict keeps both the local and server versions of a file that was
+// changed on the server. Which one keeps the original name depends on behavior.
+// The local version always ends up as a new, local-only item that gets uploaded
+// again.
+func (f *Filesystem) keepConflict(local *Inode, delta *graph.DriveItem, behavior string) error {
+	id := local.ID()
+	name := local.Name()
+	parentID := local.ParentID()
+	original := local.Path()
+	copyName := conflictCopyName(name, time.Now())
+	ctx := log.With().
+		Str("id", id).
+		Str("path", original).
+		Str("conflictCopy", copyName).
+		Str("behavior", behavior).
+		Logger()
+
+	if behavior == ConflictKeepLocal {
+		// the server's version has to move out of the way first, or uploading the
+		// local version would replace it
+		if err := graph.Rename(id, copyName, parentID, f.auth); err != nil {
+			ctx.Error().Err(err).Msg("Could not rename server copy of conflicting item.")
+			return err
+		}
+	}
+	if err := f.MoveID(id, localID()); err != nil {
+		ctx.Error().Err(err).Msg("Could not detach local copy of conflicting item.")
+		return err
+	}
+	server := f.newServerInode(delta)
+	if behavior == ConflictKeepLocal {
+		server.DriveItem.Name = copyName
+		server.conflictBehavior = ""
+		f.reportProblem(original,
+			"Changed on the server and locally, kept the server's version as "+copyName+".")
+	} else {
+		if err := f.MovePath(parentID, parentID, name, copyName, f.auth); err != nil {
+			ctx.Error().Err(err).Msg("Could not rename local copy of conflicting item.")
+			return err
+		}
+		local.Lock()
+		local.conflictBehavior = ""
+		local.Unlock()
+		server.conflictBehavior = behavior
+		f.reportProblem(original,
+			"Changed on the server and locally, kept the local version as "+copyName+".")
+	}
+	f.InsertChild(parentID, server)
+	ctx.Warn().Str("delta", "conflict").Msg("Kept both versions of conflicting item.")
+
+	if local.HasChanges() {
+		// files that are still being written will be uploaded on their next
+		// flush, one that was already waiting would use the old name
+		if f.uploads.HasPendingUpload(local.ID()) {
+			f.uploads.CancelUpload(local.ID())
+		}
+		return nil
+	}
+	return f.queueUpload(local)
+}
+
+// sameContent returns true if an item's cached content is what the server has
+// for delta. Content that is still being written counts too.
+func (f *Filesystem) sameContent(id string, delta *graph.DriveItem) bool {
+	if delta.File == nil {
+		return false
+	}
+	// not opened through the content cache, closing it there could close the
+	// file on someone who just opened it
+	fd, err := os.Open(f.content.contentPath(id))
+	if os.IsNotExist(err) {
+		return delta.Size == 0
+	} else if err != nil {
+		return false
+	}
+	defer fd.Close()
+	if st, err := fd.Stat(); err == nil && st.Size() == 0 && delta.Size == 0 {
+		// the server often leaves out the hashes of empty files
+		return true
+	}
+	return delta.VerifyChecksum(f.cachedContentHash(id, fd))
+}
+
+// keepCollision keeps a local-only file that has the same name as an item that
+// showed up on the server before the file could be uploaded, but with different
+// content. Normally the server's item gets the name, and the local file is moved
+// to a conflict copy that gets uploaded instead. With ConflictKeepLocal, it's
+// the other way around.
+func (f *Filesystem) keepCollision(local *Inode, delta *graph.DriveItem) error {
+	name := local.Name()
+	parentID := local.ParentID()
+	original := local.Path()
+	copyName := conflictCopyName(name, time.Now())
+	behavior := local.ConflictBehavior()
+	ctx := log.With().
+		Str("id", local.ID()).
+		Str("serverID", delta.ID).
+		Str("path", original).
+		Str("conflictCopy", copyName).
+		Str("behavior", behavior).
+		Logger()
+
+	server := f.newServerInode(delta)
+	if behavior == ConflictKeepLocal {
+		if err := graph.Rename(delta.ID, copyName, parentID, f.auth); err != nil {
+			ctx.Error().Err(err).Msg("Could not rename server copy of colliding item.")
+			return err
+		}
+		server.DriveItem.Name = copyName
+		f.reportProblem(original,
+			"Created on the server and locally, kept the server's version as "+copyName+".")
+	} else {
+		if err := f.MovePath(parentID, parentID, name, copyName, f.auth); err != nil {
+			ctx.Error().Err(err).Msg("Could not rename local copy of colliding item.")
+			return err
+		}
+		f.reportProblem(original,
+			"Created on the server and locally, kept the local version as "+copyName+".")
+	}
+	f.InsertChild(parentID, server)
+	ctx.Warn().Str("delta", "conflict").Msg("Kept both versions of colliding item.")
+
+	if local.HasChanges() {
+		// files that are still being written will be uploaded on their next
+		// flush, one that was already waiting would use the old name
+		if f.uploads.HasPendingUpload(local.ID()) {
+			f.uploads.CancelUpload(local.ID())
+		}
+		return nil
+	}
+	// an upload that was already waiting would still use the old name
+	return f.queueUpload(local)
+}
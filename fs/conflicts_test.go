@@ -0,0 +1,176 @@
+package fs
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// remoteChange fakes a delta for a change to a file's content on the server.
+func remoteChange(inode *Inode, content []byte) *graph.DriveItem {
+	inode.RLock()
+	delta := inode.DriveItem
+	inode.RUnlock()
+	now := time.Now().Add(10 * time.Second)
+	delta.ModTime = &now
+	delta.ETag = "changed-remotely"
+	delta.Size = uint64(len(content))
+	delta.File = &graph.File{Hashes: graph.Hashes{QuickXorHash: graph.QuickXORHash(&content)}}
+	return &delta
+}
+
+// Files set to keep-local should turn a remote overwrite into a conflict copy,
+// while other files are overwritten as usual.
+func TestConflictBehaviorKeepLocal(t *testing.T) {
+	t.Parallel()
+	dir := filepath.Join(TestDir, "conflict_behavior")
+	require.NoError(t, syscall.Mkdir(dir, 0755))
+	local := []byte("local content")
+	for _, name := range []string{"keep.kdbx", "replace.log"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), local, 0644))
+	}
+	var keep, replace *Inode
+	require.Eventually(t, func() bool {
+		keep, _ = fs.GetPath("/onedriver_tests/conflict_behavior/keep.kdbx", auth)
+		replace, _ = fs.GetPath("/onedriver_tests/conflict_behavior/replace.log", auth)
+		return keep != nil && !isLocalID(keep.ID()) && replace != nil && !isLocalID(replace.ID())
+	}, retrySeconds, time.Second, "Files were never uploaded.")
+
+	require.NoError(t, syscall.Setxattr(
+		filepath.Join(dir, "keep.kdbx"), xattrConflictBehavior, []byte(ConflictKeepLocal), 0))
+	value := make([]byte, 64)
+	size, err := syscall.Getxattr(filepath.Join(dir, "keep.kdbx"), xattrConflictBehavior, value)
+	require.NoError(t, err)
+	require.Equal(t, ConflictKeepLocal, string(value[:size]))
+	assert.Equal(t, syscall.EINVAL, syscall.Setxattr(
+		filepath.Join(dir, "replace.log"), xattrConflictBehavior, []byte("nonsense"), 0))
+
+	remote := []byte("changed on the server!")
+	keepID := keep.ID()
+	require.NoError(t, fs.applyDelta(remoteChange(keep, remote)))
+	require.NoError(t, fs.applyDelta(remoteChange(replace, remote)))
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "keep.kdbx"))
+	require.NoError(t, err)
+	assert.Equal(t, local, content, "Local version should have kept its name.")
+	assert.Equal(t, ConflictKeepLocal, keep.ConflictBehavior())
+
+	item, err := graph.GetItem(keepID, auth)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(item.Name, "keep (conflict "),
+		"Server version was not renamed to a conflict copy, got %q.", item.Name)
+	children, err := fs.GetChildrenPath("/onedriver_tests/conflict_behavior", auth)
+	require.NoError(t, err)
+	assert.Contains(t, children, strings.ToLower(item.Name), "No local conflict copy.")
+	assert.Len(t, children, 3, "Only the keep-local file should get a conflict copy.")
+
+	assert.Equal(t, uint64(len(remote)), replace.Size(),
+		"File without an override was not overwritten.")
+}
+
+// A file created locally that hasn't been uploaded yet should only take over
+// the ID of a server item with the same name if their content matches.
+// Otherwise both versions must be kept.
+func TestLocalCreateCollision(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_local_create_collision"), Options{})
+	root := cache.GetID(cache.root)
+	now := time.Now()
+	serverItem := func(id string, name string, content []byte) *graph.DriveItem {
+		return &graph.DriveItem{
+			ID:      id,
+			Name:    name,
+			ModTime: &now,
+			Size:    uint64(len(content)),
+			Parent:  &graph.DriveItemParent{ID: cache.root},
+			File:    &graph.File{Hashes: graph.Hashes{QuickXorHash: graph.QuickXORHash(&content)}},
+		}
+	}
+
+	localContent := []byte("written here, not flushed yet")
+	notes := NewInode("collision_notes.txt", 0644|fuse.S_IFREG, root)
+	cache.InsertChild(cache.root, notes)
+	require.NoError(t, cache.content.Insert(notes.ID(), localContent))
+	notes.Lock()
+	notes.hasChanges = true
+	notes.Unlock()
+
+	serverContent := []byte("something else entirely")
+	require.NoError(t, cache.applyDelta(
+		serverItem("collision-notes-server", "collision_notes.txt", serverContent)))
+	server, _ := cache.GetChild(cache.root, "collision_notes.txt", nil)
+	require.NotNil(t, server)
+	assert.Equal(t, "collision-notes-server", server.ID(), "Server item did not get its name.")
+	assert.True(t, isLocalID(notes.ID()), "Local file took over the ID of different content.")
+	assert.True(t, strings.HasPrefix(notes.Name(), "collision_notes (conflict "),
+		"Local file was not moved to a conflict copy, got %q.", notes.Name())
+	assert.Equal(t, localContent, cache.content.Get(notes.ID()), "Local content was lost.")
+
+	// a server item showing up with the name of a file being uploaded, and the
+	// content that upload is sending, is that upload, which takes care of the
+	// ID itself
+	uploading := NewInode("collision_uploading.txt", 0644|fuse.S_IFREG, root)
+	cache.InsertChild(cache.root, uploading)
+	require.NoError(t, cache.content.Insert(uploading.ID(), []byte("second version")))
+	firstVersion := []byte("first version")
+	pending := func(inode *Inode, content []byte) func() {
+		cache.uploads.sessionsM.Lock()
+		cache.uploads.sessions[inode.ID()] = &UploadSession{
+			ID:           inode.ID(),
+			QuickXORHash: graph.QuickXORHash(&content),
+		}
+		cache.uploads.sessionsM.Unlock()
+		return func() {
+			cache.uploads.sessionsM.Lock()
+			delete(cache.uploads.sessions, inode.ID())
+			cache.uploads.sessionsM.Unlock()
+		}
+	}
+	done := pending(uploading, firstVersion)
+	require.NoError(t, cache.applyDelta(
+		serverItem("collision-uploading-server", "collision_uploading.txt", firstVersion)))
+	assert.Equal(t, "collision_uploading.txt", uploading.Name(),
+		"File being uploaded was moved to a conflict copy.")
+	assert.Nil(t, cache.GetID("collision-uploading-server"))
+	done()
+
+	// an upload of something else would overwrite the server's file by name
+	racing := NewInode("collision_racing.txt", 0644|fuse.S_IFREG, root)
+	cache.InsertChild(cache.root, racing)
+	require.NoError(t, cache.content.Insert(racing.ID(), []byte("ours")))
+	racing.Lock()
+	racing.hasChanges = true
+	racing.Unlock()
+	done = pending(racing, []byte("ours"))
+	require.NoError(t, cache.applyDelta(
+		serverItem("collision-racing-server", "collision_racing.txt", []byte("theirs"))))
+	done()
+	assert.True(t, strings.HasPrefix(racing.Name(), "collision_racing (conflict "),
+		"Upload of different content was not moved to a conflict copy, got %q.", racing.Name())
+	assert.NotNil(t, cache.GetID("collision-racing-server"), "Server's file was not kept.")
+
+	same := []byte("the same on both sides")
+	copied := NewInode("collision_same.txt", 0644|fuse.S_IFREG, root)
+	cache.InsertChild(cache.root, copied)
+	require.NoError(t, cache.content.Insert(copied.ID(), same))
+	require.NoError(t, cache.applyDelta(
+		serverItem("collision-same-server", "collision_same.txt", same)))
+	assert.Equal(t, "collision-same-server", copied.ID(),
+		"Local file with the same content did not take over the server ID.")
+	assert.Equal(t, same, cache.content.Get(copied.ID()))
+}
+
+func TestConflictCopyName(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2021, 6, 1, 15, 4, 5, 0, time.UTC)
+	assert.Equal(t, "notes (conflict 2021-06-01 150405).txt", conflictCopyName("notes.txt", now))
+	assert.Equal(t, "Makefile (conflict 2021-06-01 150405)", conflictCopyName("Makefile", now))
+}
@@ -7,12 +7,34 @@ import (
 	"path/filepath"
 	"runtime"
 	"sync"
+	"time"
 )
 
+// ContentDir is where file content is cached, relative to a filesystem's cache
+// directory.
+const ContentDir = "content"
+
+// ContentSize returns how many bytes of file content are cached in a
+// filesystem's cache directory.
+func ContentSize(cacheDir string) (int64, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(cacheDir, ContentDir))
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() {
+			size += entry.Size()
+		}
+	}
+	return size, nil
+}
+
 // LoopbackCache stores the content for files under a folder as regular files
 type LoopbackCache struct {
 	directory string
 	fds       sync.Map
+	accessed  sync.Map // id -> time.Time content was last used, for eviction
 }
 
 func NewLoopbackCache(directory string) *LoopbackCache {
@@ -28,14 +50,21 @@ func (l *LoopbackCache) contentPath(id string) string {
 	return filepath.Join(l.directory, id)
 }
 
+// touch records that content was just used.
+func (l *LoopbackCache) touch(id string) {
+	l.accessed.Store(id, time.Now())
+}
+
 // Get reads a file's content from disk.
 func (l *LoopbackCache) Get(id string) []byte {
+	l.touch(id)
 	content, _ := ioutil.ReadFile(l.contentPath(id))
 	return content
 }
 
 // InsertContent writes file content to disk in a single bulk insert.
 func (l *LoopbackCache) Insert(id string, content []byte) error {
+	l.touch(id)
 	return ioutil.WriteFile(l.contentPath(id), content, 0600)
 }
 
@@ -51,14 +80,73 @@ func (l *LoopbackCache) InsertStream(id string, reader io.Reader) (int64, error)
 // Delete closes the fd AND deletes content from disk.
 func (l *LoopbackCache) Delete(id string) error {
 	l.Close(id)
+	l.accessed.Delete(id)
 	return os.Remove(l.contentPath(id))
 }
 
-// Move moves content from one ID to another
+// Move moves content from one ID to another. An open fd moves along with it and
+// stays usable.
 func (l *LoopbackCache) Move(oldID string, newID string) error {
+	if fd, ok := l.fds.Load(oldID); ok {
+		l.fds.Store(newID, fd)
+		l.fds.Delete(oldID)
+	}
+	if accessed, ok := l.accessed.Load(oldID); ok {
+		l.accessed.Store(newID, accessed)
+		l.accessed.Delete(oldID)
+	}
 	return os.Rename(l.contentPath(oldID), l.contentPath(newID))
 }
 
+// contentUsage is how much space an item's content takes up and when it was
+// last used.
+type contentUsage struct {
+	id       string
+	size     int64
+	accessed time.Time
+}
+
+// Usage returns the size and last use of every item's content on disk. Content
+// that has not been used since onedriver started counts as last used when it was
+// last written.
+func (l *LoopbackCache) Usage() ([]contentUsage, error) {
+	files, err := ioutil.ReadDir(l.directory)
+	if err != nil {
+		return nil, err
+	}
+	usage := make([]contentUsage, 0, len(files))
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		accessed := file.ModTime()
+		if last, ok := l.accessed.Load(file.Name()); ok {
+			accessed = last.(time.Time)
+		}
+		usage = append(usage, contentUsage{
+			id:       file.Name(),
+			size:     file.Size(),
+			accessed: accessed,
+		})
+	}
+	return usage, nil
+}
+
+// List returns the IDs of every item with content on disk.
+func (l *LoopbackCache) List() ([]string, error) {
+	files, err := ioutil.ReadDir(l.directory)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(files))
+	for _, file := range files {
+		if !file.IsDir() {
+			ids = append(ids, file.Name())
+		}
+	}
+	return ids, nil
+}
+
 // IsOpen returns true if the file is already opened somewhere
 func (l *LoopbackCache) IsOpen(id string) bool {
 	_, ok := l.fds.Load(id)
@@ -79,6 +167,7 @@ func (l *LoopbackCache) HasContent(id string) bool {
 
 // Open returns a filehandle for subsequent access
 func (l *LoopbackCache) Open(id string) (*os.File, error) {
+	l.touch(id)
 	if fd, ok := l.fds.Load(id); ok {
 		// already opened, return existing fd
 		return fd.(*os.File), nil
@@ -101,6 +190,7 @@ func (l *LoopbackCache) Open(id string) (*os.File, error) {
 // Close closes the currently open fd
 func (l *LoopbackCache) Close(id string) {
 	if fd, ok := l.fds.Load(id); ok {
+		l.touch(id)
 		file := fd.(*os.File)
 		file.Sync()
 		file.Close()
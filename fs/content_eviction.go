@@ -0,0 +1,70 @@
+package fs
+
+import (
+	"sort"
+
+	"github.com/rs/zerolog/log"
+)
+
+// evictContent deletes the cached content of the least recently used files until
+// the cache fits in Options.CacheSizeLimit. Content that is the only copy of
+// something (like changes that haven't been uploaded yet) is never evicted, so
+// the cache can stay over the limit.
+func (f *Filesystem) evictContent() {
+	limit := int64(f.opts.CacheSizeLimit)
+	if limit <= 0 {
+		return
+	}
+	usage, err := f.content.Usage()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not check size of content cache.")
+		return
+	}
+	var total int64
+	for _, content := range usage {
+		total += content.size
+	}
+	if total <= limit {
+		return
+	}
+
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].accessed.Before(usage[j].accessed)
+	})
+	evicted := 0
+	for _, content := range usage {
+		if total <= limit {
+			break
+		}
+		if f.evict(content.id) {
+			total -= content.size
+			evicted++
+		}
+	}
+	log.Info().Int("evicted", evicted).Int64("size", total).Int64("limit", limit).
+		Msg("Evicted least recently used content from cache.")
+}
+
+// evict deletes an item's cached content, unless it's in use or hasn't been
+// uploaded yet. Returns true if the content was deleted.
+func (f *Filesystem) evict(id string) bool {
+	if isLocalID(id) || f.content.IsOpen(id) || f.uploads.HasPendingUpload(id) || f.isDirty(id) {
+		return false
+	}
+	inode := f.GetID(id)
+	if inode == nil {
+		// nothing refers to this content anymore
+		return f.deleteContent(id) == nil
+	}
+	// holding the lock keeps the file from being opened while we delete it
+	inode.Lock()
+	defer inode.Unlock()
+	if inode.hasChanges || inode.openCount > 0 || inode.keepLocal {
+		return false
+	}
+	if err := f.deleteContent(id); err != nil {
+		log.Error().Err(err).Str("id", id).Msg("Could not evict content.")
+		return false
+	}
+	return true
+}
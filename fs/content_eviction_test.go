@@ -0,0 +1,44 @@
+package fs
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The least recently used content should be evicted first, and content that
+// can't be downloaded again never.
+func TestEvictContent(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_evict_content"),
+		Options{CacheSizeLimit: 30})
+	now := time.Now()
+	ids := []string{"evict-changed", "evict-open", "evict-oldest", "evict-older", "evict-newest"}
+	for i, id := range ids {
+		inode := NewInodeDriveItem(&graph.DriveItem{
+			ID:      id,
+			Name:    id + ".txt",
+			ModTime: &now,
+			File:    &graph.File{},
+			Parent:  &graph.DriveItemParent{ID: cache.root},
+		})
+		cache.InsertChild(cache.root, inode)
+		require.NoError(t, cache.content.Insert(id, []byte("0123456789")))
+		cache.content.accessed.Store(id, now.Add(time.Duration(i)*time.Minute))
+	}
+	cache.GetID("evict-changed").hasChanges = true
+	cache.GetID("evict-open").openCount = 1
+
+	// 50 bytes to start with, the two oldest files that are safe to evict have
+	// to go to get under the limit
+	cache.evictContent()
+	assert.True(t, cache.content.HasContent("evict-changed"), "Unuploaded changes were evicted.")
+	assert.True(t, cache.content.HasContent("evict-open"), "Open file was evicted.")
+	assert.False(t, cache.content.HasContent("evict-oldest"))
+	assert.False(t, cache.content.HasContent("evict-older"))
+	assert.True(t, cache.content.HasContent("evict-newest"), "Too much was evicted.")
+}
@@ -0,0 +1,107 @@
+package fs
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	bolt "go.etcd.io/bbolt"
+)
+
+// the QuickXorHash of each item's cached content, along with the size and
+// modification time the content had when it was hashed
+var bucketHashes = []byte("hashes")
+
+// setting this extended attribute on a file makes the next open hash its cached
+// content again, instead of trusting the hash computed last time
+const xattrVerify = xattrPrefix + "verify"
+
+// contentHash is the hash of an item's content as of the last time it was
+// computed. The content hasn't changed since if its size and modification time
+// are still the same.
+type contentHash struct {
+	QuickXorHash string `json:"quickXorHash"`
+	Size         int64  `json:"size"`
+	ModTime      int64  `json:"modTime"` // nanoseconds
+}
+
+// cachedContentHash returns the QuickXorHash of an item's cached content. Hashing
+// means reading the whole file, so the hash is only computed again if the
+// content changed since the last time.
+func (f *Filesystem) cachedContentHash(id string, fd *os.File) string {
+	st, err := fd.Stat()
+	if err != nil {
+		return graph.QuickXORHashStream(fd)
+	}
+	var cached contentHash
+	f.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucketHashes); b != nil {
+			if data := b.Get([]byte(id)); data != nil {
+				json.Unmarshal(data, &cached)
+			}
+		}
+		return nil
+	})
+	if cached.QuickXorHash != "" && cached.Size == st.Size() &&
+		cached.ModTime == st.ModTime().UnixNano() {
+		return cached.QuickXorHash
+	}
+	hash := graph.QuickXORHashStream(fd)
+	f.storeContentHash(id, fd, hash)
+	return hash
+}
+
+// storeContentHash remembers the hash of an item's cached content as it is now.
+func (f *Filesystem) storeContentHash(id string, fd *os.File, hash string) {
+	st, err := fd.Stat()
+	if err != nil || hash == "" {
+		return
+	}
+	data, _ := json.Marshal(contentHash{
+		QuickXorHash: hash,
+		Size:         st.Size(),
+		ModTime:      st.ModTime().UnixNano(),
+	})
+	f.db.Batch(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketHashes)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+}
+
+// forgetContentHash makes the next open hash an item's cached content again.
+func (f *Filesystem) forgetContentHash(id string) {
+	f.db.Batch(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucketHashes); b != nil {
+			return b.Delete([]byte(id))
+		}
+		return nil
+	})
+}
+
+// moveContentHash keeps an item's content hash when its content moves to a new
+// ID, like when a new file is uploaded for the first time.
+func (f *Filesystem) moveContentHash(oldID string, newID string) {
+	f.db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketHashes)
+		if b == nil {
+			return nil
+		}
+		data := b.Get([]byte(oldID))
+		if data == nil {
+			return nil
+		}
+		if err := b.Put([]byte(newID), append([]byte(nil), data...)); err != nil {
+			return err
+		}
+		return b.Delete([]byte(oldID))
+	})
+}
+
+// deleteContent removes an item's cached content, along with its hash.
+func (f *Filesystem) deleteContent(id string) error {
+	f.forgetContentHash(id)
+	return f.content.Delete(id)
+}
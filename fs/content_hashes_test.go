@@ -0,0 +1,88 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Cached content should only be hashed again once its size or modification time
+// changed, or when asked to.
+func TestCachedContentHash(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_cached_content_hash"), Options{})
+	id := localID()
+	original := []byte("the original content")
+	require.NoError(t, cache.content.Insert(id, original))
+	path := cache.content.contentPath(id)
+	fd, err := cache.content.Open(id)
+	require.NoError(t, err)
+	defer cache.content.Delete(id)
+
+	assert.Equal(t, graph.QuickXORHash(&original), cache.cachedContentHash(id, fd))
+
+	// same size and modification time, so this must not be read again
+	st, err := os.Stat(path)
+	require.NoError(t, err)
+	replaced := []byte("the replaced content")
+	_, err = fd.WriteAt(replaced, 0)
+	require.NoError(t, err)
+	require.NoError(t, os.Chtimes(path, st.ModTime(), st.ModTime()))
+	assert.Equal(t, graph.QuickXORHash(&original), cache.cachedContentHash(id, fd),
+		"Content was hashed again although it did not seem to change.")
+
+	cache.forgetContentHash(id)
+	assert.Equal(t, graph.QuickXORHash(&replaced), cache.cachedContentHash(id, fd),
+		"Content was not hashed again on demand.")
+
+	changed := []byte("the changed content!")
+	_, err = fd.WriteAt(changed, 0)
+	require.NoError(t, err)
+	later := st.ModTime().Add(time.Second)
+	require.NoError(t, os.Chtimes(path, later, later))
+	assert.Equal(t, graph.QuickXORHash(&changed), cache.cachedContentHash(id, fd),
+		"Content was not hashed again after it changed.")
+}
+
+// An item's content hash should move along with its content when the item gets
+// a new ID, and be deleted along with it.
+func TestContentHashFollowsContent(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_content_hash_follows"), Options{})
+	inode := NewInode("hashFollows.txt", 0644|fuse.S_IFREG, nil)
+	cache.InsertChild(cache.root, inode)
+	oldID := inode.ID()
+	data := []byte("content that gets a new ID")
+	require.NoError(t, cache.content.Insert(oldID, data))
+	fd, err := cache.content.Open(oldID)
+	require.NoError(t, err)
+	cache.storeContentHash(oldID, fd, graph.QuickXORHash(&data))
+	cache.content.Close(oldID)
+
+	hashed := func(id string) bool {
+		found := false
+		cache.db.View(func(tx *bolt.Tx) error {
+			if b := tx.Bucket(bucketHashes); b != nil {
+				found = b.Get([]byte(id)) != nil
+			}
+			return nil
+		})
+		return found
+	}
+	require.True(t, hashed(oldID))
+
+	newID := "HASHFOLLOWSCONTENT"
+	require.NoError(t, cache.MoveID(oldID, newID))
+	assert.False(t, hashed(oldID), "Hash was left behind under the old ID.")
+	assert.True(t, hashed(newID), "Hash did not move along with the content.")
+
+	require.NoError(t, cache.deleteContent(newID))
+	assert.False(t, hashed(newID), "Hash outlived the content.")
+}
@@ -0,0 +1,208 @@
+package fs
+
+import (
+	"io"
+	"math"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// how long to wait for the server to copy a file before copying it ourselves
+const serverCopyTimeout = 5 * time.Minute
+
+// how long to keep checking on a server copy after giving up on waiting for it
+const serverCopyAdoptTimeout = time.Hour
+
+// the most copy_file_range can report as copied in one call, rounded down to a
+// whole page
+const maxCopyChunk = math.MaxUint32 &^ 4095
+
+// serverCopy identifies a copy made on the server whose copy_file_range calls
+// are not done yet.
+type serverCopy struct {
+	src string
+	dst string
+}
+
+// CopyFileRange copies a whole file into a new, empty one on the server instead
+// of downloading and uploading it again, like "cp" does within the mount. The
+// file content is copied into the cache locally as well. Anything else is left
+// to the caller to copy through reads and writes, by claiming not to support it.
+func (f *Filesystem) CopyFileRange(cancel <-chan struct{}, in *fuse.CopyFileRangeIn) (uint32, fuse.Status) {
+	src := f.GetNodeID(in.NodeId)
+	dst := f.GetNodeID(in.NodeIdOut)
+	if src == nil || dst == nil {
+		return 0, fuse.EBADF
+	}
+
+	// a file that was copied already, and is too big to say so all at once
+	key := serverCopy{src: src.ID(), dst: dst.ID()}
+	if entry, ok := f.serverCopies.Load(key); ok && in.OffIn == in.OffOut {
+		size := entry.(uint64)
+		if in.OffOut >= size {
+			f.serverCopies.Delete(key)
+			return 0, fuse.OK
+		}
+		return copyChunk(size-in.OffOut, in.Len), fuse.OK
+	}
+
+	if !f.serverCopyable(src, dst, in) {
+		return 0, fuse.ENOTSUP
+	}
+	srcID := src.ID()
+	dstID := dst.ID()
+	ctx := log.With().
+		Str("op", "CopyFileRange").
+		Str("id", srcID).
+		Str("path", src.Path()).
+		Str("dest", dst.Path()).
+		Logger()
+
+	monitor, err := copyItem(srcID, dst.Name(), dst.ParentID(), f.auth)
+	if err != nil {
+		ctx.Warn().Err(err).Msg("Could not copy file on the server, copying it ourselves.")
+		return 0, fuse.ENOTSUP
+	}
+	newID, err := waitForCopy(monitor, serverCopyTimeout, cancel)
+	if err != nil {
+		ctx.Warn().Err(err).Msg("Server-side copy failed, copying file ourselves.")
+		if err == graph.ErrCopyTimeout || err == graph.ErrCopyInterrupted {
+			// the server will most likely still finish it
+			go f.adoptServerCopy(monitor, dst)
+		}
+		return 0, fuse.ENOTSUP
+	}
+	item, err := getItem(newID, f.auth)
+	if err != nil {
+		ctx.Warn().Err(err).Str("newID", newID).
+			Msg("Could not fetch file copied on the server, copying it ourselves.")
+		return 0, fuse.ENOTSUP
+	}
+
+	// we have the content already, no need to download it again
+	size := src.Size()
+	if err := f.copyContent(srcID, dstID, int64(size)); err != nil {
+		ctx.Error().Err(err).Msg("Could not copy cached content.")
+		return 0, fuse.EIO
+	}
+	dst.Lock()
+	dst.hasChanges = false
+	dst.DriveItem.Size = item.Size
+	dst.DriveItem.ModTime = item.ModTime
+	dst.DriveItem.ETag = item.ETag
+	dst.DriveItem.File = item.File
+	dst.Unlock()
+	f.uploads.CancelUpload(dstID)
+	if err := f.MoveID(dstID, newID); err != nil {
+		ctx.Error().Err(err).Msg("Could not give the copy its new ID.")
+		return 0, fuse.EIO
+	}
+	if fd, err := f.content.Open(newID); err == nil && item.File != nil {
+		f.storeContentHash(newID, fd, item.File.Hashes.QuickXorHash)
+	}
+	ctx.Info().Str("newID", newID).Msg("Copied file on the server.")
+
+	f.serverCopies.Store(serverCopy{src: srcID, dst: newID}, size)
+	return copyChunk(size, in.Len), fuse.OK
+}
+
+// adoptServerCopy keeps checking on a server copy into dst that we stopped
+// waiting for. By then the caller is copying the file itself, so to not end up
+// with two copies on the server, dst takes over the server's copy if it has not
+// been uploaded yet. Otherwise the server's copy is deleted again.
+func (f *Filesystem) adoptServerCopy(monitor string, dst *Inode) {
+	newID, err := waitForCopy(monitor, serverCopyAdoptTimeout, nil)
+	if err != nil {
+		log.Warn().Err(err).Str("monitor", monitor).
+			Msg("Server-side copy we stopped waiting for did not finish.")
+		return
+	}
+	id := dst.ID()
+	ctx := log.With().
+		Str("op", "CopyFileRange").
+		Str("id", id).
+		Str("newID", newID).
+		Logger()
+	if id == newID {
+		// our own upload already replaced it
+		return
+	}
+	if isLocalID(id) && f.GetID(id) == dst && !f.uploads.HasPendingUpload(id) {
+		if err := f.MoveID(id, newID); err != nil {
+			ctx.Error().Err(err).Msg("Could not give the copy its new ID.")
+		} else {
+			ctx.Info().Msg("Took over file copied on the server after all.")
+		}
+		return
+	}
+	if err := graph.Remove(newID, f.auth); err != nil {
+		ctx.Error().Err(err).Msg("Could not delete extra copy made on the server.")
+		return
+	}
+	ctx.Info().Msg("Deleted extra copy made on the server.")
+}
+
+// forgetServerCopies stops treating the copies into an item as done once it is
+// changed or closed, the rest has to be copied through reads and writes.
+func (f *Filesystem) forgetServerCopies(dstID string) {
+	f.serverCopies.Range(func(key interface{}, _ interface{}) bool {
+		if key.(serverCopy).dst == dstID {
+			f.serverCopies.Delete(key)
+		}
+		return true
+	})
+}
+
+// serverCopyable returns true if a copy_file_range call copies all of src into
+// dst, and the server has everything it needs to do it for us.
+func (f *Filesystem) serverCopyable(src *Inode, dst *Inode, in *fuse.CopyFileRangeIn) bool {
+	if f.IsOffline() || in.OffIn != 0 || in.OffOut != 0 || in.Len < src.Size() ||
+		src.IsDir() || dst.IsDir() {
+		return false
+	}
+	srcID := src.ID()
+	if isLocalID(srcID) || isVirtualID(srcID) || src.HasChanges() ||
+		f.uploads.HasPendingUpload(srcID) || !f.content.HasContent(srcID) {
+		return false
+	}
+	// the copy has to be a brand new file somewhere the server knows about
+	dstID := dst.ID()
+	parentID := dst.ParentID()
+	return isLocalID(dstID) && dst.Size() == 0 && !dst.KeepLocal() &&
+		!f.uploads.HasPendingUpload(dstID) && !isLocalID(parentID) && !readOnlyDir(parentID)
+}
+
+// copyContent copies the first size bytes of cached content to another item.
+func (f *Filesystem) copyContent(srcID string, dstID string, size int64) error {
+	srcFd, err := f.content.Open(srcID)
+	if err != nil {
+		return err
+	}
+	dstFd, err := f.content.Open(dstID)
+	if err != nil {
+		return err
+	}
+	if err := dstFd.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := dstFd.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(dstFd, io.NewSectionReader(srcFd, 0, size))
+	return err
+}
+
+// copyChunk is how much of what is left of a copy to report as copied to a
+// copy_file_range call asking for length bytes.
+func copyChunk(left uint64, length uint64) uint32 {
+	if length < left {
+		left = length
+	}
+	if left > maxCopyChunk {
+		left = maxCopyChunk
+	}
+	return uint32(left)
+}
@@ -0,0 +1,161 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Copying a whole file into a new one should happen on the server, without
+// uploading the content again. Anything the server can't copy is left to the
+// caller.
+func TestCopyFileRange(t *testing.T) {
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_copy_file_range"), Options{})
+	oldCopy, oldWait, oldGet := copyItem, waitForCopy, getItem
+	defer func() { copyItem, waitForCopy, getItem = oldCopy, oldWait, oldGet }()
+	content := []byte("copied on the server")
+	now := time.Now()
+	copied := &graph.DriveItem{
+		ID:      "copy-file-range-copy",
+		Name:    "copy.txt",
+		Size:    uint64(len(content)),
+		ModTime: &now,
+		Parent:  &graph.DriveItemParent{ID: cache.root},
+		File:    &graph.File{Hashes: graph.Hashes{QuickXorHash: graph.QuickXORHash(&content)}},
+	}
+	copyItem = func(id, name, parentID string, auth *graph.Auth) (string, error) {
+		if id != "copy-file-range-original" || name != "copy.txt" || parentID != cache.root {
+			return "", errors.New("unexpected copy")
+		}
+		return "monitor", nil
+	}
+	waitForCopy = func(monitor string, timeout time.Duration, cancel <-chan struct{}) (string, error) {
+		return copied.ID, nil
+	}
+	getItem = func(id string, auth *graph.Auth) (*graph.DriveItem, error) {
+		return copied, nil
+	}
+
+	root := cache.GetID(cache.root)
+	original := NewInodeDriveItem(&graph.DriveItem{
+		ID:     "copy-file-range-original",
+		Name:   "original.txt",
+		Size:   uint64(len(content)),
+		Parent: &graph.DriveItemParent{ID: cache.root},
+		File:   &graph.File{Hashes: graph.Hashes{QuickXorHash: graph.QuickXORHash(&content)}},
+	})
+	cache.InsertChild(cache.root, original)
+	require.NoError(t, cache.content.Insert(original.ID(), content))
+	dst := NewInode("copy.txt", 0644|fuse.S_IFREG, root)
+	dst.hasChanges = true
+	cache.InsertChild(cache.root, dst)
+
+	in := &fuse.CopyFileRangeIn{
+		InHeader:  fuse.InHeader{NodeId: original.NodeID()},
+		NodeIdOut: dst.NodeID(),
+		Len:       1 << 30,
+	}
+	written, status := cache.CopyFileRange(context.Background().Done(), in)
+	require.Equal(t, fuse.OK, status)
+	assert.EqualValues(t, len(content), written)
+	assert.Equal(t, copied.ID, dst.ID(), "Copy did not get the ID of the server's copy.")
+	assert.False(t, dst.HasChanges(), "Copy would be uploaded again.")
+	assert.False(t, cache.uploads.HasPendingUpload(dst.ID()))
+	assert.Equal(t, content, cache.content.Get(dst.ID()), "Content was not copied locally.")
+
+	// only the copy from the same file is done already
+	other := *in
+	other.InHeader.NodeId = dst.NodeID()
+	other.OffIn, other.OffOut = uint64(written), uint64(written)
+	_, status = cache.CopyFileRange(context.Background().Done(), &other)
+	assert.Equal(t, fuse.ENOTSUP, status, "Copy from another file was treated as done.")
+
+	// and there's nothing left to copy
+	in.OffIn, in.OffOut = uint64(written), uint64(written)
+	written, status = cache.CopyFileRange(context.Background().Done(), in)
+	assert.Equal(t, fuse.OK, status)
+	assert.EqualValues(t, 0, written)
+
+	// once the copy is written to, the rest has to be copied by the caller
+	cache.serverCopies.Store(serverCopy{src: original.ID(), dst: dst.ID()}, uint64(1<<40))
+	_, status = cache.Write(context.Background().Done(), &fuse.WriteIn{
+		InHeader: fuse.InHeader{NodeId: dst.NodeID()},
+	}, []byte("C"))
+	require.Equal(t, fuse.OK, status)
+	_, status = cache.CopyFileRange(context.Background().Done(), in)
+	assert.Equal(t, fuse.ENOTSUP, status, "Copy was treated as done after being written to.")
+
+	// if the server fails, the caller has to copy it themselves
+	copyItem = func(id, name, parentID string, auth *graph.Auth) (string, error) {
+		return "", errors.New("nope")
+	}
+	failed := NewInode("failed.txt", 0644|fuse.S_IFREG, root)
+	cache.InsertChild(cache.root, failed)
+	in = &fuse.CopyFileRangeIn{
+		InHeader:  fuse.InHeader{NodeId: original.NodeID()},
+		NodeIdOut: failed.NodeID(),
+		Len:       1 << 30,
+	}
+	_, status = cache.CopyFileRange(context.Background().Done(), in)
+	assert.Equal(t, fuse.ENOTSUP, status)
+	assert.True(t, isLocalID(failed.ID()))
+
+	// partial copies can't be done by the server
+	in.Len = 3
+	_, status = cache.CopyFileRange(context.Background().Done(), in)
+	assert.Equal(t, fuse.ENOTSUP, status)
+}
+
+// A server copy that takes too long is copied by the caller instead. If the
+// server finishes it after all, the caller's copy should take it over instead
+// of being uploaded next to it.
+func TestCopyFileRangeAdoptedLater(t *testing.T) {
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_copy_file_range_adopted"), Options{})
+	oldCopy, oldWait := copyItem, waitForCopy
+	defer func() { copyItem, waitForCopy = oldCopy, oldWait }()
+	copyItem = func(id, name, parentID string, auth *graph.Auth) (string, error) {
+		return "monitor", nil
+	}
+	finished := make(chan struct{})
+	waitForCopy = func(monitor string, timeout time.Duration, cancel <-chan struct{}) (string, error) {
+		if timeout == serverCopyTimeout {
+			return "", graph.ErrCopyTimeout
+		}
+		<-finished
+		return "copy-file-range-adopted", nil
+	}
+
+	content := []byte("copied on the server, eventually")
+	root := cache.GetID(cache.root)
+	original := NewInodeDriveItem(&graph.DriveItem{
+		ID:     "copy-file-range-slow-original",
+		Name:   "slow_original.txt",
+		Size:   uint64(len(content)),
+		Parent: &graph.DriveItemParent{ID: cache.root},
+		File:   &graph.File{Hashes: graph.Hashes{QuickXorHash: graph.QuickXORHash(&content)}},
+	})
+	cache.InsertChild(cache.root, original)
+	require.NoError(t, cache.content.Insert(original.ID(), content))
+	dst := NewInode("slow_copy.txt", 0644|fuse.S_IFREG, root)
+	cache.InsertChild(cache.root, dst)
+
+	_, status := cache.CopyFileRange(context.Background().Done(), &fuse.CopyFileRangeIn{
+		InHeader:  fuse.InHeader{NodeId: original.NodeID()},
+		NodeIdOut: dst.NodeID(),
+		Len:       1 << 30,
+	})
+	require.Equal(t, fuse.ENOTSUP, status)
+	assert.True(t, isLocalID(dst.ID()))
+
+	close(finished)
+	assert.Eventually(t, func() bool {
+		return dst.ID() == "copy-file-range-adopted"
+	}, 5*time.Second, 10*time.Millisecond, "Copy did not take over the server's copy.")
+}
@@ -3,6 +3,9 @@ package fs
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -11,15 +14,25 @@ import (
 	bolt "go.etcd.io/bbolt"
 )
 
+// how many delta fetches in a row have to fail with an error from the server
+// before sync is reported as broken, unless configured otherwise
+const defaultSyncBrokenAfter = 10
+
 // DeltaLoop creates a new thread to poll the server for changes and should be
-// called as a goroutine
+// called as a goroutine. Deltas are fetched early whenever the server notifies
+// us of a change.
 func (f *Filesystem) DeltaLoop(interval time.Duration) {
 	log.Trace().Msg("Starting delta goroutine.")
+	if !f.opts.DisableNotifications {
+		go f.notificationLoop()
+	}
 	for { // eva
+		start := time.Now()
 		// get deltas
 		log.Trace().Msg("Fetching deltas from server.")
 		pollSuccess := false
-		deltas := make(map[string]*graph.DriveItem)
+		var throttled time.Duration // how long the server asked us to back off
+		deltas := f.loadPendingDeltas()
 		for {
 			incoming, cont, err := f.pollDeltas(f.auth)
 			if err != nil {
@@ -28,8 +41,13 @@ func (f *Filesystem) DeltaLoop(interval time.Duration) {
 				log.Error().Err(err).
 					Msg("Error during delta fetch, marking fs as offline.")
 				f.Lock()
+				if !f.offline {
+					f.offlineSince = time.Now()
+				}
 				f.offline = true
 				f.Unlock()
+				f.deltaFetchFailed(err)
+				throttled = graph.RetryAfter(err)
 				break
 			}
 
@@ -41,27 +59,40 @@ func (f *Filesystem) DeltaLoop(interval time.Duration) {
 			if !cont {
 				log.Info().Msgf("Fetched %d deltas.", len(deltas))
 				pollSuccess = true
+				f.Lock()
+				f.lastDelta = time.Now()
+				f.Unlock()
 				break
 			}
+			// persist our progress through this page sequence so it can be
+			// resumed if we get killed before the whole sequence is applied
+			f.savePendingDeltas(f.deltaLink, incoming)
 		}
 
-		// now apply deltas
-		secondPass := make([]string, 0)
-		for _, delta := range deltas {
-			err := f.applyDelta(delta)
-			// retry deletion of non-empty directories after all other deltas applied
-			if err != nil && err.Error() == "directory is non-empty" {
-				secondPass = append(secondPass, delta.ID)
-			}
+		if pollSuccess && f.enumerate {
+			f.applyEnumeration(deltas)
+			f.enumerate = false
+			deltas = make(map[string]*graph.DriveItem)
 		}
-		for _, id := range secondPass {
-			// failures should explicitly be ignored the second time around as per docs
-			f.applyDelta(deltas[id])
+
+		// now apply deltas
+		parents := f.applyDeltas(deltas)
+		f.recheckRecentUploads()
+		// some of the parents of previously skipped deltas may have been created
+		f.applySkippedDeltas()
+		f.reconcileSubdirs(parents...)
+		if len(deltas) > 0 {
+			f.emit(EventDelta, "", fmt.Sprintf("Applied %d changes from the server.", len(deltas)))
 		}
 
+		f.evictContent()
 		if !f.IsOffline() {
-			f.SerializeAll()
+			f.RequestSerialize()
 		}
+		if err := f.writeStatus(); err != nil {
+			log.Error().Err(err).Msg("Could not write status file.")
+		}
+		deltaDuration.Since("", start)
 
 		if pollSuccess {
 			f.Lock()
@@ -70,18 +101,144 @@ func (f *Filesystem) DeltaLoop(interval time.Duration) {
 			}
 			f.offline = false
 			f.Unlock()
+			f.syncRecovered()
 
+			// the page sequence is complete, only now is it safe to commit the
+			// final deltaLink
 			f.db.Batch(func(tx *bolt.Tx) error {
-				return tx.Bucket(bucketDelta).Put([]byte("deltaLink"), []byte(f.deltaLink))
+				b := tx.Bucket(bucketDelta)
+				b.Delete([]byte("nextLink"))
+				if tx.Bucket(bucketDeltaPending) != nil {
+					tx.DeleteBucket(bucketDeltaPending)
+				}
+				return b.Put([]byte("deltaLink"), []byte(f.deltaLink))
 			})
 
-			// wait until next interval
-			time.Sleep(interval)
+			// wait until next interval, or until something changes
+			f.waitForDeltas(jitterInterval(interval, f.opts.DeltaJitter))
 		} else {
 			// shortened duration while offline
-			time.Sleep(2 * time.Second)
+			wait := 2 * time.Second
+			if f.auth.ReauthRequired() || f.SyncBroken() != "" {
+				// retrying quickly won't help, nothing will work until the user
+				// signs in again or whatever is wrong on the server is fixed
+				wait = interval
+			}
+			if throttled > wait {
+				// coming back any sooner gets the account blocked for longer
+				log.Warn().Dur("wait", throttled).
+					Msg("Server is throttling us, backing off before fetching deltas again.")
+				wait = throttled
+			}
+			time.Sleep(wait)
+		}
+	}
+}
+
+// deltaFetchFailed escalates once fetching deltas has failed with an error from
+// the server too many times in a row. Being offline can fix itself, this
+// probably won't, so the user needs to know.
+func (f *Filesystem) deltaFetchFailed(err error) {
+	threshold := f.opts.syncBrokenAfter()
+	if threshold == 0 || graph.IsOffline(err) {
+		return
+	}
+	f.Lock()
+	f.deltaFailures++
+	failures := f.deltaFailures
+	alreadyBroken := f.syncBroken != ""
+	if failures >= threshold {
+		f.syncBroken = err.Error()
+	}
+	f.Unlock()
+	if alreadyBroken || failures < threshold {
+		return
+	}
+	message := fmt.Sprintf("Could not fetch changes from the server %d times in a row: %s",
+		failures, err)
+	log.Error().Err(err).Int("failures", failures).
+		Msg("Sync is broken, fetching changes from the server keeps failing.")
+	f.emit(EventSyncBroken, "", message)
+	if err := f.writeStatus(); err != nil {
+		log.Error().Err(err).Msg("Could not write status file.")
+	}
+}
+
+// syncRecovered clears a broken sync once changes could be fetched again.
+func (f *Filesystem) syncRecovered() {
+	f.Lock()
+	wasBroken := f.syncBroken != ""
+	f.syncBroken = ""
+	f.deltaFailures = 0
+	f.Unlock()
+	if wasBroken {
+		log.Info().Msg("Fetched changes from the server again, sync is no longer broken.")
+	}
+}
+
+// SyncBroken returns why fetching changes from the server keeps failing, or ""
+// if it doesn't.
+func (f *Filesystem) SyncBroken() string {
+	f.RLock()
+	defer f.RUnlock()
+	return f.syncBroken
+}
+
+// jitterInterval randomizes an interval by up to +/- the given fraction of its
+// length. A fraction of 0 (or less) returns the interval unchanged.
+func jitterInterval(interval time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return interval
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	offset := (rand.Float64()*2 - 1) * fraction * float64(interval)
+	return interval + time.Duration(offset)
+}
+
+// savePendingDeltas records the nextLink of an in-progress page sequence along
+// with the deltas fetched so far, so that the sequence can be resumed after a
+// restart instead of being lost.
+func (f *Filesystem) savePendingDeltas(nextLink string, deltas []*graph.DriveItem) error {
+	return f.db.Batch(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketDeltaPending)
+		if err != nil {
+			return err
+		}
+		for _, delta := range deltas {
+			contents, _ := json.Marshal(delta)
+			if err = b.Put([]byte(delta.ID), contents); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketDelta).Put([]byte("nextLink"), []byte(nextLink))
+	})
+}
+
+// loadPendingDeltas returns any deltas fetched during a page sequence that was
+// interrupted before it could be applied.
+func (f *Filesystem) loadPendingDeltas() map[string]*graph.DriveItem {
+	deltas := make(map[string]*graph.DriveItem)
+	f.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketDeltaPending)
+		if b == nil {
+			return nil
 		}
+		return b.ForEach(func(k []byte, v []byte) error {
+			delta := &graph.DriveItem{}
+			if err := json.Unmarshal(v, delta); err != nil {
+				log.Error().Err(err).Bytes("id", k).Msg("Could not restore pending delta.")
+				return nil
+			}
+			deltas[delta.ID] = delta
+			return nil
+		})
+	})
+	if len(deltas) > 0 {
+		log.Info().Msgf("Restored %d deltas from an interrupted delta fetch.", len(deltas))
 	}
+	return deltas
 }
 
 type deltaResponse struct {
@@ -108,22 +265,78 @@ func (f *Filesystem) pollDeltas(auth *graph.Auth) ([]*graph.DriveItem, bool, err
 	// reached the end of this polling cycle and should not continue until the
 	// next poll interval.
 	if page.NextLink != "" {
-		f.deltaLink = strings.TrimPrefix(page.NextLink, graph.GraphURL)
+		f.deltaLink = strings.TrimPrefix(page.NextLink, graph.Endpoint())
 		return page.Values, true, nil
 	}
-	f.deltaLink = strings.TrimPrefix(page.DeltaLink, graph.GraphURL)
+	f.deltaLink = strings.TrimPrefix(page.DeltaLink, graph.Endpoint())
 	return page.Values, false, nil
 }
 
+// applyDeltas applies the deltas fetched in one pass of the delta loop, and
+// retries the ones that failed in earlier passes once they are due. Returns the
+// IDs of the folders whose subdirectory counts may have changed.
+func (f *Filesystem) applyDeltas(deltas map[string]*graph.DriveItem) []string {
+	secondPass := make([]string, 0)
+	parents := make([]string, 0, len(deltas))
+	for _, delta := range deltas {
+		// both the old and new parents of moved items need their
+		// subdirectory counts checked afterwards
+		if local := f.GetID(delta.ID); local != nil {
+			parents = append(parents, local.ParentID())
+		}
+		if delta.Parent != nil {
+			parents = append(parents, delta.Parent.ID)
+		}
+		err := f.applyDelta(delta)
+		switch {
+		case err == nil:
+			f.deltaApplied(delta.ID)
+		case err.Error() == "directory is non-empty":
+			// retry deletion of non-empty directories after all other deltas applied
+			secondPass = append(secondPass, delta.ID)
+		default:
+			f.deltaFailed(delta, err)
+		}
+	}
+	for _, id := range secondPass {
+		// failures should explicitly be ignored the second time around as per docs
+		f.applyDelta(deltas[id])
+	}
+	f.retryFailedDeltas()
+	return parents
+}
+
 // applyDelta diagnoses and applies a server-side change to our local state.
 // Things we care about (present in the local cache):
 // * Deleted items
 // * Changed content remotely, but not locally
 // * New items in a folder we have locally
 func (f *Filesystem) applyDelta(delta *graph.DriveItem) error {
+	delta = f.resolveShortcut(delta)
 	id := delta.ID
 	name := delta.Name
-	parentID := delta.Parent.ID
+	if id == f.root {
+		// nothing about the root itself can change, except for which drive it
+		// is on
+		f.updateDriveID(delta)
+		return nil
+	}
+
+	var parentID string
+	if delta.Parent != nil {
+		parentID = delta.Parent.ID
+	}
+	if parentID == "" {
+		// the server occasionally leaves out the parent, without it we can only
+		// assume that an item we know about has not moved
+		local := f.GetID(id)
+		if local == nil {
+			log.Warn().Str("id", id).Str("name", name).
+				Msg("Skipping delta without a parent for an item not in cache.")
+			return nil
+		}
+		parentID = local.ParentID()
+	}
 	ctx := log.With().
 		Str("id", id).
 		Str("parentID", parentID).
@@ -140,8 +353,11 @@ func (f *Filesystem) applyDelta(delta *graph.DriveItem) error {
 		ctx.Trace().
 			Str("delta", "skip").
 			Msg("Skipping delta, item's parent not in cache.")
+		f.skipped.add(id, parentID)
 		return nil
 	}
+	// anything skipped for this item before has been superseded
+	f.skipped.forget(id)
 
 	local := f.GetID(id)
 
@@ -154,8 +370,21 @@ func (f *Filesystem) applyDelta(delta *graph.DriveItem) error {
 				Msg("Refusing delta deletion of non-empty folder as per API docs.")
 			return errors.New("directory is non-empty")
 		}
+		if local != nil && !local.IsDir() &&
+			(local.HasChanges() || f.uploads.HasPendingUpload(id) || f.isDirty(id)) {
+			policy := f.opts.DeletedWithChanges
+			if policy == DeletedWithChangesKeep || policy == DeletedWithChangesRestore {
+				return f.keepDeleted(local, policy == DeletedWithChangesRestore)
+			}
+			ctx.Warn().Str("delta", "delete").
+				Msg("Item was deleted on server, discarding local changes.")
+			f.reportProblem(local.Path(), "Deleted on the server, local changes were discarded.")
+		}
 		ctx.Info().Str("delta", "delete").
 			Msg("Applying server-side deletion of item.")
+		if local != nil {
+			f.recordDeleted(local)
+		}
 		f.DeleteID(id)
 		return nil
 	}
@@ -170,18 +399,47 @@ func (f *Filesystem) applyDelta(delta *graph.DriveItem) error {
 			ctx.Info().
 				Str("localID", localID).
 				Msg("Local item already exists under different ID.")
+			if local.KeepLocal() {
+				// our local-only copy wins, the server's is never shown
+				ctx.Info().Str("delta", "skip").
+					Msg("Skipping delta, a local-only item has the same name.")
+				return nil
+			}
+			if isLocalID(localID) && !local.IsDir() && !f.sameContent(localID, delta) {
+				if hash, ok := f.uploads.pendingUploadHash(localID); ok && delta.VerifyChecksum(hash) {
+					// our own upload of an earlier version, which hands the
+					// server's ID over itself once it is done
+					ctx.Info().Str("delta", "skip").
+						Msg("Skipping delta, the local item is being uploaded.")
+					return nil
+				}
+				// taking over the server's ID would replace one version with the
+				// other, whichever gets uploaded or downloaded first. So would a
+				// pending upload of different content, which goes by name, so it
+				// gets sent again under the name it ends up with.
+				return f.keepCollision(local, delta)
+			}
 			if isLocalID(localID) {
 				if err := f.MoveID(localID, id); err != nil {
 					ctx.Error().
 						Str("localID", localID).
 						Err(err).
 						Msg("Could not move item to new, nonlocal ID!")
+				} else if local.IsDir() {
+					// the adopted folder may already have contents on the server
+					if err := f.mergeServerChildren(id, f.auth); err != nil {
+						ctx.Error().Err(err).
+							Msg("Could not fetch children of adopted directory.")
+					}
 				}
 			}
+		} else if parent := f.GetID(parentID); f.opts.isIgnored(filepath.Join(parent.Path(), name)) {
+			ctx.Trace().Str("delta", "skip").Msg("Skipping delta, item is ignored.")
+			return nil
 		} else {
 			ctx.Info().Str("delta", "create").
 				Msg("Creating inode from delta.")
-			f.InsertChild(parentID, NewInodeDriveItem(delta))
+			f.InsertChild(parentID, f.newServerInode(delta))
 			return nil
 		}
 	}
@@ -202,6 +460,9 @@ func (f *Filesystem) applyDelta(delta *graph.DriveItem) error {
 		f.MovePath(oldParentID, parentID, localName, name, f.auth)
 		// do not return, there may be additional changes
 	}
+	f.updateParentDrive(local, delta)
+	f.updateMode(local, delta)
+	f.updateFavorite(local, delta)
 
 	// Finally, check if the content/metadata of the remote has changed.
 	// "Interesting" changes must be synced back to our local state without
@@ -210,6 +471,11 @@ func (f *Filesystem) applyDelta(delta *graph.DriveItem) error {
 	// the remote metadata changes that do not deal with the file's content
 	// changing.
 	if delta.ModTimeUnix() > local.ModTime() && !delta.ETagIsMatch(local.ETag) {
+		if f.recent.stale(delta) {
+			ctx.Info().Str("delta", "skip").
+				Msg("Ignoring server metadata older than our last upload of this item.")
+			return nil
+		}
 		sameContent := false
 		if !delta.IsDir() && delta.File != nil {
 			local.RLock()
@@ -218,7 +484,19 @@ func (f *Filesystem) applyDelta(delta *graph.DriveItem) error {
 		}
 
 		if !sameContent {
-			//TODO check if local has changes and rename the server copy if so
+			behavior := local.ConflictBehavior()
+			if behavior != ConflictReplace && !delta.IsDir() && f.content.HasContent(id) {
+				// the user asked us to keep both versions of this file
+				return f.keepConflict(local, delta, behavior)
+			}
+			if !delta.IsDir() && (local.HasChanges() || f.isDirty(id)) {
+				// changes that haven't been uploaded yet must not be thrown away,
+				// the local version becomes a conflict copy
+				if behavior == ConflictReplace {
+					behavior = ConflictRename
+				}
+				return f.keepConflict(local, delta, behavior)
+			}
 			ctx.Info().Str("delta", "overwrite").
 				Msg("Overwriting local item, no local changes to preserve.")
 			// update modtime, hashes, purge any local content in memory
@@ -231,6 +509,12 @@ func (f *Filesystem) applyDelta(delta *graph.DriveItem) error {
 			// as they will be null anyways
 			local.DriveItem.File = delta.File
 			local.hasChanges = false
+			if local.openCount == 0 {
+				// stale content must never be served, even if the hash check
+				// is skipped when it gets opened
+				f.deleteContent(id)
+			}
+			f.purgeThumbnails(id)
 			return nil
 		}
 	}
@@ -238,3 +522,127 @@ func (f *Filesystem) applyDelta(delta *graph.DriveItem) error {
 	ctx.Trace().Str("delta", "skip").Msg("Skipping, no changes relative to local state.")
 	return nil
 }
+
+// updateDriveID switches the filesystem over to the drive the root item is on
+// now. Organizations migrating their users to a new tenant move everyone's
+// OneDrive to a new drive, while the items on it stay the same.
+func (f *Filesystem) updateDriveID(root *graph.DriveItem) {
+	if root.Parent == nil || root.Parent.DriveID == "" {
+		return
+	}
+	oldDriveID := f.DriveID()
+	if oldDriveID == root.Parent.DriveID {
+		return
+	}
+	log.Warn().
+		Str("oldDriveID", oldDriveID).
+		Str("driveID", root.Parent.DriveID).
+		Msg("Root item moved to a different drive, the drive was likely migrated.")
+	if oldDriveID != "" {
+		f.migrateDriveID(oldDriveID, root.Parent.DriveID)
+	}
+	f.driveID.Store(root.Parent.DriveID)
+	if inode := f.GetID(f.root); inode != nil {
+		f.updateParentDrive(inode, root)
+	}
+}
+
+// migrateDriveID moves every cached item on the old drive over to the new one.
+// Their deltas may take a while to show up, and until then they would look
+// like items on someone else's drive, with requests for them sent to a drive
+// that is gone.
+func (f *Filesystem) migrateDriveID(oldDriveID string, newDriveID string) {
+	migrate := func(inode *Inode) bool {
+		inode.Lock()
+		defer inode.Unlock()
+		if inode.DriveItem.Parent == nil || inode.DriveItem.Parent.DriveID != oldDriveID {
+			return false
+		}
+		inode.DriveItem.Parent.DriveID = newDriveID
+		return true
+	}
+	f.metadata.Range(func(key interface{}, value interface{}) bool {
+		if inode := value.(*Inode); migrate(inode) {
+			graph.RemoveRemoteItem(inode.ID())
+		}
+		return true
+	})
+
+	// items that aren't in memory right now are picked up from the db later
+	f.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMetadata)
+		migrated := make(map[string][]byte)
+		b.ForEach(func(k []byte, v []byte) error {
+			if inode, err := NewInodeJSON(v); err == nil && migrate(inode) {
+				migrated[string(k)] = inode.AsJSON()
+			}
+			return nil
+		})
+		for id, data := range migrated {
+			if err := b.Put([]byte(id), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// updateParentDrive records which drive an item is on now, if a delta says it
+// changed. Requests for the item are sent to its new drive afterwards.
+func (f *Filesystem) updateParentDrive(local *Inode, delta *graph.DriveItem) {
+	if delta.Parent == nil || delta.Parent.DriveID == "" {
+		return
+	}
+	local.Lock()
+	if local.DriveItem.Parent == nil {
+		local.DriveItem.Parent = &graph.DriveItemParent{}
+	}
+	oldDriveID := local.DriveItem.Parent.DriveID
+	changed := oldDriveID != delta.Parent.DriveID
+	if changed {
+		local.DriveItem.Parent.DriveID = delta.Parent.DriveID
+		local.DriveItem.Parent.DriveType = delta.Parent.DriveType
+	}
+	local.Unlock()
+	if !changed {
+		return
+	}
+	if oldDriveID != "" {
+		log.Info().
+			Str("id", delta.ID).
+			Str("oldDriveID", oldDriveID).
+			Str("driveID", delta.Parent.DriveID).
+			Msg("Item is on a different drive now.")
+	}
+	f.trackRemote(local)
+}
+
+// keepDeleted preserves a file with local changes that was deleted on the
+// server by detaching it from its old server-side ID. If restore is true, it is
+// uploaded again right away, otherwise it will be uploaded the next time it
+// gets modified.
+func (f *Filesystem) keepDeleted(inode *Inode, restore bool) error {
+	id := inode.ID()
+	newID := localID()
+	ctx := log.With().
+		Str("id", id).
+		Str("localID", newID).
+		Str("path", inode.Path()).
+		Logger()
+	ctx.Warn().Str("delta", "delete").
+		Msg("Item with local changes was deleted on server, keeping local copy.")
+	f.reportProblem(inode.Path(), "Deleted on the server, kept the local copy.")
+	if err := f.MoveID(id, newID); err != nil {
+		ctx.Error().Err(err).Msg("Could not detach item from its deleted server-side ID.")
+		return err
+	}
+	if !restore || inode.HasChanges() {
+		// files that are still being written will be uploaded on their next flush
+		return nil
+	}
+	if err := f.queueUpload(inode); err != nil {
+		ctx.Error().Err(err).Msg("Could not queue item for re-upload.")
+		return err
+	}
+	return nil
+}
@@ -4,9 +4,11 @@ package fs
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -137,6 +139,61 @@ func TestDeltaMoveParent(t *testing.T) {
 	}, retrySeconds, time.Second, "Rename not detected by client")
 }
 
+// Moving a folder on the server only sends a delta for the folder itself, the
+// items cached inside of it have to pick up their new paths too.
+func TestDeltaMoveDirectoryTree(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_delta_move_directory_tree"), Options{})
+	now := time.Now()
+	insert := func(id, name, parentID string, dir bool) *Inode {
+		item := &graph.DriveItem{
+			ID:      id,
+			Name:    name,
+			ModTime: &now,
+			Parent:  &graph.DriveItemParent{ID: parentID},
+		}
+		if dir {
+			item.Folder = &graph.Folder{}
+		} else {
+			item.File = &graph.File{}
+		}
+		inode := NewInodeDriveItem(item)
+		cache.InsertChild(parentID, inode)
+		return inode
+	}
+	insert("move-tree-src", "move_tree_src", cache.root, true)
+	insert("move-tree-dst", "move_tree_dst", cache.root, true)
+	dir := insert("move-tree-dir", "dir", "move-tree-src", true)
+	sub := insert("move-tree-sub", "sub", dir.ID(), true)
+	file := insert("move-tree-file", "file.txt", sub.ID(), false)
+	require.Equal(t, "/move_tree_src/dir/sub/file.txt", file.Path())
+
+	require.NoError(t, cache.applyDelta(&graph.DriveItem{
+		ID:      dir.ID(),
+		Name:    "moved",
+		ModTime: &now,
+		Parent:  &graph.DriveItemParent{ID: "move-tree-dst"},
+		Folder:  &graph.Folder{},
+	}))
+	assert.Equal(t, "/move_tree_dst/moved", dir.Path())
+	assert.Equal(t, "/move_tree_dst/moved/sub", sub.Path())
+	assert.Equal(t, "/move_tree_dst/moved/sub/file.txt", file.Path(),
+		"Nested file kept the path it had before its folder moved.")
+
+	// deltas for the contents don't say where they are, only which folder
+	require.NoError(t, cache.applyDelta(&graph.DriveItem{
+		ID:      file.ID(),
+		Name:    file.Name(),
+		ModTime: &now,
+		Parent:  &graph.DriveItemParent{ID: sub.ID()},
+		File:    &graph.File{},
+	}))
+	assert.Equal(t, "/move_tree_dst/moved/sub/file.txt", file.Path())
+	found, err := cache.GetPath("/move_tree_dst/moved/sub/file.txt", nil)
+	require.NoError(t, err)
+	assert.Equal(t, file, found)
+}
+
 // Change the content remotely on the server, and verify it gets propagated to
 // to the client.
 func TestDeltaContentChangeRemote(t *testing.T) {
@@ -183,7 +240,7 @@ func TestDeltaContentChangeRemote(t *testing.T) {
 func TestDeltaContentChangeBoth(t *testing.T) {
 	t.Parallel()
 
-	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_delta_content_change_both"))
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_delta_content_change_both"), Options{})
 	inode := NewInode("both_content_changed.txt", 0644|fuse.S_IFREG, nil)
 	cache.InsertPath("/both_content_changed.txt", nil, inode)
 	original := []byte("initial content")
@@ -232,6 +289,78 @@ func TestDeltaContentChangeBoth(t *testing.T) {
 		"Contents of local file was not changed after disabling local changes!")
 }
 
+// A file with local changes that haven't been uploaded yet should be kept as a
+// conflict copy when the server has a different version, instead of being
+// overwritten.
+func TestDeltaContentChangeBothConflictCopy(t *testing.T) {
+	t.Parallel()
+
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_delta_content_change_both_copy"), Options{})
+	inode := NewInode("both_changed_copy.txt", 0644|fuse.S_IFREG, nil)
+	_, err := cache.InsertPath("/both_changed_copy.txt", nil, inode)
+	require.NoError(t, err)
+	id := "both-changed-copy-id"
+	require.NoError(t, cache.MoveID(inode.ID(), id))
+	local := []byte("local changes that were never uploaded")
+	inode.setContent(cache, local)
+	inode.hasChanges = true
+
+	// the server's version is newer and has different content
+	remote := []byte("somebody else's changes")
+	now := time.Now().Add(time.Second * 10)
+	fakeDelta := graph.DriveItem{
+		ID:      id,
+		Name:    "both_changed_copy.txt",
+		Parent:  &graph.DriveItemParent{ID: cache.root},
+		ModTime: &now,
+		Size:    uint64(len(remote)),
+		ETag:    "sldfjlsdjflkdj",
+		File: &graph.File{
+			Hashes: graph.Hashes{QuickXorHash: graph.QuickXORHash(&remote)},
+		},
+	}
+	require.NoError(t, cache.applyDelta(&fakeDelta))
+
+	server, err := cache.GetPath("/both_changed_copy.txt", nil)
+	require.NoError(t, err)
+	require.NotNil(t, server)
+	assert.Equal(t, id, server.ID(), "The server's version should keep the original name.")
+	assert.Equal(t, uint64(len(remote)), server.Size())
+
+	assert.NotEqual(t, id, inode.ID(), "The local version should have been split off.")
+	assert.True(t, strings.HasPrefix(inode.Name(), "both_changed_copy (conflict "),
+		"Local version was not kept as a conflict copy, named %s.", inode.Name())
+	assert.True(t, strings.HasSuffix(inode.Name(), ").txt"))
+	assert.Equal(t, local, cache.content.Get(inode.ID()), "Local changes were lost!")
+}
+
+// A file with unsaved local changes that gets deleted on the server should be
+// kept as a local-only file if the user asked us to.
+func TestDeltaDeletedWithChanges(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(
+		auth,
+		filepath.Join(testDBLoc, "test_delta_deleted_with_changes"),
+		Options{DeletedWithChanges: DeletedWithChangesKeep},
+	)
+	inode := NewInode("deleted_with_changes.txt", 0644|fuse.S_IFREG, nil)
+	cache.InsertPath("/deleted_with_changes.txt", nil, inode)
+	content := []byte("unsaved local changes")
+	inode.setContent(cache, content)
+	inode.hasChanges = true
+	id := inode.ID()
+
+	fakeDelta := inode.DriveItem
+	fakeDelta.Deleted = &graph.Deleted{State: "softdeleted"}
+	require.NoError(t, cache.applyDelta(&fakeDelta))
+
+	assert.Nil(t, cache.GetID(id), "Item should no longer use its old ID.")
+	kept, _ := cache.GetPath("/deleted_with_changes.txt", nil)
+	require.NotNil(t, kept, "File with local changes was deleted.")
+	assert.True(t, isLocalID(kept.ID()), "Kept file should be local-only.")
+	assert.Equal(t, content, *cache.getInodeContent(kept), "Local changes were lost.")
+}
+
 // If we have local content in the local disk cache that doesn't match what the
 // server has, Open() should pick this up and wipe it. Otherwise Open() could
 // pick up an old version of a file from previous program startups and think
@@ -284,10 +413,81 @@ func TestDeltaFolderDeletion(t *testing.T) {
 	}, retrySeconds, time.Second, "\"nested/\" directory was not deleted.")
 }
 
+// A directory's link count should match its real number of subdirectories after
+// a batch of deltas moves and deletes things, even if the count had drifted.
+func TestDeltaReconcileSubdirs(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_delta_reconcile_subdirs"), Options{})
+	parent := NewInode("reconcile", 0755|fuse.S_IFDIR, nil)
+	_, err := cache.InsertPath("/reconcile", nil, parent)
+	require.NoError(t, err)
+	dirs := make(map[string]*Inode)
+	for _, name := range []string{"a", "b", "c"} {
+		dirs[name] = NewInode(name, 0755|fuse.S_IFDIR, parent)
+		_, err = cache.InsertPath("/reconcile/"+name, nil, dirs[name])
+		require.NoError(t, err)
+	}
+	_, err = cache.InsertPath("/reconcile/file", nil, NewInode("file", 0644|fuse.S_IFREG, parent))
+	require.NoError(t, err)
+	require.Equal(t, uint32(5), parent.NLink())
+
+	// move "a" into "b" and delete "c"
+	move := dirs["a"].DriveItem
+	move.Parent = &graph.DriveItemParent{ID: dirs["b"].ID()}
+	require.NoError(t, cache.applyDelta(&move))
+	deletion := dirs["c"].DriveItem
+	deletion.Deleted = &graph.Deleted{State: "deleted"}
+	require.NoError(t, cache.applyDelta(&deletion))
+
+	// simulate the count drifting from the actual set of children
+	parent.Lock()
+	parent.subdir += 3
+	parent.Unlock()
+
+	cache.reconcileSubdirs(parent.ID(), dirs["b"].ID(), dirs["c"].ID())
+	assert.Equal(t, uint32(3), parent.NLink(), "Link count of parent was wrong.")
+	assert.Equal(t, uint32(3), dirs["b"].NLink(), "Link count of move target was wrong.")
+}
+
+// A local-only folder that collides with a folder on the server should adopt
+// the server's folder without losing its local-only children.
+func TestDeltaAdoptDirectory(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_delta_adopt_directory"), Options{})
+	parent, err := cache.GetPath("/onedriver_tests", auth)
+	require.NoError(t, err)
+	_, err = cache.GetChildrenID(parent.ID(), auth)
+	require.NoError(t, err)
+
+	local := NewInode("adopt_directory", 0755|fuse.S_IFDIR, parent)
+	_, err = cache.InsertPath("/onedriver_tests/adopt_directory", nil, local)
+	require.NoError(t, err)
+	child := NewInode("local_child.txt", 0644|fuse.S_IFREG, local)
+	_, err = cache.InsertPath("/onedriver_tests/adopt_directory/local_child.txt", nil, child)
+	require.NoError(t, err)
+	child.setContent(cache, []byte("only exists locally"))
+
+	// now the same folder shows up on the server with some contents of its own
+	server, err := graph.Mkdir("adopt_directory", parent.ID(), auth)
+	require.NoError(t, err)
+	_, err = graph.Mkdir("server_child", server.ID, auth)
+	require.NoError(t, err)
+	require.NoError(t, cache.applyDelta(server))
+
+	adopted := cache.GetID(server.ID)
+	require.NotNil(t, adopted, "Server folder was not adopted.")
+	assert.Equal(t, local, adopted, "Ended up with two entries for the same folder.")
+	kept, err := cache.GetChild(server.ID, "local_child.txt", auth)
+	require.NoError(t, err, "Local-only child was lost.")
+	assert.Equal(t, server.ID, kept.ParentID(), "Local-only child was not migrated.")
+	_, err = cache.GetChild(server.ID, "server_child", auth)
+	assert.NoError(t, err, "Server-side child was not merged in.")
+}
+
 // We should only perform a delta deletion of a folder if it was nonempty
 func TestDeltaFolderDeletionNonEmpty(t *testing.T) {
 	t.Parallel()
-	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_delta_folder_deletion_nonempty"))
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_delta_folder_deletion_nonempty"), Options{})
 	dir := NewInode("folder", 0755|fuse.S_IFDIR, nil)
 	file := NewInode("file", 0644|fuse.S_IFREG, nil)
 	cache.InsertPath("/folder", nil, dir)
@@ -334,11 +534,169 @@ func TestDeltaNoModTimeUpdate(t *testing.T) {
 	}
 }
 
+// Right after an upload, the server can still hand back the item's previous
+// metadata. That should not make us throw away the content we just uploaded.
+func TestDeltaStaleAfterUpload(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_delta_stale_after_upload"), Options{})
+	inode := NewInode("stale_after_upload.txt", 0644|fuse.S_IFREG, nil)
+	_, err := cache.InsertPath("/onedriver_tests/stale_after_upload.txt", auth, inode)
+	require.NoError(t, err)
+
+	upload := func(content []byte) {
+		inode.setContent(cache, content)
+		done, err := cache.uploads.QueueUploadWait(inode)
+		require.NoError(t, err)
+		select {
+		case err = <-done:
+			require.NoError(t, err)
+		case <-time.After(retrySeconds):
+			t.Fatal("Upload did not finish.")
+		}
+	}
+	upload([]byte("the old version"))
+	stale, err := graph.GetItem(inode.ID(), auth)
+	require.NoError(t, err)
+
+	current := []byte("the version we just uploaded")
+	upload(current)
+	etag := inode.ETag
+
+	// make the old metadata look as new as possible
+	future := time.Now().Add(time.Hour)
+	stale.ModTime = &future
+	require.NoError(t, cache.applyDelta(stale))
+	assert.Equal(t, etag, inode.ETag, "Stale metadata replaced our own.")
+	assert.Equal(t, current, *cache.getInodeContent(inode),
+		"Uploaded content was thrown away because of stale metadata.")
+}
+
+// Items that show up on a different drive after an account migration should
+// stay where they are and remain accessible.
+func TestDeltaDriveMigration(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_delta_drive_migration"), Options{})
+	folder := NewInode("migrated", 0755|fuse.S_IFDIR, nil)
+	_, err := cache.InsertPath("/migrated", nil, folder)
+	require.NoError(t, err)
+	file := NewInode("file.txt", 0644|fuse.S_IFREG, folder)
+	_, err = cache.InsertPath("/migrated/file.txt", nil, file)
+	require.NoError(t, err)
+
+	// the root moves first, then the items on it
+	newDrive := "migrated-drive-id"
+	rootDelta := cache.GetID(cache.root).DriveItem
+	rootParent := graph.DriveItemParent{DriveID: newDrive, DriveType: "business"}
+	rootDelta.Parent = &rootParent
+	require.NoError(t, cache.applyDelta(&rootDelta))
+	assert.Equal(t, newDrive, cache.DriveID())
+
+	for _, inode := range []*Inode{folder, file} {
+		delta := inode.DriveItem
+		parent := *inode.DriveItem.Parent
+		parent.DriveID = newDrive
+		delta.Parent = &parent
+		require.NoError(t, cache.applyDelta(&delta))
+		assert.Equal(t, newDrive, inode.DriveItem.Parent.DriveID)
+	}
+
+	moved, err := cache.GetPath("/migrated/file.txt", nil)
+	require.NoError(t, err)
+	require.NotNil(t, moved, "Migrated item is no longer accessible.")
+	assert.Equal(t, file.ID(), moved.ID())
+	assert.Equal(t, folder.ID(), moved.ParentID())
+	assert.Equal(t, "", graph.RemoteDrive(moved.ID()),
+		"Items on our own drive should not be treated as remote.")
+}
+
+// Cached items on the drive we migrated away from should move along with the
+// root right away, instead of being treated as items on someone else's drive
+// until their own deltas show up.
+func TestDeltaDriveMigrationCachedItems(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_delta_drive_migration_cached"), Options{})
+	oldDrive, newDrive := "pre-migration-drive-id", "post-migration-drive-id"
+	cache.driveID.Store(oldDrive)
+	root := cache.GetID(cache.root)
+	root.DriveItem.Parent = &graph.DriveItemParent{DriveID: oldDrive}
+
+	inMemory := NewInode("migrated_in_memory.txt", 0644|fuse.S_IFREG, root)
+	inMemory.DriveItem.ID = "migrated-in-memory"
+	cache.InsertChild(cache.root, inMemory)
+	onDisk := NewInode("migrated_on_disk.txt", 0644|fuse.S_IFREG, root)
+	onDisk.DriveItem.ID = "migrated-on-disk"
+	cache.InsertChild(cache.root, onDisk)
+	cache.serializeID(onDisk.ID())
+	cache.metadata.Delete(onDisk.ID())
+	require.Equal(t, oldDrive, onDisk.DriveItem.Parent.DriveID)
+
+	rootDelta := root.DriveItem
+	rootDelta.Parent = &graph.DriveItemParent{DriveID: newDrive}
+	require.NoError(t, cache.applyDelta(&rootDelta))
+	require.Equal(t, newDrive, cache.DriveID())
+
+	assert.Equal(t, newDrive, inMemory.DriveItem.Parent.DriveID)
+	assert.Equal(t, "", graph.RemoteDrive(inMemory.ID()),
+		"Items on our own drive should not be treated as remote.")
+	loaded := cache.GetID(onDisk.ID())
+	require.NotNil(t, loaded)
+	assert.Equal(t, newDrive, loaded.DriveItem.Parent.DriveID)
+	assert.Equal(t, "", graph.RemoteDrive(loaded.ID()),
+		"Items loaded from disk after a migration should not be treated as remote.")
+}
+
+// Metadata ignored during the grace window after an upload might not have been
+// stale at all, so the item should be checked again once the window is over.
+func TestDeltaStaleRecheckedAfterGrace(t *testing.T) {
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_delta_stale_recheck"), Options{})
+	inode := NewInode("stale_recheck.txt", 0644|fuse.S_IFREG, nil)
+	_, err := cache.InsertPath("/onedriver_tests/stale_recheck.txt", auth, inode)
+	require.NoError(t, err)
+	uploaded := []byte("what we uploaded")
+	inode.setContent(cache, uploaded)
+	inode.DriveItem.ETag = "uploaded"
+	cache.recent = newRecentUploads(100 * time.Millisecond)
+	cache.recent.add(inode.ID(), inode.ETag, inode.DriveItem.File.Hashes.QuickXorHash)
+
+	changed := []byte("someone else changed it right after")
+	future := time.Now().Add(time.Hour)
+	delta := &graph.DriveItem{
+		ID:      inode.ID(),
+		Name:    inode.Name(),
+		Parent:  &graph.DriveItemParent{ID: inode.ParentID()},
+		ETag:    "changed",
+		ModTime: &future,
+		Size:    uint64(len(changed)),
+		File: &graph.File{
+			Hashes: graph.Hashes{QuickXorHash: graph.QuickXORHash(&changed)},
+		},
+	}
+	require.NoError(t, cache.applyDelta(delta))
+	require.Equal(t, "uploaded", inode.ETag, "Metadata was not ignored during the grace window.")
+
+	oldGetItem := getItem
+	defer func() { getItem = oldGetItem }()
+	fetched := 0
+	getItem = func(id string, auth *graph.Auth) (*graph.DriveItem, error) {
+		fetched++
+		return delta, nil
+	}
+	cache.recheckRecentUploads()
+	assert.Equal(t, 0, fetched, "Item was rechecked before its grace window was over.")
+
+	time.Sleep(200 * time.Millisecond)
+	cache.recheckRecentUploads()
+	assert.Equal(t, 1, fetched, "Item was not rechecked after its grace window.")
+	assert.Equal(t, "changed", inode.ETag, "Change made on the server was lost.")
+	cache.recheckRecentUploads()
+	assert.Equal(t, 1, fetched, "Item was rechecked more than once.")
+}
+
 // deltas can come back missing from the server
 // https://github.com/jstaf/onedriver/issues/111
 func TestDeltaMissingHash(t *testing.T) {
 	t.Parallel()
-	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_delta_missing_hash"))
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_delta_missing_hash"), Options{})
 	file := NewInode("file", 0644|fuse.S_IFREG, nil)
 	cache.InsertPath("/folder", nil, file)
 
@@ -353,3 +711,194 @@ func TestDeltaMissingHash(t *testing.T) {
 	cache.applyDelta(delta)
 	// if we survive to here without a segfault, test passed
 }
+
+// Deltas without a parent reference should not crash anything. Items we know
+// about stay where they are, and items we don't are not added anywhere.
+func TestDeltaNilParent(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_delta_nil_parent"), Options{})
+	file := NewInode("nil_parent.txt", 0644|fuse.S_IFREG, nil)
+	_, err := cache.InsertPath("/folder/nil_parent.txt", nil, file)
+	require.NoError(t, err)
+	parentID := file.ParentID()
+
+	now := time.Now()
+	require.NotPanics(t, func() {
+		cache.applyDelta(&graph.DriveItem{
+			ID:      file.ID(),
+			Name:    "nil_parent_renamed.txt",
+			ModTime: &now,
+		})
+	})
+	assert.Equal(t, parentID, file.ParentID(), "Item should not have moved.")
+	assert.Equal(t, "nil_parent_renamed.txt", file.Name(), "Rename was not applied.")
+
+	require.NotPanics(t, func() {
+		cache.applyDelta(&graph.DriveItem{
+			ID:      "unknown-nil-parent-id",
+			Name:    "unknown.txt",
+			ModTime: &now,
+			Parent:  &graph.DriveItemParent{},
+		})
+	})
+	assert.Nil(t, cache.GetID("unknown-nil-parent-id"), "Item without a parent was added.")
+
+	require.NotPanics(t, func() {
+		cache.applyDelta(&graph.DriveItem{
+			ID:      file.ID(),
+			Deleted: &graph.Deleted{State: "softDeleted"},
+		})
+	})
+	assert.Nil(t, cache.GetID(file.ID()), "Deletion without a parent was not applied.")
+}
+
+// A delta that keeps failing should be retried on later passes of the delta
+// loop and reported, instead of being thrown away.
+func TestDeltaFailedRetried(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_delta_failed_retried"), Options{})
+	content := []byte("local version")
+	then := time.Now().Add(-time.Hour)
+	file := NewInodeDriveItem(&graph.DriveItem{
+		ID:      "failed-delta-file",
+		Name:    "failed_delta.txt",
+		ModTime: &then,
+		ETag:    "old",
+		Size:    uint64(len(content)),
+		File:    &graph.File{Hashes: graph.Hashes{QuickXorHash: graph.QuickXORHash(&content)}},
+		Parent:  &graph.DriveItemParent{ID: cache.root},
+	})
+	// keeping the local version renames the server's out of the way first,
+	// which can't work for an item that isn't on the server
+	file.conflictBehavior = ConflictKeepLocal
+	cache.InsertChild(cache.root, file)
+	require.NoError(t, cache.content.Insert(file.ID(), content))
+
+	serverContent := []byte("server version")
+	now := time.Now()
+	delta := &graph.DriveItem{
+		ID:      file.ID(),
+		Name:    "failed_delta.txt",
+		ModTime: &now,
+		ETag:    "new",
+		Size:    uint64(len(serverContent)),
+		File:    &graph.File{Hashes: graph.Hashes{QuickXorHash: graph.QuickXORHash(&serverContent)}},
+		Parent:  &graph.DriveItemParent{ID: cache.root},
+	}
+	cache.applyDeltas(map[string]*graph.DriveItem{delta.ID: delta})
+	require.Contains(t, cache.failed.entries, file.ID(), "Failed delta was not recorded.")
+	assert.Equal(t, 1, cache.failed.entries[file.ID()].Attempts)
+
+	// later passes retry it, without the server sending it again
+	for i := 1; i < failedDeltaReportAttempts; i++ {
+		cache.failed.entries[file.ID()].NextRetry = time.Time{}
+		cache.applyDeltas(map[string]*graph.DriveItem{})
+	}
+	require.Contains(t, cache.failed.entries, file.ID(), "Failed delta was dropped.")
+	assert.Equal(t, failedDeltaReportAttempts, cache.failed.entries[file.ID()].Attempts,
+		"Failed delta was not retried.")
+	assert.Equal(t, 1, cache.CurrentStatus().FailedDeltas)
+	problems := cache.CurrentStatus().Problems
+	require.NotEmpty(t, problems, "Failed delta was not reported.")
+	assert.Equal(t, "/failed_delta.txt", problems[len(problems)-1].Path)
+
+	// a retry that isn't due yet does nothing
+	file.Lock()
+	file.conflictBehavior = ""
+	file.Unlock()
+	cache.applyDeltas(map[string]*graph.DriveItem{})
+	assert.Equal(t, failedDeltaReportAttempts, cache.failed.entries[file.ID()].Attempts,
+		"Delta was retried before it was due.")
+
+	// failures survive restarts
+	cache.failed = failedDeltas{}
+	assert.Equal(t, 1, cache.failedDeltaCount(), "Failed delta was not persisted.")
+
+	cache.failed.entries[file.ID()].NextRetry = time.Time{}
+	cache.applyDeltas(map[string]*graph.DriveItem{})
+	assert.Equal(t, 0, cache.failedDeltaCount(), "Delta was not applied once it could be.")
+	assert.Equal(t, "new", cache.GetID(file.ID()).ETag)
+}
+
+// Deltas that keep failing with errors from the server should be escalated to
+// a broken sync once there have been enough failures in a row, and cleared once
+// fetching works again.
+func TestDeltaSyncBroken(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_delta_sync_broken"),
+		Options{SyncBrokenAfter: 3})
+	events := cache.monitors.subscribe()
+	defer cache.monitors.unsubscribe(events)
+
+	// being offline is not the server's fault, and should not count
+	for i := 0; i < 5; i++ {
+		cache.deltaFetchFailed(errors.New("dial tcp: lookup graph.microsoft.com: no such host"))
+	}
+	assert.Empty(t, cache.SyncBroken(), "Being offline broke sync.")
+
+	serverErr := errors.New("HTTP 500 - generalException: An internal error occurred.")
+	for i := 0; i < 2; i++ {
+		cache.deltaFetchFailed(serverErr)
+	}
+	assert.Empty(t, cache.SyncBroken(), "Sync was broken before reaching the threshold.")
+	cache.deltaFetchFailed(serverErr)
+	assert.Equal(t, serverErr.Error(), cache.SyncBroken(), "Sync was not broken at the threshold.")
+	assert.Equal(t, serverErr.Error(), cache.CurrentStatus().SyncBroken)
+
+	// only the failure that broke sync is reported
+	cache.deltaFetchFailed(serverErr)
+	broken := 0
+	for len(events) > 0 {
+		if event := <-events; event.Type == EventSyncBroken {
+			broken++
+		}
+	}
+	assert.Equal(t, 1, broken, "Broken sync was not reported exactly once.")
+
+	cache.syncRecovered()
+	assert.Empty(t, cache.SyncBroken(), "Sync stayed broken after recovering.")
+	cache.deltaFetchFailed(serverErr)
+	assert.Empty(t, cache.SyncBroken(), "Failures before recovering still counted.")
+}
+
+// The delta loop's polling interval should vary within the configured jitter
+// band, and not at all when jitter is disabled.
+func TestDeltaJitter(t *testing.T) {
+	t.Parallel()
+	const interval = 30 * time.Second
+	assert.Equal(t, interval, jitterInterval(interval, 0))
+
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		sleep := jitterInterval(interval, 0.2)
+		require.GreaterOrEqual(t, sleep, 24*time.Second, "Jitter was below the band.")
+		require.LessOrEqual(t, sleep, 36*time.Second, "Jitter was above the band.")
+		seen[sleep] = true
+	}
+	assert.Greater(t, len(seen), 1, "Interval did not vary across cycles.")
+}
+
+// If onedriver is killed partway through a sequence of delta pages, the next run
+// should resume from the saved nextLink along with the deltas fetched so far.
+func TestDeltaResumeNextLink(t *testing.T) {
+	t.Parallel()
+	dbPath := filepath.Join(testDBLoc, "test_delta_resume_next_link")
+	cache := NewFilesystem(auth, dbPath, Options{})
+	const nextLink = "/me/drive/root/delta?token=resume-me"
+	now := time.Now()
+	pending := &graph.DriveItem{
+		ID:      "pending-delta",
+		Name:    "pending",
+		Parent:  &graph.DriveItemParent{ID: cache.root},
+		ModTime: &now,
+	}
+	require.NoError(t, cache.savePendingDeltas(nextLink, []*graph.DriveItem{pending}))
+
+	// "crash" and start up again from the same cache
+	require.NoError(t, cache.db.Close())
+	cache = NewFilesystem(auth, dbPath, Options{})
+	assert.Equal(t, nextLink, cache.deltaLink, "Did not resume from the saved nextLink.")
+	deltas := cache.loadPendingDeltas()
+	require.Contains(t, deltas, pending.ID, "Deltas from before the crash were lost.")
+	assert.Equal(t, pending.Name, deltas[pending.ID].Name)
+}
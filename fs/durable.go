@@ -0,0 +1,55 @@
+package fs
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// setting this extended attribute to "1" on a file makes it durable: fsync and
+// close do not return until the server has the file's content, and fail if the
+// upload does. Meant for files that can't afford to silently lose a save, like
+// password databases.
+const xattrDurable = xattrPrefix + "durable"
+
+// how long fsync waits on the upload of a durable file before giving up
+const durableUploadTimeout = 5 * time.Minute
+
+var errDurableInterrupted = errors.New("interrupted while waiting for upload")
+
+// parseDurable parses the value of the durable attribute.
+func parseDurable(value string) (durable bool, ok bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "true", "yes":
+		return true, true
+	case "0", "false", "no":
+		return false, true
+	}
+	return false, false
+}
+
+// Durable returns true if fsync and close wait for this item's uploads to
+// finish.
+func (i *Inode) Durable() bool {
+	i.RLock()
+	defer i.RUnlock()
+	return i.durable
+}
+
+// uploadDurably uploads an item and waits until the server has its content.
+// Durable files are uploaded right away, even with the manualSync option.
+func (f *Filesystem) uploadDurably(cancel <-chan struct{}, inode *Inode) error {
+	done, err := f.uploads.QueueUploadWait(inode)
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-done:
+		return err
+	case <-cancel:
+		// the upload carries on, but the caller stopped waiting
+		return errDurableInterrupted
+	case <-time.After(durableUploadTimeout):
+		return errors.New("timed out waiting for upload")
+	}
+}
@@ -0,0 +1,78 @@
+package fs
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Fsync on a durable file should only return once the upload is done, and fail
+// if the upload does.
+func TestDurableFsync(t *testing.T) {
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_durable_fsync"), Options{})
+	inode := NewInode("durable.kdbx", 0644|fuse.S_IFREG, nil)
+	_, err := cache.InsertPath("/onedriver_tests/durable.kdbx", auth, inode)
+	require.NoError(t, err)
+	header := fuse.InHeader{NodeId: inode.NodeID()}
+	require.Equal(t, fuse.OK, cache.SetXAttr(nil, &fuse.SetXAttrIn{InHeader: header}, xattrDurable, []byte("1")))
+	require.True(t, inode.Durable())
+
+	// uploads of our file do whatever upload does, everything else is untouched
+	id := inode.ID()
+	var upload func(session *UploadSession) error
+	oldUpload := startUpload
+	defer func() { startUpload = oldUpload }()
+	startUpload = func(session *UploadSession, auth *graph.Auth) error {
+		if session.OldID != id {
+			return oldUpload(session, auth)
+		}
+		return upload(session)
+	}
+
+	fsync := func() <-chan fuse.Status {
+		inode.setContent(cache, []byte("very important passwords"))
+		inode.hasChanges = true
+		result := make(chan fuse.Status, 1)
+		go func() {
+			result <- cache.Fsync(nil, &fuse.FsyncIn{InHeader: header})
+		}()
+		return result
+	}
+
+	release := make(chan struct{})
+	upload = func(session *UploadSession) error {
+		<-release
+		return session.setState(uploadComplete, nil)
+	}
+	result := fsync()
+	select {
+	case <-result:
+		t.Fatal("Fsync returned before the upload finished.")
+	case <-time.After(5 * time.Second):
+	}
+	close(release)
+	select {
+	case status := <-result:
+		assert.Equal(t, fuse.OK, status)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Fsync did not return after the upload finished.")
+	}
+
+	upload = func(session *UploadSession) error {
+		return session.setState(uploadErrored, errors.New("HTTP 409 - conflict"))
+	}
+	result = fsync()
+	select {
+	case status := <-result:
+		assert.Equal(t, fuse.EIO, status, "Fsync should fail when the upload does.")
+	case <-time.After(retrySeconds):
+		t.Fatal("Fsync did not return after the upload failed.")
+	}
+	assert.True(t, inode.HasChanges(), "Changes should be uploaded again on the next fsync.")
+}
@@ -0,0 +1,70 @@
+package fs
+
+import (
+	"path/filepath"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// applyEnumeration adds every item from a full delta enumeration of the drive to
+// the cache, so the whole drive can be browsed without fetching folder contents
+// first. Unlike regular deltas, items are added even if their parent was not
+// cached yet, and folders are marked as having all of their children.
+func (f *Filesystem) applyEnumeration(items map[string]*graph.DriveItem) {
+	byParent := make(map[string][]*graph.DriveItem)
+	for _, item := range items {
+		if item.Deleted != nil || item.Parent == nil || item.ID == f.root {
+			continue
+		}
+		byParent[item.Parent.ID] = append(byParent[item.Parent.ID], item)
+	}
+
+	// parents have to be added before their children, so walk down from the root
+	added := 0
+	queue := []string{f.root}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		parent := f.GetID(id)
+		if parent == nil {
+			continue
+		}
+
+		parentPath := parent.Path()
+		parent.Lock()
+		listed := parent.children != nil
+		if !listed {
+			parent.children = make([]string, 0, len(byParent[id]))
+		}
+		parent.Unlock()
+
+		for _, item := range byParent[id] {
+			if f.opts.isIgnored(filepath.Join(parentPath, item.Name)) {
+				continue
+			}
+			if item.IsDir() {
+				queue = append(queue, item.ID)
+			}
+			if listed || f.GetID(item.ID) != nil {
+				// we already know about this one, treat it like any other delta
+				f.applyDelta(item)
+				continue
+			}
+			child := f.newServerInode(f.resolveShortcut(item))
+			f.trackRemote(child)
+			f.InsertNodeID(child)
+			f.metadata.Store(child.DriveItem.ID, child)
+
+			parent.Lock()
+			parent.children = append(parent.children, child.DriveItem.ID)
+			if child.IsDir() {
+				parent.subdir++
+			}
+			parent.Unlock()
+			added++
+		}
+	}
+	log.Info().Int("items", len(items)).Int("added", added).
+		Msg("Populated cache from full enumeration of the drive.")
+}
@@ -0,0 +1,66 @@
+package fs
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A full enumeration should add every item on the drive to the cache, even
+// though the deltas for children can arrive before the ones for their parents.
+func TestFullEnumeration(t *testing.T) {
+	t.Parallel()
+	localAuth := *auth
+	cache := NewFilesystem(&localAuth, filepath.Join(testDBLoc, "test_full_enumeration"),
+		Options{FullEnumeration: true})
+	assert.True(t, cache.enumerate)
+	assert.False(t, strings.Contains(cache.deltaLink, "token="),
+		"Full enumeration must start from the beginning of the drive.")
+
+	item := func(id, name, parentID string, folder bool) *graph.DriveItem {
+		item := &graph.DriveItem{ID: id, Name: name, Parent: &graph.DriveItemParent{ID: parentID}}
+		if folder {
+			item.Folder = &graph.Folder{}
+		} else {
+			item.File = &graph.File{}
+		}
+		return item
+	}
+	items := map[string]*graph.DriveItem{}
+	for _, i := range []*graph.DriveItem{
+		item("enum-file", "file.txt", "enum-inner", false),
+		item("enum-inner", "inner", "enum-outer", true),
+		item("enum-empty", "empty", "enum-outer", true),
+		item("enum-outer", "enumerated", cache.root, true),
+		item("enum-orphan", "orphan.txt", "enum-missing", false),
+	} {
+		items[i.ID] = i
+	}
+	deleted := item("enum-deleted", "deleted.txt", "enum-outer", false)
+	deleted.Deleted = &graph.Deleted{State: "deleted"}
+	items[deleted.ID] = deleted
+
+	cache.applyEnumeration(items)
+	before := localAuth.Requests()
+	inode, err := cache.GetPath("/enumerated/inner/file.txt", &localAuth)
+	require.NoError(t, err)
+	require.NotNil(t, inode, "Enumerated item was not added to the cache.")
+	assert.Equal(t, "enum-file", inode.ID())
+
+	children, err := cache.GetChildrenID("enum-outer", &localAuth)
+	require.NoError(t, err)
+	assert.Len(t, children, 2)
+	assert.Equal(t, uint32(2), cache.GetID("enum-outer").subdir)
+	children, err = cache.GetChildrenID("enum-empty", &localAuth)
+	require.NoError(t, err)
+	assert.Empty(t, children)
+	assert.Equal(t, before, localAuth.Requests(),
+		"Browsing enumerated folders should not need the server.")
+
+	assert.Nil(t, cache.GetID("enum-deleted"))
+	assert.Nil(t, cache.GetID("enum-orphan"))
+}
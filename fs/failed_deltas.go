@@ -0,0 +1,161 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// how long to wait before retrying a delta that could not be applied, this
+	// doubles with every failure
+	failedDeltaBackoff    = 30 * time.Second
+	maxFailedDeltaBackoff = 30 * time.Minute
+	// a delta that failed this many times is reported in the status
+	failedDeltaReportAttempts = 3
+)
+
+// failedDeltas keeps track of deltas that could not be applied, so they can be
+// retried later instead of the item being stuck in its old state forever. They
+// are persisted in the db, so restarting doesn't lose them either.
+type failedDeltas struct {
+	sync.Mutex
+	loaded  bool
+	entries map[string]*failedDelta // item id -> most recent failed delta
+}
+
+type failedDelta struct {
+	Delta     *graph.DriveItem `json:"delta"`
+	Attempts  int              `json:"attempts"`
+	NextRetry time.Time        `json:"nextRetry"`
+	Error     string           `json:"error"`
+}
+
+// load reads the failed deltas from the db the first time they are needed. Must
+// be called with the lock held.
+func (d *failedDeltas) load(db *bolt.DB) {
+	if d.loaded {
+		return
+	}
+	d.loaded = true
+	d.entries = make(map[string]*failedDelta)
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketDeltaFailed)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k []byte, v []byte) error {
+			entry := &failedDelta{}
+			if err := json.Unmarshal(v, entry); err != nil || entry.Delta == nil {
+				log.Error().Err(err).Bytes("id", k).Msg("Could not restore failed delta.")
+				return nil
+			}
+			d.entries[string(k)] = entry
+			return nil
+		})
+	})
+}
+
+// deltaFailed records that a delta could not be applied, and schedules it to be
+// retried. Items that keep failing are reported as a problem.
+func (f *Filesystem) deltaFailed(delta *graph.DriveItem, err error) {
+	f.failed.Lock()
+	f.failed.load(f.db)
+	entry, exists := f.failed.entries[delta.ID]
+	if !exists {
+		entry = &failedDelta{}
+		f.failed.entries[delta.ID] = entry
+	}
+	entry.Delta = delta
+	entry.Attempts++
+	entry.Error = err.Error()
+	backoff := maxFailedDeltaBackoff
+	if entry.Attempts < 10 {
+		backoff = failedDeltaBackoff << uint(entry.Attempts-1)
+		if backoff > maxFailedDeltaBackoff {
+			backoff = maxFailedDeltaBackoff
+		}
+	}
+	entry.NextRetry = time.Now().Add(backoff)
+	attempts := entry.Attempts
+	contents, _ := json.Marshal(entry)
+	f.failed.Unlock()
+
+	f.db.Batch(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketDeltaFailed)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(delta.ID), contents)
+	})
+	log.Warn().Err(err).Str("id", delta.ID).Str("name", delta.Name).
+		Int("attempts", attempts).Dur("retryIn", backoff).
+		Msg("Could not apply delta, will retry it later.")
+
+	if attempts == failedDeltaReportAttempts {
+		path := delta.Name
+		if local := f.GetID(delta.ID); local != nil {
+			path = local.Path()
+		}
+		f.reportProblem(path, fmt.Sprintf(
+			"Could not apply changes from the server after %d attempts: %s", attempts, err))
+	}
+}
+
+// deltaApplied forgets about an earlier failure to apply a delta for an item,
+// since a delta for it was applied successfully.
+func (f *Filesystem) deltaApplied(id string) {
+	f.failed.Lock()
+	f.failed.load(f.db)
+	_, exists := f.failed.entries[id]
+	delete(f.failed.entries, id)
+	f.failed.Unlock()
+	if !exists {
+		return
+	}
+	f.db.Batch(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucketDeltaFailed); b != nil {
+			return b.Delete([]byte(id))
+		}
+		return nil
+	})
+}
+
+// retryFailedDeltas tries applying the deltas that failed before again, once
+// they are due for a retry.
+func (f *Filesystem) retryFailedDeltas() {
+	f.failed.Lock()
+	f.failed.load(f.db)
+	now := time.Now()
+	due := make([]*graph.DriveItem, 0)
+	for _, entry := range f.failed.entries {
+		if now.After(entry.NextRetry) {
+			due = append(due, entry.Delta)
+		}
+	}
+	f.failed.Unlock()
+
+	for _, delta := range due {
+		if err := f.applyDelta(delta); err != nil {
+			f.deltaFailed(delta, err)
+			continue
+		}
+		log.Info().Str("id", delta.ID).Str("name", delta.Name).
+			Msg("Applied delta that failed before.")
+		f.deltaApplied(delta.ID)
+	}
+}
+
+// failedDeltaCount returns the number of items with deltas that could not be
+// applied yet.
+func (f *Filesystem) failedDeltaCount() int {
+	f.failed.Lock()
+	defer f.failed.Unlock()
+	f.failed.load(f.db)
+	return len(f.failed.entries)
+}
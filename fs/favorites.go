@@ -0,0 +1,67 @@
+package fs
+
+import (
+	"net/http"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// xattrFavorite is "1" on items starred in OneDrive. Setting it to "1" or "0"
+// (or removing it) stars or unstars the item on the server.
+const xattrFavorite = xattrPrefix + "favorite"
+
+// Favorite returns true if the item is starred in OneDrive.
+func (i *Inode) Favorite() bool {
+	i.RLock()
+	defer i.RUnlock()
+	return i.DriveItem.Favorite != nil
+}
+
+// setFavorite stars or unstars an item on the server, and keeps what the server
+// says about it afterwards.
+func (f *Filesystem) setFavorite(inode *Inode, favorite bool) fuse.Status {
+	id := inode.ID()
+	ctx := log.With().
+		Str("op", "setFavorite").
+		Str("id", id).
+		Str("path", inode.Path()).
+		Bool("favorite", favorite).
+		Logger()
+	if isVirtualID(id) {
+		return fuse.EPERM
+	}
+	if isLocalID(id) {
+		// there's nothing to star until the server knows about it
+		return fuse.Status(syscall.EAGAIN)
+	}
+	if f.IsOffline() {
+		return fuse.EROFS
+	}
+	item, err := setFavorite(id, favorite, f.auth)
+	if err != nil {
+		ctx.Error().Err(err).Msg("Could not change favorite on the server.")
+		if graph.StatusCode(err) == http.StatusBadRequest {
+			// the drive doesn't do favorites
+			return fuse.Status(syscall.ENOTSUP)
+		}
+		return fuse.EREMOTEIO
+	}
+	ctx.Info().Msg("Changed favorite.")
+	f.updateFavorite(inode, item)
+	return fuse.OK
+}
+
+// updateFavorite takes an item's favorite state from the server. Nothing else
+// about the item changes with it, so it is applied on its own.
+func (f *Filesystem) updateFavorite(local *Inode, remote *graph.DriveItem) {
+	local.Lock()
+	changed := (local.DriveItem.Favorite != nil) != (remote.Favorite != nil)
+	local.DriveItem.Favorite = remote.Favorite
+	local.Unlock()
+	if changed {
+		f.serializeID(local.ID())
+	}
+}
@@ -0,0 +1,97 @@
+package fs
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Starring an item through its favorite xattr should patch it on the server,
+// and the server's answer should be what the xattr reads back.
+func TestFavoriteXAttr(t *testing.T) {
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_favorite_xattr"), Options{})
+	oldSetFavorite := setFavorite
+	defer func() { setFavorite = oldSetFavorite }()
+	var patches []bool
+	setFavorite = func(id string, favorite bool, auth *graph.Auth) (*graph.DriveItem, error) {
+		patches = append(patches, favorite)
+		item := &graph.DriveItem{ID: id}
+		if favorite {
+			item.Favorite = &graph.Favorite{}
+		}
+		return item, nil
+	}
+
+	content := []byte("a favorite")
+	now := time.Now()
+	inode := NewInodeDriveItem(&graph.DriveItem{
+		ID:      "favorite-xattr",
+		Name:    "favorite.txt",
+		Size:    uint64(len(content)),
+		ModTime: &now,
+		Parent:  &graph.DriveItemParent{ID: cache.root},
+		File:    &graph.File{Hashes: graph.Hashes{QuickXorHash: graph.QuickXORHash(&content)}},
+	})
+	cache.InsertChild(cache.root, inode)
+	header := &fuse.InHeader{NodeId: inode.NodeID()}
+	dest := make([]byte, 16)
+
+	_, status := cache.GetXAttr(nil, header, xattrFavorite, dest)
+	assert.Equal(t, fuse.ENOATTR, status, "Item should not start out starred.")
+
+	in := &fuse.SetXAttrIn{InHeader: *header}
+	require.Equal(t, fuse.OK, cache.SetXAttr(nil, in, xattrFavorite, []byte("1")))
+	n, status := cache.GetXAttr(nil, header, xattrFavorite, dest)
+	require.Equal(t, fuse.OK, status)
+	assert.Equal(t, "1", string(dest[:n]))
+	n, _ = cache.ListXAttr(nil, header, dest[:0])
+	assert.NotZero(t, n, "Starred item should list its favorite xattr.")
+
+	require.Equal(t, fuse.OK, cache.RemoveXAttr(nil, header, xattrFavorite))
+	_, status = cache.GetXAttr(nil, header, xattrFavorite, dest)
+	assert.Equal(t, fuse.ENOATTR, status, "Item was not unstarred.")
+	assert.Equal(t, []bool{true, false}, patches)
+
+	assert.Equal(t, fuse.EINVAL, cache.SetXAttr(nil, in, xattrFavorite, []byte("maybe")))
+	assert.Equal(t, []bool{true, false}, patches, "Invalid values should not be sent.")
+}
+
+// An item starred elsewhere shows up in deltas like any other change. Only its
+// favorite state should change locally, not its content.
+func TestFavoriteDelta(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_favorite_delta"), Options{})
+	content := []byte("starred somewhere else")
+	hash := graph.QuickXORHash(&content)
+	before := time.Now().Add(-time.Hour)
+	inode := NewInodeDriveItem(&graph.DriveItem{
+		ID:      "favorite-delta",
+		Name:    "starred.txt",
+		Size:    uint64(len(content)),
+		ModTime: &before,
+		ETag:    "before",
+		Parent:  &graph.DriveItemParent{ID: cache.root},
+		File:    &graph.File{Hashes: graph.Hashes{QuickXorHash: hash}},
+	})
+	cache.InsertChild(cache.root, inode)
+	require.NoError(t, cache.content.Insert(inode.ID(), content))
+
+	after := time.Now()
+	require.NoError(t, cache.applyDelta(&graph.DriveItem{
+		ID:       "favorite-delta",
+		Name:     "starred.txt",
+		Size:     uint64(len(content)),
+		ModTime:  &after,
+		ETag:     "after",
+		Parent:   &graph.DriveItemParent{ID: cache.root},
+		File:     &graph.File{Hashes: graph.Hashes{QuickXorHash: hash}},
+		Favorite: &graph.Favorite{},
+	}))
+	assert.True(t, inode.Favorite(), "Favorite from the server was not applied.")
+	assert.True(t, cache.content.HasContent(inode.ID()), "Content was thrown away.")
+}
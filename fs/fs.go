@@ -1,8 +1,11 @@
 package fs
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"math"
+	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -15,7 +18,36 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-const timeout = time.Second
+// how long the kernel caches attributes and lookups unless configured otherwise
+const defaultKernelCacheTimeout = time.Second
+
+// how many times a download whose content doesn't match its hash is tried
+// before giving up, connections that drop mid-download can truncate it
+const downloadAttempts = 3
+
+// swapped out during tests, so they can play the server's part
+var (
+	getItem          = graph.GetItem
+	getItemContent   = graph.GetItemContentStream
+	copyItem         = graph.Copy
+	waitForCopy      = graph.WaitForCopy
+	startUpload      = (*UploadSession).Upload
+	listenForChanges = graph.ListenForChanges
+	searchItems      = graph.Search
+	sharedItems      = graph.SharedWithMe
+	restoreItem      = graph.Restore
+	setFavorite      = graph.SetFavorite
+)
+
+// openContent opens an item's cached content. Items can change IDs while their
+// content is being read or written (like when a new file is uploaded for the
+// first time), so the ID has to be read under the same lock that is held while
+// changing it and moving the content.
+func (f *Filesystem) openContent(i *Inode) (*os.File, error) {
+	i.RLock()
+	defer i.RUnlock()
+	return f.content.Open(i.DriveItem.ID)
+}
 
 func (f *Filesystem) getInodeContent(i *Inode) *[]byte {
 	i.RLock()
@@ -89,6 +121,19 @@ func (f *Filesystem) remoteID(i *Inode) (string, error) {
 	return originalID, nil
 }
 
+// neverUploaded returns true for freshly created files that haven't been
+// written to yet, and files that are kept local. These only exist locally, so
+// there is no need to talk to the server about them until they have content to
+// upload.
+func (f *Filesystem) neverUploaded(i *Inode) bool {
+	id := i.ID()
+	if i.KeepLocal() {
+		return true
+	}
+	return isLocalID(id) && !i.IsDir() && !i.HasChanges() && i.Size() == 0 &&
+		!f.uploads.HasPendingUpload(id)
+}
+
 var disallowedRexp = regexp.MustCompile(`(?i)LPT[0-9]|COM[0-9]|_vti_|["*:<>?\/\\\|]`)
 
 // isNameRestricted returns true if the name is disallowed according to the doc here:
@@ -112,9 +157,29 @@ func isNameRestricted(name string) bool {
 	if strings.EqualFold(name, "desktop.ini") {
 		return true
 	}
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		// windows silently drops these, so they can't be told apart
+		return true
+	}
 	return disallowedRexp.FindStringIndex(name) != nil
 }
 
+// Init is called by the server that serves the filesystem before it is mounted.
+func (f *Filesystem) Init(server *fuse.Server) {
+	f.server = server
+}
+
+// invalidateKernelCache makes the kernel forget the attributes and content it
+// cached for a node.
+func (f *Filesystem) invalidateKernelCache(nodeID uint64) {
+	if f.server == nil || nodeID == 0 {
+		return
+	}
+	// the kernel may be waiting on us to finish the op that led to this, so
+	// don't wait on it in turn
+	go f.server.InodeNotify(nodeID, 0, -1)
+}
+
 // Statfs returns information about the filesystem. Mainly useful for checking
 // quotas and storage limits.
 func (f *Filesystem) StatFs(cancel <-chan struct{}, in *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
@@ -150,7 +215,8 @@ func (f *Filesystem) StatFs(cancel <-chan struct{}, in *fuse.InHeader, out *fuse
 
 // Mkdir creates a directory.
 func (f *Filesystem) Mkdir(cancel <-chan struct{}, in *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
-	if isNameRestricted(name) {
+	name, ok := f.serverName(name)
+	if !ok {
 		return fuse.EINVAL
 	}
 
@@ -159,7 +225,14 @@ func (f *Filesystem) Mkdir(cancel <-chan struct{}, in *fuse.MkdirIn, name string
 		return fuse.ENOENT
 	}
 	id := inode.ID()
+	if readOnlyDir(id) {
+		return fuse.EROFS
+	}
 	path := filepath.Join(inode.Path(), name)
+	if f.opts.isIgnored(path) {
+		// it would never be shown or synced
+		return fuse.EPERM
+	}
 	ctx := log.With().
 		Str("op", "Mkdir").
 		Uint64("nodeID", in.NodeId).
@@ -171,6 +244,22 @@ func (f *Filesystem) Mkdir(cancel <-chan struct{}, in *fuse.MkdirIn, name string
 
 	// create the new directory on the server
 	item, err := graph.Mkdir(name, id, f.auth)
+	if graph.StatusCode(err) == http.StatusConflict {
+		// made elsewhere and we haven't heard about it yet, a folder is just as
+		// good as the one we were asked to make
+		existing, getErr := graph.GetItemChild(id, name, f.auth)
+		if getErr != nil || !existing.IsDir() || f.GetID(existing.ID) != nil {
+			return fuse.Status(syscall.EEXIST)
+		}
+		ctx.Info().Str("serverID", existing.ID).
+			Msg("Directory already exists on the server, adopting it.")
+		newInode := f.newServerInode(existing)
+		out.NodeId = f.InsertChild(id, newInode)
+		out.Attr = newInode.makeAttr(f.uid, f.gid)
+		out.SetAttrTimeout(f.opts.kernelCacheTimeout())
+		out.SetEntryTimeout(f.opts.kernelCacheTimeout())
+		return fuse.OK
+	}
 	if err != nil {
 		ctx.Error().Err(err).Msg("Could not create remote directory!")
 		return fuse.EREMOTEIO
@@ -178,11 +267,12 @@ func (f *Filesystem) Mkdir(cancel <-chan struct{}, in *fuse.MkdirIn, name string
 
 	newInode := NewInodeDriveItem(item)
 	newInode.mode = in.Mode | fuse.S_IFDIR
+	f.pushMode(newInode)
 
 	out.NodeId = f.InsertChild(id, newInode)
-	out.Attr = newInode.makeAttr()
-	out.SetAttrTimeout(timeout)
-	out.SetEntryTimeout(timeout)
+	out.Attr = newInode.makeAttr(f.uid, f.gid)
+	out.SetAttrTimeout(f.opts.kernelCacheTimeout())
+	out.SetEntryTimeout(f.opts.kernelCacheTimeout())
 	return fuse.OK
 }
 
@@ -191,12 +281,36 @@ func (f *Filesystem) Rmdir(cancel <-chan struct{}, in *fuse.InHeader, name strin
 	parentID := f.TranslateID(in.NodeId)
 	if parentID == "" {
 		return fuse.ENOENT
+	} else if readOnlyDir(parentID) {
+		return fuse.EROFS
 	}
-	child, _ := f.GetChild(parentID, name, f.auth)
+	child, _ := f.GetChild(parentID, f.lookupName(name), f.auth)
 	if child == nil {
 		return fuse.ENOENT
+	} else if isVirtualID(child.ID()) {
+		return fuse.EROFS
 	}
-	if child.HasChildren() {
+	// HasChildren() is not enough here - a directory's children may never have
+	// been fetched, and deleting it on the server would take all of them with
+	// it. Local-only children that have not been uploaded yet count too.
+	child.RLock()
+	fetched := child.children != nil
+	child.RUnlock()
+	if !fetched && f.IsOffline() {
+		// GetChildrenID pretends there are none while offline, there could be
+		// anything in there
+		return fuse.Status(syscall.ENOTEMPTY)
+	}
+	children, err := f.GetChildrenID(child.ID(), f.auth)
+	if err != nil {
+		log.Error().Err(err).
+			Str("op", "Rmdir").
+			Str("id", child.ID()).
+			Str("path", child.Path()).
+			Msg("Could not fetch children of directory to remove.")
+		return fuse.EREMOTEIO
+	}
+	if len(children) > 0 {
 		return fuse.Status(syscall.ENOTEMPTY)
 	}
 	return f.Unlink(cancel, in, name)
@@ -241,10 +355,21 @@ func (f *Filesystem) OpenDir(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.
 	entries[1] = parent
 
 	for _, child := range children {
+		if f.opts.isHidden(child) || f.aliases.shadowed(child) ||
+			f.opts.isIgnored(child.Path()) {
+			continue
+		}
 		entries = append(entries, child)
 	}
+	names := make([]string, len(entries))
+	names[0], names[1] = ".", ".."
+	for i, child := range entries[2:] {
+		names[i+2] = f.aliases.localName(child)
+	}
+	names = f.unmangledNames(names)
 	f.opendirsM.Lock()
 	f.opendirs[in.NodeId] = entries
+	f.opendirNames[in.NodeId] = names
 	f.opendirsM.Unlock()
 
 	return fuse.OK
@@ -254,6 +379,7 @@ func (f *Filesystem) OpenDir(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.
 func (f *Filesystem) ReleaseDir(in *fuse.ReleaseIn) {
 	f.opendirsM.Lock()
 	delete(f.opendirs, in.NodeId)
+	delete(f.opendirNames, in.NodeId)
 	f.opendirsM.Unlock()
 }
 
@@ -261,12 +387,14 @@ func (f *Filesystem) ReleaseDir(in *fuse.ReleaseIn) {
 func (f *Filesystem) ReadDirPlus(cancel <-chan struct{}, in *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
 	f.opendirsM.RLock()
 	entries, ok := f.opendirs[in.NodeId]
+	names := f.opendirNames[in.NodeId]
 	f.opendirsM.RUnlock()
 	if !ok {
 		// readdir can sometimes arrive before the corresponding opendir, so we force it
 		f.OpenDir(cancel, &fuse.OpenIn{InHeader: in.InHeader}, nil)
 		f.opendirsM.RLock()
 		entries, ok = f.opendirs[in.NodeId]
+		names = f.opendirNames[in.NodeId]
 		f.opendirsM.RUnlock()
 		if !ok {
 			return fuse.EBADF
@@ -279,18 +407,11 @@ func (f *Filesystem) ReadDirPlus(cancel <-chan struct{}, in *fuse.ReadIn, out *f
 	}
 
 	inode := entries[in.Offset]
+	// first two entries will always be "." and ".."
 	entry := fuse.DirEntry{
 		Ino:  inode.NodeID(),
 		Mode: inode.Mode(),
-	}
-	// first two entries will always be "." and ".."
-	switch in.Offset {
-	case 0:
-		entry.Name = "."
-	case 1:
-		entry.Name = ".."
-	default:
-		entry.Name = inode.Name()
+		Name: names[in.Offset],
 	}
 	entryOut := out.AddDirLookupEntry(entry)
 	if entryOut == nil {
@@ -305,9 +426,9 @@ func (f *Filesystem) ReadDirPlus(cancel <-chan struct{}, in *fuse.ReadIn, out *f
 		return fuse.EIO
 	}
 	entryOut.NodeId = entry.Ino
-	entryOut.Attr = inode.makeAttr()
-	entryOut.SetAttrTimeout(timeout)
-	entryOut.SetEntryTimeout(timeout)
+	entryOut.Attr = inode.makeAttr(f.uid, f.gid)
+	entryOut.SetAttrTimeout(f.opts.kernelCacheTimeout())
+	entryOut.SetEntryTimeout(f.opts.kernelCacheTimeout())
 	return fuse.OK
 }
 
@@ -316,12 +437,14 @@ func (f *Filesystem) ReadDirPlus(cancel <-chan struct{}, in *fuse.ReadIn, out *f
 func (f *Filesystem) ReadDir(cancel <-chan struct{}, in *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
 	f.opendirsM.RLock()
 	entries, ok := f.opendirs[in.NodeId]
+	names := f.opendirNames[in.NodeId]
 	f.opendirsM.RUnlock()
 	if !ok {
 		// readdir can sometimes arrive before the corresponding opendir, so we force it
 		f.OpenDir(cancel, &fuse.OpenIn{InHeader: in.InHeader}, nil)
 		f.opendirsM.RLock()
 		entries, ok = f.opendirs[in.NodeId]
+		names = f.opendirNames[in.NodeId]
 		f.opendirsM.RUnlock()
 		if !ok {
 			return fuse.EBADF
@@ -334,18 +457,11 @@ func (f *Filesystem) ReadDir(cancel <-chan struct{}, in *fuse.ReadIn, out *fuse.
 	}
 
 	inode := entries[in.Offset]
+	// first two entries will always be "." and ".."
 	entry := fuse.DirEntry{
 		Ino:  inode.NodeID(),
 		Mode: inode.Mode(),
-	}
-	// first two entries will always be "." and ".."
-	switch in.Offset {
-	case 0:
-		entry.Name = "."
-	case 1:
-		entry.Name = ".."
-	default:
-		entry.Name = inode.Name()
+		Name: names[in.Offset],
 	}
 
 	out.AddDirEntry(entry)
@@ -363,21 +479,33 @@ func (f *Filesystem) Lookup(cancel <-chan struct{}, in *fuse.InHeader, name stri
 		Str("name", name).
 		Msg("")
 
+	if name = f.aliases.serverName(f.GetID(id), name); name == "" {
+		return fuse.ENOENT
+	}
+	name = f.lookupName(name)
+	if f.negative.missing(id, name) {
+		return fuse.ENOENT
+	}
+	if parent := f.GetID(id); parent != nil && f.opts.isIgnored(filepath.Join(parent.Path(), name)) {
+		return fuse.ENOENT
+	}
 	child, _ := f.GetChild(id, strings.ToLower(name), f.auth)
 	if child == nil {
+		f.negative.add(id, name)
 		return fuse.ENOENT
 	}
 
 	out.NodeId = child.NodeID()
-	out.Attr = child.makeAttr()
-	out.SetAttrTimeout(timeout)
-	out.SetEntryTimeout(timeout)
+	out.Attr = child.makeAttr(f.uid, f.gid)
+	out.SetAttrTimeout(f.opts.kernelCacheTimeout())
+	out.SetEntryTimeout(f.opts.kernelCacheTimeout())
 	return fuse.OK
 }
 
 // Mknod creates a regular file. The server doesn't have this yet.
 func (f *Filesystem) Mknod(cancel <-chan struct{}, in *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
-	if isNameRestricted(name) {
+	name, ok := f.serverName(name)
+	if !ok {
 		return fuse.EINVAL
 	}
 
@@ -389,9 +517,15 @@ func (f *Filesystem) Mknod(cancel <-chan struct{}, in *fuse.MknodIn, name string
 	parent := f.GetID(parentID)
 	if parent == nil {
 		return fuse.ENOENT
+	} else if readOnlyDir(parentID) {
+		return fuse.EROFS
 	}
 
 	path := filepath.Join(parent.Path(), name)
+	if f.opts.isIgnored(path) {
+		// it would never be shown or synced
+		return fuse.EPERM
+	}
 	ctx := log.With().
 		Str("op", "Mknod").
 		Uint64("nodeID", in.NodeId).
@@ -412,14 +546,15 @@ func (f *Filesystem) Mknod(cancel <-chan struct{}, in *fuse.MknodIn, name string
 		Str("mode", Octal(in.Mode)).
 		Msg("Creating inode.")
 	out.NodeId = f.InsertChild(parentID, inode)
-	out.Attr = inode.makeAttr()
-	out.SetAttrTimeout(timeout)
-	out.SetEntryTimeout(timeout)
+	out.Attr = inode.makeAttr(f.uid, f.gid)
+	out.SetAttrTimeout(f.opts.kernelCacheTimeout())
+	out.SetEntryTimeout(f.opts.kernelCacheTimeout())
 	return fuse.OK
 }
 
 // Create creates a regular file and opens it. The server doesn't have this yet.
 func (f *Filesystem) Create(cancel <-chan struct{}, in *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
+	out.OpenFlags = openFlags(in.Flags)
 	// we reuse mknod here
 	result := f.Mknod(
 		cancel,
@@ -435,7 +570,7 @@ func (f *Filesystem) Create(cancel <-chan struct{}, in *fuse.CreateIn, name stri
 		// if the inode already exists, we should truncate the existing file and
 		// return the existing file inode as per "man creat"
 		parentID := f.TranslateID(in.NodeId)
-		child, _ := f.GetChild(parentID, name, f.auth)
+		child, _ := f.GetChild(parentID, f.lookupName(name), f.auth)
 		log.Debug().
 			Str("op", "Create").
 			Uint64("nodeID", in.NodeId).
@@ -444,16 +579,35 @@ func (f *Filesystem) Create(cancel <-chan struct{}, in *fuse.CreateIn, name stri
 			Str("path", child.Path()).
 			Str("mode", Octal(in.Mode)).
 			Msg("Child inode already exists, truncating.")
-		f.content.Delete(child.ID())
+		f.deleteContent(child.ID())
 		f.content.Open(child.ID())
+		child.Lock()
 		child.DriveItem.Size = 0
 		child.hasChanges = true
+		child.openCount++
+		child.Unlock()
 		return fuse.OK
 	}
-	// no further initialized required to open the file, it's empty
+	if result == fuse.OK {
+		// no further initialized required to open the file, it's empty
+		if inode := f.GetNodeID(out.NodeId); inode != nil {
+			inode.Lock()
+			inode.openCount++
+			inode.Unlock()
+		}
+	}
 	return result
 }
 
+// openFlags returns how the kernel should treat a file opened with flags.
+func openFlags(flags uint32) uint32 {
+	if flags&syscall.O_DIRECT != 0 {
+		// skip the page cache, every read and write comes to us
+		return fuse.FOPEN_DIRECT_IO
+	}
+	return 0
+}
+
 // Open fetches a Inodes's content and initializes the .Data field with actual
 // data from the server.
 func (f *Filesystem) Open(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
@@ -471,7 +625,13 @@ func (f *Filesystem) Open(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.Ope
 		Str("path", path).
 		Logger()
 
+	if isVirtualID(id) {
+		// deleted items in the recycle bin have to be restored to be read
+		return fuse.EACCES
+	}
+
 	flags := int(in.Flags)
+	out.OpenFlags = openFlags(in.Flags)
 	if flags&os.O_RDWR+flags&os.O_WRONLY > 0 && f.IsOffline() {
 		ctx.Warn().
 			Bool("readWrite", flags&os.O_RDWR > 0).
@@ -489,7 +649,8 @@ func (f *Filesystem) Open(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.Ope
 	// stay locked until end to prevent multiple Opens() from competing for
 	// downloads of the same file.
 
-	// try grabbing from disk
+	// try grabbing from disk, the ID may have changed while we waited for the lock
+	id = inode.DriveItem.ID
 	fd, err := f.content.Open(id)
 	if err != nil {
 		ctx.Error().Err(err).Msg("Could not create cache file.")
@@ -498,10 +659,36 @@ func (f *Filesystem) Open(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.Ope
 
 	if isLocalID(id) {
 		// just use whatever's present if we're the only ones who have it
+		inode.openCount++
+		return fuse.OK
+	}
+
+	if inode.DriveItem.Size == 0 {
+		// there's nothing to download, and the server often leaves out the hashes
+		// of empty files, so they would never pass verification
+		if st, err := fd.Stat(); err == nil && st.Size() > 0 {
+			ctx.Info().Msg("File is empty on the server, discarding cached content.")
+			fd.Truncate(0)
+		}
+		inode.openCount++
+		return fuse.OK
+	}
+
+	if f.trustCachedContent(inode, fd) {
+		// hashing a huge file means reading all of it before we can serve it
+		ctx.Debug().Msg("Trusting cached content without verifying its hash.")
+		inode.openCount++
 		return fuse.OK
 	}
 
-	if inode.VerifyChecksum(graph.QuickXORHashStream(fd)) {
+	var cached bool
+	if inode.DriveItem.File != nil && inode.DriveItem.File.Hashes.QuickXorHash == "" {
+		// only a SHA1 hash to check against, and only QuickXorHashes are cached
+		cached = inode.VerifyContent(fd)
+	} else {
+		cached = inode.VerifyChecksum(f.cachedContentHash(id, fd))
+	}
+	if cached {
 		// disk content is only used if the checksums match
 		ctx.Info().Msg("Found content in cache.")
 
@@ -512,40 +699,106 @@ func (f *Filesystem) Open(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.Ope
 			return fuse.EIO
 		}
 		inode.DriveItem.Size = uint64(st.Size())
+		inode.openCount++
 		return fuse.OK
 	}
 
 	ctx.Info().Msg(
 		"Not using cached item due to file hash mismatch, fetching content from API.",
 	)
+	if status := f.downloadContent(inode, fd); status != fuse.OK {
+		return status
+	}
+	inode.openCount++
+	f.emit(EventDownload, path, "")
+	return fuse.OK
+}
+
+// downloadContent replaces an item's cached content with what is on the server,
+// as long as it matches the hash we have for it. The inode's lock must be held.
+func (f *Filesystem) downloadContent(inode *Inode, fd *os.File) fuse.Status {
+	id := inode.DriveItem.ID
 
 	// write to tempfile first to ensure our download is good
 	tempID := "temp-" + id
 	temp, err := f.content.Open(tempID)
 	if err != nil {
-		ctx.Error().Err(err).Msg("Failed to create tempfile for download.")
+		log.Error().Err(err).Str("id", id).Msg("Failed to create tempfile for download.")
 		return fuse.EIO
 	}
 	defer f.content.Delete(tempID)
 
 	// replace content only on a match
-	size, err := graph.GetItemContentStream(id, f.auth, temp)
-	if err != nil || !inode.VerifyChecksum(graph.QuickXORHashStream(temp)) {
-		ctx.Error().Err(err).Msg("Failed to fetch remote content.")
-		return fuse.EREMOTEIO
+	var size uint64
+	for attempt := 1; ; attempt++ {
+		temp.Seek(0, 0)
+		temp.Truncate(0)
+		size, err = getItemContent(id, f.auth, temp)
+		if err != nil {
+			log.Error().Err(err).Str("id", id).Msg("Failed to fetch remote content.")
+			return fuse.EREMOTEIO
+		}
+		if inode.VerifyContent(temp) {
+			break
+		}
+		if attempt >= downloadAttempts {
+			log.Error().Str("id", id).Int("attempts", attempt).
+				Msg("Downloaded content never matched its hash, giving up.")
+			return fuse.EREMOTEIO
+		}
+		log.Warn().Str("id", id).Uint64("size", size).Int("attempt", attempt).
+			Msg("Downloaded content did not match its hash, downloading it again.")
+		if attempt == 1 {
+			// the file may have changed on the server since we got its hash, in
+			// which case no amount of downloading would ever match it
+			item, err := getItem(id, f.auth)
+			if err != nil {
+				log.Warn().Err(err).Str("id", id).Msg("Could not fetch the item's current hash.")
+			} else if item.File != nil {
+				inode.DriveItem.File = item.File
+				inode.DriveItem.Size = item.Size
+			}
+		}
 	}
 	temp.Seek(0, 0) // being explicit, even though already done in hashstream func
 	fd.Seek(0, 0)
 	fd.Truncate(0)
 	io.Copy(fd, temp)
+	f.storeContentHash(id, fd, inode.DriveItem.File.Hashes.QuickXorHash)
 	inode.DriveItem.Size = size
 	return fuse.OK
 }
 
+// trustCachedContent returns true if the user has opted out of verifying the
+// cached content of a file like this one. The inode's lock must be held.
+func (f *Filesystem) trustCachedContent(inode *Inode, fd *os.File) bool {
+	if f.opts.TrustCacheAbove == 0 && len(f.opts.TrustCacheExtensions) == 0 {
+		return false
+	}
+	st, err := fd.Stat()
+	if err != nil || st.Size() == 0 || uint64(st.Size()) != inode.DriveItem.Size {
+		// nothing cached yet, or definitely not the right content
+		return false
+	}
+	if f.opts.TrustCacheAbove > 0 && uint64(st.Size()) >= f.opts.TrustCacheAbove {
+		return true
+	}
+	ext := filepath.Ext(inode.DriveItem.Name)
+	for _, trusted := range f.opts.TrustCacheExtensions {
+		if ext != "" && strings.EqualFold(ext, "."+strings.TrimPrefix(trusted, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
 // Unlink deletes a child file.
 func (f *Filesystem) Unlink(cancel <-chan struct{}, in *fuse.InHeader, name string) fuse.Status {
 	parentID := f.TranslateID(in.NodeId)
-	child, _ := f.GetChild(parentID, name, nil)
+	if readOnlyDir(parentID) {
+		return fuse.EROFS
+	}
+	child, _ := f.GetChild(parentID, f.lookupName(name), nil)
 	if child == nil {
 		// the file we are unlinking never existed
 		return fuse.ENOENT
@@ -565,6 +818,21 @@ func (f *Filesystem) Unlink(cancel <-chan struct{}, in *fuse.InHeader, name stri
 		Logger()
 	ctx.Debug().Msg("Unlinking inode.")
 
+	if !child.IsDir() {
+		child.Lock()
+		open := child.openCount > 0
+		child.unlinked = open
+		child.Unlock()
+		if open {
+			// the file is still usable through its open handles, so the rest of
+			// the cleanup waits until the last one is released
+			ctx.Debug().Msg("File is still open, deferring deletion until released.")
+			f.detachID(id)
+			f.forgetMangledName(child.Name())
+			return fuse.OK
+		}
+	}
+
 	// if no ID, the item is local-only, and does not need to be deleted on the
 	// server
 	if !isLocalID(id) {
@@ -572,10 +840,16 @@ func (f *Filesystem) Unlink(cancel <-chan struct{}, in *fuse.InHeader, name stri
 			ctx.Err(err).Msg("Failed to delete item on server. Aborting op.")
 			return fuse.EREMOTEIO
 		}
+		f.recordDeleted(child)
 	}
 
+	if child.IsDir() {
+		f.deleteDescendants(id)
+	}
 	f.DeleteID(id)
-	f.content.Delete(id)
+	f.deleteContent(id)
+	f.purgeThumbnails(id)
+	f.forgetMangledName(child.Name())
 	return fuse.OK
 }
 
@@ -597,16 +871,102 @@ func (f *Filesystem) Read(cancel <-chan struct{}, in *fuse.ReadIn, buf []byte) (
 		Logger()
 	ctx.Trace().Msg("")
 
-	fd, err := f.content.Open(id)
+	fd, err := f.openContent(inode)
 	if err != nil {
 		ctx.Error().Err(err).Msg("Cache Open() failed.")
 		return fuse.ReadResultData(make([]byte, 0)), fuse.EIO
 	}
 
+	// The content we actually have is what bounds the read, not the size the API
+	// reported (which is occasionally wrong).
+	st, err := fd.Stat()
+	if err != nil {
+		ctx.Error().Err(err).Msg("Could not fetch file stats.")
+		return fuse.ReadResultData(make([]byte, 0)), fuse.EIO
+	}
+	actual := st.Size()
+	end := int64(in.Offset) + int64(in.Size)
+	if reported := inode.Size(); reported > uint64(actual) && end > actual {
+		// cutting the read short could silently truncate the file, so ask the
+		// server which of the two is wrong first
+		if refetched, err := f.recheckSize(inode, fd); err != nil {
+			ctx.Warn().Err(err).Msg("Could not check the file's size with the server.")
+		} else {
+			actual = refetched
+		}
+	}
+	if reported := inode.Size(); reported != uint64(actual) {
+		ctx.Warn().
+			Uint64("reported", reported).
+			Int64("actual", actual).
+			Msg("Size of cached content does not match reported size, using actual size.")
+		inode.Lock()
+		inode.DriveItem.Size = uint64(actual)
+		inode.Unlock()
+	}
+	offset := int64(in.Offset)
+	if offset >= actual {
+		return fuse.ReadResultData(make([]byte, 0)), fuse.OK
+	}
+	size := int(in.Size)
+	if offset+int64(size) > actual {
+		size = int(actual - offset)
+	}
+
 	// we are locked for the remainder of this op
 	inode.RLock()
 	defer inode.RUnlock()
-	return fuse.ReadResultFd(fd.Fd(), int64(in.Offset), int(in.Size)), fuse.OK
+	return fuse.ReadResultFd(fd.Fd(), offset, size), fuse.OK
+}
+
+// recheckSize fetches an item's metadata from the server again when its cached
+// content is smaller than the size we have for it. If the server agrees the file
+// is bigger, its content is downloaded again. Returns how big the cached
+// content is afterwards.
+func (f *Filesystem) recheckSize(inode *Inode, fd *os.File) (int64, error) {
+	id := inode.ID()
+	if isLocalID(id) || isVirtualID(id) || inode.HasChanges() ||
+		f.uploads.HasPendingUpload(id) {
+		// our content is the only copy that counts
+		return contentSize(fd)
+	}
+	if f.IsOffline() {
+		return 0, errors.New("offline")
+	}
+	item, err := getItem(id, f.auth)
+	if err != nil {
+		return 0, err
+	}
+
+	inode.Lock()
+	defer inode.Unlock()
+	actual, err := contentSize(fd)
+	if err != nil || uint64(actual) >= item.Size {
+		// someone else caught up in the meantime, or the size was just wrong
+		return actual, err
+	}
+	log.Warn().
+		Str("id", id).
+		Uint64("size", item.Size).
+		Int64("cached", actual).
+		Msg("Cached content is smaller than the file on the server, downloading it again.")
+	inode.DriveItem.Size = item.Size
+	if item.File != nil {
+		inode.DriveItem.File = item.File
+	}
+	if status := f.downloadContent(inode, fd); status != fuse.OK {
+		return actual, fmt.Errorf("could not download content again: %s", status)
+	}
+	return contentSize(fd)
+}
+
+// contentSize is how big the content in a cache file is.
+func contentSize(fd *os.File) (int64, error) {
+	st, err := fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), nil
 }
 
 // Write to an Inode like a file. Note that changes are 100% local until
@@ -619,6 +979,8 @@ func (f *Filesystem) Write(cancel <-chan struct{}, in *fuse.WriteIn, data []byte
 		return 0, fuse.EBADF
 	}
 
+	f.forgetServerCopies(id)
+
 	nWrite := len(data)
 	offset := int(in.Offset)
 	ctx := log.With().
@@ -631,14 +993,25 @@ func (f *Filesystem) Write(cancel <-chan struct{}, in *fuse.WriteIn, data []byte
 		Logger()
 	ctx.Trace().Msg("")
 
-	fd, err := f.content.Open(id)
+	inode.Lock()
+	defer inode.Unlock()
+	fd, err := f.content.Open(inode.DriveItem.ID)
 	if err != nil {
 		ctx.Error().Msg("Cache Open() failed.")
 		return 0, fuse.EIO
 	}
-
-	inode.Lock()
-	defer inode.Unlock()
+	if in.Flags&syscall.O_APPEND != 0 {
+		// the kernel passes along where it thinks the file ends, which can be
+		// out of date if another handle has written to it since. Appends always
+		// go at the end, and the inode lock keeps concurrent writers from
+		// interleaving with us.
+		st, err := fd.Stat()
+		if err != nil {
+			ctx.Error().Err(err).Msg("Could not find end of file to append to.")
+			return 0, fuse.EIO
+		}
+		offset = int(st.Size())
+	}
 	n, err := fd.WriteAt(data, int64(offset))
 	if err != nil {
 		ctx.Error().Err(err).Msg("Error during write")
@@ -667,21 +1040,47 @@ func (f *Filesystem) Fsync(cancel <-chan struct{}, in *fuse.FsyncIn) fuse.Status
 		Str("path", inode.Path()).
 		Logger()
 	ctx.Debug().Msg("")
+	inode.RLock()
+	unlinked := inode.unlinked
+	inode.RUnlock()
+	if unlinked {
+		// there's no point uploading something that is about to be deleted
+		return fuse.OK
+	}
 	if inode.HasChanges() {
 		inode.Lock()
 		inode.hasChanges = false
 
 		// recompute hashes when saving new content
 		inode.DriveItem.File = &graph.File{}
-		fd, err := f.content.Open(id)
+		fd, err := f.content.Open(inode.DriveItem.ID)
 		if err != nil {
 			ctx.Error().Err(err).Msg("Could not get fd.")
 		}
 		fd.Sync()
 		inode.DriveItem.File.Hashes.QuickXorHash = graph.QuickXORHashStream(fd)
+		f.storeContentHash(inode.DriveItem.ID, fd, inode.DriveItem.File.Hashes.QuickXorHash)
 		inode.Unlock()
 
-		if err := f.uploads.QueueUpload(inode); err != nil {
+		if inode.Durable() {
+			if err := f.uploadDurably(cancel, inode); err != nil {
+				ctx.Error().Err(err).Msg("Upload of durable file failed.")
+				// try again on the next fsync or close
+				inode.Lock()
+				inode.hasChanges = true
+				inode.Unlock()
+				if err == errDurableInterrupted {
+					return fuse.EINTR
+				}
+				if graph.IsQuotaExceeded(err) {
+					return fuse.Status(syscall.ENOSPC)
+				}
+				return fuse.EIO
+			}
+			ctx.Info().Msg("Durable file uploaded.")
+			return fuse.OK
+		}
+		if err := f.queueUpload(inode); err != nil {
 			ctx.Error().Err(err).Msg("Error creating upload session.")
 			return fuse.EREMOTEIO
 		}
@@ -691,27 +1090,73 @@ func (f *Filesystem) Fsync(cancel <-chan struct{}, in *fuse.FsyncIn) fuse.Status
 }
 
 // Flush is called when a file descriptor is closed. Uses Fsync() to perform file
-// uploads. (Release not implemented because all cleanup is already done here).
+// uploads. Flush can be called several times for the same open file, so cleanup
+// is left to Release().
 func (f *Filesystem) Flush(cancel <-chan struct{}, in *fuse.FlushIn) fuse.Status {
 	inode := f.GetNodeID(in.NodeId)
 	if inode == nil {
 		return fuse.EBADF
 	}
 
-	id := inode.ID()
 	log.Trace().
 		Str("op", "Flush").
-		Str("id", id).
+		Str("id", inode.ID()).
 		Str("path", inode.Path()).
 		Uint64("nodeID", in.NodeId).
 		Msg("")
-	f.Fsync(cancel, &fuse.FsyncIn{InHeader: in.InHeader})
+	status := f.Fsync(cancel, &fuse.FsyncIn{InHeader: in.InHeader})
+	if inode.Durable() {
+		// close() has to fail if the data didn't make it
+		return status
+	}
+	return fuse.OK
+}
+
+// Release is called once a file handle will no longer be used. When the last
+// handle to a file is released, its cache file is closed and, if it was unlinked
+// while still open, it is finally deleted.
+func (f *Filesystem) Release(cancel <-chan struct{}, in *fuse.ReleaseIn) {
+	inode := f.GetNodeID(in.NodeId)
+	if inode == nil {
+		return
+	}
+
+	id := inode.ID()
+	f.forgetServerCopies(id)
+	ctx := log.With().
+		Str("op", "Release").
+		Str("id", id).
+		Uint64("nodeID", in.NodeId).
+		Logger()
 
 	// grab a lock to prevent a race condition closing an opened file prior to its use (use after free segfault)
 	inode.Lock()
-	defer inode.Unlock()
-	f.content.Close(id)
-	return 0
+	if inode.openCount > 0 {
+		inode.openCount--
+	}
+	last := inode.openCount == 0
+	unlinked := inode.unlinked
+	id = inode.DriveItem.ID // may have changed since the file was opened
+	if last {
+		f.content.Close(id)
+	}
+	inode.Unlock()
+	ctx.Trace().Bool("last", last).Msg("")
+	if !last || !unlinked {
+		return
+	}
+
+	ctx.Debug().Msg("Last handle to unlinked file released, deleting.")
+	if !isLocalID(id) {
+		if err := graph.Remove(id, f.auth); err != nil {
+			ctx.Error().Err(err).Msg("Failed to delete unlinked file on server.")
+		} else {
+			f.recordDeleted(inode)
+		}
+	}
+	f.DeleteID(id)
+	f.deleteContent(id)
+	f.purgeThumbnails(id)
 }
 
 // Getattr returns a the Inode as a UNIX stat. Holds the read mutex for all of
@@ -729,8 +1174,8 @@ func (f *Filesystem) GetAttr(cancel <-chan struct{}, in *fuse.GetAttrIn, out *fu
 		Str("path", inode.Path()).
 		Msg("")
 
-	out.Attr = inode.makeAttr()
-	out.SetTimeout(timeout)
+	out.Attr = inode.makeAttr(f.uid, f.gid)
+	out.SetTimeout(f.opts.kernelCacheTimeout())
 	return fuse.OK
 }
 
@@ -744,6 +1189,13 @@ func (f *Filesystem) SetAttr(cancel <-chan struct{}, in *fuse.SetAttrIn, out *fu
 	}
 	path := i.Path()
 	isDir := i.IsDir() // holds an rlock
+	if mode, valid := in.GetMode(); valid && f.opts.PreserveModes &&
+		i.Mode()&^syscall.S_IFMT != mode&^syscall.S_IFMT && !modesSupported(i) {
+		// refuse before changing anything, the mode could never be stored
+		log.Warn().Str("op", "SetAttr").Str("path", path).
+			Msg("Modes can't be stored on this drive, only personal drives support it.")
+		return fuse.ENOTSUP
+	}
 	i.Lock()
 
 	ctx := log.With().
@@ -758,9 +1210,11 @@ func (f *Filesystem) SetAttr(cancel <-chan struct{}, in *fuse.SetAttrIn, out *fu
 		ctx.Info().
 			Str("subop", "utimens").
 			Time("oldMtime", *i.DriveItem.ModTime).
-			Time("newMtime", *i.DriveItem.ModTime).
+			Time("newMtime", mtime).
 			Msg("")
 		i.DriveItem.ModTime = &mtime
+		// a truncate in the same call must not make the upload forget this
+		i.mtimeSet = true
 	}
 
 	// chmod
@@ -784,6 +1238,7 @@ func (f *Filesystem) SetAttr(cancel <-chan struct{}, in *fuse.SetAttrIn, out *fu
 			Uint64("oldSize", i.DriveItem.Size).
 			Uint64("newSize", size).
 			Msg("")
+		f.forgetServerCopies(i.DriveItem.ID)
 		fd, _ := f.content.Open(i.DriveItem.ID)
 		// the unix syscall does not update the seek position, so neither should we
 		fd.Truncate(int64(size))
@@ -792,16 +1247,50 @@ func (f *Filesystem) SetAttr(cancel <-chan struct{}, in *fuse.SetAttrIn, out *fu
 	}
 
 	i.Unlock()
-	out.Attr = i.makeAttr()
-	out.SetTimeout(timeout)
+	if _, valid := in.GetMode(); valid {
+		f.serializeID(i.ID())
+		// the mode is kept on this computer either way, pushMode logs failures
+		f.pushMode(i)
+	}
+	out.Attr = i.makeAttr(f.uid, f.gid)
+	out.SetTimeout(f.opts.kernelCacheTimeout())
 	return fuse.OK
 }
 
+// dropReplaced gets rid of our copy of a file that was replaced by a rename.
+// Its content must never be served under its old name again, and anything it
+// had waiting to be uploaded would only bring it back.
+func (f *Filesystem) dropReplaced(replaced *Inode) {
+	id := replaced.ID()
+	f.uploads.CancelUpload(id)
+	replaced.Lock()
+	open := replaced.openCount > 0
+	replaced.unlinked = open
+	replaced.hasChanges = false
+	nodeID := replaced.nodeID
+	replaced.Unlock()
+	f.invalidateKernelCache(nodeID)
+
+	if open {
+		// whoever has it open can keep using the old content until they close
+		// it. It's gone from the server already, so it's local-only from now on.
+		newID := localID()
+		f.MoveID(id, newID)
+		f.detachID(newID)
+		return
+	}
+	f.DeleteID(id)
+	f.deleteContent(id)
+	f.purgeThumbnails(id)
+}
+
 // Rename renames and/or moves an inode.
 func (f *Filesystem) Rename(cancel <-chan struct{}, in *fuse.RenameIn, name string, newName string) fuse.Status {
-	if isNameRestricted(newName) {
+	newName, ok := f.serverName(newName)
+	if !ok {
 		return fuse.EINVAL
 	}
+	name = f.lookupName(name)
 
 	oldParentID := f.TranslateID(in.NodeId)
 	oldParentItem := f.GetNodeID(in.NodeId)
@@ -818,10 +1307,42 @@ func (f *Filesystem) Rename(cancel <-chan struct{}, in *fuse.RenameIn, name stri
 		return fuse.ENOENT
 	}
 	dest := filepath.Join(newParentItem.Path(), newName)
+	if f.opts.isIgnored(dest) {
+		// it would never be shown or synced
+		return fuse.EPERM
+	}
 
 	inode, _ := f.GetChild(oldParentID, name, f.auth)
-	id, err := f.remoteID(inode)
+	if inode == nil {
+		return fuse.ENOENT
+	}
 	newParentID := newParentItem.ID()
+	if oldParentID == recycleBinDirID && !readOnlyDir(newParentID) {
+		return f.restore(inode, newParentID, newName)
+	}
+	if readOnlyDir(oldParentID) || readOnlyDir(newParentID) || isVirtualID(inode.ID()) {
+		return fuse.EROFS
+	}
+	if f.neverUploaded(inode) {
+		if existing, _ := f.GetChild(newParentID, newName, f.auth); existing == nil {
+			// nothing to do on the server, it gets uploaded under its new name
+			// whenever it is written to
+			log.Debug().
+				Str("op", "Rename").
+				Str("id", inode.ID()).
+				Str("path", path).
+				Str("dest", dest).
+				Msg("Renaming local-only item.")
+			if err := f.MovePath(oldParentID, newParentID, name, newName, f.auth); err != nil {
+				return fuse.EIO
+			}
+			if name != newName {
+				f.forgetMangledName(name)
+			}
+			return fuse.OK
+		}
+	}
+	id, err := f.remoteID(inode)
 
 	ctx := log.With().
 		Str("op", "Rename").
@@ -842,17 +1363,31 @@ func (f *Filesystem) Rename(cancel <-chan struct{}, in *fuse.RenameIn, name stri
 		return fuse.EREMOTEIO
 	}
 
+	// editors save by writing a temp file and renaming it over the original,
+	// which the server replaces on its own
+	replaced, _ := f.GetChild(newParentID, newName, f.auth)
+	if replaced != nil && (replaced.ID() == id || replaced.IsDir()) {
+		replaced = nil
+	}
+
 	// perform remote rename
 	if err = graph.Rename(id, newName, newParentID, f.auth); err != nil {
 		ctx.Error().Err(err).Msg("Failed to rename remote item.")
 		return fuse.EREMOTEIO
 	}
+	if replaced != nil {
+		ctx.Info().Str("replacedID", replaced.ID()).Msg("Replacing existing item.")
+		f.dropReplaced(replaced)
+	}
 
 	// now rename local copy
 	if err = f.MovePath(oldParentID, newParentID, name, newName, f.auth); err != nil {
 		ctx.Error().Err(err).Msg("Failed to rename local item.")
 		return fuse.EIO
 	}
+	if name != newName {
+		f.forgetMangledName(name)
+	}
 
 	// whew! item renamed
 	return fuse.OK
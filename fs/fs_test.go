@@ -6,6 +6,9 @@ package fs
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -15,6 +18,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/jstaf/onedriver/fs/graph"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -37,6 +41,133 @@ func TestReaddir(t *testing.T) {
 	t.Fatal("Could not find \"Documents\" folder.")
 }
 
+// Hidden items should not show up in directory listings, but should still be
+// accessible by name.
+func TestReaddirHiddenItems(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(
+		auth,
+		filepath.Join(testDBLoc, "test_readdir_hidden_items"),
+		Options{HiddenItems: []string{"HIDDEN_*", "/hidden_dir/by_path.txt"}},
+	)
+	dir := NewInode("hidden_dir", 0755|fuse.S_IFDIR, nil)
+	dirNodeID, err := cache.InsertPath("/hidden_dir", nil, dir)
+	require.NoError(t, err)
+	for _, name := range []string{"visible.txt", "hidden_by_name.txt", "by_path.txt"} {
+		_, err = cache.InsertPath("/hidden_dir/"+name, nil, NewInode(name, 0644|fuse.S_IFREG, dir))
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, fuse.OK, cache.OpenDir(
+		context.Background().Done(),
+		&fuse.OpenIn{InHeader: fuse.InHeader{NodeId: dirNodeID}},
+		&fuse.OpenOut{},
+	))
+	names := make([]string, 0)
+	for _, entry := range cache.opendirs[dirNodeID][2:] {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"visible.txt"}, names, "Hidden items were listed.")
+
+	for _, name := range []string{"hidden_by_name.txt", "by_path.txt"} {
+		status := cache.Lookup(
+			context.Background().Done(),
+			&fuse.InHeader{NodeId: dirNodeID},
+			name,
+			&fuse.EntryOut{},
+		)
+		assert.Equal(t, fuse.OK, status, "Could not access hidden item %s by name.", name)
+	}
+}
+
+// The kernel should be told to cache attributes and lookups for as long as
+// configured.
+func TestKernelCacheTimeout(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, time.Second, Options{}.kernelCacheTimeout())
+	assert.Equal(t, time.Duration(0), Options{KernelCacheSeconds: -1}.kernelCacheTimeout())
+
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_kernel_cache_timeout"),
+		Options{KernelCacheSeconds: 15})
+	file := NewInode("timeout.txt", 0644|fuse.S_IFREG, nil)
+	_, err := cache.InsertPath("/timeout.txt", nil, file)
+	require.NoError(t, err)
+
+	entry := fuse.EntryOut{}
+	require.Equal(t, fuse.OK, cache.Lookup(
+		context.Background().Done(),
+		&fuse.InHeader{NodeId: 1},
+		"timeout.txt",
+		&entry,
+	))
+	assert.EqualValues(t, 15, entry.EntryValid)
+	assert.EqualValues(t, 15, entry.AttrValid)
+
+	attr := fuse.AttrOut{}
+	require.Equal(t, fuse.OK, cache.GetAttr(
+		context.Background().Done(),
+		&fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: file.NodeID()}},
+		&attr,
+	))
+	assert.EqualValues(t, 15, attr.AttrValid)
+}
+
+// Ignored items should not be listed, found or created from deltas.
+func TestIgnorePatterns(t *testing.T) {
+	t.Parallel()
+	opts := Options{IgnorePatterns: []string{"NODE_MODULES", "/ignored_dir/*.log"}}
+	assert.True(t, opts.isIgnored("/code/project/node_modules"))
+	assert.False(t, opts.isIgnored("/code/project/node_modules.txt"))
+	assert.False(t, opts.isIgnored("/elsewhere/debug.log"), "Rooted patterns should match full paths.")
+
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_ignore_patterns"), opts)
+	dir := NewInode("ignored_dir", 0755|fuse.S_IFDIR, nil)
+	dirNodeID, err := cache.InsertPath("/ignored_dir", nil, dir)
+	require.NoError(t, err)
+	for _, name := range []string{"visible.txt", "node_modules", "debug.log"} {
+		_, err = cache.InsertPath("/ignored_dir/"+name, nil, NewInode(name, 0644|fuse.S_IFREG, dir))
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, fuse.OK, cache.OpenDir(
+		context.Background().Done(),
+		&fuse.OpenIn{InHeader: fuse.InHeader{NodeId: dirNodeID}},
+		&fuse.OpenOut{},
+	))
+	names := make([]string, 0)
+	for _, entry := range cache.opendirs[dirNodeID][2:] {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"visible.txt"}, names, "Ignored items were listed.")
+
+	for _, name := range []string{"node_modules", "debug.log"} {
+		status := cache.Lookup(
+			context.Background().Done(),
+			&fuse.InHeader{NodeId: dirNodeID},
+			name,
+			&fuse.EntryOut{},
+		)
+		assert.Equal(t, fuse.ENOENT, status, "Ignored item %s was found.", name)
+	}
+
+	delta := &graph.DriveItem{
+		ID:     "ignored-delta-id",
+		Name:   "other.log",
+		Parent: &graph.DriveItemParent{ID: dir.ID()},
+	}
+	require.NoError(t, cache.applyDelta(delta))
+	assert.Nil(t, cache.GetID(delta.ID), "Ignored item was created from a delta.")
+
+	// they can't be created either, they'd never show up
+	header := fuse.InHeader{NodeId: dirNodeID}
+	assert.Equal(t, fuse.EPERM, cache.Mkdir(context.Background().Done(),
+		&fuse.MkdirIn{InHeader: header, Mode: 0755}, "node_modules", &fuse.EntryOut{}))
+	assert.Equal(t, fuse.EPERM, cache.Create(context.Background().Done(),
+		&fuse.CreateIn{InHeader: header, Mode: 0644}, "trace.log", &fuse.CreateOut{}))
+	assert.Equal(t, fuse.EPERM, cache.Rename(context.Background().Done(),
+		&fuse.RenameIn{InHeader: header, Newdir: dirNodeID}, "visible.txt", "visible.log"))
+}
+
 // does ls work and can we find the Documents folder?
 func TestLs(t *testing.T) {
 	t.Parallel()
@@ -105,6 +236,32 @@ func TestMkdirRmdir(t *testing.T) {
 	require.NoError(t, os.Mkdir(fname, 0755))
 }
 
+// A mkdir racing a folder of the same name made elsewhere should end up with
+// that folder, not a duplicate under a name the kernel doesn't know about.
+func TestMkdirExistsOnServer(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_mkdir_exists_on_server"), Options{})
+	parent, err := cache.GetPath("/onedriver_tests", auth)
+	require.NoError(t, err)
+	_, err = cache.GetChildrenID(parent.ID(), auth)
+	require.NoError(t, err)
+	server, err := graph.Mkdir("mkdir_exists_on_server", parent.ID(), auth)
+	require.NoError(t, err)
+
+	out := fuse.EntryOut{}
+	require.Equal(t, fuse.OK, cache.Mkdir(context.Background().Done(),
+		&fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: parent.NodeID()}, Mode: 0755},
+		"mkdir_exists_on_server", &out))
+	assert.Equal(t, server.ID, cache.TranslateID(out.NodeId), "Server folder was not adopted.")
+
+	children, err := graph.GetItemChildren(parent.ID(), auth)
+	require.NoError(t, err)
+	for _, child := range children {
+		assert.False(t, strings.HasPrefix(child.Name, "mkdir_exists_on_server "),
+			"Duplicate folder %q was created.", child.Name)
+	}
+}
+
 // We shouldn't be able to rmdir nonempty directories
 func TestRmdirNonempty(t *testing.T) {
 	t.Parallel()
@@ -118,6 +275,54 @@ func TestRmdirNonempty(t *testing.T) {
 		"Could not remove a nonempty directory the correct way!")
 }
 
+// A directory whose only child is local-only (not yet uploaded) is still
+// nonempty and should not be removed until that child is gone.
+func TestRmdirLocalOnlyChild(t *testing.T) {
+	t.Parallel()
+	dir := filepath.Join(TestDir, "rmdir_local_only")
+	require.NoError(t, os.Mkdir(dir, 0755))
+
+	// an open, never-flushed file only exists locally
+	file, err := os.Create(filepath.Join(dir, "local_only"))
+	require.NoError(t, err)
+	inode, err := fs.GetPath("/onedriver_tests/rmdir_local_only/local_only", nil)
+	require.NoError(t, err)
+	require.True(t, isLocalID(inode.ID()), "Child should not have been uploaded yet.")
+
+	err = syscall.Rmdir(dir)
+	require.Equal(t, syscall.ENOTEMPTY, err,
+		"Directory with a local-only child was not reported as nonempty.")
+
+	require.NoError(t, file.Close())
+	require.NoError(t, os.Remove(filepath.Join(dir, "local_only")))
+	require.NoError(t, syscall.Rmdir(dir))
+	assert.Nil(t, fs.GetID(inode.ID()), "Child was left behind in the cache.")
+}
+
+// While offline, a directory whose children were never fetched could contain
+// anything, so it must not be treated as empty.
+func TestRmdirOfflineUnfetched(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_rmdir_offline_unfetched"), Options{})
+	now := time.Now()
+	dir := NewInodeDriveItem(&graph.DriveItem{
+		ID:      "rmdir-offline-unfetched",
+		Name:    "rmdir_offline_unfetched",
+		ModTime: &now,
+		Folder:  &graph.Folder{ChildCount: 1},
+		Parent:  &graph.DriveItemParent{ID: cache.root},
+	})
+	cache.InsertChild(cache.root, dir)
+	dir.children = nil
+	cache.Lock()
+	cache.offline = true
+	cache.Unlock()
+
+	assert.Equal(t, fuse.Status(syscall.ENOTEMPTY),
+		cache.Rmdir(nil, &fuse.InHeader{NodeId: 1}, "rmdir_offline_unfetched"))
+	assert.NotNil(t, cache.GetID(dir.ID()), "Directory was removed.")
+}
+
 // test that we can write to a file and read its contents back correctly
 func TestReadWrite(t *testing.T) {
 	t.Parallel()
@@ -263,6 +468,275 @@ massa lectus mattis dolor, in volutpat nulla lectus id neque.`
 	require.Equal(t, match, string(result), "Content did not match expected output.")
 }
 
+// The API sometimes reports the wrong size for a file. Reads should be bounded by
+// the content we actually have instead.
+func TestReadWrongReportedSize(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_read_wrong_reported_size"), Options{})
+	inode := NewInode("wrong_size.txt", 0644|fuse.S_IFREG, nil)
+	nodeID, err := cache.InsertPath("/wrong_size.txt", nil, inode)
+	require.NoError(t, err)
+	content := []byte("the server thinks this file is bigger than it is")
+	inode.setContent(cache, content)
+	inode.DriveItem.Size = uint64(len(content) + 1000)
+
+	read := func(offset uint64) []byte {
+		buf := make([]byte, 4096)
+		result, status := cache.Read(
+			context.Background().Done(),
+			&fuse.ReadIn{
+				InHeader: fuse.InHeader{NodeId: nodeID},
+				Offset:   offset,
+				Size:     uint32(len(buf)),
+			},
+			buf,
+		)
+		require.Equal(t, fuse.OK, status, "Read failed.")
+		data, status := result.Bytes(buf)
+		require.Equal(t, fuse.OK, status)
+		return data
+	}
+	assert.Equal(t, content, read(0), "Read returned the wrong content.")
+	assert.Equal(t, uint64(len(content)), inode.Size(), "Size was not corrected.")
+	assert.Empty(t, read(uint64(len(content)+10)),
+		"Read past the end of the real content returned data.")
+}
+
+// When a read goes past the content we have for a file the server knows about,
+// the server should be asked how big the file really is, once.
+func TestReadRechecksSize(t *testing.T) {
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_read_rechecks_size"), Options{})
+	oldGetItem := getItem
+	defer func() { getItem = oldGetItem }()
+	content := []byte("the metadata we have says this file is bigger")
+	lookups := 0
+	getItem = func(id string, auth *graph.Auth) (*graph.DriveItem, error) {
+		lookups++
+		return &graph.DriveItem{ID: id, Size: uint64(len(content))}, nil
+	}
+
+	inode := NewInodeDriveItem(&graph.DriveItem{
+		ID:     "read-rechecks-size",
+		Name:   "rechecks_size.txt",
+		Size:   uint64(len(content) + 1000),
+		Parent: &graph.DriveItemParent{ID: cache.root},
+	})
+	nodeID := cache.InsertChild(cache.root, inode)
+	require.NoError(t, cache.content.Insert(inode.ID(), content))
+
+	read := func(offset uint64) []byte {
+		buf := make([]byte, 4096)
+		result, status := cache.Read(
+			context.Background().Done(),
+			&fuse.ReadIn{
+				InHeader: fuse.InHeader{NodeId: nodeID},
+				Offset:   offset,
+				Size:     uint32(len(buf)),
+			},
+			buf,
+		)
+		require.Equal(t, fuse.OK, status, "Read failed.")
+		data, status := result.Bytes(buf)
+		require.Equal(t, fuse.OK, status)
+		return data
+	}
+	assert.Equal(t, content, read(0), "Read returned the wrong content.")
+	assert.Equal(t, 1, lookups, "Server was not asked for the file's size.")
+	assert.Equal(t, uint64(len(content)), inode.Size(), "Size was not corrected.")
+	assert.Empty(t, read(uint64(len(content))))
+	assert.Equal(t, 1, lookups, "Server was asked again after the size was settled.")
+}
+
+// A download that doesn't match the item's hash (like one cut short by a flaky
+// connection) should be thrown away and fetched again, not cached.
+func TestOpenRetriesBadDownload(t *testing.T) {
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_open_retries_bad_download"), Options{})
+	oldGetItemContent, oldGetItem := getItemContent, getItem
+	defer func() { getItemContent, getItem = oldGetItemContent, oldGetItem }()
+	content := []byte("only the first few bytes of this make it through the first time")
+	// what the server says about the file when asked again
+	serverFile := &graph.File{Hashes: graph.Hashes{QuickXorHash: graph.QuickXORHash(&content)}}
+	lookups := 0
+	getItem = func(id string, auth *graph.Auth) (*graph.DriveItem, error) {
+		lookups++
+		return &graph.DriveItem{ID: id, Size: uint64(len(content)), File: serverFile}, nil
+	}
+	downloads := 0
+	badDownloads := 1
+	getItemContent = func(id string, auth *graph.Auth, output io.Writer) (uint64, error) {
+		downloads++
+		data := content
+		if downloads <= badDownloads {
+			data = content[:10]
+		}
+		n, err := output.Write(data)
+		return uint64(n), err
+	}
+
+	open := func(item *graph.DriveItem) fuse.Status {
+		inode := NewInodeDriveItem(item)
+		nodeID := cache.InsertChild(cache.root, inode)
+		return cache.Open(
+			context.Background().Done(),
+			&fuse.OpenIn{InHeader: fuse.InHeader{NodeId: nodeID}, Flags: uint32(os.O_RDONLY)},
+			&fuse.OpenOut{},
+		)
+	}
+	item := &graph.DriveItem{
+		ID:     "open-retries-bad-download",
+		Name:   "bad_download.txt",
+		Size:   uint64(len(content)),
+		Parent: &graph.DriveItemParent{ID: cache.root},
+		File:   &graph.File{Hashes: graph.Hashes{QuickXorHash: graph.QuickXORHash(&content)}},
+	}
+	require.Equal(t, fuse.OK, open(item))
+	assert.Equal(t, 2, downloads, "Bad download was not retried.")
+	assert.Equal(t, content, cache.content.Get(item.ID), "Bad download was cached.")
+	assert.Equal(t, 1, lookups, "Server was not asked for the item's current hash.")
+
+	// drives that only send a SHA1 hash get checked against that instead
+	downloads = 0
+	sha1Item := &graph.DriveItem{
+		ID:     "open-retries-bad-download-sha1",
+		Name:   "bad_download_sha1.txt",
+		Size:   uint64(len(content)),
+		Parent: &graph.DriveItemParent{ID: cache.root},
+		File:   &graph.File{Hashes: graph.Hashes{SHA1Hash: graph.SHA1Hash(&content)}},
+	}
+	serverFile = sha1Item.File
+	require.Equal(t, fuse.OK, open(sha1Item))
+	assert.Equal(t, 2, downloads)
+	assert.Equal(t, content, cache.content.Get(sha1Item.ID))
+
+	// a file that changed on the server after we got its hash gets checked
+	// against the new one
+	downloads = 0
+	badDownloads = 0
+	outdated := []byte("what the file used to be")
+	changedItem := &graph.DriveItem{
+		ID:     "open-retries-bad-download-changed",
+		Name:   "bad_download_changed.txt",
+		Size:   uint64(len(outdated)),
+		Parent: &graph.DriveItemParent{ID: cache.root},
+		File:   &graph.File{Hashes: graph.Hashes{QuickXorHash: graph.QuickXORHash(&outdated)}},
+	}
+	serverFile = item.File
+	require.Equal(t, fuse.OK, open(changedItem))
+	assert.Equal(t, 2, downloads, "Download was not checked against the new hash.")
+	assert.Equal(t, content, cache.content.Get(changedItem.ID))
+	assert.Equal(t, uint64(len(content)), cache.GetID(changedItem.ID).Size(),
+		"Size was not updated along with the hash.")
+
+	// and nothing is cached if it never comes through right
+	downloads = 0
+	badDownloads = downloadAttempts
+	item.ID = "open-retries-bad-download-never"
+	assert.Equal(t, fuse.EREMOTEIO, open(item))
+	assert.Equal(t, downloadAttempts, downloads)
+	assert.Empty(t, cache.content.Get(item.ID))
+}
+
+// Writes to a file opened with O_APPEND always go to its end, wherever the
+// kernel thinks that is. O_DIRECT should keep the kernel from caching the file.
+func TestWriteAppend(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_write_append"), Options{})
+	inode := NewInode("append.txt", 0644|fuse.S_IFREG, cache.GetID(cache.root))
+	nodeID := cache.InsertChild(cache.root, inode)
+	require.NoError(t, cache.content.Insert(inode.ID(), []byte("hello")))
+
+	open := &fuse.OpenIn{
+		InHeader: fuse.InHeader{NodeId: nodeID},
+		Flags:    uint32(os.O_WRONLY | os.O_APPEND | syscall.O_DIRECT),
+	}
+	out := &fuse.OpenOut{}
+	require.Equal(t, fuse.OK, cache.Open(context.Background().Done(), open, out))
+	assert.NotZero(t, out.OpenFlags&fuse.FOPEN_DIRECT_IO, "O_DIRECT did not bypass the page cache.")
+
+	for i := 0; i < 2; i++ {
+		// stale offsets, like from another handle that has not seen our writes
+		n, status := cache.Write(
+			context.Background().Done(),
+			&fuse.WriteIn{
+				InHeader: fuse.InHeader{NodeId: nodeID},
+				Offset:   0,
+				Flags:    open.Flags,
+			},
+			[]byte(" world"),
+		)
+		require.Equal(t, fuse.OK, status, "Write failed.")
+		assert.EqualValues(t, len(" world"), n)
+	}
+	assert.Equal(t, []byte("hello world world"), cache.content.Get(inode.ID()))
+	assert.EqualValues(t, len("hello world world"), inode.Size())
+}
+
+// With hash verification skipped for large files, opening one should use the
+// cached content as-is instead of hashing it (and then trying to redownload it
+// when the hash does not match).
+func TestOpenTrustCache(t *testing.T) {
+	t.Parallel()
+	for _, trusted := range []bool{true, false} {
+		opts := Options{}
+		if trusted {
+			opts.TrustCacheAbove = 1024
+		}
+		cache := NewFilesystem(
+			auth,
+			filepath.Join(testDBLoc, fmt.Sprintf("test_open_trust_cache_%t", trusted)),
+			opts,
+		)
+		content := bytes.Repeat([]byte("a"), 4096)
+		inode := NewInodeDriveItem(&graph.DriveItem{
+			ID:     "trust-cache-not-a-real-id",
+			Name:   "trust_cache.bin",
+			Size:   uint64(len(content)),
+			Parent: &graph.DriveItemParent{ID: cache.root},
+			// a hash that will never match, so hashing would force a download
+			File: &graph.File{Hashes: graph.Hashes{QuickXorHash: "bogus"}},
+		})
+		nodeID := cache.InsertChild(cache.root, inode)
+		require.NoError(t, cache.content.Insert(inode.ID(), content))
+
+		status := cache.Open(
+			context.Background().Done(),
+			&fuse.OpenIn{InHeader: fuse.InHeader{NodeId: nodeID}},
+			&fuse.OpenOut{},
+		)
+		if trusted {
+			assert.Equal(t, fuse.OK, status, "Cached content was not trusted.")
+		} else {
+			assert.NotEqual(t, fuse.OK, status, "Cached content was not verified.")
+		}
+	}
+}
+
+// Empty files on the server often come without any hashes. Opening one should
+// give empty content without trying (and failing) to download it, every time.
+func TestOpenZeroByteFile(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_open_zero_byte"), Options{})
+	inode := NewInodeDriveItem(&graph.DriveItem{
+		ID:     "zero-byte-not-a-real-id",
+		Name:   "zero_byte.txt",
+		Parent: &graph.DriveItemParent{ID: cache.root},
+		File:   &graph.File{},
+	})
+	nodeID := cache.InsertChild(cache.root, inode)
+	// leftovers from an older version of the file
+	require.NoError(t, cache.content.Insert(inode.ID(), []byte("stale")))
+
+	for i := 0; i < 2; i++ {
+		status := cache.Open(
+			context.Background().Done(),
+			&fuse.OpenIn{InHeader: fuse.InHeader{NodeId: nodeID}},
+			&fuse.OpenOut{},
+		)
+		require.Equal(t, fuse.OK, status, "Could not open empty file.")
+		assert.Empty(t, cache.content.Get(inode.ID()), "Stale content was not discarded.")
+	}
+}
+
 // Statfs should succeed
 func TestStatFs(t *testing.T) {
 	t.Parallel()
@@ -284,6 +758,41 @@ func TestUnlink(t *testing.T) {
 	}
 }
 
+// A file that is unlinked while open should stay usable through its open
+// handles, and only be deleted once the last one is closed.
+func TestUnlinkWhileOpen(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(TestDir, "unlink_while_open.txt")
+	content := []byte("still here")
+	require.NoError(t, ioutil.WriteFile(fname, content, 0644))
+	var item *graph.DriveItem
+	require.Eventually(t, func() bool {
+		item, _ = graph.GetItemPath("/onedriver_tests/unlink_while_open.txt", auth)
+		return item != nil
+	}, retrySeconds, time.Second, "File was never uploaded.")
+
+	first, err := os.Open(fname)
+	require.NoError(t, err)
+	second, err := os.Open(fname)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(fname))
+	_, err = os.Stat(fname)
+	assert.True(t, os.IsNotExist(err), "File was still visible after being unlinked.")
+
+	require.NoError(t, first.Close())
+	read, err := ioutil.ReadAll(second)
+	require.NoError(t, err)
+	assert.Equal(t, content, read, "Content was lost while a handle was still open.")
+	_, err = graph.GetItem(item.ID, auth)
+	assert.NoError(t, err, "File was deleted on server before its last handle was closed.")
+
+	require.NoError(t, second.Close())
+	assert.Eventually(t, func() bool {
+		_, err := graph.GetItem(item.ID, auth)
+		return err != nil
+	}, retrySeconds, time.Second, "File was not deleted after its last handle was closed.")
+}
+
 // OneDrive is case-insensitive due to limitations imposed by Windows NTFS
 // filesystem. Make sure we prevent users of normal systems from running into
 // issues with OneDrive's case-insensitivity.
@@ -477,6 +986,47 @@ func TestLibreOfficeSavePattern(t *testing.T) {
 	)
 }
 
+// Editors like vim and gedit save by writing to a temp file and renaming it over
+// the original. Afterwards, only the new content should be there, both locally
+// and on the server.
+func TestAtomicSavePattern(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(TestDir, "atomic_save.txt")
+	require.NoError(t, ioutil.WriteFile(fname, []byte("old content"), 0644))
+	content, err := ioutil.ReadFile(fname)
+	require.NoError(t, err)
+	require.Equal(t, "old content", string(content))
+
+	temp := filepath.Join(TestDir, ".atomic_save.txt.swp")
+	require.NoError(t, ioutil.WriteFile(temp, []byte("new content"), 0644))
+	require.NoError(t, os.Rename(temp, fname))
+
+	content, err = ioutil.ReadFile(fname)
+	require.NoError(t, err)
+	assert.Equal(t, "new content", string(content), "Old content was served.")
+	_, err = os.Stat(temp)
+	assert.True(t, os.IsNotExist(err), "Temp file still exists.")
+
+	entries, err := ioutil.ReadDir(TestDir)
+	require.NoError(t, err)
+	found := 0
+	for _, entry := range entries {
+		if entry.Name() == "atomic_save.txt" {
+			found++
+		}
+	}
+	assert.Equal(t, 1, found, "The replaced file was still listed.")
+
+	assert.Eventually(t, func() bool {
+		item, err := graph.GetItemPath("/onedriver_tests/atomic_save.txt", auth)
+		if err != nil || item == nil {
+			return false
+		}
+		remote, _, err := graph.GetItemContent(item.ID, auth)
+		return err == nil && string(remote) == "new content"
+	}, retrySeconds, 3*time.Second, "Server did not end up with the new content.")
+}
+
 // TestDisallowedFilenames verifies that we can't create any of the disallowed filenames
 // https://support.microsoft.com/en-us/office/restrictions-and-limitations-in-onedrive-and-sharepoint-64883a5d-228e-48f5-b3d2-eb39e07630fa
 func TestDisallowedFilenames(t *testing.T) {
@@ -486,6 +1036,9 @@ func TestDisallowedFilenames(t *testing.T) {
 	assert.Error(t, os.WriteFile(filepath.Join(TestDir, "disallowed_vti_text.txt"), contents, 0644))
 	assert.Error(t, os.WriteFile(filepath.Join(TestDir, "disallowed_<_text.txt"), contents, 0644))
 	assert.Error(t, os.WriteFile(filepath.Join(TestDir, "COM0"), contents, 0644))
+	assert.Error(t, os.WriteFile(filepath.Join(TestDir, "CON"), contents, 0644))
+	assert.Error(t, os.WriteFile(filepath.Join(TestDir, "trailing dot."), contents, 0644))
+	assert.Error(t, os.WriteFile(filepath.Join(TestDir, "trailing space "), contents, 0644))
 	assert.Error(t, os.Mkdir(filepath.Join(TestDir, "disallowed:folder"), 0755))
 	assert.Error(t, os.Mkdir(filepath.Join(TestDir, "disallowed_vti_folder"), 0755))
 	assert.Error(t, os.Mkdir(filepath.Join(TestDir, "disallowed>folder"), 0755))
@@ -497,3 +1050,55 @@ func TestDisallowedFilenames(t *testing.T) {
 		filepath.Join(TestDir, "invalid_vti_directory"),
 	))
 }
+
+// Temporary files that are created, renamed and deleted again before anything
+// is written to them should never touch the server.
+func TestTransientFileNoRequests(t *testing.T) {
+	t.Parallel()
+	localAuth := *auth
+	cache := NewFilesystem(&localAuth, filepath.Join(testDBLoc, "test_transient_file"), Options{})
+	// lookups of the parent directory are fine, they happen before any of this
+	_, err := cache.GetChildrenID(cache.root, &localAuth)
+	require.NoError(t, err)
+	before := localAuth.Requests()
+
+	root := fuse.InHeader{NodeId: 1}
+	out := &fuse.CreateOut{}
+	require.Equal(t, fuse.OK, cache.Create(
+		nil, &fuse.CreateIn{InHeader: root, Mode: 0644 | fuse.S_IFREG}, "transient.tmp", out,
+	))
+	file := fuse.InHeader{NodeId: out.NodeId}
+	require.Equal(t, fuse.OK, cache.Rename(
+		nil, &fuse.RenameIn{InHeader: root, Newdir: 1}, "transient.tmp", "transient-renamed.tmp",
+	))
+	require.Equal(t, fuse.OK, cache.Flush(nil, &fuse.FlushIn{InHeader: file}))
+	cache.Release(nil, &fuse.ReleaseIn{InHeader: file})
+	require.Equal(t, fuse.OK, cache.Unlink(nil, &root, "transient-renamed.tmp"))
+
+	assert.Equal(t, before, localAuth.Requests(), "Transient file caused requests to the server.")
+}
+
+// Editors doing atomic saves often truncate a file and set its mtime in the same
+// setattr call. The server should end up with that mtime, not the upload time.
+func TestSetAttrTruncateKeepsMtime(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(TestDir, "truncate_mtime.txt")
+	require.NoError(t, ioutil.WriteFile(fname, []byte("some content to truncate"), 0644))
+	inode, err := fs.GetPath("/onedriver_tests/truncate_mtime.txt", auth)
+	require.NoError(t, err)
+	require.NotNil(t, inode)
+
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	in := &fuse.SetAttrIn{}
+	in.NodeId = inode.NodeID()
+	in.Valid = fuse.FATTR_SIZE | fuse.FATTR_MTIME
+	in.Size = 4
+	in.Mtime = uint64(mtime.Unix())
+	require.Equal(t, fuse.OK, fs.SetAttr(nil, in, &fuse.AttrOut{}))
+	require.Equal(t, fuse.OK, fs.Flush(nil, &fuse.FlushIn{InHeader: in.InHeader}))
+
+	assert.Eventually(t, func() bool {
+		item, err := graph.GetItemPath("/onedriver_tests/truncate_mtime.txt", auth)
+		return err == nil && item.Size == 4 && item.ModTime.Equal(mtime)
+	}, retrySeconds, 2*time.Second, "Uploaded item did not keep the requested mtime.")
+}
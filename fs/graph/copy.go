@@ -0,0 +1,105 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+)
+
+// how often to check on a copy that is still in progress
+const copyPollInterval = time.Second
+
+// ErrCopyTimeout is returned by WaitForCopy when the server did not finish a
+// copy in time. The copy may still complete later.
+var ErrCopyTimeout = errors.New("copy did not finish in time")
+
+// ErrCopyInterrupted is returned by WaitForCopy when it was cancelled. The copy
+// may still complete later.
+var ErrCopyInterrupted = errors.New("copy was interrupted")
+
+// the monitor URL of a copy is preauthenticated, and redirects to the new item
+// once done, which we'd need auth for
+var monitorClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// copyStatus is what the monitor URL of a copy reports about it.
+type copyStatus struct {
+	Status     string `json:"status"` // notStarted | inProgress | completed | failed
+	ResourceID string `json:"resourceId"`
+	Error      struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Copy starts copying an item into the folder with parentID under itemName,
+// entirely on the server. Returns the URL to pass to WaitForCopy to find out
+// when the copy is done.
+func Copy(itemID string, itemName string, parentID string, auth *Auth) (string, error) {
+	copyContent := DriveItem{
+		Name: itemName,
+		Parent: &DriveItemParent{
+			ID:      parentID,
+			DriveID: RemoteDrive(parentID),
+		},
+	}
+	payload, _ := json.Marshal(copyContent)
+	_, headers, err := requestHeaders(IDPath(itemID)+"/copy", auth, "POST",
+		bytes.NewReader(payload), nil)
+	if err != nil {
+		return "", err
+	}
+	monitor := headers.Get("Location")
+	if monitor == "" {
+		return "", errors.New("server did not say where to check on the copy")
+	}
+	return monitor, nil
+}
+
+// WaitForCopy checks on a copy started with Copy until it is done, and returns
+// the ID of the new item. Gives up after timeout or once cancel is closed.
+func WaitForCopy(monitor string, timeout time.Duration, cancel <-chan struct{}) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		response, err := monitorClient.Get(monitor)
+		if err != nil {
+			return "", err
+		}
+		var status copyStatus
+		json.NewDecoder(response.Body).Decode(&status)
+		response.Body.Close()
+
+		switch {
+		case response.StatusCode >= 300 && response.StatusCode < 400:
+			// redirected to the new item
+			location := response.Header.Get("Location")
+			if location == "" {
+				return "", errors.New("copy finished, but the new item is unknown")
+			}
+			return path.Base(location), nil
+		case response.StatusCode >= 400:
+			return "", &Error{StatusCode: response.StatusCode}
+		case status.Status == "completed":
+			return status.ResourceID, nil
+		case status.Status == "failed":
+			return "", fmt.Errorf("copy failed: %s: %s", status.Error.Code, status.Error.Message)
+		}
+
+		if time.Now().Add(copyPollInterval).After(deadline) {
+			return "", ErrCopyTimeout
+		}
+		select {
+		case <-cancel:
+			return "", ErrCopyInterrupted
+		case <-time.After(copyPollInterval):
+		}
+	}
+}
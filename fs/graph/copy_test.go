@@ -0,0 +1,74 @@
+package graph
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A copy should be started with the new name and parent, then checked on
+// through its monitor URL until the server is done with it.
+func TestCopy(t *testing.T) {
+	var polls int32
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/me/drive/items/original/copy":
+				var body DriveItem
+				json.NewDecoder(r.Body).Decode(&body)
+				if body.Name != "copy.txt" || body.Parent == nil || body.Parent.ID != "folder" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				assert.Equal(t, "POST", r.Method)
+				w.Header().Set("Location", server.URL+"/monitor")
+				w.WriteHeader(http.StatusAccepted)
+			case "/monitor":
+				assert.Empty(t, r.Header.Get("Authorization"),
+					"Monitor URLs are preauthenticated, the token should not be sent.")
+				if atomic.AddInt32(&polls, 1) < 2 {
+					w.Write([]byte(`{"status": "inProgress"}`))
+					return
+				}
+				w.Write([]byte(`{"status": "completed", "resourceId": "copied"}`))
+			default:
+				http.NotFound(w, r)
+			}
+		},
+	))
+	defer server.Close()
+	oldGraphURL := graphURL
+	defer func() { graphURL = oldGraphURL }()
+	graphURL = server.URL
+	auth := &Auth{AccessToken: "token", ExpiresAt: time.Now().Unix() + 3600}
+
+	monitor, err := Copy("original", "copy.txt", "folder", auth)
+	require.NoError(t, err)
+	assert.Equal(t, server.URL+"/monitor", monitor)
+
+	id, err := WaitForCopy(monitor, time.Minute, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "copied", id)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&polls))
+}
+
+// A copy the server gave up on should be reported as failed.
+func TestWaitForCopyFailed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"status": "failed", "error": {"code": "nameAlreadyExists"}}`))
+		},
+	))
+	defer server.Close()
+
+	_, err := WaitForCopy(server.URL, time.Minute, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "nameAlreadyExists")
+}
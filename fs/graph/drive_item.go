@@ -55,6 +55,10 @@ type Deleted struct {
 	State string `json:"state,omitempty"`
 }
 
+// Favorite is present on items the user starred. Not every drive reports it,
+// an item without it may just be on a drive that doesn't support favorites.
+type Favorite struct{}
+
 // DriveItem contains the data fields from the Graph API
 // https://docs.microsoft.com/en-us/onedrive/developer/rest-api/resources/driveitem
 type DriveItem struct {
@@ -62,10 +66,14 @@ type DriveItem struct {
 	Name             string           `json:"name,omitempty"`
 	Size             uint64           `json:"size,omitempty"`
 	ModTime          *time.Time       `json:"lastModifiedDatetime,omitempty"`
+	CreateTime       *time.Time       `json:"createdDateTime,omitempty"`
 	Parent           *DriveItemParent `json:"parentReference,omitempty"`
 	Folder           *Folder          `json:"folder,omitempty"`
 	File             *File            `json:"file,omitempty"`
 	Deleted          *Deleted         `json:"deleted,omitempty"`
+	RemoteItem       *RemoteItem      `json:"remoteItem,omitempty"`
+	Favorite         *Favorite        `json:"favorite,omitempty"`
+	Description      string           `json:"description,omitempty"`
 	ConflictBehavior string           `json:"@microsoft.graph.conflictBehavior,omitempty"`
 	ETag             string           `json:"eTag,omitempty"`
 }
@@ -75,6 +83,12 @@ func (d *DriveItem) IsDir() bool {
 	return d.Folder != nil
 }
 
+// IsShortcut returns if the DriveItem is a shortcut to another item (like a
+// folder someone shared with us that was added to our drive).
+func (d *DriveItem) IsShortcut() bool {
+	return d.RemoteItem != nil
+}
+
 // ModTimeUnix returns the modification time as a unix uint64 time
 func (d *DriveItem) ModTimeUnix() uint64 {
 	return uint64(d.ModTime.Unix())
@@ -134,10 +148,10 @@ func GetItemContentStream(id string, auth *Auth, output io.Writer) (uint64, erro
 	}
 
 	const downloadChunkSize = 10 * 1024 * 1024
-	downloadURL := fmt.Sprintf("/me/drive/items/%s/content", id)
+	downloadURL := IDPath(id) + "/content"
 	if item.Size <= downloadChunkSize {
 		// simple one-shot download
-		content, err := Get(downloadURL, auth)
+		content, err := getContent(downloadURL, auth)
 		if err != nil {
 			return 0, err
 		}
@@ -154,7 +168,7 @@ func GetItemContentStream(id string, auth *Auth, output io.Writer) (uint64, erro
 			Str("id", item.ID).
 			Str("name", item.Name).
 			Msgf("Downloading bytes %d-%d/%d.", start, end, item.Size)
-		content, err := Get(downloadURL, auth, Header{
+		content, err := getContent(downloadURL, auth, Header{
 			key:   "Range",
 			value: fmt.Sprintf("bytes=%d-%d", start, end),
 		})
@@ -175,17 +189,31 @@ func GetItemContentStream(id string, auth *Auth, output io.Writer) (uint64, erro
 	return n, nil
 }
 
+// ThumbnailSizes are the sizes of the thumbnails the server generates for
+// images, videos, and documents.
+var ThumbnailSizes = []string{"small", "medium", "large"}
+
+// GetItemThumbnail fetches one of an item's server-generated thumbnails. size
+// must be one of ThumbnailSizes.
+func GetItemThumbnail(id string, size string, auth *Auth) ([]byte, error) {
+	return Get(fmt.Sprintf("%s/thumbnails/0/%s/content", IDPath(id), size), auth)
+}
+
 // Remove removes a directory or file by ID
 func Remove(id string, auth *Auth) error {
-	return Delete("/me/drive/items/"+id, auth)
+	return Delete(IDPath(id), auth)
 }
 
-// Mkdir creates a directory on the server at the specified parent ID.
+// Mkdir creates a directory on the server at the specified parent ID. Fails
+// with a 409 Conflict if an item with this name already exists.
 func Mkdir(name string, parentID string, auth *Auth) (*DriveItem, error) {
 	// create a new folder on the server
 	newFolderPost := DriveItem{
 		Name:   name,
 		Folder: &Folder{},
+		// the caller decides what to do with an existing item, a folder under
+		// a name nobody asked for would only be a duplicate
+		ConflictBehavior: "fail",
 	}
 	bytePayload, _ := json.Marshal(newFolderPost)
 	resp, err := Post(childrenPathID(parentID), auth, bytes.NewReader(bytePayload))
@@ -212,17 +240,58 @@ func Rename(itemID string, itemName string, parentID string, auth *Auth) error {
 	// apply patch to server copy - note that we don't actually care about the
 	// response content, only if it returns an error
 	jsonPatch, _ := json.Marshal(patchContent)
-	_, err := Patch("/me/drive/items/"+itemID, auth, bytes.NewReader(jsonPatch))
+	_, err := Patch(IDPath(itemID), auth, bytes.NewReader(jsonPatch))
 	if err != nil && strings.Contains(err.Error(), "resourceModified") {
 		// Wait a second, then retry the request. The Onedrive servers sometimes
 		// aren't quick enough here if the object has been recently created
 		// (<1 second ago).
 		time.Sleep(time.Second)
-		_, err = Patch("/me/drive/items/"+itemID, auth, bytes.NewReader(jsonPatch))
+		_, err = Patch(IDPath(itemID), auth, bytes.NewReader(jsonPatch))
 	}
 	return err
 }
 
+// Restore brings an item back out of the recycle bin, into the folder with
+// parentID under itemName. Only personal OneDrives support this.
+func Restore(itemID string, itemName string, parentID string, auth *Auth) (*DriveItem, error) {
+	restoreContent := DriveItem{
+		Name:   itemName,
+		Parent: &DriveItemParent{ID: parentID},
+	}
+	payload, _ := json.Marshal(restoreContent)
+	resp, err := Post(IDPath(itemID)+"/restore", auth, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	item := &DriveItem{}
+	return item, json.Unmarshal(resp, item)
+}
+
+// SetFavorite stars or unstars an item. Returns the item as updated by the
+// server.
+func SetFavorite(itemID string, favorite bool, auth *Auth) (*DriveItem, error) {
+	// unstarring needs an explicit null, which omitempty would leave out
+	patch := map[string]*Favorite{"favorite": nil}
+	if favorite {
+		patch["favorite"] = &Favorite{}
+	}
+	payload, _ := json.Marshal(patch)
+	resp, err := Patch(IDPath(itemID), auth, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	item := &DriveItem{}
+	return item, json.Unmarshal(resp, item)
+}
+
+// Search finds items whose name or content matches a query anywhere below the
+// root item.
+func Search(query string, auth *Auth) ([]*DriveItem, error) {
+	// quotes inside OData string literals are escaped by doubling them
+	query = strings.ReplaceAll(query, "'", "''")
+	return getItemChildren(IDPath("root")+"/search(q='"+url.PathEscape(query)+"')", auth)
+}
+
 // only used for parsing
 type driveChildren struct {
 	Children []*DriveItem `json:"value"`
@@ -238,12 +307,15 @@ func getItemChildren(pollURL string, auth *Auth) ([]*DriveItem, error) {
 			return fetched, err
 		}
 		var pollResult driveChildren
-		json.Unmarshal(body, &pollResult)
+		if err = json.Unmarshal(body, &pollResult); err != nil {
+			// better to fail than to hand back a silently truncated listing
+			return fetched, err
+		}
 
 		// there can be multiple pages of 200 items each (default).
 		// continue to next interation if we have an @odata.nextLink value
 		fetched = append(fetched, pollResult.Children...)
-		pollURL = strings.TrimPrefix(pollResult.NextLink, GraphURL)
+		pollURL = strings.TrimPrefix(pollResult.NextLink, graphURL)
 	}
 	return fetched, nil
 }
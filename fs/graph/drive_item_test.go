@@ -1,9 +1,16 @@
 package graph
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetItem(t *testing.T) {
@@ -17,3 +24,73 @@ func TestGetItem(t *testing.T) {
 	_, err = GetItemPath("/lkjfsdlfjdwjkfl", &auth)
 	assert.Error(t, err, "We didn't return an error for a non-existent item!")
 }
+
+// Every page of a folder's children should be fetched, no matter how the folder
+// was looked up.
+func TestGetItemChildrenPaging(t *testing.T) {
+	const pages = 3
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/me/drive/items/paged/children" &&
+				r.URL.Path != "/me/drive/root:/paged:/children" {
+				http.NotFound(w, r)
+				return
+			}
+			page := 1
+			fmt.Sscan(r.URL.Query().Get("page"), &page)
+			response := driveChildren{Children: []*DriveItem{
+				{ID: fmt.Sprintf("child-%d", page), Name: fmt.Sprintf("%d.txt", page)},
+			}}
+			if page < pages {
+				response.NextLink = fmt.Sprintf("%s%s?page=%d", server.URL, r.URL.Path, page+1)
+			}
+			json.NewEncoder(w).Encode(response)
+		},
+	))
+	defer server.Close()
+	oldGraphURL := graphURL
+	defer func() { graphURL = oldGraphURL }()
+	graphURL = server.URL
+	auth := &Auth{AccessToken: "token", ExpiresAt: time.Now().Unix() + 3600}
+
+	byID, err := GetItemChildren("paged", auth)
+	require.NoError(t, err)
+	assert.Len(t, byID, pages, "Not all pages were fetched by ID.")
+
+	byPath, err := GetItemChildrenPath("/paged", auth)
+	require.NoError(t, err)
+	assert.Len(t, byPath, pages, "Not all pages were fetched by path.")
+}
+
+// Starring and unstarring an item should patch its favorite facet, with an
+// explicit null to unstar it.
+func TestSetFavorite(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "PATCH" || r.URL.Path != "/me/drive/items/starred" {
+				http.NotFound(w, r)
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+			var patch DriveItem
+			json.Unmarshal(body, &patch)
+			json.NewEncoder(w).Encode(DriveItem{ID: "starred", Favorite: patch.Favorite, ETag: "new"})
+		},
+	))
+	defer server.Close()
+	oldGraphURL := graphURL
+	defer func() { graphURL = oldGraphURL }()
+	graphURL = server.URL
+	auth := &Auth{AccessToken: "token", ExpiresAt: time.Now().Unix() + 3600}
+
+	item, err := SetFavorite("starred", true, auth)
+	require.NoError(t, err)
+	assert.NotNil(t, item.Favorite)
+	item, err = SetFavorite("starred", false, auth)
+	require.NoError(t, err)
+	assert.Nil(t, item.Favorite)
+	assert.Equal(t, []string{`{"favorite":{}}`, `{"favorite":null}`}, bodies)
+}
@@ -9,18 +9,106 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/imdario/mergo"
+	"github.com/jstaf/onedriver/fs/metrics"
 	"github.com/rs/zerolog/log"
 )
 
 // GraphURL is the API endpoint of Microsoft Graph
 const GraphURL = "https://graph.microsoft.com/v1.0"
 
+// how long requests take, for graphing
+var requestDuration = metrics.NewHistogram("onedriver_graph_request_duration_seconds",
+	"How long requests to the Microsoft Graph API took, including reading the response.",
+	"method", metrics.DefaultBuckets)
+
+// graphURL is where requests actually get sent
+var graphURL = GraphURL
+
+// userAgent is sent as the User-Agent of every request when set
+var userAgent string
+
+// SetGraphURL sends requests to a different Microsoft Graph endpoint, like the
+// ones for national clouds. An empty url goes back to the default endpoint.
+// Only meant to be called before any requests are made.
+func SetGraphURL(url string) {
+	if url == "" {
+		url = GraphURL
+	}
+	graphURL = strings.TrimSuffix(url, "/")
+}
+
+// Endpoint is the Microsoft Graph endpoint requests are sent to.
+func Endpoint() string {
+	return graphURL
+}
+
+// SetUserAgent replaces Go's default User-Agent on every request, some proxies
+// only let certain clients through. Only meant to be called before any requests
+// are made.
+func SetUserAgent(agent string) {
+	userAgent = agent
+}
+
+// requestTimeout is how long a request to the API may take before giving up
+const requestTimeout = 60 * time.Second
+
+// transport is shared by every client so that connections get reused between
+// requests instead of being set up again each time.
+var transport = newTransport()
+
+// client is used for all requests made through Request
+var client = NewClient(requestTimeout)
+
+// newTransport creates a transport that keeps connections alive and negotiates
+// HTTP/2 with servers that support it. This lets many small metadata requests be
+// multiplexed over a single connection.
+func newTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// NewClient returns an HTTP client that shares onedriver's connection pool. A
+// timeout of 0 means requests made with the client never time out.
+func NewClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: userAgentTransport{transport}, Timeout: timeout}
+}
+
+// userAgentTransport sets the configured User-Agent on requests before handing
+// them to the shared transport.
+type userAgentTransport struct {
+	base http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if userAgent == "" {
+		return t.base.RoundTrip(req)
+	}
+	// a RoundTripper may not modify the request it was given
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", userAgent)
+	return t.base.RoundTrip(req)
+}
+
 // graphError is an internal struct used when decoding Graph's error messages
 type graphError struct {
 	Error struct {
@@ -29,6 +117,64 @@ type graphError struct {
 	} `json:"error"`
 }
 
+// Error is what Request() returns when the server answered with an error, as
+// opposed to not answering at all.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	// how long the server asked us to wait before trying again, 0 if it didn't
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("HTTP %d - %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// StatusCode returns the HTTP status the server answered with if err came from
+// Request(), or 0 if the request never got an answer.
+func StatusCode(err error) int {
+	var graphErr *Error
+	if errors.As(err, &graphErr) {
+		return graphErr.StatusCode
+	}
+	return 0
+}
+
+// ParseError turns an error response from the server into an Error. Responses
+// that aren't a Graph error are kept as the message.
+func ParseError(statusCode int, body []byte) *Error {
+	var decoded graphError
+	if json.Unmarshal(body, &decoded) != nil {
+		decoded.Error.Message = string(body)
+	}
+	return &Error{
+		StatusCode: statusCode,
+		Code:       decoded.Error.Code,
+		Message:    decoded.Error.Message,
+	}
+}
+
+// IsQuotaExceeded returns true if err means there is no space left on the drive.
+func IsQuotaExceeded(err error) bool {
+	var graphErr *Error
+	if errors.As(err, &graphErr) {
+		return graphErr.StatusCode == http.StatusInsufficientStorage ||
+			graphErr.Code == "quotaLimitReached"
+	}
+	return false
+}
+
+// RetryAfter returns how long the server asked us to back off for if err came
+// from Request(), or 0 if it did not say.
+func RetryAfter(err error) time.Duration {
+	var graphErr *Error
+	if errors.As(err, &graphErr) {
+		return graphErr.RetryAfter
+	}
+	return 0
+}
+
 // This is an additional header that can be specified to Request
 type Header struct {
 	key, value string
@@ -36,16 +182,33 @@ type Header struct {
 
 // Request performs an authenticated request to Microsoft Graph
 func Request(resource string, auth *Auth, method string, content io.Reader, headers ...Header) ([]byte, error) {
+	return request(resource, auth, method, content, nil, headers...)
+}
+
+// request does the work of Request. If limiter is not nil, the request body and
+// the response are sent and read no faster than its limit.
+func request(resource string, auth *Auth, method string, content io.Reader,
+	limiter *RateLimiter, headers ...Header) ([]byte, error) {
+	body, _, err := requestHeaders(resource, auth, method, content, limiter, headers...)
+	return body, err
+}
+
+// requestHeaders is request, but also returns the headers of the response.
+func requestHeaders(resource string, auth *Auth, method string, content io.Reader,
+	limiter *RateLimiter, headers ...Header) ([]byte, http.Header, error) {
 	if auth == nil || auth.AccessToken == "" {
 		// a catch all condition to avoid wiping our auth by accident
 		log.Error().Msg("Auth was empty and we attempted to make a request with it!")
-		return nil, errors.New("cannot make a request with empty auth")
+		return nil, nil, errors.New("cannot make a request with empty auth")
 	}
 
 	auth.Refresh()
+	if auth.ReauthRequired() {
+		return nil, nil, ErrReauthRequired
+	}
+	atomic.AddUint32(&auth.requests, 1)
 
-	client := &http.Client{Timeout: 60 * time.Second}
-	request, _ := http.NewRequest(method, GraphURL+resource, content)
+	request, _ := http.NewRequest(method, graphURL+resource, content)
 	request.Header.Add("Authorization", "bearer "+auth.AccessToken)
 	switch method { // request type-specific code here
 	case "PATCH":
@@ -59,46 +222,77 @@ func Request(resource string, auth *Auth, method string, content io.Reader, head
 	for _, header := range headers {
 		request.Header.Add(header.key, header.value)
 	}
+	// a body can only be sent again if we can start reading it over
+	replayable := content == nil || request.GetBody != nil
 
-	response, err := client.Do(request)
-	if err != nil {
-		// the actual request failed
-		return nil, err
+	send := func() (*http.Response, []byte, error) {
+		defer requestDuration.Since(method, time.Now())
+		if request.GetBody != nil {
+			request.Body, _ = request.GetBody()
+		}
+		if limiter != nil && content != nil {
+			// wrapping the body after the fact keeps the Content-Length worked out
+			// from the original body
+			request.Body = ioutil.NopCloser(limiter.Reader(request.Body))
+		}
+		response, err := client.Do(request)
+		if err != nil {
+			return nil, nil, err
+		}
+		body, _ := ioutil.ReadAll(limitedBody(response.Body, limiter))
+		response.Body.Close()
+		return response, body, nil
 	}
-	body, _ := ioutil.ReadAll(response.Body)
-	response.Body.Close()
 
-	if response.StatusCode == 401 {
-		var err graphError
-		json.Unmarshal(body, &err)
+	response, body, err := send()
+	if err == nil && response.StatusCode == 401 {
+		var authErr graphError
+		json.Unmarshal(body, &authErr)
 		log.Warn().
-			Str("code", err.Error.Code).
-			Str("message", err.Error.Message).
+			Str("code", authErr.Error.Code).
+			Str("message", authErr.Error.Message).
 			Msg("Authentication token invalid or new app permissions required, " +
 				"forcing reauth before retrying.")
 
 		reauth := newAuth(auth.AuthConfig, auth.path, false)
 		mergo.Merge(auth, reauth, mergo.WithOverride)
+		if reauth.RefreshToken != "" {
+			// unexported fields are not merged
+			auth.setReauthRequired(false)
+		}
 		request.Header.Set("Authorization", "bearer "+auth.AccessToken)
+		if replayable {
+			response, body, err = send()
+		}
 	}
-	if response.StatusCode >= 500 || response.StatusCode == 401 {
-		// the onedrive API is having issues, retry once
-		response, err = client.Do(request)
+	for attempt := 1; replayable; attempt++ {
+		wait, retry := retryDelay(method, response, err, attempt)
+		if !retry {
+			break
+		}
+		event := log.Warn().Str("method", method).Str("resource", resource).
+			Int("attempt", attempt).Dur("wait", wait)
 		if err != nil {
-			return nil, err
+			event.Err(err)
+		} else {
+			event.Int("status", response.StatusCode)
 		}
-		body, _ = ioutil.ReadAll(response.Body)
-		response.Body.Close()
+		event.Msg("Request failed, retrying.")
+		time.Sleep(wait)
+		response, body, err = send()
+	}
+	if err != nil {
+		// the actual request failed
+		return nil, nil, err
 	}
 
 	if response.StatusCode >= 400 {
 		// something was wrong with the request
-		var err graphError
-		json.Unmarshal(body, &err)
-		return nil, fmt.Errorf("HTTP %d - %s: %s",
-			response.StatusCode, err.Error.Code, err.Error.Message)
+		graphErr := ParseError(response.StatusCode, body)
+		graphErr.RetryAfter, _ = retryAfter(response.Header.Get("Retry-After"))
+		return nil, response.Header, graphErr
 	}
-	return body, nil
+	return body, response.Header, nil
 }
 
 // Get is a convenience wrapper around Request
@@ -121,6 +315,18 @@ func Put(resource string, auth *Auth, content io.Reader, headers ...Header) ([]b
 	return Request(resource, auth, "PUT", content, headers...)
 }
 
+// PutContent uploads file content, no faster than the upload limit.
+func PutContent(resource string, auth *Auth, content io.Reader, headers ...Header) ([]byte, error) {
+	upload, _ := auth.limiters()
+	return request(resource, auth, "PUT", content, upload, headers...)
+}
+
+// getContent downloads file content, no faster than the download limit.
+func getContent(resource string, auth *Auth, headers ...Header) ([]byte, error) {
+	_, download := auth.limiters()
+	return request(resource, auth, "GET", nil, download, headers...)
+}
+
 // Delete performs an HTTP delete
 func Delete(resource string, auth *Auth, headers ...Header) error {
 	_, err := Request(resource, auth, "DELETE", nil, headers...)
@@ -130,17 +336,20 @@ func Delete(resource string, auth *Auth, headers ...Header) error {
 // IDPath computes the resource path for an item by ID
 func IDPath(id string) string {
 	if id == "root" {
-		return "/me/drive/root"
+		return rootPath
 	}
-	return "/me/drive/items/" + url.PathEscape(id)
+	if driveID := RemoteDrive(id); driveID != "" {
+		return remoteIDPath(driveID, id)
+	}
+	return drivePath + "/items/" + url.PathEscape(id)
 }
 
 // ResourcePath translates an item's path to the proper path used by Graph
 func ResourcePath(path string) string {
 	if path == "/" {
-		return "/me/drive/root"
+		return rootPath
 	}
-	return "/me/drive/root:" + url.PathEscape(path)
+	return rootPath + ":" + url.PathEscape(path)
 }
 
 // ChildrenPath returns the path to an item's children
@@ -153,7 +362,7 @@ func childrenPath(path string) string {
 
 // ChildrenPathID returns the API resource path of an item's children
 func childrenPathID(id string) string {
-	return fmt.Sprintf("/me/drive/items/%s/children", url.PathEscape(id))
+	return IDPath(id) + "/children"
 }
 
 // User represents the user. Currently only used to fetch the account email so
@@ -194,7 +403,7 @@ type Drive struct {
 
 // GetDrive is used to fetch the details of the user's OneDrive.
 func GetDrive(auth *Auth) (Drive, error) {
-	resp, err := Get("/me/drive", auth)
+	resp, err := Get(drivePath, auth)
 	drive := Drive{}
 	if err != nil {
 		return drive, err
@@ -212,3 +421,14 @@ func IsOffline(err error) bool {
 	rexp := regexp.MustCompile("HTTP [0-9]+ - ")
 	return !rexp.MatchString(err.Error())
 }
+
+// IsTransient checks if an error from Request() was caused by a problem on the
+// server's end that will probably go away if we try again later, like being
+// throttled or the service being unavailable.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	rexp := regexp.MustCompile("^HTTP (429|5[0-9][0-9]) - ")
+	return rexp.MatchString(err.Error())
+}
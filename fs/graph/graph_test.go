@@ -1,10 +1,15 @@
 package graph
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestResourcePath(t *testing.T) {
@@ -26,3 +31,54 @@ func TestRequestUnauthenticated(t *testing.T) {
 	_, err := Get("/me/drive/root", badAuth)
 	assert.Error(t, err, "An unauthenticated request was not handled as an error")
 }
+
+// Our transport should negotiate HTTP/2 with servers that support it.
+func TestTransportHTTP2(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	// trust the stub server's self-signed certificate
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	tr := newTransport()
+	tr.TLSClientConfig = &tls.Config{RootCAs: pool}
+	client := &http.Client{Transport: tr, Timeout: requestTimeout}
+
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 2, resp.ProtoMajor, "HTTP/2 was not negotiated.")
+}
+
+// Requests should go to the configured endpoint with the configured User-Agent.
+func TestCustomEndpointAndUserAgent(t *testing.T) {
+	var agent, path string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			agent, path = r.UserAgent(), r.URL.Path
+			w.Write([]byte(`{"id": "root"}`))
+		},
+	))
+	defer server.Close()
+	defer SetGraphURL("")
+	defer SetUserAgent("")
+	SetGraphURL(server.URL + "/v1.0/")
+	SetUserAgent("ISV|onedriver|test")
+	assert.Equal(t, server.URL+"/v1.0", Endpoint())
+
+	auth := &Auth{AccessToken: "token", ExpiresAt: time.Now().Unix() + 3600}
+	_, err := Get("/me/drive/root", auth)
+	require.NoError(t, err)
+	assert.Equal(t, "/v1.0/me/drive/root", path)
+	assert.Equal(t, "ISV|onedriver|test", agent)
+
+	SetGraphURL("")
+	assert.Equal(t, GraphURL, Endpoint())
+}
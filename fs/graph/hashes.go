@@ -65,6 +65,21 @@ func (d *DriveItem) VerifyChecksum(checksum string) bool {
 	return strings.EqualFold(d.File.Hashes.QuickXorHash, checksum)
 }
 
+// VerifyContent hashes a stream and checks it against the item's QuickXorHash,
+// or its SHA1 hash if the server only sent that (older personal drives).
+func (d *DriveItem) VerifyContent(reader io.ReadSeeker) bool {
+	if d.File == nil {
+		return false
+	}
+	if d.File.Hashes.QuickXorHash != "" {
+		return d.VerifyChecksum(QuickXORHashStream(reader))
+	}
+	if d.File.Hashes.SHA1Hash != "" {
+		return strings.EqualFold(d.File.Hashes.SHA1Hash, SHA1HashStream(reader))
+	}
+	return false
+}
+
 // ETagIsMatch returns true if the etag matches the one in the DriveItem
 func (d *DriveItem) ETagIsMatch(etag string) bool {
 	return d.ETag != "" && d.ETag == etag
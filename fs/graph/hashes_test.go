@@ -81,3 +81,22 @@ func TestHashSeekPosition(t *testing.T) {
 	assert.Equal(t, SHA1Hash(&content), SHA1HashStream(tmp))
 	assert.Equal(t, SHA256Hash(&content), SHA256HashStream(tmp))
 }
+
+// Content should be checked against the QuickXorHash when there is one, and the
+// SHA1 hash otherwise.
+func TestVerifyContent(t *testing.T) {
+	content := []byte("this is some text to hash")
+	truncated := content[:10]
+
+	item := DriveItem{File: &File{Hashes: Hashes{QuickXorHash: QuickXORHash(&content)}}}
+	assert.True(t, item.VerifyContent(bytes.NewReader(content)))
+	assert.False(t, item.VerifyContent(bytes.NewReader(truncated)))
+
+	item = DriveItem{File: &File{Hashes: Hashes{SHA1Hash: SHA1Hash(&content)}}}
+	assert.True(t, item.VerifyContent(bytes.NewReader(content)))
+	assert.False(t, item.VerifyContent(bytes.NewReader(truncated)))
+
+	item = DriveItem{File: &File{}}
+	assert.False(t, item.VerifyContent(bytes.NewReader(content)), "Nothing to check against.")
+	assert.False(t, (&DriveItem{}).VerifyContent(bytes.NewReader(content)))
+}
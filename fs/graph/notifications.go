@@ -0,0 +1,186 @@
+package graph
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OneDrive can push a notification over socket.io whenever something on the
+// drive changes. Only what's needed to receive those notifications is
+// implemented here, using socket.io's long-polling transport (Engine.IO
+// version 4) so that plain HTTP requests are enough.
+
+const subscribeChangesLink = "/me/drive/root/subscriptions/socketIo"
+
+// how long to wait on the notification server before it has told us how often
+// it pings
+const notificationTimeout = 60 * time.Second
+
+// the separator between packets in a long-polling response
+const engineIOSeparator = "\x1e"
+
+// ErrNotificationsClosed is returned when the notification server ends the
+// connection on its end.
+var ErrNotificationsClosed = errors.New("notification server closed the connection")
+
+type socketIOSubscription struct {
+	NotificationURL string `json:"notificationUrl"`
+}
+
+// engineIOOpen is the first thing a server sends on a new connection.
+type engineIOOpen struct {
+	SID          string `json:"sid"`
+	PingInterval int    `json:"pingInterval"` // milliseconds
+	PingTimeout  int    `json:"pingTimeout"`  // milliseconds
+}
+
+// engineIOSession is a long-polling connection to a socket.io server.
+type engineIOSession struct {
+	client    *http.Client
+	endpoint  string // the url to poll, without the session id
+	namespace string // the socket.io namespace notifications are sent to
+	sid       string
+}
+
+// ListenForChanges calls notify every time OneDrive says something changed on
+// the drive. It blocks until the connection to the notification server is
+// lost, and always returns why.
+func ListenForChanges(auth *Auth, notify func()) error {
+	resp, err := Get(subscribeChangesLink, auth)
+	if err != nil {
+		return err
+	}
+	subscription := socketIOSubscription{}
+	if err = json.Unmarshal(resp, &subscription); err != nil {
+		return err
+	}
+	if subscription.NotificationURL == "" {
+		return errors.New("subscription did not include a notification url")
+	}
+	session, err := openEngineIO(subscription.NotificationURL)
+	if err != nil {
+		return err
+	}
+	return session.listen(notify)
+}
+
+// openEngineIO connects to the socket.io server at a notification url. The
+// url's path is the namespace to join, not where the server lives.
+func openEngineIO(notificationURL string) (*engineIOSession, error) {
+	u, err := url.Parse(notificationURL)
+	if err != nil {
+		return nil, err
+	}
+	session := &engineIOSession{
+		client:    NewClient(notificationTimeout),
+		namespace: strings.TrimSuffix(u.Path, "/"),
+	}
+	query := u.Query()
+	query.Set("EIO", "4")
+	query.Set("transport", "polling")
+	u.Path = "/socket.io/"
+	u.RawQuery = query.Encode()
+	session.endpoint = u.String()
+
+	packets, err := session.poll()
+	if err != nil {
+		return nil, err
+	}
+	if len(packets) == 0 || !strings.HasPrefix(packets[0], "0") {
+		return nil, fmt.Errorf("unexpected handshake from notification server: %q", packets)
+	}
+	open := engineIOOpen{}
+	if err = json.Unmarshal([]byte(packets[0][1:]), &open); err != nil {
+		return nil, fmt.Errorf("could not parse handshake from notification server: %w", err)
+	}
+	session.sid = open.SID
+	if open.PingInterval > 0 {
+		// the server pings us at least this often, anything longer means the
+		// connection is gone
+		session.client = NewClient(
+			time.Duration(open.PingInterval+open.PingTimeout) * time.Millisecond)
+	}
+
+	connect := "40"
+	if session.namespace != "" {
+		connect += session.namespace + ","
+	}
+	if err = session.send(connect); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// listen waits for events until the connection fails, calling notify for each.
+func (s *engineIOSession) listen(notify func()) error {
+	for {
+		packets, err := s.poll()
+		if err != nil {
+			return err
+		}
+		for _, packet := range packets {
+			switch {
+			case packet == "1":
+				return ErrNotificationsClosed
+			case packet == "2":
+				// the server wants a pong, or it drops us
+				if err := s.send("3"); err != nil {
+					return err
+				}
+			case strings.HasPrefix(packet, "41"):
+				return ErrNotificationsClosed
+			case strings.HasPrefix(packet, "42"):
+				// the only events sent are notifications, and they don't say what
+				// changed anyways
+				notify()
+			case strings.HasPrefix(packet, "44"):
+				return fmt.Errorf("could not subscribe to notifications: %s", packet[2:])
+			}
+		}
+	}
+}
+
+// url is the session's endpoint, including the session id once there is one.
+func (s *engineIOSession) url() string {
+	if s.sid == "" {
+		return s.endpoint
+	}
+	return s.endpoint + "&sid=" + url.QueryEscape(s.sid)
+}
+
+// poll waits for the next packets from the server.
+func (s *engineIOSession) poll() ([]string, error) {
+	resp, err := s.client.Get(s.url())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("notification server returned %s: %s", resp.Status, body)
+	}
+	return strings.Split(string(body), engineIOSeparator), nil
+}
+
+// send sends a packet to the server.
+func (s *engineIOSession) send(packet string) error {
+	resp, err := s.client.Post(s.url(), "text/plain;charset=UTF-8", strings.NewReader(packet))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("notification server returned %s: %s", resp.Status, body)
+	}
+	return nil
+}
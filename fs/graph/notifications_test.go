@@ -0,0 +1,61 @@
+package graph
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// We should be able to join the notification channel over long-polling, answer
+// pings, and get told about notifications until the server hangs up.
+func TestEngineIOListen(t *testing.T) {
+	t.Parallel()
+	var m sync.Mutex
+	sent := make([]string, 0)
+	polls := []string{
+		"40/callback,{\"sid\":\"namespace-sid\"}" + engineIOSeparator + "2",
+		"42/callback,[\"notification\",{\"clientState\":null}]",
+		"1",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		assert.Equal(t, "/socket.io/", r.URL.Path)
+		assert.Equal(t, "secret", r.URL.Query().Get("token"),
+			"The notification url's query should be kept.")
+		assert.Equal(t, "polling", r.URL.Query().Get("transport"))
+		sid := r.URL.Query().Get("sid")
+		switch {
+		case sid == "":
+			w.Write([]byte(`0{"sid":"session","pingInterval":25000,"pingTimeout":20000}`))
+		case r.Method == "POST":
+			assert.Equal(t, "session", sid)
+			body, _ := ioutil.ReadAll(r.Body)
+			sent = append(sent, string(body))
+			w.Write([]byte("ok"))
+		default:
+			assert.Equal(t, "session", sid)
+			require.NotEmpty(t, polls, "Kept polling after the server closed the connection.")
+			w.Write([]byte(polls[0]))
+			polls = polls[1:]
+		}
+	}))
+	defer server.Close()
+
+	session, err := openEngineIO(server.URL + "/callback?token=secret")
+	require.NoError(t, err)
+	notifications := 0
+	err = session.listen(func() { notifications++ })
+	assert.Equal(t, ErrNotificationsClosed, err)
+	assert.Equal(t, 1, notifications)
+
+	m.Lock()
+	defer m.Unlock()
+	assert.Equal(t, []string{"40/callback,", "3"}, sent,
+		"Should have joined the url's namespace and answered the ping.")
+}
@@ -5,11 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	"net/url"
 	"os"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/imdario/mergo"
@@ -25,6 +25,14 @@ const (
 	authRedirectURL = "https://login.live.com/oauth20_desktop.srf"
 )
 
+// these environment variables take precedence over the config file, so that
+// credentials can be supplied without ever writing them to disk
+const (
+	EnvClientID     = "ONEDRIVER_CLIENT_ID"
+	EnvClientSecret = "ONEDRIVER_CLIENT_SECRET"
+	EnvRefreshToken = "ONEDRIVER_REFRESH_TOKEN"
+)
+
 func (a *AuthConfig) applyDefaults() error {
 	return mergo.Merge(a, AuthConfig{
 		ClientID:    authClientID,
@@ -34,12 +42,35 @@ func (a *AuthConfig) applyDefaults() error {
 	})
 }
 
+// applyEnv overrides the config with any values set through environment
+// variables.
+func (a *AuthConfig) applyEnv() {
+	if clientID := os.Getenv(EnvClientID); clientID != "" {
+		a.ClientID = clientID
+	}
+	if secret := os.Getenv(EnvClientSecret); secret != "" {
+		a.ClientSecret = secret
+	}
+}
+
+// clientSecretParam returns the form parameter for the client secret, if one
+// was configured.
+func (a AuthConfig) clientSecretParam() string {
+	if a.ClientSecret == "" {
+		return ""
+	}
+	return "&client_secret=" + url.QueryEscape(a.ClientSecret)
+}
+
 // AuthConfig configures the authentication flow
 type AuthConfig struct {
 	ClientID    string `json:"clientID" yaml:"clientID"`
 	CodeURL     string `json:"codeURL" yaml:"codeURL"`
 	TokenURL    string `json:"tokenURL" yaml:"tokenURL"`
 	RedirectURL string `json:"redirectURL" yaml:"redirectURL"`
+	// ClientSecret is only needed for app registrations that require one. It can
+	// only be set through the environment and is never saved to disk.
+	ClientSecret string `json:"-" yaml:"-"`
 }
 
 // Auth represents a set of oauth2 authentication tokens
@@ -51,6 +82,49 @@ type Auth struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
 	path         string // auth tokens remember their path for use by Refresh()
+	// set to 1 when the server will no longer give us tokens until the user
+	// signs in again, so we stop asking. Accessed atomically.
+	reauthRequired uint32
+	requests       uint32 // number of API requests made with this auth
+	// limits shared by every upload and every download of file content made
+	// with this auth, so each mount has its own. Use limiters().
+	uploadLimiter   *RateLimiter
+	downloadLimiter *RateLimiter
+}
+
+// ErrReauthRequired is returned for requests made after the user's access was
+// revoked. It is deliberately formatted like an HTTP error so that it is not
+// mistaken for being offline.
+var ErrReauthRequired = errors.New("HTTP 401 - reauthRequired: access was revoked, " +
+	"re-authenticate with \"onedriver --auth-only\"")
+
+// reauthErrors are the errors from the token endpoint that mean retrying will
+// never succeed: consent was revoked, the account was disabled or locked, or
+// the refresh token is otherwise no longer valid.
+var reauthErrors = map[string]bool{
+	"invalid_grant":        true,
+	"interaction_required": true,
+	"consent_required":     true,
+	"unauthorized_client":  true,
+}
+
+// ReauthRequired returns true if the user has to sign in again before any more
+// requests can be made.
+func (a *Auth) ReauthRequired() bool {
+	return atomic.LoadUint32(&a.reauthRequired) == 1
+}
+
+func (a *Auth) setReauthRequired(required bool) {
+	var value uint32
+	if required {
+		value = 1
+	}
+	atomic.StoreUint32(&a.reauthRequired, value)
+}
+
+// Requests returns how many API requests have been made with this auth.
+func (a *Auth) Requests() uint32 {
+	return atomic.LoadUint32(&a.requests)
 }
 
 // AuthError is an authentication error from the Microsoft API. Generally we don't see
@@ -80,22 +154,35 @@ func (a *Auth) FromFile(file string) error {
 		return err
 	}
 	a.path = file
+	oldToken := a.RefreshToken
 	err = json.Unmarshal(contents, a)
 	if err != nil {
 		return err
 	}
+	if a.RefreshToken != "" && a.RefreshToken != oldToken {
+		// the user signed in again, the new tokens are worth trying
+		a.setReauthRequired(false)
+	}
 	return a.applyDefaults()
 }
 
 // Refresh auth tokens if expired.
 func (a *Auth) Refresh() {
+	if a.ReauthRequired() {
+		// nothing to do until the user signs in again with --auth-only, which
+		// saves new tokens to our file
+		if a.path == "" || a.FromFile(a.path) != nil || a.ReauthRequired() {
+			return
+		}
+	}
 	if a.ExpiresAt <= time.Now().Unix() {
 		oldTime := a.ExpiresAt
 		postData := strings.NewReader("client_id=" + a.ClientID +
 			"&redirect_uri=" + a.RedirectURL +
 			"&refresh_token=" + a.RefreshToken +
-			"&grant_type=refresh_token")
-		resp, err := http.Post(a.TokenURL,
+			"&grant_type=refresh_token" +
+			a.clientSecretParam())
+		resp, err := client.Post(a.TokenURL,
 			"application/x-www-form-urlencoded",
 			postData)
 
@@ -114,6 +201,18 @@ func (a *Auth) Refresh() {
 		defer resp.Body.Close()
 
 		body, _ := ioutil.ReadAll(resp.Body)
+		var authErr AuthError
+		if json.Unmarshal(body, &authErr) == nil && reauthErrors[authErr.Error] {
+			log.Error().
+				Str("error", authErr.Error).
+				Str("errorDescription", authErr.ErrorDescription).
+				Int("http_code", resp.StatusCode).
+				Msg("Access to this account was revoked, or the account is disabled or " +
+					"locked. Re-authentication is required, please run " +
+					"\"onedriver --auth-only\".")
+			a.setReauthRequired(true)
+			return
+		}
 		json.Unmarshal(body, &a)
 		if a.ExpiresAt == oldTime {
 			a.ExpiresAt = time.Now().Unix() + a.ExpiresIn
@@ -172,8 +271,9 @@ func getAuthTokens(a AuthConfig, authCode string) *Auth {
 	postData := strings.NewReader("client_id=" + a.ClientID +
 		"&redirect_uri=" + a.RedirectURL +
 		"&code=" + authCode +
-		"&grant_type=authorization_code")
-	resp, err := http.Post(a.TokenURL,
+		"&grant_type=authorization_code" +
+		a.clientSecretParam())
+	resp, err := client.Post(a.TokenURL,
 		"application/x-www-form-urlencoded",
 		postData)
 	if err != nil {
@@ -242,16 +342,27 @@ func newAuth(config AuthConfig, path string, headless bool) *Auth {
 
 // Authenticate performs authentication to Graph or load auth/refreshes it
 // from an existing file. If headless is true, we will authenticate in the
-// terminal.
+// terminal. Values set through the environment take precedence over the config,
+// which takes precedence over the defaults.
 func Authenticate(config AuthConfig, path string, headless bool) *Auth {
+	config.applyEnv()
 	auth := &Auth{}
 	_, err := os.Stat(path)
 	if os.IsNotExist(err) {
+		if refreshToken := os.Getenv(EnvRefreshToken); refreshToken != "" {
+			// a pre-obtained refresh token lets us skip the interactive flow
+			log.Info().Msg("Using refresh token from environment.")
+			config.applyDefaults()
+			auth = &Auth{AuthConfig: config, RefreshToken: refreshToken, path: path}
+			auth.Refresh()
+			return auth
+		}
 		// no tokens found, gotta start oauth flow from beginning
 		auth = newAuth(config, path, headless)
 	} else {
 		// we already have tokens, no need to force a new auth flow
 		auth.FromFile(path)
+		auth.AuthConfig.applyEnv()
 		auth.Refresh()
 	}
 	return auth
@@ -1,6 +1,11 @@
 package graph
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -59,3 +64,83 @@ func TestAuthConfigMerge(t *testing.T) {
 	assert.Equal(t, "test", testConfig.RedirectURL)
 	assert.Equal(t, authClientID, testConfig.ClientID)
 }
+
+// Credentials from the environment should be used over the ones in the config.
+func TestAuthEnv(t *testing.T) {
+	t.Setenv(EnvClientID, "env-client-id")
+	t.Setenv(EnvClientSecret, "env-client-secret")
+	t.Setenv(EnvRefreshToken, "env-refresh-token")
+
+	var form map[string]string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			form = map[string]string{
+				"client_id":     r.PostForm.Get("client_id"),
+				"client_secret": r.PostForm.Get("client_secret"),
+				"refresh_token": r.PostForm.Get("refresh_token"),
+			}
+			fmt.Fprint(w, `{"access_token":"new-access","refresh_token":"new-refresh","expires_in":3600}`)
+		},
+	))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "auth_tokens.json")
+	auth := Authenticate(
+		AuthConfig{ClientID: "config-client-id", TokenURL: server.URL},
+		path,
+		true,
+	)
+	assert.Equal(t, "env-client-id", form["client_id"], "Client ID from config was used.")
+	assert.Equal(t, "env-client-secret", form["client_secret"])
+	assert.Equal(t, "env-refresh-token", form["refresh_token"])
+	assert.Equal(t, "new-access", auth.AccessToken)
+	assert.Equal(t, authRedirectURL, auth.RedirectURL, "Defaults were not applied.")
+
+	// the secret should never end up on disk
+	saved := Auth{}
+	require.NoError(t, saved.FromFile(path))
+	assert.Equal(t, "new-refresh", saved.RefreshToken)
+	assert.Empty(t, saved.ClientSecret, "Client secret was written to disk.")
+}
+
+// When access is revoked, we should stop trying to refresh our tokens and
+// report that the user has to sign in again instead of acting like we're offline.
+func TestAuthRevoked(t *testing.T) {
+	t.Parallel()
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant","error_description":"AADSTS65001: consent revoked"}`)
+		},
+	))
+	defer server.Close()
+
+	auth := &Auth{
+		AuthConfig:   AuthConfig{TokenURL: server.URL},
+		AccessToken:  "old-access",
+		RefreshToken: "old-refresh",
+		path:         filepath.Join(t.TempDir(), "auth_tokens.json"),
+	}
+	auth.Refresh()
+	require.True(t, auth.ReauthRequired(), "Revoked access was not detected.")
+
+	auth.Refresh()
+	_, err := Get("/me", auth)
+	assert.Equal(t, 1, requests, "Kept retrying after access was revoked.")
+	assert.True(t, errors.Is(err, ErrReauthRequired))
+	assert.False(t, IsOffline(err), "Revoked access was treated as being offline.")
+
+	// signing in again with --auth-only saves new tokens to the same file
+	signedIn := *auth
+	signedIn.AccessToken = "new-access"
+	signedIn.RefreshToken = "new-refresh"
+	signedIn.ExpiresAt = time.Now().Add(time.Hour).Unix()
+	require.NoError(t, signedIn.ToFile(auth.path))
+	auth.Refresh()
+	assert.False(t, auth.ReauthRequired(), "New tokens were not picked up.")
+	assert.Equal(t, "new-access", auth.AccessToken)
+	assert.Equal(t, 1, requests, "Tokens were renewed even though they had not expired.")
+}
@@ -0,0 +1,49 @@
+package graph
+
+import (
+	"net/url"
+	"sync"
+)
+
+// RemoteItem is the item a shortcut points to. It usually lives on someone
+// else's drive.
+// https://docs.microsoft.com/en-us/onedrive/developer/rest-api/resources/remoteitem
+type RemoteItem struct {
+	ID     string           `json:"id,omitempty"`
+	Name   string           `json:"name,omitempty"`
+	Size   uint64           `json:"size,omitempty"`
+	WebURL string           `json:"webUrl,omitempty"`
+	Parent *DriveItemParent `json:"parentReference,omitempty"`
+	Folder *Folder          `json:"folder,omitempty"`
+	File   *File            `json:"file,omitempty"`
+}
+
+// remoteDrives maps the IDs of items that live on other drives to the ID of
+// their drive. Items on other drives can't be found through our own drive, so
+// requests for them have to go to their drive directly.
+var remoteDrives sync.Map
+
+// AddRemoteItem records that an item lives on another drive, requests for it
+// will be sent there from now on.
+func AddRemoteItem(id string, driveID string) {
+	remoteDrives.Store(id, driveID)
+}
+
+// RemoveRemoteItem records that an item no longer lives on another drive.
+func RemoveRemoteItem(id string) {
+	remoteDrives.Delete(id)
+}
+
+// RemoteDrive returns the ID of the drive an item added with AddRemoteItem
+// lives on, or "" if it is on our own drive.
+func RemoteDrive(id string) string {
+	if driveID, exists := remoteDrives.Load(id); exists {
+		return driveID.(string)
+	}
+	return ""
+}
+
+// remoteIDPath is IDPath for items on another drive.
+func remoteIDPath(driveID string, id string) string {
+	return "/drives/" + url.PathEscape(driveID) + "/items/" + url.PathEscape(id)
+}
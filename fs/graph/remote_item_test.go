@@ -0,0 +1,47 @@
+package graph
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Children and content of items on another drive should be fetched from that
+// drive, not ours. Not parallel, since this changes where every request is sent.
+func TestRemoteItemRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/drives/other-drive/items/remote-folder/children":
+				w.Write([]byte(`{"value": [{"id": "remote-file", "name": "inside.txt", "file": {}}]}`))
+			case "/drives/other-drive/items/remote-file":
+				w.Write([]byte(`{"id": "remote-file", "name": "inside.txt", "size": 20, "file": {}}`))
+			case "/drives/other-drive/items/remote-file/content":
+				w.Write([]byte("from the other drive"))
+			default:
+				http.NotFound(w, r)
+			}
+		},
+	))
+	defer server.Close()
+	defer SetGraphURL("")
+	SetGraphURL(server.URL)
+	AddRemoteItem("remote-folder", "other-drive")
+	AddRemoteItem("remote-file", "other-drive")
+	defer RemoveRemoteItem("remote-folder")
+	defer RemoveRemoteItem("remote-file")
+	auth := &Auth{AccessToken: "token", ExpiresAt: time.Now().Unix() + 3600}
+
+	children, err := GetItemChildren("remote-folder", auth)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	assert.Equal(t, "inside.txt", children[0].Name)
+
+	content, _, err := GetItemContent("remote-file", auth)
+	require.NoError(t, err)
+	assert.Equal(t, "from the other drive", string(content))
+}
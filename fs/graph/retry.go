@@ -0,0 +1,108 @@
+package graph
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultRetries is how many times a failed request is tried again, unless
+// changed with SetRetries.
+const DefaultRetries = 3
+
+// the longest we wait when the server tells us when to come back, anything
+// longer fails right away instead of hanging whoever is waiting on us
+const maxRetryAfter = time.Minute
+
+var (
+	// how many times failed requests are tried again
+	maxRetries = DefaultRetries
+	// how long to wait before the first retry, doubled for every one after
+	retryBaseDelay = time.Second
+)
+
+// SetRetries changes how many times a failed request is tried again. 0 turns
+// retries off. Only meant to be called before any requests are made.
+func SetRetries(retries int) {
+	if retries < 0 {
+		retries = 0
+	}
+	maxRetries = retries
+}
+
+// retryDelay decides if a request should be tried again after it failed for the
+// attempt-th time, and how long to wait before doing so. Requests that could
+// have changed something on the server are only repeated when the server says
+// it did not get to them.
+func retryDelay(method string, response *http.Response, err error, attempt int) (time.Duration, bool) {
+	if attempt > maxRetries {
+		return 0, false
+	}
+	backoff := retryBaseDelay << uint(attempt-1)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			// it already took as long as a request is allowed to
+			return 0, false
+		}
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			// we're offline, trying again won't change that
+			return 0, false
+		}
+		return backoff, idempotent(method)
+	}
+
+	switch {
+	case response.StatusCode == http.StatusTooManyRequests ||
+		response.StatusCode == http.StatusServiceUnavailable:
+		// throttled, the server did nothing and may say when to come back
+		wait, ok := retryAfter(response.Header.Get("Retry-After"))
+		if !ok {
+			return backoff, true
+		}
+		return wait, wait <= maxRetryAfter
+	case response.StatusCode >= 500:
+		// anything else still gets a single retry, the API has its hiccups
+		return backoff, idempotent(method) || attempt == 1
+	}
+	return 0, false
+}
+
+// idempotent returns true if sending a request twice does the same as sending
+// it once.
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// ParseRetryAfter returns how long a Retry-After header asks us to wait, 0 if
+// it is missing or can't be parsed.
+func ParseRetryAfter(header string) time.Duration {
+	wait, _ := retryAfter(header)
+	return wait
+}
+
+// retryAfter parses a Retry-After header, which is either a number of seconds or
+// a date.
+func retryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		wait := time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
@@ -0,0 +1,114 @@
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// retryServer answers every request with the next status in statuses, and 200
+// once it runs out. It records the bodies it was sent.
+func retryServer(header http.Header, statuses ...int) (*httptest.Server, *[]string) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+			if len(bodies) <= len(statuses) {
+				for key, values := range header {
+					w.Header()[key] = values
+				}
+				w.WriteHeader(statuses[len(bodies)-1])
+				return
+			}
+			w.Write([]byte(`{"id": "item"}`))
+		},
+	))
+	return server, &bodies
+}
+
+// useServer sends requests to a test server with fast retries until the test is
+// over. Tests using it cannot be parallel.
+func useServer(t *testing.T, server *httptest.Server) *Auth {
+	oldGraphURL, oldDelay := graphURL, retryBaseDelay
+	t.Cleanup(func() {
+		server.Close()
+		graphURL, retryBaseDelay = oldGraphURL, oldDelay
+		SetRetries(DefaultRetries)
+	})
+	graphURL = server.URL
+	retryBaseDelay = time.Millisecond
+	return &Auth{AccessToken: "token", ExpiresAt: time.Now().Unix() + 3600}
+}
+
+// Throttled requests should wait as long as the server asks before being sent
+// again, with the same body.
+func TestRetryThrottled(t *testing.T) {
+	server, bodies := retryServer(http.Header{"Retry-After": {"1"}},
+		http.StatusTooManyRequests, http.StatusServiceUnavailable)
+	auth := useServer(t, server)
+
+	start := time.Now()
+	_, err := Patch("/me/drive/items/item", auth, strings.NewReader(`{"name": "renamed"}`))
+	require.NoError(t, err)
+	assert.True(t, time.Since(start) >= 2*time.Second, "Retry-After was not honored.")
+	assert.Equal(t, []string{`{"name": "renamed"}`, `{"name": "renamed"}`, `{"name": "renamed"}`},
+		*bodies, "Body was not sent again.")
+}
+
+// Server errors should only be retried over and over for requests that can be
+// safely repeated, and not forever.
+func TestRetryServerError(t *testing.T) {
+	server, bodies := retryServer(nil, 500, 502, 504, 500, 500)
+	auth := useServer(t, server)
+
+	_, err := Get("/me/drive/items/item", auth)
+	assert.Error(t, err, "Retries did not stop.")
+	assert.Len(t, *bodies, 1+DefaultRetries)
+
+	*bodies = nil
+	_, err = Post("/me/drive/items/item/children", auth, strings.NewReader("{}"))
+	assert.Error(t, err)
+	assert.Len(t, *bodies, 2, "A POST was repeated more than once.")
+
+	*bodies = nil
+	SetRetries(0)
+	_, err = Get("/me/drive/items/item", auth)
+	assert.Error(t, err)
+	assert.Len(t, *bodies, 1, "Retries were not turned off.")
+}
+
+// A Retry-After that is too far off should fail right away, leaving it up to the
+// caller to back off for as long as the server asked.
+func TestRetryAfterTooLong(t *testing.T) {
+	server, bodies := retryServer(http.Header{"Retry-After": {"3600"}}, http.StatusTooManyRequests)
+	auth := useServer(t, server)
+
+	_, err := Get("/me/drive/items/item", auth)
+	assert.Error(t, err)
+	assert.True(t, IsTransient(err))
+	assert.False(t, IsOffline(err))
+	assert.Len(t, *bodies, 1)
+	assert.Equal(t, http.StatusTooManyRequests, StatusCode(fmt.Errorf("wrapped: %w", err)))
+	assert.Equal(t, time.Hour, RetryAfter(fmt.Errorf("wrapped: %w", err)))
+
+	assert.Equal(t, 0, StatusCode(errors.New("dial tcp: no such host")))
+	assert.Zero(t, RetryAfter(errors.New("dial tcp: no such host")))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, 30*time.Second, ParseRetryAfter("30"))
+	assert.Equal(t, time.Duration(0), ParseRetryAfter(""))
+	assert.Equal(t, time.Duration(0), ParseRetryAfter("soon"))
+	wait := ParseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	assert.True(t, wait > 59*time.Minute && wait <= time.Hour, "Date was not parsed: %s", wait)
+}
@@ -0,0 +1,75 @@
+package graph
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// All requests are made relative to these paths. By default this is the
+// signed-in user's own drive, but they point at a shared item's drive instead
+// when mounting a single shared folder with UseSharedItem().
+var (
+	drivePath = "/me/drive"
+	rootPath  = "/me/drive/root"
+)
+
+// sharePermission is used to check what a sharing link allows us to do
+// https://docs.microsoft.com/en-us/graph/api/resources/permission
+type sharePermission struct {
+	Roles []string `json:"roles"`
+}
+
+// EncodeShareURL converts a sharing link to the sharing token format used by
+// the shares API.
+// https://docs.microsoft.com/en-us/graph/api/shares-get#encoding-sharing-urls
+func EncodeShareURL(link string) string {
+	encoded := base64.URLEncoding.EncodeToString([]byte(link))
+	return "u!" + strings.TrimRight(encoded, "=")
+}
+
+// GetSharedItem resolves a sharing link to the item it points to. writable is
+// true if the link allows changes to the item.
+func GetSharedItem(link string, auth *Auth) (item *DriveItem, writable bool, err error) {
+	sharePath := "/shares/" + EncodeShareURL(link)
+	if item, err = getItem(sharePath+"/driveItem", auth); err != nil {
+		return nil, false, err
+	}
+	if item.Parent == nil || item.Parent.DriveID == "" {
+		return nil, false, errors.New("shared item did not say which drive it is on")
+	}
+
+	resp, err := Get(sharePath+"/permission", auth)
+	if err != nil {
+		return nil, false, err
+	}
+	permission := sharePermission{}
+	if err = json.Unmarshal(resp, &permission); err != nil {
+		return nil, false, err
+	}
+	for _, role := range permission.Roles {
+		writable = writable || role == "write" || role == "owner"
+	}
+	return item, writable, nil
+}
+
+// UseSharedItem makes a shared item the root of all subsequent requests instead
+// of the signed-in user's own drive.
+func UseSharedItem(item *DriveItem) {
+	drivePath = "/drives/" + item.Parent.DriveID
+	rootPath = IDPath(item.ID)
+}
+
+// UsingSharedItem returns true if requests are being made against a shared item
+// instead of the user's own drive.
+func UsingSharedItem() bool {
+	return drivePath != "/me/drive"
+}
+
+// SharedWithMe lists the items other people have shared with the signed-in
+// user. The items live on other drives, their RemoteItem says where.
+// https://docs.microsoft.com/en-us/graph/api/drive-sharedwithme
+func SharedWithMe(auth *Auth) ([]*DriveItem, error) {
+	return getItemChildren("/me/drive/sharedWithMe", auth)
+}
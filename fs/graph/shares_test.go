@@ -0,0 +1,75 @@
+package graph
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Sharing links should be encoded as described in the API docs.
+func TestEncodeShareURL(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t,
+		"u!aHR0cHM6Ly9vbmVkcml2ZS5saXZlLmNvbS9yZWRpci5hc3B4P3M9YWJjMTIz",
+		EncodeShareURL("https://onedrive.live.com/redir.aspx?s=abc123"),
+	)
+}
+
+// A shared folder's contents should be listable from just its sharing link.
+// Not parallel, since this changes where every request is sent.
+func TestSharedItemChildren(t *testing.T) {
+	const link = "https://1drv.ms/f/s!shared-folder-link"
+	share := "/shares/" + EncodeShareURL(link)
+	folder := DriveItem{
+		ID:     "shared-folder",
+		Name:   "Shared with me",
+		Folder: &Folder{ChildCount: 1},
+		Parent: &DriveItemParent{DriveID: "someone-elses-drive"},
+	}
+	responses := map[string]interface{}{
+		share + "/driveItem":                              folder,
+		share + "/permission":                             sharePermission{Roles: []string{"read"}},
+		"/drives/someone-elses-drive/items/shared-folder": folder,
+		"/drives/someone-elses-drive/items/shared-folder/children": map[string]interface{}{
+			"value": []DriveItem{{ID: "shared-file", Name: "shared.txt", File: &File{}}},
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			response, exists := responses[r.URL.Path]
+			if !exists {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(response)
+		},
+	))
+	defer server.Close()
+
+	oldGraphURL, oldDrivePath, oldRootPath := graphURL, drivePath, rootPath
+	defer func() {
+		graphURL, drivePath, rootPath = oldGraphURL, oldDrivePath, oldRootPath
+	}()
+	graphURL = server.URL
+	auth := &Auth{AccessToken: "token", ExpiresAt: time.Now().Unix() + 3600}
+
+	item, writable, err := GetSharedItem(link, auth)
+	require.NoError(t, err)
+	assert.Equal(t, "shared-folder", item.ID)
+	assert.False(t, writable, "Read-only link was treated as writable.")
+
+	UseSharedItem(item)
+	assert.True(t, UsingSharedItem())
+	root, err := GetItem("root", auth)
+	require.NoError(t, err)
+	assert.Equal(t, item.ID, root.ID, "Shared folder was not used as the root.")
+	children, err := GetItemChildren(root.ID, auth)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	assert.Equal(t, "shared.txt", children[0].Name)
+}
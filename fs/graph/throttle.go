@@ -0,0 +1,117 @@
+package graph
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// the most bytes that pass through a throttled reader or writer at once, so
+// that concurrent transfers take turns instead of one hogging the limit
+const throttleChunkSize = 32 * 1024
+
+// RateLimiter is a token bucket that limits how many bytes per second are
+// transferred. Every transfer using the same RateLimiter shares its limit.
+type RateLimiter struct {
+	sync.Mutex
+	rate   float64 // bytes per second, 0 is unlimited
+	tokens float64 // can go negative when transfers wait for their turn
+	last   time.Time
+}
+
+// guards creating the limiters of an Auth
+var limitersM sync.Mutex
+
+// limiters returns the upload and download limiters of an auth, which are
+// created the first time they are needed.
+func (a *Auth) limiters() (upload *RateLimiter, download *RateLimiter) {
+	limitersM.Lock()
+	defer limitersM.Unlock()
+	if a.uploadLimiter == nil {
+		a.uploadLimiter, a.downloadLimiter = &RateLimiter{}, &RateLimiter{}
+	}
+	return a.uploadLimiter, a.downloadLimiter
+}
+
+// SetUploadLimit limits file uploads made with this auth to a number of bytes
+// per second, across all of them. 0 removes the limit.
+func (a *Auth) SetUploadLimit(bytesPerSecond uint64) {
+	upload, _ := a.limiters()
+	upload.SetRate(bytesPerSecond)
+}
+
+// SetDownloadLimit limits file downloads made with this auth to a number of
+// bytes per second, across all of them. 0 removes the limit.
+func (a *Auth) SetDownloadLimit(bytesPerSecond uint64) {
+	_, download := a.limiters()
+	download.SetRate(bytesPerSecond)
+}
+
+// ThrottleUpload limits how fast an upload's content is read to the upload limit.
+func (a *Auth) ThrottleUpload(r io.Reader) io.Reader {
+	upload, _ := a.limiters()
+	return upload.Reader(r)
+}
+
+// SetRate changes the limit, 0 removes it.
+func (l *RateLimiter) SetRate(bytesPerSecond uint64) {
+	l.Lock()
+	defer l.Unlock()
+	l.rate = float64(bytesPerSecond)
+	// start out with a full bucket
+	l.tokens = l.rate
+	l.last = time.Now()
+}
+
+// Wait blocks until n bytes may be transferred.
+func (l *RateLimiter) Wait(n int) {
+	l.Lock()
+	if l.rate <= 0 {
+		l.Unlock()
+		return
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		// don't let more than a second's worth of transfers build up
+		l.tokens = l.rate
+	}
+	l.last = now
+	// take the bytes right away and wait until the bucket would have had them,
+	// waiting transfers then get through in the order they arrived
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	rate := l.rate
+	l.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / rate * float64(time.Second)))
+	}
+}
+
+// limitedBody throttles reading a response body if there is a limiter.
+func limitedBody(body io.Reader, limiter *RateLimiter) io.Reader {
+	if limiter == nil {
+		return body
+	}
+	return limiter.Reader(body)
+}
+
+// Reader returns a reader that reads no faster than the limit.
+func (l *RateLimiter) Reader(r io.Reader) io.Reader {
+	return &throttledReader{r: r, limiter: l}
+}
+
+type throttledReader struct {
+	r       io.Reader
+	limiter *RateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunkSize {
+		p = p[:throttleChunkSize]
+	}
+	n, err := t.r.Read(p)
+	t.limiter.Wait(n)
+	return n, err
+}
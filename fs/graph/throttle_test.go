@@ -0,0 +1,67 @@
+package graph
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Concurrent transfers should share a limit instead of each getting their own.
+func TestRateLimiterShared(t *testing.T) {
+	t.Parallel()
+	limiter := &RateLimiter{}
+	limiter.SetRate(100 * 1024)
+
+	// the bucket starts out with a second's worth of bytes, so moving 300KB at
+	// 100KB/s takes at least 2 seconds
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := io.Copy(ioutil.Discard, limiter.Reader(bytes.NewReader(make([]byte, 100*1024))))
+			assert.NoError(t, err)
+			assert.EqualValues(t, 100*1024, n)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 1900*time.Millisecond,
+		"Transfers were not limited, took %s.", elapsed)
+	assert.True(t, elapsed < 4*time.Second, "Transfers were limited too much, took %s.", elapsed)
+}
+
+// A limit of 0 should not slow anything down.
+func TestRateLimiterUnlimited(t *testing.T) {
+	t.Parallel()
+	limiter := &RateLimiter{}
+	start := time.Now()
+	content, err := ioutil.ReadAll(limiter.Reader(bytes.NewReader(make([]byte, 10*1024*1024))))
+	require.NoError(t, err)
+	assert.Len(t, content, 10*1024*1024)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+// Each mount has its own auth, and a limit set for one must not slow down the
+// others.
+func TestRateLimitPerAuth(t *testing.T) {
+	t.Parallel()
+	limited, unlimited := &Auth{}, &Auth{}
+	limited.SetUploadLimit(1024)
+
+	start := time.Now()
+	content, err := ioutil.ReadAll(unlimited.ThrottleUpload(bytes.NewReader(make([]byte, 10*1024*1024))))
+	require.NoError(t, err)
+	assert.Len(t, content, 10*1024*1024)
+	assert.True(t, time.Since(start) < time.Second, "Limit of another auth was applied.")
+
+	upload, _ := limited.limiters()
+	assert.EqualValues(t, 1024, upload.rate)
+}
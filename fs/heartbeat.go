@@ -0,0 +1,166 @@
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/rs/zerolog/log"
+)
+
+// how long a heartbeat can take before the filesystem is considered hung
+const heartbeatThreshold = 30 * time.Second
+
+// HeartbeatStacksFile is where goroutine stacks are dumped when the heartbeat
+// detects a hang, relative to the cache directory.
+const HeartbeatStacksFile = "hang-stacks.txt"
+
+// heartbeat keeps track of the heartbeat probe that is currently running. Only
+// one runs at a time, a probe that is stuck is waited on instead of piling more
+// stuck probes on top of it.
+type heartbeat struct {
+	sync.Mutex
+	probe   chan error // result of the running probe, nil if none is running
+	started time.Time
+	hung    bool // the running probe was already reported as hung
+}
+
+// Heartbeat periodically stats the root and one of its children the same way
+// the kernel would, and reports it in the status when this hangs or fails. A
+// hang usually means a deadlock somewhere. Does nothing unless enabled with the
+// heartbeatSeconds option.
+func (f *Filesystem) Heartbeat() {
+	if f.opts.HeartbeatSeconds <= 0 {
+		return
+	}
+	interval := time.Duration(f.opts.HeartbeatSeconds) * time.Second
+	log.Info().Dur("interval", interval).Msg("Starting heartbeat.")
+	for {
+		f.checkHeartbeat(heartbeatThreshold)
+		time.Sleep(interval)
+	}
+}
+
+// checkHeartbeat waits up to threshold for a heartbeat probe to finish. A probe
+// still running from an earlier check is waited on instead of starting a new one.
+func (f *Filesystem) checkHeartbeat(threshold time.Duration) error {
+	f.heartbeat.Lock()
+	if f.heartbeat.probe == nil {
+		probe := make(chan error, 1)
+		go func() { probe <- f.heartbeatProbe() }()
+		f.heartbeat.probe = probe
+		f.heartbeat.started = time.Now()
+	}
+	probe, started := f.heartbeat.probe, f.heartbeat.started
+	f.heartbeat.Unlock()
+
+	wait := threshold - time.Since(started)
+	if wait < 0 {
+		wait = 0
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	var err error
+	select {
+	case err = <-probe:
+	case <-timer.C:
+		// the probe may have finished just as we ran out of patience
+		select {
+		case err = <-probe:
+		default:
+			return f.heartbeatHung(started)
+		}
+	}
+
+	f.heartbeat.Lock()
+	f.heartbeat.probe = nil
+	wasHung := f.heartbeat.hung
+	f.heartbeat.hung = false
+	f.heartbeat.Unlock()
+	if wasHung {
+		log.Warn().Dur("duration", time.Since(started)).
+			Msg("Heartbeat finished after hanging, filesystem recovered.")
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Heartbeat failed.")
+		// a deadlocked filesystem would also hang while writing the status
+		go f.reportProblem("/", "Heartbeat failed: "+err.Error())
+	}
+	return err
+}
+
+// heartbeatHung reports a heartbeat probe that is taking too long. Each hang is
+// only reported once.
+func (f *Filesystem) heartbeatHung(started time.Time) error {
+	err := fmt.Errorf("heartbeat has been hung for %s", time.Since(started).Round(time.Second))
+	f.heartbeat.Lock()
+	alreadyReported := f.heartbeat.hung
+	f.heartbeat.hung = true
+	f.heartbeat.Unlock()
+	if alreadyReported {
+		return err
+	}
+
+	log.Error().Err(err).Msg("Filesystem operations appear to be hung.")
+	if f.opts.HeartbeatDumpStacks {
+		f.dumpStacks()
+	}
+	go f.reportProblem("/", "Filesystem operations are hung, "+err.Error())
+	return err
+}
+
+// heartbeatProbe stats the root and a child of it that we already know about.
+func (f *Filesystem) heartbeatProbe() error {
+	root := f.GetID(f.root)
+	if root == nil {
+		return fmt.Errorf("root item is not in cache")
+	}
+	out := fuse.AttrOut{}
+	in := fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: root.NodeID()}}
+	if status := f.GetAttr(nil, &in, &out); status != fuse.OK {
+		return fmt.Errorf("could not stat root: %s", status)
+	}
+
+	root.RLock()
+	var childID string
+	if len(root.children) > 0 {
+		childID = root.children[0]
+	}
+	root.RUnlock()
+	if childID == "" {
+		return nil
+	}
+	child := f.GetID(childID)
+	if child == nil {
+		return nil
+	}
+	in.NodeId = child.NodeID()
+	if status := f.GetAttr(nil, &in, &out); status != fuse.OK {
+		return fmt.Errorf("could not stat %s: %s", child.Path(), status)
+	}
+	return nil
+}
+
+// dumpStacks writes the stacks of every goroutine to the cache directory for
+// debugging a hang.
+func (f *Filesystem) dumpStacks() {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	path := filepath.Join(f.cacheDir, HeartbeatStacksFile)
+	if err := ioutil.WriteFile(path, buf, 0600); err != nil {
+		log.Error().Err(err).Msg("Could not dump goroutine stacks.")
+		return
+	}
+	log.Warn().Str("path", path).Msg("Dumped goroutine stacks.")
+}
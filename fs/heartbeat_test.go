@@ -0,0 +1,42 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A filesystem op that never finishes should be reported by the heartbeat, and
+// the heartbeat should recover once the op does.
+func TestHeartbeatDetectsHang(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_heartbeat"),
+		Options{HeartbeatDumpStacks: true})
+	require.NoError(t, cache.checkHeartbeat(time.Second))
+
+	// stall anything that looks at the root
+	root := cache.GetID(cache.root)
+	root.Lock()
+	err := cache.checkHeartbeat(time.Second)
+	assert.Error(t, err, "Hung heartbeat was not detected.")
+	assert.Error(t, cache.checkHeartbeat(time.Second), "Heartbeat is still hung.")
+	root.Unlock()
+
+	assert.Eventually(t, func() bool {
+		status := cache.CurrentStatus()
+		for _, problem := range status.Problems {
+			if problem.Path == "/" {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 100*time.Millisecond, "Hang was not reported in the status.")
+	_, err = os.Stat(filepath.Join(cache.cacheDir, HeartbeatStacksFile))
+	assert.NoError(t, err, "Goroutine stacks were not dumped.")
+
+	assert.NoError(t, cache.checkHeartbeat(time.Second), "Heartbeat did not recover.")
+}
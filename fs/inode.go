@@ -3,7 +3,6 @@ package fs
 import (
 	"encoding/json"
 	"math/rand"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,20 +23,29 @@ import (
 type Inode struct {
 	sync.RWMutex
 	graph.DriveItem
-	nodeID     uint64   // filesystem node id
-	children   []string // a slice of ids, nil when uninitialized
-	hasChanges bool     // used to trigger an upload on flush
-	subdir     uint32   // used purely by NLink()
-	mode       uint32   // do not set manually
+	nodeID           uint64   // filesystem node id
+	children         []string // a slice of ids, nil when uninitialized
+	hasChanges       bool     // used to trigger an upload on flush
+	subdir           uint32   // used purely by NLink()
+	mode             uint32   // do not set manually
+	openCount        uint32   // number of open file handles, decremented by Release()
+	unlinked         bool     // unlinked while open, cleaned up on the last Release()
+	mtimeSet         bool     // modtime was set explicitly and must survive uploads
+	conflictBehavior string   // one of the Conflict* constants, "" for the default
+	durable          bool     // fsync and close wait for uploads to finish
+	keepLocal        bool     // never uploaded, only exists in our cache
 }
 
 // SerializeableInode is like a Inode, but can be serialized for local storage
 // to disk
 type SerializeableInode struct {
 	graph.DriveItem
-	Children []string
-	Subdir   uint32
-	Mode     uint32
+	Children         []string
+	Subdir           uint32
+	Mode             uint32
+	ConflictBehavior string `json:",omitempty"`
+	Durable          bool   `json:",omitempty"`
+	KeepLocal        bool   `json:",omitempty"`
 }
 
 // NewInode initializes a new Inode
@@ -55,10 +63,11 @@ func NewInode(name string, mode uint32, parent *Inode) *Inode {
 	currentTime := time.Now()
 	return &Inode{
 		DriveItem: graph.DriveItem{
-			ID:      localID(),
-			Name:    name,
-			Parent:  itemParent,
-			ModTime: &currentTime,
+			ID:         localID(),
+			Name:       name,
+			Parent:     itemParent,
+			ModTime:    &currentTime,
+			CreateTime: &currentTime,
 		},
 		children: make([]string, 0),
 		mode:     mode,
@@ -72,10 +81,13 @@ func (i *Inode) AsJSON() []byte {
 	i.RLock()
 	defer i.RUnlock()
 	data, _ := json.Marshal(SerializeableInode{
-		DriveItem: i.DriveItem,
-		Children:  i.children,
-		Subdir:    i.subdir,
-		Mode:      i.mode,
+		DriveItem:        i.DriveItem,
+		Children:         i.children,
+		Subdir:           i.subdir,
+		Mode:             i.mode,
+		ConflictBehavior: i.conflictBehavior,
+		Durable:          i.durable,
+		KeepLocal:        i.keepLocal,
 	})
 	return data
 }
@@ -89,10 +101,13 @@ func NewInodeJSON(data []byte) (*Inode, error) {
 		return nil, err
 	}
 	return &Inode{
-		DriveItem: raw.DriveItem,
-		children:  raw.Children,
-		mode:      raw.Mode,
-		subdir:    raw.Subdir,
+		DriveItem:        raw.DriveItem,
+		children:         raw.Children,
+		mode:             raw.Mode,
+		subdir:           raw.Subdir,
+		conflictBehavior: raw.ConflictBehavior,
+		durable:          raw.Durable,
+		keepLocal:        raw.KeepLocal,
 	}, nil
 }
 
@@ -212,8 +227,8 @@ func (i *Inode) HasChildren() bool {
 }
 
 // makeattr is a convenience function to create a set of filesystem attrs for
-// use with syscalls that use or modify attrs.
-func (i *Inode) makeAttr() fuse.Attr {
+// use with syscalls that use or modify attrs. Everything belongs to uid and gid.
+func (i *Inode) makeAttr(uid, gid uint32) fuse.Attr {
 	mtime := i.ModTime()
 	return fuse.Attr{
 		Ino:   i.NodeID(),
@@ -223,11 +238,7 @@ func (i *Inode) makeAttr() fuse.Attr {
 		Mtime: mtime,
 		Atime: mtime,
 		Mode:  i.Mode(),
-		// whatever user is running the filesystem is the owner
-		Owner: fuse.Owner{
-			Uid: uint32(os.Getuid()),
-			Gid: uint32(os.Getgid()),
-		},
+		Owner: fuse.Owner{Uid: uid, Gid: gid},
 	}
 }
 
@@ -242,6 +253,12 @@ func (i *Inode) Mode() uint32 {
 	i.RLock()
 	defer i.RUnlock()
 	if i.mode == 0 { // only 0 if fetched from Graph API
+		if i.DriveItem.IsShortcut() {
+			return fuse.S_IFLNK | 0777
+		}
+		if isSymlinkItem(&i.DriveItem) {
+			return fuse.S_IFLNK | 0777
+		}
 		if i.DriveItem.IsDir() {
 			return fuse.S_IFDIR | 0755
 		}
@@ -250,6 +267,17 @@ func (i *Inode) Mode() uint32 {
 	return i.mode
 }
 
+// CreateTime returns when the item was created, or the zero time if the server
+// never said.
+func (i *Inode) CreateTime() time.Time {
+	i.RLock()
+	defer i.RUnlock()
+	if i.DriveItem.CreateTime == nil {
+		return time.Time{}
+	}
+	return *i.DriveItem.CreateTime
+}
+
 // ModTime returns the Unix timestamp of last modification (to get a time.Time
 // struct, use time.Unix(int64(d.ModTime()), 0))
 func (i *Inode) ModTime() uint64 {
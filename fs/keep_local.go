@@ -0,0 +1,39 @@
+package fs
+
+import (
+	"errors"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// CreateLocalFile creates a file that only exists in our cache. It is never
+// uploaded, even after being written to, which is useful for files that only
+// make sense on this computer.
+func (f *Filesystem) CreateLocalFile(parentID string, name string, content []byte) (*Inode, error) {
+	parent := f.GetID(parentID)
+	if parent == nil {
+		return nil, errors.New("parent " + parentID + " not found in cache")
+	}
+	inode := NewInode(name, 0644|fuse.S_IFREG, parent)
+	inode.keepLocal = true
+	inode.DriveItem.Size = uint64(len(content))
+	inode.DriveItem.File = &graph.File{
+		Hashes: graph.Hashes{QuickXorHash: graph.QuickXORHash(&content)},
+	}
+	if err := f.content.Insert(inode.ID(), content); err != nil {
+		return nil, err
+	}
+	f.InsertChild(parentID, inode)
+	f.serializeID(inode.ID())
+	log.Info().Str("path", inode.Path()).Msg("Created local-only file.")
+	return inode, nil
+}
+
+// KeepLocal returns true if an item is never uploaded to the server.
+func (i *Inode) KeepLocal() bool {
+	i.RLock()
+	defer i.RUnlock()
+	return i.keepLocal
+}
@@ -0,0 +1,44 @@
+package fs
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Local-only files should be readable like any other file, but never end up on
+// the server, even after being written to.
+func TestCreateLocalFile(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_create_local_file"), Options{})
+	tests, err := cache.GetPath("/onedriver_tests", auth)
+	require.NoError(t, err)
+
+	content := []byte("[Volume Info]\nName=Work files\n")
+	inode, err := cache.CreateLocalFile(tests.ID(), "local_only.txt", content)
+	require.NoError(t, err)
+	found, err := cache.GetPath("/onedriver_tests/local_only.txt", auth)
+	require.NoError(t, err)
+	require.Equal(t, inode, found)
+	assert.Equal(t, content, *cache.getInodeContent(inode))
+
+	header := fuse.InHeader{NodeId: inode.NodeID()}
+	written := []byte("changed")
+	_, status := cache.Write(
+		context.Background().Done(),
+		&fuse.WriteIn{InHeader: header, Size: uint32(len(written))},
+		written,
+	)
+	require.Equal(t, fuse.OK, status)
+	require.Equal(t, fuse.OK, cache.Flush(nil, &fuse.FlushIn{InHeader: header}))
+	assert.False(t, cache.uploads.HasPendingUpload(inode.ID()), "Local-only file was queued for upload.")
+	assert.True(t, isLocalID(inode.ID()), "Local-only file got a server ID.")
+
+	_, err = graph.GetItemPath("/onedriver_tests/local_only.txt", auth)
+	assert.Error(t, err, "Local-only file exists on the server.")
+}
@@ -0,0 +1,80 @@
+package fs
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Some of an item's metadata only exists locally, like its UNIX mode (OneDrive
+// has no notion of these), its conflict behavior, or whether it is durable. Our
+// own metadata is the only record of these, so they have to be carried over
+// whenever an item is rebuilt from the server's copy (like after a remount).
+
+// newServerInode creates an inode for an item fetched from the server, keeping
+// any local-only metadata it had.
+func (f *Filesystem) newServerInode(item *graph.DriveItem) *Inode {
+	inode := NewInodeDriveItem(item)
+	if f.opts.PreserveModes {
+		inode.mode = remoteMode(item)
+	}
+	stored := f.storedInode(item.ID)
+	if stored == nil {
+		return inode
+	}
+	stored.RLock()
+	mode := stored.mode
+	inode.conflictBehavior = stored.conflictBehavior
+	inode.durable = stored.durable
+	stored.RUnlock()
+
+	if f.opts.PreserveModes && inode.mode != 0 {
+		// the mode stored on the server is at least as recent as ours
+		return inode
+	}
+	// a mode for the wrong type of item would be worse than no mode at all
+	expected := uint32(fuse.S_IFREG)
+	if item.IsDir() {
+		expected = fuse.S_IFDIR
+	} else if item.IsShortcut() {
+		return inode
+	}
+	if mode&syscall.S_IFMT == expected ||
+		(mode&syscall.S_IFMT == fuse.S_IFLNK && !item.IsDir()) {
+		// symlinks are regular files on the server
+		inode.mode = mode
+	}
+	return inode
+}
+
+// storedInode returns the last known local copy of an item, without loading it
+// into the cache like GetID() would. Returns nil if there isn't one.
+func (f *Filesystem) storedInode(id string) *Inode {
+	if entry, exists := f.metadata.Load(id); exists {
+		return entry.(*Inode)
+	}
+	var stored *Inode
+	f.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(bucketMetadata).Get([]byte(id)); data != nil {
+			stored, _ = NewInodeJSON(data)
+		}
+		return nil
+	})
+	return stored
+}
+
+// serializeID writes a single inode's metadata to disk right away instead of
+// waiting for the next SerializeAll(), so local-only changes are not lost if
+// onedriver is stopped before then.
+func (f *Filesystem) serializeID(id string) {
+	inode := f.GetID(id)
+	if inode == nil {
+		return
+	}
+	data := inode.AsJSON()
+	f.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMetadata).Put([]byte(id), data)
+	})
+}
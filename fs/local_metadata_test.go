@@ -0,0 +1,45 @@
+package fs
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The server does not store UNIX modes, so a script made executable should stay
+// executable after a remount because of our own metadata.
+func TestModePersistsAcrossRemount(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(TestDir, "persist_mode.sh")
+	require.NoError(t, ioutil.WriteFile(fname, []byte("#!/bin/sh\necho hi\n"), 0644))
+	require.Eventually(t, func() bool {
+		inode, _ := fs.GetPath("/onedriver_tests/persist_mode.sh", auth)
+		return inode != nil && !isLocalID(inode.ID())
+	}, retrySeconds, time.Second, "Script was never uploaded.")
+
+	dbPath := filepath.Join(testDBLoc, "test_mode_persists")
+	cache := NewFilesystem(auth, dbPath, Options{})
+	inode, err := cache.GetPath("/onedriver_tests/persist_mode.sh", auth)
+	require.NoError(t, err)
+	require.NotNil(t, inode)
+	require.Zero(t, inode.Mode()&0111, "Script should not start out executable.")
+
+	in := &fuse.SetAttrIn{}
+	in.NodeId = inode.NodeID()
+	in.Valid = fuse.FATTR_MODE
+	in.Mode = 0755
+	require.Equal(t, fuse.OK, cache.SetAttr(nil, in, &fuse.AttrOut{}))
+
+	// remount, this refetches everything below the root from the server
+	require.NoError(t, cache.db.Close())
+	cache = NewFilesystem(auth, dbPath, Options{})
+	inode, err = cache.GetPath("/onedriver_tests/persist_mode.sh", auth)
+	require.NoError(t, err)
+	require.NotNil(t, inode)
+	assert.Equal(t, uint32(fuse.S_IFREG|0755), inode.Mode(), "Mode was lost on remount.")
+}
@@ -0,0 +1,95 @@
+package fs
+
+import (
+	"syscall"
+
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ids of files with changes that are waiting for an explicit sync before they
+// are uploaded, only used with the manualSync option
+var bucketDirty = []byte("dirty")
+
+// setting this extended attribute on anything in the mount uploads all files
+// waiting for an explicit sync
+const xattrSync = xattrPrefix + "sync"
+
+// RequestSync asks the onedriver instance serving a mountpoint to upload all of
+// the changes waiting for an explicit sync.
+func RequestSync(mountpoint string) error {
+	return syscall.Setxattr(mountpoint, xattrSync, []byte("1"), 0)
+}
+
+// queueUpload uploads an item's changes, or with the manualSync option, holds
+// onto them until the next explicit sync.
+func (f *Filesystem) queueUpload(inode *Inode) error {
+	if inode.KeepLocal() {
+		return nil
+	}
+	if !f.opts.ManualSync {
+		return f.uploads.QueueUpload(inode)
+	}
+	id := inode.ID()
+	log.Debug().Str("id", id).Str("path", inode.Path()).
+		Msg("Holding changes until the next sync.")
+	// the item and its parent have to survive a restart to be found again
+	f.serializeID(id)
+	f.serializeID(inode.ParentID())
+	return f.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketDirty).Put([]byte(id), []byte{})
+	})
+}
+
+// isDirty returns true if an item has changes waiting for an explicit sync.
+func (f *Filesystem) isDirty(id string) bool {
+	dirty := false
+	f.db.View(func(tx *bolt.Tx) error {
+		dirty = tx.Bucket(bucketDirty).Get([]byte(id)) != nil
+		return nil
+	})
+	return dirty
+}
+
+// moveDirty keeps an item's changes waiting for a sync after its ID changes.
+func (f *Filesystem) moveDirty(oldID string, newID string) {
+	f.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketDirty)
+		if b.Get([]byte(oldID)) == nil {
+			return nil
+		}
+		b.Delete([]byte(oldID))
+		return b.Put([]byte(newID), []byte{})
+	})
+}
+
+// Sync queues uploads for all of the files with changes waiting for an explicit
+// sync. Returns the number of uploads queued.
+func (f *Filesystem) Sync() int {
+	var ids []string
+	f.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketDirty).ForEach(func(k, v []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+
+	queued := 0
+	for _, id := range ids {
+		inode := f.GetID(id)
+		if inode != nil && !inode.IsDir() {
+			if err := f.uploads.QueueUpload(inode); err != nil {
+				log.Error().Err(err).Str("id", id).Str("path", inode.Path()).
+					Msg("Could not queue upload, will try again on the next sync.")
+				continue
+			}
+			queued++
+		}
+		// deleted items don't need uploading
+		f.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(bucketDirty).Delete([]byte(id))
+		})
+	}
+	log.Info().Int("uploads", queued).Msg("Synced changes.")
+	return queued
+}
@@ -0,0 +1,61 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// With manualSync, closed files should only be uploaded once a sync is
+// requested, even if onedriver restarts in the meantime.
+func TestManualSync(t *testing.T) {
+	t.Parallel()
+	dbPath := filepath.Join(testDBLoc, "test_manual_sync")
+	options := Options{ManualSync: true}
+	cache := NewFilesystem(auth, dbPath, options)
+
+	paths := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		path := fmt.Sprintf("/onedriver_tests/manual_sync_%d.txt", i)
+		inode := NewInode(filepath.Base(path), 0644|fuse.S_IFREG, nil)
+		_, err := cache.InsertPath(path, auth, inode)
+		require.NoError(t, err)
+		inode.setContent(cache, []byte("waiting for a sync"))
+		inode.hasChanges = true
+		status := cache.Flush(context.Background().Done(),
+			&fuse.FlushIn{InHeader: fuse.InHeader{NodeId: inode.NodeID()}})
+		require.Equal(t, fuse.OK, status)
+
+		assert.False(t, cache.uploads.HasPendingUpload(inode.ID()),
+			"File was queued for upload before a sync.")
+		assert.True(t, cache.isDirty(inode.ID()))
+		paths = append(paths, path)
+	}
+
+	// restart, nothing should be lost
+	require.NoError(t, cache.db.Close())
+	cache = NewFilesystem(auth, dbPath, options)
+	for _, path := range paths {
+		inode, err := cache.GetPath(path, auth)
+		require.NoError(t, err)
+		require.NotNil(t, inode, "Unsynced file was lost on restart.")
+		assert.True(t, cache.isDirty(inode.ID()), "Unsynced changes were lost on restart.")
+		_, err = graph.GetItemPath(path, auth)
+		assert.Error(t, err, "File was uploaded before a sync.")
+	}
+
+	assert.Equal(t, len(paths), cache.Sync())
+	for _, path := range paths {
+		assert.Eventually(t, func() bool {
+			_, err := graph.GetItemPath(path, auth)
+			return err == nil
+		}, retrySeconds, time.Second, "File was not uploaded after a sync.")
+	}
+}
@@ -0,0 +1,223 @@
+package fs
+
+import (
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/metrics"
+)
+
+var (
+	fuseOpDuration = metrics.NewHistogram("onedriver_fuse_op_duration_seconds",
+		"How long FUSE operations took.", "op", metrics.DefaultBuckets)
+	fuseOpErrors = metrics.NewCounter("onedriver_fuse_op_errors_total",
+		"FUSE operations that returned an error (including ENOENT from lookups).", "op")
+	deltaDuration = metrics.NewHistogram("onedriver_delta_duration_seconds",
+		"How long fetching and applying changes from the server took.", "", metrics.DefaultBuckets)
+	uploadDuration = metrics.NewHistogram("onedriver_upload_duration_seconds",
+		"How long uploads that succeeded took.", "", metrics.DefaultBuckets)
+	uploadedBytes = metrics.NewCounter("onedriver_uploaded_bytes_total",
+		"Bytes of file content uploaded.", "")
+)
+
+// observeOp records how long a FUSE operation took, and if it failed.
+func observeOp(op string, start time.Time, status fuse.Status) {
+	fuseOpDuration.Since(op, start)
+	if status != fuse.OK {
+		fuseOpErrors.Inc(op)
+	}
+}
+
+// meteredFilesystem times every FUSE operation the filesystem handles. The
+// filesystem itself doesn't know about it, so none of this costs anything
+// unless metrics are turned on.
+type meteredFilesystem struct {
+	*Filesystem
+}
+
+// Metered wraps a filesystem so that how long its FUSE operations take shows up
+// in its metrics. Pass the result to the FUSE server instead of the filesystem.
+func Metered(f *Filesystem) fuse.RawFileSystem {
+	return meteredFilesystem{f}
+}
+
+func (m meteredFilesystem) CopyFileRange(cancel <-chan struct{}, in *fuse.CopyFileRangeIn) (uint32, fuse.Status) {
+	start := time.Now()
+	result, status := m.Filesystem.CopyFileRange(cancel, in)
+	observeOp("CopyFileRange", start, status)
+	return result, status
+}
+
+func (m meteredFilesystem) StatFs(cancel <-chan struct{}, in *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
+	start := time.Now()
+	status := m.Filesystem.StatFs(cancel, in, out)
+	observeOp("StatFs", start, status)
+	return status
+}
+
+func (m meteredFilesystem) Mkdir(cancel <-chan struct{}, in *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	start := time.Now()
+	status := m.Filesystem.Mkdir(cancel, in, name, out)
+	observeOp("Mkdir", start, status)
+	return status
+}
+
+func (m meteredFilesystem) Rmdir(cancel <-chan struct{}, in *fuse.InHeader, name string) fuse.Status {
+	start := time.Now()
+	status := m.Filesystem.Rmdir(cancel, in, name)
+	observeOp("Rmdir", start, status)
+	return status
+}
+
+func (m meteredFilesystem) OpenDir(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	start := time.Now()
+	status := m.Filesystem.OpenDir(cancel, in, out)
+	observeOp("OpenDir", start, status)
+	return status
+}
+
+func (m meteredFilesystem) ReadDirPlus(cancel <-chan struct{}, in *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	start := time.Now()
+	status := m.Filesystem.ReadDirPlus(cancel, in, out)
+	observeOp("ReadDirPlus", start, status)
+	return status
+}
+
+func (m meteredFilesystem) ReadDir(cancel <-chan struct{}, in *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	start := time.Now()
+	status := m.Filesystem.ReadDir(cancel, in, out)
+	observeOp("ReadDir", start, status)
+	return status
+}
+
+func (m meteredFilesystem) Lookup(cancel <-chan struct{}, in *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	start := time.Now()
+	status := m.Filesystem.Lookup(cancel, in, name, out)
+	observeOp("Lookup", start, status)
+	return status
+}
+
+func (m meteredFilesystem) Mknod(cancel <-chan struct{}, in *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	start := time.Now()
+	status := m.Filesystem.Mknod(cancel, in, name, out)
+	observeOp("Mknod", start, status)
+	return status
+}
+
+func (m meteredFilesystem) Create(cancel <-chan struct{}, in *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
+	start := time.Now()
+	status := m.Filesystem.Create(cancel, in, name, out)
+	observeOp("Create", start, status)
+	return status
+}
+
+func (m meteredFilesystem) Open(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	start := time.Now()
+	status := m.Filesystem.Open(cancel, in, out)
+	observeOp("Open", start, status)
+	return status
+}
+
+func (m meteredFilesystem) Unlink(cancel <-chan struct{}, in *fuse.InHeader, name string) fuse.Status {
+	start := time.Now()
+	status := m.Filesystem.Unlink(cancel, in, name)
+	observeOp("Unlink", start, status)
+	return status
+}
+
+func (m meteredFilesystem) Read(cancel <-chan struct{}, in *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	start := time.Now()
+	result, status := m.Filesystem.Read(cancel, in, buf)
+	observeOp("Read", start, status)
+	return result, status
+}
+
+func (m meteredFilesystem) Write(cancel <-chan struct{}, in *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	start := time.Now()
+	result, status := m.Filesystem.Write(cancel, in, data)
+	observeOp("Write", start, status)
+	return result, status
+}
+
+func (m meteredFilesystem) Fsync(cancel <-chan struct{}, in *fuse.FsyncIn) fuse.Status {
+	start := time.Now()
+	status := m.Filesystem.Fsync(cancel, in)
+	observeOp("Fsync", start, status)
+	return status
+}
+
+func (m meteredFilesystem) Flush(cancel <-chan struct{}, in *fuse.FlushIn) fuse.Status {
+	start := time.Now()
+	status := m.Filesystem.Flush(cancel, in)
+	observeOp("Flush", start, status)
+	return status
+}
+
+func (m meteredFilesystem) Release(cancel <-chan struct{}, in *fuse.ReleaseIn) {
+	start := time.Now()
+	m.Filesystem.Release(cancel, in)
+	observeOp("Release", start, fuse.OK)
+}
+
+func (m meteredFilesystem) GetAttr(cancel <-chan struct{}, in *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	start := time.Now()
+	status := m.Filesystem.GetAttr(cancel, in, out)
+	observeOp("GetAttr", start, status)
+	return status
+}
+
+func (m meteredFilesystem) SetAttr(cancel <-chan struct{}, in *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+	start := time.Now()
+	status := m.Filesystem.SetAttr(cancel, in, out)
+	observeOp("SetAttr", start, status)
+	return status
+}
+
+func (m meteredFilesystem) Rename(cancel <-chan struct{}, in *fuse.RenameIn, name string, newName string) fuse.Status {
+	start := time.Now()
+	status := m.Filesystem.Rename(cancel, in, name, newName)
+	observeOp("Rename", start, status)
+	return status
+}
+
+func (m meteredFilesystem) Readlink(cancel <-chan struct{}, in *fuse.InHeader) ([]byte, fuse.Status) {
+	start := time.Now()
+	result, status := m.Filesystem.Readlink(cancel, in)
+	observeOp("Readlink", start, status)
+	return result, status
+}
+
+func (m meteredFilesystem) Symlink(cancel <-chan struct{}, header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) fuse.Status {
+	start := time.Now()
+	status := m.Filesystem.Symlink(cancel, header, pointedTo, linkName, out)
+	observeOp("Symlink", start, status)
+	return status
+}
+
+func (m meteredFilesystem) GetXAttr(cancel <-chan struct{}, in *fuse.InHeader, attr string, dest []byte) (uint32, fuse.Status) {
+	start := time.Now()
+	result, status := m.Filesystem.GetXAttr(cancel, in, attr, dest)
+	observeOp("GetXAttr", start, status)
+	return result, status
+}
+
+func (m meteredFilesystem) SetXAttr(cancel <-chan struct{}, in *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
+	start := time.Now()
+	status := m.Filesystem.SetXAttr(cancel, in, attr, data)
+	observeOp("SetXAttr", start, status)
+	return status
+}
+
+func (m meteredFilesystem) RemoveXAttr(cancel <-chan struct{}, in *fuse.InHeader, attr string) fuse.Status {
+	start := time.Now()
+	status := m.Filesystem.RemoveXAttr(cancel, in, attr)
+	observeOp("RemoveXAttr", start, status)
+	return status
+}
+
+func (m meteredFilesystem) ListXAttr(cancel <-chan struct{}, in *fuse.InHeader, dest []byte) (uint32, fuse.Status) {
+	start := time.Now()
+	result, status := m.Filesystem.ListXAttr(cancel, in, dest)
+	observeOp("ListXAttr", start, status)
+	return result, status
+}
@@ -0,0 +1,212 @@
+// Package metrics keeps counters and timings of what onedriver is doing, and
+// writes them in the Prometheus text format so they can be scraped and graphed.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds in seconds of the buckets timings are
+// sorted into, from quick cache hits to slow requests to the server.
+var DefaultBuckets = []float64{
+	0.0001, 0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60,
+}
+
+// metric is anything that can be written out.
+type metric interface {
+	write(out io.Writer)
+}
+
+var (
+	registryM sync.Mutex
+	registry  []metric
+)
+
+func register(m metric) {
+	registryM.Lock()
+	defer registryM.Unlock()
+	registry = append(registry, m)
+}
+
+// WriteAll writes every metric in the Prometheus text format.
+func WriteAll(out io.Writer) {
+	registryM.Lock()
+	metrics := append([]metric{}, registry...)
+	registryM.Unlock()
+	for _, m := range metrics {
+		m.write(out)
+	}
+}
+
+// Handler serves every metric for Prometheus to scrape.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteAll(w)
+	})
+}
+
+// labels formats label pairs like {op="Open",le="0.5"}. Pairs with an empty
+// name are left out.
+func labels(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i] == "" {
+			continue
+		}
+		parts = append(parts, pairs[i]+"="+strconv.Quote(pairs[i+1]))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Counter is a total that only goes up, kept separately for each value of its
+// label.
+type Counter struct {
+	sync.Mutex
+	name   string
+	help   string
+	label  string
+	values map[string]float64
+}
+
+// NewCounter creates and registers a counter. An empty label makes it a single
+// total.
+func NewCounter(name string, help string, label string) *Counter {
+	c := &Counter{name: name, help: help, label: label, values: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+// Add adds to the total for a label value.
+func (c *Counter) Add(value string, delta float64) {
+	c.Lock()
+	c.values[value] += delta
+	c.Unlock()
+}
+
+// Inc adds one to the total for a label value.
+func (c *Counter) Inc(value string) {
+	c.Add(value, 1)
+}
+
+// Get returns the total for a label value.
+func (c *Counter) Get(value string) float64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.values[value]
+}
+
+func (c *Counter) write(out io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(out, "%s%s %s\n", c.name, labels(c.label, key), formatFloat(c.values[key]))
+	}
+}
+
+// Histogram counts observations, like how long something took, in buckets so
+// that their distribution can be graphed. Kept separately for each value of its
+// label.
+type Histogram struct {
+	sync.Mutex
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // observations less than or equal to each bucket
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram creates and registers a histogram. An empty label makes it a
+// single series.
+func NewHistogram(name string, help string, label string, buckets []float64) *Histogram {
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		label:   label,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	register(h)
+	return h
+}
+
+// Observe records an observation for a label value.
+func (h *Histogram) Observe(value string, observed float64) {
+	h.Lock()
+	defer h.Unlock()
+	series, ok := h.series[value]
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[value] = series
+	}
+	for i, bound := range h.buckets {
+		if observed <= bound {
+			series.counts[i]++
+		}
+	}
+	series.sum += observed
+	series.count++
+}
+
+// Since records how many seconds have passed since start for a label value.
+func (h *Histogram) Since(value string, start time.Time) {
+	h.Observe(value, time.Since(start).Seconds())
+}
+
+// Count returns how many observations there were for a label value.
+func (h *Histogram) Count(value string) uint64 {
+	h.Lock()
+	defer h.Unlock()
+	if series, ok := h.series[value]; ok {
+		return series.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(out io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(out, "%s_bucket%s %d\n",
+				h.name, labels(h.label, key, "le", formatFloat(bound)), series.counts[i])
+		}
+		fmt.Fprintf(out, "%s_bucket%s %d\n",
+			h.name, labels(h.label, key, "le", "+Inf"), series.count)
+		fmt.Fprintf(out, "%s_sum%s %s\n", h.name, labels(h.label, key), formatFloat(series.sum))
+		fmt.Fprintf(out, "%s_count%s %d\n", h.name, labels(h.label, key), series.count)
+	}
+}
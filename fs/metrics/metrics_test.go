@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Histograms should count each observation in every bucket it fits in, the way
+// Prometheus expects cumulative buckets.
+func TestHistogram(t *testing.T) {
+	t.Parallel()
+	h := NewHistogram("test_duration_seconds", "Only used by tests.", "op", []float64{0.1, 1})
+	h.Observe("Read", 0.05)
+	h.Observe("Read", 0.5)
+	h.Observe("Read", 5)
+	assert.EqualValues(t, 3, h.Count("Read"))
+	assert.EqualValues(t, 0, h.Count("Write"))
+
+	var out bytes.Buffer
+	h.write(&out)
+	assert.Equal(t, `# HELP test_duration_seconds Only used by tests.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{op="Read",le="0.1"} 1
+test_duration_seconds_bucket{op="Read",le="1"} 2
+test_duration_seconds_bucket{op="Read",le="+Inf"} 3
+test_duration_seconds_sum{op="Read"} 5.55
+test_duration_seconds_count{op="Read"} 3
+`, out.String())
+}
+
+// Counters without a label are a single total.
+func TestCounterUnlabeled(t *testing.T) {
+	t.Parallel()
+	c := NewCounter("test_bytes_total", "Only used by tests.", "")
+	c.Add("", 1024)
+	c.Inc("")
+	assert.EqualValues(t, 1025, c.Get(""))
+
+	var out bytes.Buffer
+	c.write(&out)
+	assert.Contains(t, out.String(), "\ntest_bytes_total 1025\n")
+}
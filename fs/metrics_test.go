@@ -0,0 +1,26 @@
+package fs
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+// FUSE operations going through a metered filesystem should be timed, and
+// failures counted.
+func TestMetered(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_metered"), Options{})
+	metered := Metered(cache)
+	lookups := fuseOpDuration.Count("Lookup")
+	failures := fuseOpErrors.Get("Lookup")
+
+	root := cache.GetID(cache.root)
+	status := metered.Lookup(nil, &fuse.InHeader{NodeId: root.NodeID()},
+		"metered_does_not_exist", &fuse.EntryOut{})
+	assert.Equal(t, fuse.ENOENT, status)
+	assert.Equal(t, lookups+1, fuseOpDuration.Count("Lookup"), "Lookup was not timed.")
+	assert.Equal(t, failures+1, fuseOpErrors.Get("Lookup"), "Failed lookup was not counted.")
+}
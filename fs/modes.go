@@ -0,0 +1,139 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// OneDrive has no notion of UNIX modes. With the PreserveModes option, modes
+// other than the default are kept in an item's description as "unix-mode=0755",
+// next to whatever description it already had, so that things like executable
+// scripts stay executable after wiping the cache or on another computer. Only
+// personal drives let us write descriptions, on business drives and SharePoint
+// modes stay local. Symlinks are marked with "unix-symlink" in the same way.
+
+var modePattern = regexp.MustCompile(`(?:^|\s)unix-mode=([0-7]{3,4})(?:\s|$)`)
+
+// modeFromDescription returns the permission bits stored in a description.
+func modeFromDescription(description string) (uint32, bool) {
+	match := modePattern.FindStringSubmatch(description)
+	if match == nil {
+		return 0, false
+	}
+	perm, _ := strconv.ParseUint(match[1], 8, 32)
+	return uint32(perm), true
+}
+
+// descriptionWithMode stores the permission bits of mode in a description,
+// replacing any that were there before. Default modes are not stored, symlinks
+// only store that they are one.
+func descriptionWithMode(description string, mode uint32) string {
+	description = strings.TrimSpace(modePattern.ReplaceAllString(description, " "))
+	description = strings.TrimSpace(symlinkPattern.ReplaceAllString(description, " "))
+	perm := mode & 07777
+	var token string
+	switch {
+	case mode&syscall.S_IFMT == fuse.S_IFLNK:
+		token = "unix-symlink"
+	case mode&syscall.S_IFMT == fuse.S_IFDIR && perm == 0755,
+		mode&syscall.S_IFMT != fuse.S_IFDIR && perm == 0644:
+		return description
+	default:
+		token = fmt.Sprintf("unix-mode=%04o", perm)
+	}
+	if description == "" {
+		return token
+	}
+	return description + " " + token
+}
+
+// remoteMode is the mode stored in an item's description on the server, 0 if
+// there is none.
+func remoteMode(item *graph.DriveItem) uint32 {
+	if item.IsShortcut() || isSymlinkItem(item) {
+		// these have modes of their own
+		return 0
+	}
+	perm, ok := modeFromDescription(item.Description)
+	if !ok {
+		return 0
+	}
+	if item.IsDir() {
+		return fuse.S_IFDIR | perm
+	}
+	return fuse.S_IFREG | perm
+}
+
+// modesSupported returns true if modes can be stored on the server for an item,
+// which needs a drive with writable descriptions.
+func modesSupported(inode *Inode) bool {
+	inode.RLock()
+	defer inode.RUnlock()
+	parent := inode.DriveItem.Parent
+	return parent == nil || parent.DriveType == "" || parent.DriveType == graph.DriveTypePersonal
+}
+
+// updateMode picks up a mode changed on another computer.
+func (f *Filesystem) updateMode(local *Inode, delta *graph.DriveItem) {
+	if !f.opts.PreserveModes {
+		return
+	}
+	mode := remoteMode(delta)
+	local.Lock()
+	_, hadMode := modeFromDescription(local.DriveItem.Description)
+	local.DriveItem.Description = delta.Description
+	if local.mode&syscall.S_IFMT == fuse.S_IFLNK || local.mode == mode || mode == 0 && !hadMode {
+		local.Unlock()
+		return
+	}
+	// a mode that disappeared went back to the default
+	local.mode = mode
+	local.Unlock()
+	f.serializeID(local.ID())
+}
+
+// pushMode stores an item's mode on the server, if it needs to be.
+func (f *Filesystem) pushMode(inode *Inode) fuse.Status {
+	if !f.opts.PreserveModes || f.IsOffline() {
+		return fuse.OK
+	}
+	inode.RLock()
+	id := inode.DriveItem.ID
+	description := inode.DriveItem.Description
+	mode := inode.mode
+	inode.RUnlock()
+	if isLocalID(id) || mode == 0 || mode&syscall.S_IFMT == fuse.S_IFLNK {
+		// items not on the server yet get their mode when uploaded
+		return fuse.OK
+	}
+	updated := descriptionWithMode(description, mode)
+	if updated == description {
+		return fuse.OK
+	}
+	if !modesSupported(inode) {
+		log.Warn().Str("id", id).
+			Msg("Modes can't be stored on this drive, only personal drives support it.")
+		return fuse.ENOTSUP
+	}
+	// an empty description has to be sent too, to remove a mode
+	patch, _ := json.Marshal(struct {
+		Description string `json:"description"`
+	}{updated})
+	if _, err := graph.Patch(graph.IDPath(id), f.auth, bytes.NewReader(patch)); err != nil {
+		log.Error().Err(err).Str("id", id).Msg("Could not store mode on the server.")
+		return fuse.EREMOTEIO
+	}
+	inode.Lock()
+	inode.DriveItem.Description = updated
+	inode.Unlock()
+	return fuse.OK
+}
@@ -0,0 +1,111 @@
+package fs
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+)
+
+// Modes should be stored next to any existing description, and only when they
+// aren't the default.
+func TestDescriptionWithMode(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "unix-mode=0755", descriptionWithMode("", fuse.S_IFREG|0755))
+	assert.Equal(t, "", descriptionWithMode("", fuse.S_IFREG|0644))
+	assert.Equal(t, "", descriptionWithMode("", fuse.S_IFDIR|0755))
+	assert.Equal(t, "unix-mode=0700", descriptionWithMode("", fuse.S_IFDIR|0700))
+	assert.Equal(t, "my link unix-symlink", descriptionWithMode("my link", fuse.S_IFLNK|0777))
+	assert.Equal(t, "my script unix-mode=0755",
+		descriptionWithMode("my script", fuse.S_IFREG|0755))
+	assert.Equal(t, "my script unix-mode=0750",
+		descriptionWithMode("my script unix-mode=0755", fuse.S_IFREG|0750))
+	assert.Equal(t, "my script",
+		descriptionWithMode("my script unix-mode=0755", fuse.S_IFREG|0644))
+
+	perm, ok := modeFromDescription("my script unix-mode=0755")
+	assert.True(t, ok)
+	assert.EqualValues(t, 0755, perm)
+	_, ok = modeFromDescription("my-unix-mode=0755")
+	assert.False(t, ok, "Part of a word was taken as a mode.")
+}
+
+// Items fetched from the server should get the mode stored in their
+// description, but only with preserveModes.
+func TestRemoteMode(t *testing.T) {
+	t.Parallel()
+	script := &graph.DriveItem{
+		ID:          "remote-mode-script",
+		Name:        "script.sh",
+		File:        &graph.File{},
+		Description: "unix-mode=0755",
+	}
+	assert.EqualValues(t, fuse.S_IFREG|0755, remoteMode(script))
+	assert.EqualValues(t, fuse.S_IFREG|0644, NewInodeDriveItem(script).Mode(),
+		"Mode was used without preserveModes.")
+
+	folder := &graph.DriveItem{
+		ID:          "remote-mode-folder",
+		Name:        "private",
+		Folder:      &graph.Folder{},
+		Description: "secrets unix-mode=0700",
+	}
+	assert.EqualValues(t, fuse.S_IFDIR|0700, remoteMode(folder))
+
+	plain := &graph.DriveItem{
+		ID:   "remote-mode-plain",
+		Name: "plain.txt",
+		File: &graph.File{},
+	}
+	assert.EqualValues(t, 0, remoteMode(plain))
+}
+
+// Descriptions can only be written on personal drives.
+func TestModesSupported(t *testing.T) {
+	t.Parallel()
+	for driveType, expected := range map[string]bool{
+		"":                        true,
+		graph.DriveTypePersonal:   true,
+		graph.DriveTypeBusiness:   false,
+		graph.DriveTypeSharepoint: false,
+	} {
+		inode := NewInodeDriveItem(&graph.DriveItem{
+			ID:     "modes-supported",
+			Parent: &graph.DriveItemParent{DriveType: driveType},
+		})
+		assert.Equal(t, expected, modesSupported(inode), "Wrong answer for %q.", driveType)
+	}
+}
+
+// A chmod that can't be stored on the server should fail without changing the
+// mode, instead of only failing after it was applied.
+func TestChmodUnsupported(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_chmod_unsupported"),
+		Options{PreserveModes: true})
+	now := time.Now()
+	inode := NewInodeDriveItem(&graph.DriveItem{
+		ID:      "chmod-unsupported",
+		Name:    "chmod_unsupported.txt",
+		ModTime: &now,
+		File:    &graph.File{},
+		Parent:  &graph.DriveItemParent{ID: cache.root, DriveType: graph.DriveTypeBusiness},
+	})
+	cache.InsertChild(cache.root, inode)
+	before := inode.Mode()
+
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{
+		InHeader: fuse.InHeader{NodeId: inode.NodeID()},
+		Valid:    fuse.FATTR_MODE,
+		Mode:     0600,
+	}}
+	assert.Equal(t, fuse.ENOTSUP, cache.SetAttr(nil, in, &fuse.AttrOut{}))
+	assert.Equal(t, before, inode.Mode(), "Mode was changed although it could not be stored.")
+
+	// the same mode again is fine, there is nothing to store
+	in.Mode = before &^ fuse.S_IFREG
+	assert.Equal(t, fuse.OK, cache.SetAttr(nil, in, &fuse.AttrOut{}))
+}
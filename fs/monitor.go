@@ -0,0 +1,143 @@
+package fs
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Types of events streamed to monitors.
+const (
+	EventUpload       = "upload"       // an item finished uploading
+	EventUploadFailed = "uploadFailed" // an upload attempt failed, it will be retried
+	EventDownload     = "download"     // an item's content was downloaded
+	EventDelta        = "delta"        // changes from the server were applied
+	EventProblem      = "problem"      // see StatusProblem
+	EventSyncBroken   = "syncBroken"   // fetching changes from the server keeps failing
+	EventQuotaFull    = "quotaFull"    // the drive is full, uploads wait until there is space
+)
+
+// Event is something that happened in the filesystem, sent to monitors as it
+// happens.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Path    string    `json:"path,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+// MonitorMessage is a single line sent to a monitor, it holds either an event
+// or the filesystem's status. Monitors get the status when they connect and
+// whenever they send a "status" line.
+type MonitorMessage struct {
+	Event  *Event  `json:"event,omitempty"`
+	Status *Status `json:"status,omitempty"`
+}
+
+// monitors fans events out to everyone connected to the monitor socket.
+type monitors struct {
+	sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+func (m *monitors) subscribe() chan Event {
+	events := make(chan Event, 64)
+	m.Lock()
+	if m.subscribers == nil {
+		m.subscribers = make(map[chan Event]struct{})
+	}
+	m.subscribers[events] = struct{}{}
+	m.Unlock()
+	return events
+}
+
+func (m *monitors) unsubscribe(events chan Event) {
+	m.Lock()
+	delete(m.subscribers, events)
+	m.Unlock()
+}
+
+// emit sends an event to all monitors. Monitors that can't keep up miss events
+// rather than slowing down the filesystem.
+func (f *Filesystem) emit(eventType string, path string, message string) {
+	event := Event{Time: time.Now(), Type: eventType, Path: path, Message: message}
+	f.monitors.Lock()
+	defer f.monitors.Unlock()
+	for events := range f.monitors.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// ServeMonitor listens for monitors on a unix socket at socketPath until the
+// returned listener is closed. Anything left at socketPath by a previous run is
+// replaced.
+func (f *Filesystem) ServeMonitor(socketPath string) (net.Listener, error) {
+	os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	os.Chmod(socketPath, 0600)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.handleMonitor(conn)
+		}
+	}()
+	return listener, nil
+}
+
+// handleMonitor sends the status and then a stream of events to a monitor until
+// it disconnects.
+func (f *Filesystem) handleMonitor(conn net.Conn) {
+	defer conn.Close()
+	events := f.monitors.subscribe()
+	defer f.monitors.unsubscribe(events)
+
+	done := make(chan struct{})
+	defer close(done)
+	requests := make(chan struct{})
+	go func() {
+		defer close(requests)
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			if strings.TrimSpace(scanner.Text()) != "status" {
+				continue
+			}
+			select {
+			case requests <- struct{}{}:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	encoder := json.NewEncoder(conn)
+	status := f.CurrentStatus()
+	err := encoder.Encode(MonitorMessage{Status: &status})
+	for err == nil {
+		select {
+		case event := <-events:
+			err = encoder.Encode(MonitorMessage{Event: &event})
+		case _, ok := <-requests:
+			if !ok {
+				return
+			}
+			status := f.CurrentStatus()
+			err = encoder.Encode(MonitorMessage{Status: &status})
+		}
+	}
+	log.Debug().Err(err).Msg("Monitor disconnected.")
+}
@@ -0,0 +1,50 @@
+package fs
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Monitors should get the status when they connect, then events as they happen.
+func TestMonitorStreamsEvents(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_monitor"), Options{})
+	socket := filepath.Join(t.TempDir(), "monitor.sock")
+	listener, err := cache.ServeMonitor(socket)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	conn, err := net.Dial("unix", socket)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	decoder := json.NewDecoder(bufio.NewReader(conn))
+
+	var msg MonitorMessage
+	require.NoError(t, decoder.Decode(&msg))
+	require.NotNil(t, msg.Status, "Monitor did not get the status on connect.")
+
+	cache.reportProblem("/onedriver_tests/monitor.txt", "something went wrong")
+	msg = MonitorMessage{}
+	require.NoError(t, decoder.Decode(&msg))
+	require.NotNil(t, msg.Event, "Event was not streamed to the monitor.")
+	assert.Equal(t, EventProblem, msg.Event.Type)
+	assert.Equal(t, "/onedriver_tests/monitor.txt", msg.Event.Path)
+	assert.Equal(t, "something went wrong", msg.Event.Message)
+
+	_, err = conn.Write([]byte("status\n"))
+	require.NoError(t, err)
+	msg = MonitorMessage{}
+	require.NoError(t, decoder.Decode(&msg))
+	require.NotNil(t, msg.Status, "Monitor did not get the status it asked for.")
+	require.NotEmpty(t, msg.Status.Problems)
+	assert.Equal(t, "something went wrong",
+		msg.Status.Problems[len(msg.Status.Problems)-1].Message)
+}
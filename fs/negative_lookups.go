@@ -0,0 +1,67 @@
+package fs
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// the default for Options.NegativeLookupSeconds
+const defaultNegativeLookupTTL = 5 * time.Second
+
+// negativeLookups remembers names that recently did not exist, so that tools
+// probing lots of paths that aren't there (like a compiler searching its include
+// directories) get an answer without the folder being searched again. Entries
+// for a folder are dropped whenever something is added to it.
+type negativeLookups struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]map[string]time.Time // parent id -> name -> expiry
+}
+
+func newNegativeLookups(ttl time.Duration) *negativeLookups {
+	return &negativeLookups{
+		ttl:     ttl,
+		entries: make(map[string]map[string]time.Time),
+	}
+}
+
+// missing returns true if a name was recently looked up in a folder and did not
+// exist.
+func (n *negativeLookups) missing(parentID string, name string) bool {
+	if n.ttl <= 0 {
+		return false
+	}
+	n.Lock()
+	defer n.Unlock()
+	expiry, exists := n.entries[parentID][strings.ToLower(name)]
+	return exists && time.Now().Before(expiry)
+}
+
+// add records that a name does not exist in a folder.
+func (n *negativeLookups) add(parentID string, name string) {
+	if n.ttl <= 0 {
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+	names, exists := n.entries[parentID]
+	if !exists {
+		names = make(map[string]time.Time)
+		n.entries[parentID] = names
+	}
+	now := time.Now()
+	for name, expiry := range names {
+		if now.After(expiry) {
+			delete(names, name)
+		}
+	}
+	names[strings.ToLower(name)] = now.Add(n.ttl)
+}
+
+// invalidate forgets everything that was missing from a folder.
+func (n *negativeLookups) invalidate(parentID string) {
+	n.Lock()
+	delete(n.entries, parentID)
+	n.Unlock()
+}
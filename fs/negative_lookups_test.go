@@ -0,0 +1,52 @@
+package fs
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegativeLookupsExpire(t *testing.T) {
+	t.Parallel()
+	n := newNegativeLookups(100 * time.Millisecond)
+	n.add("parent", "Missing.h")
+	assert.True(t, n.missing("parent", "missing.h"))
+	assert.False(t, n.missing("other", "missing.h"))
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, n.missing("parent", "missing.h"), "Entry did not expire.")
+
+	n.add("parent", "missing.h")
+	n.invalidate("parent")
+	assert.False(t, n.missing("parent", "missing.h"), "Entry was not invalidated.")
+
+	disabled := newNegativeLookups(0)
+	disabled.add("parent", "missing.h")
+	assert.False(t, disabled.missing("parent", "missing.h"))
+}
+
+// Looking up the same missing file over and over should only go to the server
+// once, and creating the file should make it show up right away.
+func TestNegativeLookupRequests(t *testing.T) {
+	t.Parallel()
+	localAuth := *auth
+	cache := NewFilesystem(&localAuth, filepath.Join(testDBLoc, "test_negative_lookup"), Options{})
+	root := fuse.InHeader{NodeId: 1}
+
+	before := localAuth.Requests()
+	for i := 0; i < 20; i++ {
+		status := cache.Lookup(nil, &root, "missing.h", &fuse.EntryOut{})
+		require.Equal(t, fuse.ENOENT, status)
+	}
+	assert.LessOrEqual(t, localAuth.Requests()-before, uint32(1),
+		"Repeated lookups of a missing file went to the server.")
+
+	require.Equal(t, fuse.OK, cache.Create(
+		nil, &fuse.CreateIn{InHeader: root, Mode: 0644 | fuse.S_IFREG}, "missing.h", &fuse.CreateOut{},
+	))
+	assert.Equal(t, fuse.OK, cache.Lookup(nil, &root, "missing.h", &fuse.EntryOut{}),
+		"Created file was still remembered as missing.")
+}
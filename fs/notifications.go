@@ -0,0 +1,63 @@
+package fs
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// how long to wait before subscribing to change notifications again after the
+// connection is lost, doubling each time it fails right away (shortened during
+// tests)
+var (
+	notificationRetryMin = 5 * time.Second
+	notificationRetryMax = 10 * time.Minute
+)
+
+// notificationLoop subscribes to change notifications from the server and
+// fetches deltas as soon as something changes, instead of waiting for the next
+// poll. Deltas are still polled as usual, so nothing is missed while the
+// subscription is down. Should be called as a goroutine.
+func (f *Filesystem) notificationLoop() {
+	retry := notificationRetryMin
+	for {
+		if f.IsOffline() {
+			time.Sleep(notificationRetryMin)
+			continue
+		}
+		start := time.Now()
+		err := listenForChanges(f.auth, f.wakeDeltaLoop)
+		if time.Since(start) > notificationRetryMax {
+			// it worked for a good while, so just reconnect
+			retry = notificationRetryMin
+		}
+		log.Warn().Err(err).Str("retry", retry.String()).
+			Msg("Lost change notifications, falling back to polling for deltas.")
+		time.Sleep(retry)
+		retry *= 2
+		if retry > notificationRetryMax {
+			retry = notificationRetryMax
+		}
+	}
+}
+
+// wakeDeltaLoop makes the delta loop fetch deltas right away. Wakeups while the
+// delta loop is busy are coalesced into one.
+func (f *Filesystem) wakeDeltaLoop() {
+	select {
+	case f.deltaWake <- struct{}{}:
+	default:
+	}
+}
+
+// waitForDeltas waits for the next delta poll, which is either after interval
+// or when the delta loop is woken up.
+func (f *Filesystem) waitForDeltas(interval time.Duration) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-f.deltaWake:
+		log.Debug().Msg("Server says something changed, fetching deltas.")
+	}
+}
@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Being woken up should cut the wait for the next delta poll short, and several
+// wakeups in a row should only result in one early poll.
+func TestWaitForDeltasWake(t *testing.T) {
+	t.Parallel()
+	f := &Filesystem{deltaWake: make(chan struct{}, 1)}
+	f.wakeDeltaLoop()
+	f.wakeDeltaLoop()
+
+	start := time.Now()
+	f.waitForDeltas(time.Minute)
+	assert.True(t, time.Since(start) < time.Second, "Wakeup did not end the wait.")
+
+	start = time.Now()
+	f.waitForDeltas(100 * time.Millisecond)
+	assert.True(t, time.Since(start) >= 100*time.Millisecond,
+		"Wakeups should have been coalesced into one.")
+}
+
+// Losing the subscription right away should double the wait before subscribing
+// again up to the maximum, while one that lasted a good while should reconnect
+// quickly.
+func TestNotificationLoopBackoff(t *testing.T) {
+	oldMin, oldMax, oldListen := notificationRetryMin, notificationRetryMax, listenForChanges
+	notificationRetryMin, notificationRetryMax = 50*time.Millisecond, 250*time.Millisecond
+	const connected = 300 * time.Millisecond
+
+	starts := make(chan time.Time, 10)
+	calls := 0
+	listenForChanges = func(auth *graph.Auth, notify func()) error {
+		starts <- time.Now()
+		calls++
+		switch calls {
+		case 1:
+			notify()
+		case 5:
+			// stays connected for longer than notificationRetryMax
+			time.Sleep(connected)
+		case 6:
+			// the loop never stops, so it's left hanging here for good and
+			// doesn't see the settings being put back
+			select {}
+		}
+		return errors.New("subscription lost")
+	}
+	defer func() {
+		notificationRetryMin, notificationRetryMax, listenForChanges = oldMin, oldMax, oldListen
+	}()
+
+	f := &Filesystem{deltaWake: make(chan struct{}, 1)}
+	go f.notificationLoop()
+
+	var times []time.Time
+	for len(times) < 6 {
+		select {
+		case start := <-starts:
+			times = append(times, start)
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "Notification loop did not subscribe again.", "calls: %d", len(times))
+		}
+	}
+	gap := func(i int) time.Duration { return times[i].Sub(times[i-1]) }
+	assert.True(t, gap(1) >= 50*time.Millisecond, "First retry was too soon: %s", gap(1))
+	assert.True(t, gap(2) >= 100*time.Millisecond, "Wait did not double: %s", gap(2))
+	assert.True(t, gap(3) >= 200*time.Millisecond, "Wait did not double: %s", gap(3))
+	assert.True(t, gap(4) >= 250*time.Millisecond && gap(4) < 400*time.Millisecond,
+		"Wait should be capped at the maximum: %s", gap(4))
+	assert.True(t, gap(5)-connected < 200*time.Millisecond,
+		"Wait should have been reset after a long-lived subscription: %s", gap(5))
+
+	select {
+	case <-f.deltaWake:
+	default:
+		t.Error("Notifications should wake up the delta loop.")
+	}
+}
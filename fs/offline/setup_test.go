@@ -52,12 +52,11 @@ func TestMain(m *testing.M) {
 
 	// reuses the cached data from the previous tests
 	server, _ := fuse.NewServer(
-		fs.NewFilesystem(auth, filepath.Join(testDBLoc, "test")),
+		fs.NewFilesystem(auth, filepath.Join(testDBLoc, "test"), fs.Options{}),
 		mountLoc,
 		&fuse.MountOptions{
 			Name:          "onedriver",
 			FsName:        "onedriver",
-			DisableXAttrs: true,
 			MaxBackground: 1024,
 		},
 	)
@@ -0,0 +1,350 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+)
+
+// Options are the user-configurable settings that change how the filesystem
+// behaves. They are loaded as part of onedriver's config file. The zero value
+// results in onedriver's default behavior.
+type Options struct {
+	// DeltaJitter randomizes each delta polling interval by up to +/- this
+	// fraction of the interval (0.2 means +/-20%) so that many onedriver
+	// instances polling the same tenant do not all hit the server at once.
+	DeltaJitter float64 `yaml:"deltaJitter"`
+
+	// DeletedWithChanges decides what happens to a file that is deleted on the
+	// server while it has local changes that have not been uploaded yet. See the
+	// DeletedWithChanges* constants for the possible values.
+	DeletedWithChanges string `yaml:"deletedWithChanges"`
+	// CacheDirMode is the permissions a new cache directory is created with, in
+	// octal like "0750". An existing cache directory keeps its permissions, but
+	// there is a warning if anyone can read it since it holds the auth tokens
+	// and file content. Defaults to "0700".
+	CacheDirMode string `yaml:"cacheDirMode"`
+	// CacheSizeLimit is how many bytes of file content can be cached on disk
+	// before the content of the least recently used files gets deleted. Changes
+	// that haven't been uploaded yet are always kept. 0 is unlimited.
+	CacheSizeLimit uint64 `yaml:"cacheSizeLimit"`
+	// TrustCacheAbove skips verifying the hash of cached content when opening
+	// files at least this many bytes in size. 0 disables this.
+	TrustCacheAbove uint64 `yaml:"trustCacheAbove"`
+	// TrustCacheExtensions skips verifying the hash of cached content when
+	// opening files with one of these extensions (like ".mkv").
+	TrustCacheExtensions []string `yaml:"trustCacheExtensions,omitempty"`
+	// HiddenItems are left out of directory listings, but can still be accessed
+	// by name. Patterns use shell glob syntax and are case-insensitive. Patterns
+	// containing a "/" match an item's full path, the rest match its name.
+	HiddenItems []string `yaml:"hiddenItems,omitempty"`
+	// IgnorePatterns are treated as if they did not exist: they are never
+	// fetched, listed or synced, and creating them fails with EPERM. Patterns
+	// use shell glob syntax, are case-insensitive and are matched against an
+	// item's full path. Patterns starting with a "/" match from the root of the
+	// drive, the rest match at any depth.
+	IgnorePatterns []string `yaml:"ignorePatterns,omitempty"`
+	// Shortcuts decides how shortcuts to items on other drives are shown. See the
+	// Shortcuts* constants for the possible values.
+	Shortcuts string `yaml:"shortcuts"`
+	// PathAliases show items under a different name in the mount, like showing
+	// "/Pictures" as "photos". Keys are the path of an item on the server, values
+	// are the name it is shown as. Aliased items can only be accessed by their
+	// new name.
+	PathAliases map[string]string `yaml:"pathAliases,omitempty"`
+	// ChildrenRetrySeconds is how long to wait before trying again when a
+	// folder's contents could not be fetched because of a temporary server
+	// problem. The folder's contents from the last time onedriver ran are shown
+	// in the meantime. 0 uses the default of 10 seconds.
+	ChildrenRetrySeconds int `yaml:"childrenRetrySeconds"`
+	// NegativeLookupSeconds is how long a name that was looked up and did not
+	// exist is remembered as missing. 0 uses the default of 5 seconds, -1 turns
+	// this off.
+	NegativeLookupSeconds int `yaml:"negativeLookupSeconds"`
+	// UploadGraceSeconds is how long server metadata that contradicts an upload
+	// we just made is ignored, since OneDrive can keep returning an item's old
+	// content hash for a while after it was uploaded. 0 uses the default of 30
+	// seconds, -1 turns this off.
+	UploadGraceSeconds int `yaml:"uploadGraceSeconds"`
+	// KernelCacheSeconds is how long the kernel caches the attributes of items
+	// and the results of name lookups. Longer saves trips through onedriver,
+	// shorter makes changes from the server show up sooner (though they only
+	// arrive as often as deltas are fetched anyways). 0 uses the default of 1
+	// second, -1 turns this off.
+	KernelCacheSeconds int `yaml:"kernelCacheSeconds"`
+	// ManualSync holds onto local changes instead of uploading them as soon as
+	// files are closed. They are uploaded all at once when a sync is requested
+	// with "onedriver --sync".
+	ManualSync bool `yaml:"manualSync"`
+	// FullEnumeration fetches the metadata of every item on the drive at
+	// startup, instead of fetching the contents of folders as they are
+	// accessed. Useful for browsing the whole drive offline later, but slow
+	// for large drives.
+	FullEnumeration bool `yaml:"fullEnumeration"`
+	// ReservedNames decides what happens when something is created with a name
+	// OneDrive does not allow, like "CON" or a name ending with a ".". See the
+	// ReservedNames* constants for the possible values.
+	ReservedNames string `yaml:"reservedNames"`
+	// SkipStartupTasks skips creating things like the trash folder and
+	// .xdg-volume-info at startup, which saves a few requests on slow links.
+	// Local files that never got uploaded are picked up regardless.
+	SkipStartupTasks bool `yaml:"skipStartupTasks"`
+	// HeartbeatSeconds checks that the filesystem is still responding this
+	// often, by stat-ing the root and one of its children. Hangs and failures
+	// are reported in the status. 0 turns this off.
+	HeartbeatSeconds int `yaml:"heartbeatSeconds"`
+	// HeartbeatDumpStacks writes the stacks of all goroutines to the cache
+	// directory when the heartbeat detects a hang.
+	HeartbeatDumpStacks bool `yaml:"heartbeatDumpStacks"`
+	// UploadOrder decides which waiting uploads go first when more files are
+	// waiting to be uploaded than are uploaded at once. See the UploadOrder*
+	// constants for the possible values.
+	UploadOrder string `yaml:"uploadOrder"`
+	// UploadConflictBehavior decides what the server does when a new file is
+	// uploaded and an item with the same name already exists there. See the
+	// UploadConflict* constants for the possible values.
+	UploadConflictBehavior string `yaml:"uploadConflictBehavior"`
+	// UploadLimitKB limits how fast file content is uploaded in KB/s, shared
+	// between all uploads. 0 is unlimited.
+	UploadLimitKB uint64 `yaml:"uploadLimitKB"`
+	// DownloadLimitKB limits how fast file content is downloaded in KB/s, shared
+	// between all downloads. 0 is unlimited.
+	DownloadLimitKB uint64 `yaml:"downloadLimitKB"`
+	// DisableNotifications stops onedriver from subscribing to change
+	// notifications from the server, so changes from elsewhere only show up
+	// once deltas are polled again.
+	DisableNotifications bool `yaml:"disableNotifications"`
+	// UID and GID are who the files in the mount belong to, instead of the user
+	// running onedriver. Only root or a user with CAP_CHOWN can change them.
+	UID *uint32 `yaml:"uid,omitempty"`
+	GID *uint32 `yaml:"gid,omitempty"`
+	// PreserveModes stores UNIX modes that aren't the default (like the
+	// executable bit) in the description of items on the server, so they are
+	// kept when the cache is wiped and show up on other computers. Only works on
+	// personal drives, chmod fails with ENOTSUP elsewhere.
+	PreserveModes bool `yaml:"preserveModes"`
+	// RequestRetries is how many times a request to the server is tried again
+	// when it fails because of throttling, a server problem or a dropped
+	// connection. 0 uses the default of 3, -1 turns this off.
+	RequestRetries int `yaml:"requestRetries"`
+	// SyncBrokenAfter is how many times in a row fetching changes from the
+	// server has to fail with an error from the server (as opposed to being
+	// offline) before sync is reported as broken. 0 uses the default of 10, -1
+	// never reports it.
+	SyncBrokenAfter int `yaml:"syncBrokenAfter"`
+	// MaxParallelUploads is how many files are uploaded at once. 0 uses the
+	// default of 5.
+	MaxParallelUploads int `yaml:"maxParallelUploads"`
+	// BandwidthSchedule replaces UploadLimitKB and DownloadLimitKB with other
+	// limits at certain times of day.
+	BandwidthSchedule []BandwidthWindow `yaml:"bandwidthSchedule,omitempty"`
+}
+
+const (
+	// DeletedWithChangesDiscard applies the server-side deletion anyways and
+	// throws away the local changes. This is the default.
+	DeletedWithChangesDiscard = "discard"
+	// DeletedWithChangesKeep keeps the file as a local-only file. It will be
+	// uploaded as a new file the next time it is modified.
+	DeletedWithChangesKeep = "keep"
+	// DeletedWithChangesRestore keeps the file and immediately uploads it again.
+	DeletedWithChangesRestore = "restore"
+)
+
+const (
+	// ShortcutsFollow shows shortcuts to items on other drives as the item they
+	// point to, so they can be browsed like any other folder. This is the
+	// default. Shortcuts to items on our own drive are always symlinks.
+	ShortcutsFollow = "follow"
+	// ShortcutsSymlink shows all shortcuts as symlinks. Shortcuts to items on
+	// other drives point at the item's web URL.
+	ShortcutsSymlink = "symlink"
+)
+
+// Validate checks that the options contain sensible values.
+func (o Options) Validate() error {
+	if o.DeltaJitter < 0 || o.DeltaJitter > 1 {
+		return fmt.Errorf("deltaJitter must be between 0 and 1, got %g", o.DeltaJitter)
+	}
+	switch o.DeletedWithChanges {
+	case "", DeletedWithChangesDiscard, DeletedWithChangesKeep, DeletedWithChangesRestore:
+	default:
+		return fmt.Errorf("unknown deletedWithChanges policy %q", o.DeletedWithChanges)
+	}
+	if o.CacheDirMode != "" {
+		mode, err := strconv.ParseUint(o.CacheDirMode, 8, 32)
+		if err != nil || mode > 0777 {
+			return fmt.Errorf("cacheDirMode must be octal permissions like 0700, got %q", o.CacheDirMode)
+		}
+		if mode&0700 != 0700 {
+			return fmt.Errorf("cacheDirMode must let onedriver read, write and enter the cache directory, got %q",
+				o.CacheDirMode)
+		}
+	}
+	if o.ChildrenRetrySeconds < 0 {
+		return fmt.Errorf("childrenRetrySeconds cannot be negative, got %d", o.ChildrenRetrySeconds)
+	}
+	if o.NegativeLookupSeconds < -1 {
+		return fmt.Errorf("negativeLookupSeconds must be -1 or more, got %d", o.NegativeLookupSeconds)
+	}
+	if o.HeartbeatSeconds < 0 {
+		return fmt.Errorf("heartbeatSeconds cannot be negative, got %d", o.HeartbeatSeconds)
+	}
+	if o.KernelCacheSeconds < -1 {
+		return fmt.Errorf("kernelCacheSeconds must be -1 or more, got %d", o.KernelCacheSeconds)
+	}
+	if o.SyncBrokenAfter < -1 {
+		return fmt.Errorf("syncBrokenAfter must be -1 or more, got %d", o.SyncBrokenAfter)
+	}
+	if o.MaxParallelUploads < 0 {
+		return fmt.Errorf("maxParallelUploads cannot be negative, got %d", o.MaxParallelUploads)
+	}
+	if o.RequestRetries < -1 {
+		return fmt.Errorf("requestRetries must be -1 or more, got %d", o.RequestRetries)
+	}
+	if o.UploadGraceSeconds < -1 {
+		return fmt.Errorf("uploadGraceSeconds must be -1 or more, got %d", o.UploadGraceSeconds)
+	}
+	switch o.ReservedNames {
+	case "", ReservedNamesReject, ReservedNamesMangle:
+	default:
+		return fmt.Errorf("unknown reservedNames mode %q", o.ReservedNames)
+	}
+	switch o.UploadOrder {
+	case "", UploadOrderOldest, UploadOrderSmallest, UploadOrderNewest:
+	default:
+		return fmt.Errorf("unknown uploadOrder %q", o.UploadOrder)
+	}
+	switch o.UploadConflictBehavior {
+	case "", UploadConflictReplace, UploadConflictRename, UploadConflictFail:
+	default:
+		return fmt.Errorf("unknown uploadConflictBehavior %q", o.UploadConflictBehavior)
+	}
+	switch o.Shortcuts {
+	case "", ShortcutsFollow, ShortcutsSymlink:
+	default:
+		return fmt.Errorf("unknown shortcuts mode %q", o.Shortcuts)
+	}
+	for _, pattern := range o.HiddenItems {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid hiddenItems pattern %q: %w", pattern, err)
+		}
+	}
+	for _, pattern := range o.IgnorePatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid ignorePatterns pattern %q: %w", pattern, err)
+		}
+	}
+	if err := validateSchedule(o.BandwidthSchedule); err != nil {
+		return err
+	}
+	return validateAliases(o.PathAliases)
+}
+
+// cacheDirMode is the permissions the cache directory is created with.
+func (o Options) cacheDirMode() os.FileMode {
+	if o.CacheDirMode == "" {
+		return defaultCacheDirMode
+	}
+	// already checked by Validate
+	mode, _ := strconv.ParseUint(o.CacheDirMode, 8, 32)
+	return os.FileMode(mode)
+}
+
+// orDefault resolves the settings where 0 uses a default and -1 (or anything
+// below 0) turns the feature off, which comes out as 0.
+func orDefault(setting, def int) int {
+	switch {
+	case setting < 0:
+		return 0
+	case setting == 0:
+		return def
+	}
+	return setting
+}
+
+// negativeLookupTTL is how long missing names are remembered, 0 if they aren't.
+func (o Options) negativeLookupTTL() time.Duration {
+	return time.Duration(orDefault(o.NegativeLookupSeconds,
+		int(defaultNegativeLookupTTL/time.Second))) * time.Second
+}
+
+// kernelCacheTimeout is how long the kernel caches attributes and lookups.
+func (o Options) kernelCacheTimeout() time.Duration {
+	return time.Duration(orDefault(o.KernelCacheSeconds,
+		int(defaultKernelCacheTimeout/time.Second))) * time.Second
+}
+
+// uploadGraceTTL is how long server metadata contradicting an upload is
+// ignored, 0 if it isn't.
+func (o Options) uploadGraceTTL() time.Duration {
+	return time.Duration(orDefault(o.UploadGraceSeconds,
+		int(defaultUploadGraceTTL/time.Second))) * time.Second
+}
+
+// Retries is how many times a failed request is tried again. Requests are made
+// before the filesystem exists, so this is handed to graph.SetRetries when the
+// options are loaded.
+func (o Options) Retries() int {
+	return orDefault(o.RequestRetries, graph.DefaultRetries)
+}
+
+// syncBrokenAfter is how many delta fetches in a row have to fail before sync
+// is broken, 0 if it never is.
+func (o Options) syncBrokenAfter() int {
+	return orDefault(o.SyncBrokenAfter, defaultSyncBrokenAfter)
+}
+
+// maxParallelUploads is how many files are uploaded at once.
+func (o Options) maxParallelUploads() int {
+	if o.MaxParallelUploads == 0 {
+		return defaultMaxParallelUploads
+	}
+	return o.MaxParallelUploads
+}
+
+// isHidden returns true if an item matches one of the HiddenItems patterns.
+func (o Options) isHidden(inode *Inode) bool {
+	for _, pattern := range o.HiddenItems {
+		pattern = strings.ToLower(pattern)
+		target := inode.Name()
+		if strings.Contains(pattern, "/") {
+			target = inode.Path()
+		}
+		if matched, _ := path.Match(pattern, strings.ToLower(target)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// isIgnored returns true if the item at a path matches one of the
+// IgnorePatterns.
+func (o Options) isIgnored(itemPath string) bool {
+	itemPath = strings.ToLower(itemPath)
+	for _, pattern := range o.IgnorePatterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "/") {
+			if matched, _ := path.Match(pattern, itemPath); matched {
+				return true
+			}
+			continue
+		}
+		// match against every trailing part of the path, "node_modules" should
+		// match "/code/project/node_modules"
+		for i, c := range itemPath {
+			if c != '/' {
+				continue
+			}
+			if matched, _ := path.Match(pattern, itemPath[i+1:]); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package fs
+
+import (
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// OrphanGracePeriod is how old a content file must be before it can be removed
+// as an orphan. Newer files may belong to an operation that is still in flight
+// and just hasn't saved its metadata yet.
+const OrphanGracePeriod = time.Hour
+
+// isReferenced checks if anything still refers to an item's content, either
+// its metadata (in memory or on disk) or a pending upload.
+func (f *Filesystem) isReferenced(id string) bool {
+	if _, exists := f.metadata.Load(id); exists {
+		return true
+	}
+	found := false
+	f.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(bucketMetadata).Get([]byte(id)) != nil
+		if b := tx.Bucket(bucketUploads); !found && b != nil {
+			found = b.Get([]byte(id)) != nil
+		}
+		return nil
+	})
+	return found
+}
+
+// RemoveOrphanedContent deletes content files that no item refers to anymore.
+// These can be left behind if onedriver is killed between writing a file's
+// content and saving its metadata. Files modified within the grace period are
+// left alone. Returns the IDs of the content that was removed.
+func (f *Filesystem) RemoveOrphanedContent(grace time.Duration) []string {
+	ids, err := f.content.List()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not list content cache.")
+		return nil
+	}
+
+	removed := make([]string, 0)
+	for _, id := range ids {
+		if f.content.IsOpen(id) || f.isReferenced(id) {
+			continue
+		}
+		st, err := os.Stat(f.content.contentPath(id))
+		if err != nil || time.Since(st.ModTime()) < grace {
+			continue
+		}
+		if err := f.deleteContent(id); err != nil {
+			log.Warn().Err(err).Str("id", id).Msg("Could not remove orphaned content.")
+			continue
+		}
+		log.Info().
+			Str("id", id).
+			Int64("size", st.Size()).
+			Msg("Removed orphaned content.")
+		removed = append(removed, id)
+	}
+	return removed
+}
+
+// resolveLocalOrphans deals with files that were created but never made it to
+// the server, usually because onedriver was stopped before they were uploaded.
+// Nothing would ever upload them otherwise. Local-only files are uploaded, empty
+// ones included: new files aren't uploaded until they are written to, so
+// anything made with "touch" ends up here too. Files whose folder no longer exists have nowhere to be uploaded
+// to. Those are removed if they are empty and older than OrphanGracePeriod,
+// ones with content are left where they are so nothing is lost. Files that are
+// open, waiting on an upload or an explicit sync, or kept local on purpose are
+// left alone. Returns the IDs of the files that were queued for upload and of
+// those that were removed.
+func (f *Filesystem) resolveLocalOrphans() (uploaded []string, pruned []string) {
+	var ids []string
+	f.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMetadata).ForEach(func(k, v []byte) error {
+			if isLocalID(string(k)) {
+				ids = append(ids, string(k))
+			}
+			return nil
+		})
+	})
+
+	for _, id := range ids {
+		inode := f.GetID(id)
+		if inode == nil || inode.IsDir() || inode.KeepLocal() || f.content.IsOpen(id) ||
+			f.uploads.HasPendingUpload(id) || f.isDirty(id) {
+			continue
+		}
+		path := inode.Path()
+		if parentID := inode.ParentID(); parentID == "" || f.GetID(parentID) == nil {
+			if st, err := os.Stat(f.content.contentPath(id)); err == nil && st.Size() > 0 {
+				log.Warn().Str("id", id).Str("path", path).Int64("size", st.Size()).
+					Msg("File that never made it to the server has lost its folder, keeping its content.")
+				continue
+			}
+			if time.Since(time.Unix(int64(inode.ModTime()), 0)) < OrphanGracePeriod {
+				continue
+			}
+			f.DeleteID(id)
+			f.deleteContent(id)
+			f.db.Batch(func(tx *bolt.Tx) error {
+				return tx.Bucket(bucketMetadata).Delete([]byte(id))
+			})
+			log.Info().Str("id", id).Str("path", path).
+				Msg("Removed empty file that never made it to the server, its folder is gone.")
+			pruned = append(pruned, id)
+			continue
+		}
+
+		// the content is what survived, the size we saved may predate it
+		var size uint64
+		if st, err := os.Stat(f.content.contentPath(id)); err == nil {
+			size = uint64(st.Size())
+		}
+		inode.Lock()
+		inode.DriveItem.Size = size
+		inode.Unlock()
+		if err := f.uploads.QueueUpload(inode); err != nil {
+			log.Error().Err(err).Str("id", id).Str("path", path).
+				Msg("Could not queue upload of file that never made it to the server.")
+			continue
+		}
+		log.Info().Str("id", id).Str("path", path).
+			Msg("Uploading file that never made it to the server.")
+		uploaded = append(uploaded, id)
+	}
+	return uploaded, pruned
+}
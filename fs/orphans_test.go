@@ -0,0 +1,104 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Content nothing refers to should be removed, but only once it's old enough
+// that it can't belong to an operation that's still in progress.
+func TestRemoveOrphanedContent(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_orphaned_content"), Options{})
+	old := time.Now().Add(-2 * OrphanGracePeriod)
+
+	orphan := localID()
+	require.NoError(t, cache.content.Insert(orphan, []byte("nobody loves me")))
+	require.NoError(t, os.Chtimes(cache.content.contentPath(orphan), old, old))
+
+	recent := localID()
+	require.NoError(t, cache.content.Insert(recent, []byte("still being written")))
+
+	root := cache.GetID(cache.root)
+	inode := NewInode("orphaned_content_referenced.txt", 0644|fuse.S_IFREG, root)
+	cache.InsertChild(cache.root, inode)
+	require.NoError(t, cache.content.Insert(inode.ID(), []byte("i have a home")))
+	require.NoError(t, os.Chtimes(cache.content.contentPath(inode.ID()), old, old))
+
+	removed := cache.RemoveOrphanedContent(OrphanGracePeriod)
+	assert.Equal(t, []string{orphan}, removed)
+	assert.False(t, cache.content.HasContent(orphan), "Orphaned content was not removed.")
+	assert.True(t, cache.content.HasContent(recent),
+		"Content within the grace period should not be removed.")
+	assert.True(t, cache.content.HasContent(inode.ID()),
+		"Content that is still referenced should not be removed.")
+}
+
+// Files that never made it to the server before onedriver stopped should be
+// uploaded, even empty ones (new files aren't uploaded until they're written
+// to). Only empty files whose folder is gone are removed, once they're old
+// enough.
+func TestResolveLocalOrphans(t *testing.T) {
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_local_orphans"), Options{})
+	root := cache.GetID(cache.root)
+
+	newOrphan := func(name string, content []byte, parent *Inode) *Inode {
+		inode := NewInode(name, 0644|fuse.S_IFREG, parent)
+		cache.InsertChild(parent.ID(), inode)
+		if content != nil {
+			require.NoError(t, cache.content.Insert(inode.ID(), content))
+		}
+		cache.serializeID(inode.ID())
+		return inode
+	}
+	withContent := newOrphan("local_orphan_content.txt", []byte("upload me"), root)
+	touched := newOrphan("local_orphan_touched.txt", nil, root)
+	folder := NewInode("local_orphan_folder", 0755|fuse.S_IFDIR, root)
+	cache.InsertChild(cache.root, folder)
+	homeless := newOrphan("local_orphan_homeless.txt", nil, folder)
+	old := time.Now().Add(-2 * OrphanGracePeriod)
+	homeless.DriveItem.ModTime = &old
+	cache.serializeID(homeless.ID())
+	homelessNew := newOrphan("local_orphan_homeless_new.txt", nil, folder)
+	homelessContent := newOrphan("local_orphan_homeless_content.txt", []byte("nowhere to go"), folder)
+	homelessContent.DriveItem.ModTime = &old
+	cache.serializeID(homelessContent.ID())
+	cache.DeleteID(folder.ID())
+
+	var m sync.Mutex
+	started := make([]string, 0)
+	oldUpload := startUpload
+	defer func() { startUpload = oldUpload }()
+	startUpload = func(session *UploadSession, auth *graph.Auth) error {
+		if session.OldID != withContent.ID() && session.OldID != touched.ID() {
+			return oldUpload(session, auth)
+		}
+		m.Lock()
+		started = append(started, session.OldID)
+		m.Unlock()
+		return session.setState(uploadComplete, nil)
+	}
+
+	uploaded, pruned := cache.resolveLocalOrphans()
+	assert.ElementsMatch(t, []string{withContent.ID(), touched.ID()}, uploaded)
+	assert.Equal(t, []string{homeless.ID()}, pruned)
+	assert.Eventually(t, func() bool {
+		m.Lock()
+		defer m.Unlock()
+		return len(started) == 2
+	}, 10*time.Second, 100*time.Millisecond, "Orphans were not uploaded.")
+	assert.Nil(t, cache.GetID(homeless.ID()), "Orphan without a folder is still in the metadata db.")
+	assert.NotNil(t, cache.GetID(homelessNew.ID()),
+		"Orphan within the grace period should not be removed.")
+	assert.NotNil(t, cache.GetID(homelessContent.ID()), "Orphan with content was removed.")
+	assert.Equal(t, []byte("nowhere to go"), cache.content.Get(homelessContent.ID()),
+		"Content of an orphan without a folder was lost.")
+}
@@ -0,0 +1,67 @@
+package fs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// the bit of CAP_CHOWN in a capability set
+const capChown = 1 << 0
+
+// owner is who the files in the mount belong to, the user running onedriver
+// unless the UID or GID options say otherwise.
+func (o Options) owner() (uid uint32, gid uint32) {
+	uid, gid = uint32(os.Getuid()), uint32(os.Getgid())
+	if o.UID != nil {
+		uid = *o.UID
+	}
+	if o.GID != nil {
+		gid = *o.GID
+	}
+	return uid, gid
+}
+
+// CheckOwner returns an error if the files in the mount would belong to someone
+// else than the user running onedriver, and that user is not allowed to give
+// files away (it is neither root nor has CAP_CHOWN).
+func CheckOwner(options Options) error {
+	uid, gid := options.owner()
+	if uid == uint32(os.Getuid()) && gid == uint32(os.Getgid()) {
+		return nil
+	}
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	caps, err := effectiveCapabilities()
+	if err != nil {
+		return fmt.Errorf("could not check for CAP_CHOWN: %w", err)
+	}
+	if caps&capChown == 0 {
+		return fmt.Errorf("only root or a user with CAP_CHOWN can mount files owned "+
+			"by uid %d and gid %d", uid, gid)
+	}
+	return nil
+}
+
+// effectiveCapabilities reads the effective capability set of this process.
+func effectiveCapabilities() (uint64, error) {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "CapEff:") {
+			return strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no CapEff in /proc/self/status")
+}
@@ -0,0 +1,29 @@
+package fs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Files should belong to whoever runs onedriver unless configured otherwise.
+func TestOwner(t *testing.T) {
+	t.Parallel()
+	uid, gid := Options{}.owner()
+	assert.EqualValues(t, os.Getuid(), uid)
+	assert.EqualValues(t, os.Getgid(), gid)
+	assert.NoError(t, CheckOwner(Options{}))
+
+	other := uint32(54321)
+	uid, gid = Options{UID: &other}.owner()
+	assert.Equal(t, other, uid)
+	assert.EqualValues(t, os.Getgid(), gid)
+
+	caps, err := effectiveCapabilities()
+	assert.NoError(t, err)
+	if os.Geteuid() != 0 && caps&capChown == 0 {
+		assert.Error(t, CheckOwner(Options{UID: &other}),
+			"An unprivileged user was allowed to give away files.")
+	}
+}
@@ -0,0 +1,117 @@
+package fs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// the default for Options.UploadGraceSeconds
+const defaultUploadGraceTTL = 30 * time.Second
+
+// recentUploads remembers what the server told us about items we just uploaded.
+// OneDrive is only eventually consistent, so for a little while after an upload
+// both deltas and GetItem can hand back the item's previous metadata. Trusting
+// those would make us throw away the content we just wrote and download the old
+// version again.
+type recentUploads struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]recentUpload // item id -> result of its last upload
+}
+
+type recentUpload struct {
+	etag    string
+	hash    string
+	expires time.Time
+	skipped bool // server metadata was ignored, the item needs a second look
+}
+
+func newRecentUploads(ttl time.Duration) *recentUploads {
+	return &recentUploads{
+		ttl:     ttl,
+		entries: make(map[string]recentUpload),
+	}
+}
+
+// add records the ETag and content hash the server returned for an upload.
+func (r *recentUploads) add(id string, etag string, hash string) {
+	if r.ttl <= 0 {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	for id, entry := range r.entries {
+		if now.After(entry.expires) && !entry.skipped {
+			delete(r.entries, id)
+		}
+	}
+	r.entries[id] = recentUpload{etag: etag, hash: hash, expires: now.Add(r.ttl)}
+}
+
+// stale returns true if server metadata for an item contradicts what we got back
+// from uploading it a moment ago. Once the server returns metadata matching our
+// upload, it has caught up and nothing is ignored anymore.
+func (r *recentUploads) stale(delta *graph.DriveItem) bool {
+	r.Lock()
+	defer r.Unlock()
+	entry, exists := r.entries[delta.ID]
+	if !exists {
+		return false
+	}
+	if time.Now().After(entry.expires) || delta.ETagIsMatch(entry.etag) ||
+		delta.VerifyChecksum(entry.hash) {
+		delete(r.entries, delta.ID)
+		return false
+	}
+	entry.skipped = true
+	r.entries[delta.ID] = entry
+	return true
+}
+
+// expired returns the items that had server metadata ignored and are past their
+// grace window. They are forgotten, so whatever the server says about them now
+// is trusted.
+func (r *recentUploads) expired() []string {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	ids := make([]string, 0)
+	for id, entry := range r.entries {
+		if entry.skipped && now.After(entry.expires) {
+			ids = append(ids, id)
+			delete(r.entries, id)
+		}
+	}
+	return ids
+}
+
+// recheckLater has an item returned by expired again next time.
+func (r *recentUploads) recheckLater(id string) {
+	r.Lock()
+	defer r.Unlock()
+	r.entries[id] = recentUpload{skipped: true}
+}
+
+// recheckRecentUploads fetches items again that had server metadata ignored
+// during their grace window. That metadata might not have been stale after all,
+// and the server won't send it a second time.
+func (f *Filesystem) recheckRecentUploads() {
+	for _, id := range f.recent.expired() {
+		item, err := getItem(id, f.auth)
+		if err != nil {
+			if graph.IsOffline(err) || graph.IsTransient(err) {
+				f.recent.recheckLater(id)
+			}
+			log.Warn().Err(err).Str("id", id).
+				Msg("Could not recheck item after ignoring its server metadata.")
+			continue
+		}
+		if err := f.applyDelta(item); err != nil {
+			f.deltaFailed(item, err)
+		}
+	}
+}
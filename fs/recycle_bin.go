@@ -0,0 +1,207 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The Graph API can restore items from the recycle bin, but can't list what is
+// in it. Instead we remember what gets deleted, whether from the mount or by
+// changes from the server, and list that in .onedriver/recycle-bin. Moving an
+// item out of that folder restores it.
+const (
+	recycleBinDirID = virtualIDPrefix + "recycle-bin"
+	recycledID      = virtualIDPrefix + "recycled-" // followed by the item's ID
+)
+
+// OneDrive empties its recycle bin of items older than this on its own
+const recycleBinRetention = 30 * 24 * time.Hour
+
+// deleted items that can still be restored, by ID
+var bucketRecycleBin = []byte("recycleBin")
+
+// recycledItem is an item that was deleted and should still be in the recycle
+// bin on the server.
+type recycledItem struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Size    uint64    `json:"size"`
+	IsDir   bool      `json:"isDir"`
+	Deleted time.Time `json:"deleted"`
+}
+
+// recordDeleted remembers that an item was deleted so it can be restored from
+// .onedriver/recycle-bin later. Items that never made it to the server are gone
+// for good.
+func (f *Filesystem) recordDeleted(inode *Inode) {
+	inode.RLock()
+	item := recycledItem{
+		ID:      inode.DriveItem.ID,
+		Name:    inode.DriveItem.Name,
+		Size:    inode.DriveItem.Size,
+		IsDir:   inode.DriveItem.IsDir(),
+		Deleted: time.Now(),
+	}
+	inode.RUnlock()
+	if isLocalID(item.ID) || isVirtualID(item.ID) {
+		return
+	}
+	data, _ := json.Marshal(item)
+	f.db.Batch(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketRecycleBin)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(item.ID), data)
+	})
+}
+
+// recycledItems returns what is still in the recycle bin, most recently deleted
+// first. Items that the server has emptied from the recycle bin by now are
+// forgotten.
+func (f *Filesystem) recycledItems() []recycledItem {
+	items := make([]recycledItem, 0)
+	expired := make([][]byte, 0)
+	f.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketRecycleBin)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k []byte, v []byte) error {
+			var item recycledItem
+			if json.Unmarshal(v, &item) != nil ||
+				time.Since(item.Deleted) > recycleBinRetention {
+				expired = append(expired, append([]byte{}, k...))
+				return nil
+			}
+			items = append(items, item)
+			return nil
+		})
+	})
+	if len(expired) > 0 {
+		f.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(bucketRecycleBin)
+			for _, k := range expired {
+				b.Delete(k)
+			}
+			return nil
+		})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Deleted.After(items[j].Deleted)
+	})
+	return items
+}
+
+// forgetDeleted removes an item from the recycle bin listing.
+func (f *Filesystem) forgetDeleted(id string) {
+	f.db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucketRecycleBin); b != nil {
+			return b.Delete([]byte(id))
+		}
+		return nil
+	})
+	f.DeleteID(recycledID + id)
+}
+
+// recycleBin returns the virtual folder listing the deleted items that can be
+// restored. Its contents are placeholders that can't be opened, only moved out
+// of the folder.
+func (f *Filesystem) recycleBin() *Inode {
+	dir := f.virtualDir(recycleBinDirID, "recycle-bin", virtualDirID)
+	items := f.recycledItems()
+
+	children := make([]string, 0, len(items))
+	subdir := uint32(0)
+	taken := make(map[string]bool)
+	for _, item := range items {
+		// the same name can be deleted more than once, the most recent one gets
+		// to keep it
+		name := item.Name
+		for n := 2; taken[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s (%d)", item.Name, n)
+		}
+		taken[strings.ToLower(name)] = true
+
+		id := recycledID + item.ID
+		if entry, exists := f.metadata.Load(id); exists {
+			inode := entry.(*Inode)
+			inode.Lock()
+			inode.DriveItem.Name = name
+			inode.Unlock()
+		} else {
+			mode := uint32(fuse.S_IFREG | 0444)
+			if item.IsDir {
+				mode = fuse.S_IFDIR | 0555
+			}
+			deleted := item.Deleted
+			inode := NewInode(name, mode, dir)
+			inode.DriveItem.ID = id
+			inode.DriveItem.Size = item.Size
+			inode.DriveItem.ModTime = &deleted
+			if item.IsDir {
+				inode.DriveItem.Folder = &graph.Folder{}
+			}
+			if _, loaded := f.metadata.LoadOrStore(id, inode); !loaded {
+				f.InsertNodeID(inode)
+			}
+		}
+		children = append(children, id)
+		if item.IsDir {
+			subdir++
+		}
+	}
+
+	dir.Lock()
+	dir.children = children
+	dir.subdir = subdir
+	dir.Unlock()
+	return dir
+}
+
+// restore brings an item listed in the recycle bin back into the folder with
+// parentID under a new name.
+func (f *Filesystem) restore(placeholder *Inode, parentID string, name string) fuse.Status {
+	id := strings.TrimPrefix(placeholder.ID(), recycledID)
+	ctx := log.With().
+		Str("op", "Restore").
+		Str("id", id).
+		Str("parentID", parentID).
+		Str("name", name).
+		Logger()
+	if f.IsOffline() {
+		return fuse.EROFS
+	}
+	if existing, _ := f.GetChild(parentID, name, f.auth); existing != nil {
+		// the server would rename the restored item instead
+		return fuse.Status(syscall.EEXIST)
+	}
+
+	item, err := restoreItem(id, name, parentID, f.auth)
+	if err != nil {
+		ctx.Error().Err(err).Msg("Could not restore item from the recycle bin.")
+		if graph.StatusCode(err) == http.StatusNotFound {
+			// emptied from the recycle bin by someone else
+			f.forgetDeleted(id)
+			return fuse.ENOENT
+		}
+		return fuse.EREMOTEIO
+	}
+	ctx.Info().Msg("Restored item from the recycle bin.")
+	f.forgetDeleted(id)
+	if item.Parent == nil {
+		item.Parent = &graph.DriveItemParent{}
+	}
+	f.InsertChild(parentID, f.newServerInode(item))
+	return fuse.OK
+}
@@ -0,0 +1,80 @@
+package fs
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Deleted items should show up in .onedriver/recycle-bin, and moving them out
+// of it should restore them.
+func TestRecycleBinRestore(t *testing.T) {
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_recycle_bin"), Options{})
+	oldRestore := restoreItem
+	defer func() { restoreItem = oldRestore }()
+	var restored []string
+	restoreItem = func(id, name, parentID string, auth *graph.Auth) (*graph.DriveItem, error) {
+		restored = append(restored, id)
+		return &graph.DriveItem{
+			ID:     id,
+			Name:   name,
+			Size:   5,
+			File:   &graph.File{},
+			Parent: &graph.DriveItemParent{ID: parentID},
+		}, nil
+	}
+
+	for _, id := range []string{"recycled-older", "recycled-newer"} {
+		deleted := NewInodeDriveItem(&graph.DriveItem{
+			ID:     id,
+			Name:   "notes.txt",
+			Size:   5,
+			File:   &graph.File{},
+			Parent: &graph.DriveItemParent{ID: cache.root},
+		})
+		cache.recordDeleted(deleted)
+	}
+
+	bin, err := cache.GetPath("/.onedriver/recycle-bin", auth)
+	require.NoError(t, err)
+	require.NotNil(t, bin)
+	children, err := cache.GetChildrenID(bin.ID(), auth)
+	require.NoError(t, err)
+	require.Contains(t, children, "notes.txt")
+	require.Contains(t, children, "notes.txt (2)",
+		"Items deleted under the same name should all be listed.")
+	assert.Equal(t, uint64(5), children["notes.txt"].Size())
+
+	status := cache.Open(context.Background().Done(),
+		&fuse.OpenIn{InHeader: fuse.InHeader{NodeId: children["notes.txt"].NodeID()}},
+		&fuse.OpenOut{})
+	assert.Equal(t, fuse.EACCES, status, "Deleted items can't be read until restored.")
+
+	root := cache.GetID(cache.root)
+	status = cache.Rename(context.Background().Done(),
+		&fuse.RenameIn{
+			InHeader: fuse.InHeader{NodeId: bin.NodeID()},
+			Newdir:   root.NodeID(),
+		},
+		"notes.txt (2)", "restored_notes.txt")
+	require.Equal(t, fuse.OK, status)
+	assert.Equal(t, []string{"recycled-older"}, restored,
+		"The wrong item was restored.")
+
+	inode, err := cache.GetPath("/restored_notes.txt", auth)
+	require.NoError(t, err)
+	require.NotNil(t, inode, "Restored item did not show up where it was moved to.")
+	assert.Equal(t, "recycled-older", inode.ID())
+
+	bin, err = cache.GetPath("/.onedriver/recycle-bin", auth)
+	require.NoError(t, err)
+	children, err = cache.GetChildrenID(bin.ID(), auth)
+	require.NoError(t, err)
+	assert.Len(t, children, 1)
+	assert.Contains(t, children, "notes.txt")
+}
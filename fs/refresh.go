@@ -0,0 +1,76 @@
+package fs
+
+import (
+	"errors"
+	"path/filepath"
+	"syscall"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// setting this extended attribute on a directory in the mount fetches its
+// contents from the server again
+const xattrRefresh = xattrPrefix + "refresh"
+
+// RequestRefresh asks the onedriver instance serving a directory to fetch its
+// contents from the server again.
+func RequestRefresh(dir string) error {
+	return syscall.Setxattr(dir, xattrRefresh, []byte("1"), 0)
+}
+
+// RefreshChildren fetches a directory's children from the server and applies
+// the differences to our cached copy, as if deltas had arrived for them. Meant
+// for when something changed on the server and the delta for it has not shown
+// up yet. Items that were never uploaded are left alone.
+func (f *Filesystem) RefreshChildren(id string) error {
+	dir := f.GetID(id)
+	if dir == nil || !dir.IsDir() {
+		return errors.New("not a directory in cache")
+	}
+	fetched, err := graph.GetItemChildren(id, f.auth)
+	if err != nil {
+		return err
+	}
+	cached, err := f.GetChildrenID(id, f.auth)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("id", id).Str("path", dir.Path()).Int("children", len(fetched)).
+		Msg("Refreshing directory contents.")
+
+	dirPath := dir.Path()
+	onServer := make(map[string]bool, len(fetched))
+	for _, item := range fetched {
+		if f.opts.isIgnored(filepath.Join(dirPath, item.Name)) {
+			continue
+		}
+		item = f.resolveShortcut(item)
+		onServer[item.ID] = true
+		if item.Parent == nil {
+			item.Parent = &graph.DriveItemParent{}
+		}
+		item.Parent.ID = id
+		if err := f.applyDelta(item); err != nil {
+			log.Warn().Err(err).Str("id", item.ID).Msg("Could not refresh child.")
+		}
+	}
+
+	// whatever we have cached that the server doesn't know about was deleted
+	for _, child := range cached {
+		childID := child.ID()
+		if onServer[childID] || isLocalID(childID) || child.KeepLocal() {
+			continue
+		}
+		child.RLock()
+		gone := child.DriveItem
+		child.RUnlock()
+		gone.Deleted = &graph.Deleted{State: "deleted"}
+		if err := f.applyDelta(&gone); err != nil {
+			log.Warn().Err(err).Str("id", childID).Msg("Could not remove deleted child.")
+		}
+	}
+	f.negative.invalidate(id)
+	f.reconcileSubdirs(id)
+	return nil
+}
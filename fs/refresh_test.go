@@ -0,0 +1,47 @@
+package fs
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Something created on the server should show up in a folder whose contents are
+// already cached after a refresh, without waiting for its delta.
+func TestRefreshChildren(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_refresh_children"), Options{})
+	tests, err := cache.GetPath("/onedriver_tests", auth)
+	require.NoError(t, err)
+	folder, err := graph.Mkdir("refresh_children", tests.ID(), auth)
+	require.NoError(t, err)
+	gone, err := graph.Mkdir("deleted_elsewhere", folder.ID, auth)
+	require.NoError(t, err)
+
+	dir, err := cache.GetPath("/onedriver_tests/refresh_children", auth)
+	require.NoError(t, err)
+	children, err := cache.GetChildrenID(dir.ID(), auth)
+	require.NoError(t, err)
+	require.Contains(t, children, "deleted_elsewhere")
+
+	added, err := graph.Mkdir("added_elsewhere", folder.ID, auth)
+	require.NoError(t, err)
+	require.NoError(t, graph.Remove(gone.ID, auth))
+	children, err = cache.GetChildrenID(dir.ID(), auth)
+	require.NoError(t, err)
+	require.NotContains(t, children, "added_elsewhere", "Children were not cached.")
+
+	status := cache.SetXAttr(nil, &fuse.SetXAttrIn{InHeader: fuse.InHeader{NodeId: dir.NodeID()}},
+		xattrRefresh, []byte("1"))
+	require.Equal(t, fuse.OK, status)
+	children, err = cache.GetChildrenID(dir.ID(), auth)
+	require.NoError(t, err)
+	if assert.Contains(t, children, "added_elsewhere", "New child did not show up after a refresh.") {
+		assert.Equal(t, added.ID, children["added_elsewhere"].ID())
+	}
+	assert.NotContains(t, children, "deleted_elsewhere", "Deleted child is still there after a refresh.")
+}
@@ -0,0 +1,153 @@
+package fs
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// ReservedNamesReject refuses to create items with names OneDrive does not
+	// allow (like "CON" or "notes."), the same way an invalid character would be
+	// refused. This is the default.
+	ReservedNamesReject = "reject"
+	// ReservedNamesMangle creates them anyways, but uploads them under a name
+	// OneDrive does allow. Disallowed characters are swapped for lookalikes
+	// (":" becomes "：", a trailing "." becomes "．"), and the original name is
+	// shown in the mount.
+	ReservedNamesMangle = "mangle"
+)
+
+// mangled server names -> the names they were mangled from
+var bucketMangled = []byte("mangled")
+
+// fullwidth lookalikes for the characters OneDrive does not allow in names
+var mangledChars = strings.NewReplacer(
+	`"`, "＂", "*", "＊", ":", "：", "<", "＜", ">", "＞", "?", "？", `\`, "＼", "|", "｜",
+)
+
+// mangleName turns a name that OneDrive does not allow into one that it does.
+// Names that are allowed are returned as-is.
+func mangleName(name string) string {
+	if !isNameRestricted(name) {
+		return name
+	}
+	mangled := mangledChars.Replace(name)
+
+	// dots and spaces are fine everywhere but the end
+	trimmed := strings.TrimRight(mangled, ". ")
+	for _, c := range mangled[len(trimmed):] {
+		if c == '.' {
+			trimmed += "．"
+		} else {
+			trimmed += "␠"
+		}
+	}
+	mangled = trimmed
+
+	// reserved names and parts of names are broken up by swapping their first
+	// letter for its fullwidth version
+	for i := 0; isNameRestricted(mangled) && i < len(name); i++ {
+		start := 0
+		if loc := disallowedRexp.FindStringIndex(mangled); loc != nil {
+			start = loc[0]
+		}
+		c, size := utf8.DecodeRuneInString(mangled[start:])
+		if c < '!' || c > '~' {
+			break
+		}
+		mangled = mangled[:start] + string(c+0xFEE0) + mangled[start+size:]
+	}
+	return mangled
+}
+
+// serverName returns the name an item created in the mount with the given name
+// should have on the server. ok is false if the name is not allowed.
+func (f *Filesystem) serverName(name string) (serverName string, ok bool) {
+	if !isNameRestricted(name) {
+		return name, true
+	}
+	if f.opts.ReservedNames != ReservedNamesMangle {
+		return "", false
+	}
+	serverName = mangleName(name)
+	if isNameRestricted(serverName) {
+		return "", false
+	}
+	log.Info().Str("name", name).Str("serverName", serverName).
+		Msg("Name is not allowed on OneDrive, mangling it.")
+	err := f.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMangled).Put([]byte(serverName), []byte(name))
+	})
+	if err != nil {
+		log.Error().Err(err).Str("name", name).Msg("Could not record mangled name.")
+	}
+	return serverName, true
+}
+
+// lookupName translates a name looked up in the mount to the name the item has
+// on the server. This is done no matter how reservedNames is set, items mangled
+// before it was changed are still listed under their original names.
+func (f *Filesystem) lookupName(name string) string {
+	return mangleName(name)
+}
+
+// forgetMangledName drops the record of what a server name was mangled from,
+// once the item with that name was deleted or renamed.
+func (f *Filesystem) forgetMangledName(serverName string) {
+	if isASCII(serverName) {
+		return
+	}
+	err := f.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMangled).Delete([]byte(serverName))
+	})
+	if err != nil {
+		log.Error().Err(err).Str("serverName", serverName).
+			Msg("Could not forget mangled name.")
+	}
+}
+
+// unmangledName returns the name an item was created with in the mount, if the
+// name it has on the server was mangled.
+func (f *Filesystem) unmangledName(name string) string {
+	return f.unmangledNames([]string{name})[0]
+}
+
+// unmangledNames is unmangledName for all the names in a directory listing at
+// once.
+func (f *Filesystem) unmangledNames(names []string) []string {
+	originals := make([]string, len(names))
+	copy(originals, names)
+	mangled := false
+	for _, name := range names {
+		// mangled names always contain a lookalike character
+		mangled = mangled || !isASCII(name)
+	}
+	if !mangled {
+		return originals
+	}
+	f.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMangled)
+		for i, name := range names {
+			if isASCII(name) {
+				continue
+			}
+			if v := b.Get([]byte(name)); v != nil {
+				originals[i] = string(v)
+			}
+		}
+		return nil
+	})
+	return originals
+}
+
+func isASCII(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package fs
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMangleName(t *testing.T) {
+	t.Parallel()
+	for name, expected := range map[string]string{
+		"normal.txt":      "normal.txt",
+		"CON":             "ＣON",
+		"nul":             "ｎul",
+		"notes.":          "notes．",
+		"notes. ":         "notes．␠",
+		"what?: really":   "what？： really",
+		"desktop.ini":     "ｄesktop.ini",
+		"LPT1.txt":        "ＬPT1.txt",
+		"page_vti_1.html": "page＿vti_1.html",
+	} {
+		mangled := mangleName(name)
+		assert.Equal(t, expected, mangled, "Unexpected mangled name for %q.", name)
+		assert.False(t, isNameRestricted(mangled), "Mangled name %q is still not allowed.", mangled)
+	}
+}
+
+// With reservedNames set to mangle, items with names OneDrive does not allow
+// should be created under a different name on the server, but keep their
+// original name in the mount.
+func TestReservedNamesMangle(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_reserved_names_mangle"),
+		Options{ReservedNames: ReservedNamesMangle})
+	root := fuse.InHeader{NodeId: 1}
+
+	for name, serverName := range map[string]string{"CON": "ＣON", "trailing.": "trailing．"} {
+		out := &fuse.CreateOut{}
+		require.Equal(t, fuse.OK, cache.Create(
+			nil, &fuse.CreateIn{InHeader: root, Mode: 0644 | fuse.S_IFREG}, name, out,
+		), "Could not create %q.", name)
+		inode := cache.GetNodeID(out.NodeId)
+		require.NotNil(t, inode)
+		assert.Equal(t, serverName, inode.Name(), "Name was not mangled for the server.")
+		assert.Equal(t, name, cache.unmangledName(inode.Name()), "Original name was not recorded.")
+
+		lookup := &fuse.EntryOut{}
+		require.Equal(t, fuse.OK, cache.Lookup(nil, &root, name, lookup),
+			"Could not look up %q by its original name.", name)
+		assert.Equal(t, out.NodeId, lookup.NodeId)
+
+		// it is still listed under its original name after switching back
+		cache.opts.ReservedNames = ReservedNamesReject
+		assert.Equal(t, fuse.OK, cache.Lookup(nil, &root, name, &fuse.EntryOut{}),
+			"Could not look up %q after switching to reject.", name)
+		cache.opts.ReservedNames = ReservedNamesMangle
+
+		require.Equal(t, fuse.OK, cache.Unlink(nil, &root, name))
+		assert.Equal(t, serverName, cache.unmangledName(serverName),
+			"Original name of %q was not forgotten after deleting it.", name)
+	}
+
+	rejecting := NewFilesystem(auth, filepath.Join(testDBLoc, "test_reserved_names_reject"), Options{})
+	assert.Equal(t, fuse.EINVAL, rejecting.Create(
+		nil, &fuse.CreateIn{InHeader: root, Mode: 0644 | fuse.S_IFREG}, "CON", &fuse.CreateOut{},
+	))
+}
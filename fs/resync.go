@@ -0,0 +1,125 @@
+package fs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrUnsyncedChanges is returned by Resync when local changes have not made it
+// to the server yet, and would be lost along with the metadata.
+var ErrUnsyncedChanges = errors.New("there are local changes that have not been uploaded yet")
+
+// bucketResynced maps folders to the files kept local in them when the cache was
+// resynced. The server does not know these files, so they have to be added back
+// to the folder's children by hand once it is fetched again.
+var bucketResynced = []byte("resynced")
+
+// Resync throws away the metadata and delta state stored in a mount's cache
+// directory, so the next time it is mounted onedriver rebuilds its view of the
+// drive from the server. Cached file content and auth tokens are kept, content
+// that still matches the server's hash is used as-is instead of downloaded
+// again. Local-only metadata like UNIX modes is lost, except for files that are
+// kept local, which are never on the server and carried over as they are. Must
+// not be run while the cache directory is mounted.
+func Resync(cacheDir string) error {
+	db, err := bolt.Open(
+		filepath.Join(cacheDir, "onedriver.db"),
+		0600,
+		&bolt.Options{Timeout: time.Second * 5},
+	)
+	if err != nil {
+		return fmt.Errorf("could not open db, is it still mounted? %w", err)
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketUploads, bucketDirty} {
+			if b := tx.Bucket(name); b != nil && b.Stats().KeyN > 0 {
+				return ErrUnsyncedChanges
+			}
+		}
+		keepLocal := make(map[string][]byte)
+		relink := make(map[string][]string)
+		if b := tx.Bucket(bucketMetadata); b != nil {
+			err := b.ForEach(func(k []byte, v []byte) error {
+				if !isLocalID(string(k)) {
+					return nil
+				}
+				// files that are kept local are never uploaded, waiting won't help
+				if inode, err := NewInodeJSON(v); err == nil && inode.KeepLocal() {
+					keepLocal[string(k)] = append([]byte(nil), v...)
+					parentID := inode.ParentID()
+					relink[parentID] = append(relink[parentID], string(k))
+					return nil
+				}
+				return ErrUnsyncedChanges
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		buckets := [][]byte{
+			bucketMetadata, bucketDelta, bucketDeltaPending, bucketDeltaFailed, bucketResynced,
+		}
+		for _, name := range buckets {
+			if err := tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		if len(keepLocal) == 0 {
+			return nil
+		}
+		metadata, err := tx.CreateBucket(bucketMetadata)
+		if err != nil {
+			return err
+		}
+		for id, v := range keepLocal {
+			if err := metadata.Put([]byte(id), v); err != nil {
+				return err
+			}
+		}
+		resynced, err := tx.CreateBucket(bucketResynced)
+		if err != nil {
+			return err
+		}
+		for parentID, childIDs := range relink {
+			payload, _ := json.Marshal(childIDs)
+			if err := resynced.Put([]byte(parentID), payload); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// relinkResynced adds the files that were carried over by Resync back to the
+// children of a folder that was just fetched from the server. Must be called with
+// the folder's lock held.
+func (f *Filesystem) relinkResynced(parent *Inode, children map[string]*Inode) {
+	id := parent.DriveItem.ID
+	var childIDs []string
+	f.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucketResynced); b != nil {
+			if payload := b.Get([]byte(id)); payload != nil {
+				json.Unmarshal(payload, &childIDs)
+			}
+		}
+		return nil
+	})
+	for _, childID := range childIDs {
+		// skip files that were deleted or moved elsewhere since
+		child := f.GetID(childID)
+		if child == nil || child.ParentID() != id {
+			continue
+		}
+		children[strings.ToLower(child.Name())] = child
+		parent.children = append(parent.children, childID)
+	}
+}
@@ -0,0 +1,108 @@
+package fs
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Resyncing should forget the metadata and delta state, but keep everything else,
+// and refuse to do anything while there are changes that would be lost.
+func TestResync(t *testing.T) {
+	t.Parallel()
+	cacheDir := t.TempDir()
+	dbPath := filepath.Join(cacheDir, "onedriver.db")
+	db, err := bolt.Open(dbPath, 0600, nil)
+	require.NoError(t, err)
+	local := NewInodeDriveItem(&graph.DriveItem{ID: localID(), Name: "new.txt"})
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		metadata, _ := tx.CreateBucket(bucketMetadata)
+		metadata.Put([]byte("root"), []byte("{}"))
+		metadata.Put([]byte(local.ID()), local.AsJSON())
+		delta, _ := tx.CreateBucket(bucketDelta)
+		delta.Put([]byte("deltaLink"), []byte("/me/drive/root/delta?token=abc"))
+		pending, _ := tx.CreateBucket(bucketDeltaPending)
+		pending.Put([]byte("0"), []byte("{}"))
+		hashes, _ := tx.CreateBucket(bucketHashes)
+		hashes.Put([]byte("root"), []byte("{}"))
+		tx.CreateBucket(bucketDirty)
+		return nil
+	}))
+	require.NoError(t, db.Close())
+
+	assert.ErrorIs(t, Resync(cacheDir), ErrUnsyncedChanges,
+		"Resynced although a local file was never uploaded.")
+
+	// the same file, but kept local
+	db, err = bolt.Open(dbPath, 0600, nil)
+	require.NoError(t, err)
+	local.keepLocal = true
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMetadata).Put([]byte(local.ID()), local.AsJSON())
+	}))
+	require.NoError(t, db.Close())
+
+	require.NoError(t, Resync(cacheDir))
+	db, err = bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second})
+	require.NoError(t, err)
+	defer db.Close()
+	db.View(func(tx *bolt.Tx) error {
+		metadata := tx.Bucket(bucketMetadata)
+		require.NotNil(t, metadata, "Files that are kept local were thrown away.")
+		assert.Nil(t, metadata.Get([]byte("root")), "Metadata was not reset.")
+		assert.Equal(t, local.AsJSON(), metadata.Get([]byte(local.ID())),
+			"File that is kept local was not carried over.")
+		assert.Nil(t, tx.Bucket(bucketDelta), "Delta link was not reset.")
+		assert.Nil(t, tx.Bucket(bucketDeltaPending), "Pending deltas were not reset.")
+		assert.NotNil(t, tx.Bucket(bucketHashes), "Content hashes were thrown away.")
+		return nil
+	})
+}
+
+// Pending uploads would be orphaned by resyncing, so they have to finish first.
+func TestResyncPendingUpload(t *testing.T) {
+	t.Parallel()
+	cacheDir := t.TempDir()
+	db, err := bolt.Open(filepath.Join(cacheDir, "onedriver.db"), 0600, nil)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		tx.CreateBucket(bucketMetadata)
+		uploads, _ := tx.CreateBucket(bucketUploads)
+		payload, _ := json.Marshal(&UploadSession{ID: "some-id"})
+		return uploads.Put([]byte("some-id"), payload)
+	}))
+	require.NoError(t, db.Close())
+
+	assert.ErrorIs(t, Resync(cacheDir), ErrUnsyncedChanges)
+}
+
+// Files that are kept local are not part of the server's listing of their folder,
+// but they should still show up in it after resyncing.
+func TestResyncListsKeptLocalFiles(t *testing.T) {
+	t.Parallel()
+	dbPath := filepath.Join(testDBLoc, "test_resync_lists_kept_local")
+	cache := NewFilesystem(auth, dbPath, Options{})
+	tests, err := cache.GetPath("/onedriver_tests", auth)
+	require.NoError(t, err)
+	local, err := cache.CreateLocalFile(tests.ID(), "resync_kept_local.txt", []byte("local"))
+	require.NoError(t, err)
+	cache.SerializeAll()
+	require.NoError(t, cache.db.Close())
+
+	require.NoError(t, Resync(dbPath))
+	cache = NewFilesystem(auth, dbPath, Options{})
+	tests, err = cache.GetPath("/onedriver_tests", auth)
+	require.NoError(t, err)
+	children, err := cache.GetChildrenID(tests.ID(), auth)
+	require.NoError(t, err)
+	if assert.Contains(t, children, "resync_kept_local.txt",
+		"File that is kept local was not listed after resyncing.") {
+		assert.Equal(t, local.ID(), children["resync_kept_local.txt"].ID())
+	}
+}
@@ -0,0 +1,153 @@
+package fs
+
+import (
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// Virtual items only exist inside onedriver, they are never uploaded or
+// serialized. They live under a ".onedriver" folder in the root of the mount,
+// which does not show up in listings but can be accessed by name.
+const (
+	virtualDirName  = ".onedriver"
+	virtualIDPrefix = "virtual-"
+	virtualDirID    = virtualIDPrefix + "onedriver"
+	searchDirID     = virtualIDPrefix + "search"
+	searchQueryID   = virtualIDPrefix + "search-" // followed by the query
+	sharedDirID     = virtualIDPrefix + "shared"
+	tagsDirID       = virtualIDPrefix + "tags"
+	tagQueryID      = virtualIDPrefix + "tag-" // followed by the tag
+)
+
+func isVirtualID(id string) bool {
+	return strings.HasPrefix(id, virtualIDPrefix)
+}
+
+// virtualChild looks up a virtual item by name, returns nil if there is no such
+// item. Looking up a folder in .onedriver/search runs the folder's name as a
+// search query, its contents are the results. .onedriver/tags works the same
+// way, for finding items by tag. .onedriver/shared contains what other people
+// have shared with us, .onedriver/recycle-bin what was deleted recently.
+func (f *Filesystem) virtualChild(parentID string, name string, auth *graph.Auth) *Inode {
+	switch {
+	case parentID == f.root && strings.EqualFold(name, virtualDirName):
+		dir := f.virtualDir(virtualDirID, virtualDirName, f.root)
+		f.virtualDir(searchDirID, "search", virtualDirID)
+		f.virtualDir(sharedDirID, "shared", virtualDirID)
+		f.virtualDir(tagsDirID, "tags", virtualDirID)
+		f.virtualDir(recycleBinDirID, "recycle-bin", virtualDirID)
+		dir.Lock()
+		dir.children = []string{searchDirID, sharedDirID, tagsDirID, recycleBinDirID}
+		dir.subdir = 4
+		dir.Unlock()
+		return dir
+	case parentID == virtualDirID && strings.EqualFold(name, "search"):
+		return f.virtualDir(searchDirID, "search", virtualDirID)
+	case parentID == virtualDirID && strings.EqualFold(name, "shared"):
+		return f.sharedWithMe(auth)
+	case parentID == virtualDirID && strings.EqualFold(name, "tags"):
+		return f.virtualDir(tagsDirID, "tags", virtualDirID)
+	case parentID == virtualDirID && strings.EqualFold(name, "recycle-bin"):
+		return f.recycleBin()
+	case parentID == searchDirID:
+		return f.search(name, auth)
+	case parentID == tagsDirID:
+		return f.tagged(name, auth)
+	}
+	return nil
+}
+
+// virtualDir returns a virtual folder, creating it if it does not exist yet.
+func (f *Filesystem) virtualDir(id string, name string, parentID string) *Inode {
+	if entry, exists := f.metadata.Load(id); exists {
+		return entry.(*Inode)
+	}
+	dir := NewInode(name, fuse.S_IFDIR|0555, f.GetID(parentID))
+	dir.DriveItem.ID = id
+	dir.DriveItem.Folder = &graph.Folder{}
+	if entry, loaded := f.metadata.LoadOrStore(id, dir); loaded {
+		return entry.(*Inode)
+	}
+	f.InsertNodeID(dir)
+	return dir
+}
+
+// search runs a search query and returns a virtual folder containing the
+// results. Results are the actual items, so reading them works like anywhere
+// else in the mount.
+func (f *Filesystem) search(query string, auth *graph.Auth) *Inode {
+	if f.IsOffline() {
+		return nil
+	}
+	results, err := searchItems(query, auth)
+	if err != nil {
+		log.Error().Err(err).Str("query", query).Msg("Search failed.")
+		return nil
+	}
+
+	children, subdir := f.insertResults(results)
+	dir := f.virtualDir(searchQueryID+strings.ToLower(query), query, searchDirID)
+	dir.Lock()
+	dir.children = children
+	dir.subdir = subdir
+	dir.Unlock()
+	log.Debug().Str("query", query).Int("results", len(children)).Msg("Searched drive.")
+	return dir
+}
+
+// tagged returns a virtual folder containing the items found for a tag. Tags
+// can't be queried on their own, and the items we get back don't say which tags
+// they have, so this is a search for the tag and which results match is up to
+// the server.
+func (f *Filesystem) tagged(tag string, auth *graph.Auth) *Inode {
+	if f.IsOffline() {
+		return nil
+	}
+	results, err := searchItems(tag, auth)
+	if err != nil {
+		log.Error().Err(err).Str("tag", tag).Msg("Search for tagged items failed.")
+		return nil
+	}
+
+	children, subdir := f.insertResults(results)
+	dir := f.virtualDir(tagQueryID+strings.ToLower(tag), tag, tagsDirID)
+	dir.Lock()
+	dir.children = children
+	dir.subdir = subdir
+	dir.Unlock()
+	log.Debug().Str("tag", tag).Int("results", len(children)).Msg("Listed tagged items.")
+	return dir
+}
+
+// insertResults makes sure the items found by a query are cached, returning
+// their IDs and how many of them are folders. The items stay where they are,
+// virtual folders only list them.
+func (f *Filesystem) insertResults(items []*graph.DriveItem) ([]string, uint32) {
+	children := make([]string, 0, len(items))
+	subdir := uint32(0)
+	for _, item := range items {
+		result := f.GetID(item.ID)
+		if result == nil {
+			result = f.newServerInode(f.resolveShortcut(item))
+			f.trackRemote(result)
+			if entry, loaded := f.metadata.LoadOrStore(item.ID, result); loaded {
+				result = entry.(*Inode)
+			} else {
+				f.InsertNodeID(result)
+			}
+		}
+		children = append(children, result.ID())
+		if result.IsDir() {
+			subdir++
+		}
+	}
+	return children, subdir
+}
+
+// readOnlyDir returns true if the contents of a folder cannot be changed.
+func readOnlyDir(id string) bool {
+	return isVirtualID(id)
+}
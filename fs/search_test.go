@@ -0,0 +1,99 @@
+package fs
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Folders in .onedriver/search should contain the results of searching for
+// their name, and nothing in there can be changed.
+func TestSearchVirtualFolder(t *testing.T) {
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_search"), Options{})
+	queries := make([]string, 0)
+	oldSearch := searchItems
+	defer func() { searchItems = oldSearch }()
+	searchItems = func(query string, auth *graph.Auth) ([]*graph.DriveItem, error) {
+		queries = append(queries, query)
+		return []*graph.DriveItem{
+			{ID: "search-result-file", Name: "report.docx", Parent: &graph.DriveItemParent{ID: "elsewhere"},
+				File: &graph.File{}, Size: 42},
+			{ID: "search-result-folder", Name: "reports", Parent: &graph.DriveItemParent{ID: "elsewhere"},
+				Folder: &graph.Folder{}},
+		}, nil
+	}
+
+	root, err := cache.GetChildrenID(cache.root, auth)
+	require.NoError(t, err)
+	assert.NotContains(t, root, virtualDirName, "Virtual folder should not be listed.")
+
+	dir, err := cache.GetPath("/.onedriver/search/report", auth)
+	require.NoError(t, err)
+	require.NotNil(t, dir)
+	assert.Equal(t, []string{"report"}, queries)
+	assert.True(t, dir.IsDir())
+
+	children, err := cache.GetChildrenID(dir.ID(), auth)
+	require.NoError(t, err)
+	require.Contains(t, children, "report.docx")
+	assert.Contains(t, children, "reports")
+	assert.Equal(t, "search-result-file", children["report.docx"].ID(),
+		"Results should be the actual items so they can be read.")
+	assert.Equal(t, uint64(42), children["report.docx"].Size())
+
+	status := cache.Unlink(context.Background().Done(),
+		&fuse.InHeader{NodeId: dir.NodeID()}, "report.docx")
+	assert.Equal(t, fuse.EROFS, status, "Search results should be read-only.")
+	status = cache.Mkdir(context.Background().Done(),
+		&fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: dir.NodeID()}, Mode: 0755},
+		"new", &fuse.EntryOut{})
+	assert.Equal(t, fuse.EROFS, status, "Search results should be read-only.")
+
+	cache.SerializeAll()
+	cache.db.View(func(tx *bolt.Tx) error {
+		assert.Nil(t, tx.Bucket(bucketMetadata).Get([]byte(virtualDirID)),
+			"Virtual items should not be serialized.")
+		return nil
+	})
+}
+
+// Folders in .onedriver/tags should list what the server finds for their tag,
+// and be read-only like search results.
+func TestTagsVirtualFolder(t *testing.T) {
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_tags"), Options{})
+	oldSearch := searchItems
+	defer func() { searchItems = oldSearch }()
+	queries := make([]string, 0)
+	searchItems = func(query string, auth *graph.Auth) ([]*graph.DriveItem, error) {
+		queries = append(queries, query)
+		return []*graph.DriveItem{
+			{ID: "tagged-file", Name: "sunset.jpg", Parent: &graph.DriveItemParent{ID: "elsewhere"},
+				File: &graph.File{}},
+			{ID: "tagged-folder", Name: "vacation", Parent: &graph.DriveItemParent{ID: "elsewhere"},
+				Folder: &graph.Folder{}},
+		}, nil
+	}
+
+	dir, err := cache.GetPath("/.onedriver/tags/beach", auth)
+	require.NoError(t, err)
+	require.NotNil(t, dir)
+	assert.True(t, dir.IsDir())
+	assert.Equal(t, []string{"beach"}, queries, "Tag was not searched for.")
+
+	children, err := cache.GetChildrenID(dir.ID(), auth)
+	require.NoError(t, err)
+	assert.Len(t, children, 2)
+	require.Contains(t, children, "sunset.jpg")
+	assert.Contains(t, children, "vacation")
+	assert.Equal(t, "tagged-file", children["sunset.jpg"].ID())
+
+	status := cache.Unlink(context.Background().Done(),
+		&fuse.InHeader{NodeId: dir.NodeID()}, "sunset.jpg")
+	assert.Equal(t, fuse.EROFS, status, "Tag folders should be read-only.")
+}
@@ -59,14 +59,15 @@ func TestMain(m *testing.M) {
 	defer f.Close()
 
 	auth = graph.Authenticate(graph.AuthConfig{}, ".auth_tokens.json", false)
-	fs = NewFilesystem(auth, filepath.Join(testDBLoc, "test"))
+	// the notification loop gets a fake server in its own tests, and shouldn't
+	// be running when they swap it out
+	fs = NewFilesystem(auth, filepath.Join(testDBLoc, "test"), Options{DisableNotifications: true})
 	server, _ := fuse.NewServer(
 		fs,
 		mountLoc,
 		&fuse.MountOptions{
 			Name:          "onedriver",
 			FsName:        "onedriver",
-			DisableXAttrs: true,
 			MaxBackground: 1024,
 		},
 	)
@@ -78,6 +79,8 @@ func TestMain(m *testing.M) {
 
 	// mount fs in background thread
 	go server.Serve()
+	server.WaitMount()
+	<-fs.RunStartupTasks(CreateTrash)
 
 	// cleanup from last run
 	log.Info().Msg("Setup test environment ---------------------------------")
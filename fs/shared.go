@@ -0,0 +1,92 @@
+package fs
+
+import (
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// how long the list of items shared with us is reused before fetching it again
+const sharedRefreshInterval = 30 * time.Second
+
+// sharedWithMe returns the virtual folder holding the items other people have
+// shared with us. The items are the actual items on their owners' drives, so
+// they can be read like anywhere else in the mount, but the folder itself can't
+// be changed.
+func (f *Filesystem) sharedWithMe(auth *graph.Auth) *Inode {
+	dir := f.virtualDir(sharedDirID, "shared", virtualDirID)
+	f.sharedM.Lock()
+	defer f.sharedM.Unlock()
+	if f.IsOffline() || time.Since(f.sharedFetched) < sharedRefreshInterval {
+		return dir
+	}
+	items, err := sharedItems(auth)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not fetch items shared with us.")
+		return dir
+	}
+	f.sharedFetched = time.Now()
+
+	dirPath := dir.Path()
+	children := make([]string, 0, len(items))
+	subdir := uint32(0)
+	for _, item := range items {
+		shared := sharedItem(item, dirPath)
+		if shared == nil {
+			log.Warn().Str("id", item.ID).Str("name", item.Name).
+				Msg("Shared item did not say which drive it is on, skipping.")
+			continue
+		}
+		inode := f.GetID(shared.ID)
+		if inode == nil {
+			inode = f.newServerInode(shared)
+			f.trackRemote(inode)
+			if entry, loaded := f.metadata.LoadOrStore(shared.ID, inode); loaded {
+				inode = entry.(*Inode)
+			} else {
+				f.InsertNodeID(inode)
+			}
+		}
+		children = append(children, inode.ID())
+		if inode.IsDir() {
+			subdir++
+		}
+	}
+
+	dir.Lock()
+	dir.children = children
+	dir.subdir = subdir
+	dir.Unlock()
+	log.Debug().Int("items", len(children)).Msg("Fetched items shared with us.")
+	return dir
+}
+
+// sharedItem translates an item from the sharedWithMe listing into the item it
+// refers to on its owner's drive, placed in the folder at parentPath. Returns nil
+// if the owner's drive is unknown.
+func sharedItem(item *graph.DriveItem, parentPath string) *graph.DriveItem {
+	remote := item.RemoteItem
+	if remote == nil || remote.Parent == nil || remote.Parent.DriveID == "" {
+		return nil
+	}
+	modTime := item.ModTime
+	if modTime == nil {
+		now := time.Now()
+		modTime = &now
+	}
+	return &graph.DriveItem{
+		ID:      remote.ID,
+		Name:    item.Name,
+		Size:    remote.Size,
+		ModTime: modTime,
+		Parent: &graph.DriveItemParent{
+			ID:        sharedDirID,
+			Path:      parentPath,
+			DriveID:   remote.Parent.DriveID,
+			DriveType: remote.Parent.DriveType,
+		},
+		Folder: remote.Folder,
+		File:   remote.File,
+	}
+}
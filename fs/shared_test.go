@@ -0,0 +1,61 @@
+package fs
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// .onedriver/shared should contain the items shared with us, as the items on
+// their owners' drives so that they can be read.
+func TestSharedVirtualFolder(t *testing.T) {
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_shared"), Options{})
+	oldShared := sharedItems
+	defer func() { sharedItems = oldShared }()
+	sharedItems = func(auth *graph.Auth) ([]*graph.DriveItem, error) {
+		return []*graph.DriveItem{
+			{ID: "shared-listing-file", Name: "budget.xlsx", RemoteItem: &graph.RemoteItem{
+				ID:     "shared-remote-file",
+				Size:   42,
+				File:   &graph.File{},
+				Parent: &graph.DriveItemParent{DriveID: "someone-elses-drive"},
+			}},
+			{ID: "shared-listing-folder", Name: "photos", RemoteItem: &graph.RemoteItem{
+				ID:     "shared-remote-folder",
+				Folder: &graph.Folder{},
+				Parent: &graph.DriveItemParent{DriveID: "someone-elses-drive"},
+			}},
+			{ID: "shared-listing-unknown", Name: "mystery", RemoteItem: &graph.RemoteItem{
+				ID: "shared-remote-unknown",
+			}},
+		}, nil
+	}
+
+	dir, err := cache.GetPath("/.onedriver/shared", auth)
+	require.NoError(t, err)
+	require.NotNil(t, dir)
+	assert.True(t, dir.IsDir())
+
+	children, err := cache.GetChildrenID(dir.ID(), auth)
+	require.NoError(t, err)
+	require.Contains(t, children, "budget.xlsx")
+	assert.Contains(t, children, "photos")
+	assert.NotContains(t, children, "mystery",
+		"Items without a known drive can't be fetched and should be skipped.")
+	assert.Equal(t, "shared-remote-file", children["budget.xlsx"].ID(),
+		"Shared items should be the items on their owner's drive.")
+	assert.Equal(t, uint64(42), children["budget.xlsx"].Size())
+	assert.Equal(t, "someone-elses-drive", graph.RemoteDrive("shared-remote-file"),
+		"Shared items should be fetched from their owner's drive.")
+	assert.Equal(t, "/.onedriver/shared/budget.xlsx", children["budget.xlsx"].Path())
+
+	status := cache.Mkdir(context.Background().Done(),
+		&fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: dir.NodeID()}, Mode: 0755},
+		"new", &fuse.EntryOut{})
+	assert.Equal(t, fuse.EROFS, status, "The shared folder should be read-only.")
+}
@@ -0,0 +1,124 @@
+package fs
+
+import (
+	"path"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// resolveShortcut replaces a shortcut to an item on another drive with the item
+// it points to, so it can be browsed like anything else. The item keeps the
+// shortcut's name and location. Anything else is returned as-is, shortcuts that
+// are not resolved show up as symlinks.
+func (f *Filesystem) resolveShortcut(item *graph.DriveItem) *graph.DriveItem {
+	if item == nil || !item.IsShortcut() || item.Parent == nil ||
+		f.opts.Shortcuts == ShortcutsSymlink {
+		return item
+	}
+	remote := item.RemoteItem
+	if remote.Parent == nil || remote.Parent.DriveID == "" || remote.Parent.DriveID == f.DriveID() {
+		// an item can't be in two places at once, so shortcuts to our own items
+		// stay symlinks
+		return item
+	}
+	// the parent reference says which drive an item is on, so requests for it
+	// (and anything in it) go to the other drive
+	parent := *item.Parent
+	parent.DriveID = remote.Parent.DriveID
+	parent.DriveType = remote.Parent.DriveType
+	return &graph.DriveItem{
+		ID:      remote.ID,
+		Name:    item.Name,
+		Size:    remote.Size,
+		ModTime: item.ModTime,
+		Parent:  &parent,
+		Folder:  remote.Folder,
+		File:    remote.File,
+	}
+}
+
+// trackRemote makes sure requests for items that live on another drive (found
+// by following a shortcut) are sent to that drive.
+func (f *Filesystem) trackRemote(inode *Inode) {
+	inode.RLock()
+	id := inode.DriveItem.ID
+	var driveID string
+	if inode.DriveItem.Parent != nil {
+		driveID = inode.DriveItem.Parent.DriveID
+	}
+	inode.RUnlock()
+	ourDrive := f.DriveID()
+	if driveID == "" || ourDrive == "" || isLocalID(id) {
+		return
+	}
+	if driveID != ourDrive {
+		graph.AddRemoteItem(id, driveID)
+	} else {
+		// may have been on another drive before a migration
+		graph.RemoveRemoteItem(id)
+	}
+}
+
+// shortcutTarget is where a shortcut's symlink points. Shortcuts to our own
+// items point at the item's path relative to the shortcut, anything else points
+// at the item's web URL.
+func (f *Filesystem) shortcutTarget(inode *Inode) string {
+	inode.RLock()
+	remote := *inode.DriveItem.RemoteItem
+	inode.RUnlock()
+	if remote.Parent == nil || remote.Parent.DriveID != f.DriveID() || remote.Parent.Path == "" {
+		return remote.WebURL
+	}
+	target := path.Join("/", strings.TrimPrefix(remote.Parent.Path, "/drive/root:"), remote.Name)
+	return relativePath(path.Dir(inode.Path()), target)
+}
+
+// relativePath is the path to target from the directory dir, both absolute.
+func relativePath(dir string, target string) string {
+	from := strings.Split(strings.Trim(dir, "/"), "/")
+	to := strings.Split(strings.Trim(target, "/"), "/")
+	if from[0] == "" {
+		from = from[:0]
+	}
+	common := 0
+	for common < len(from) && common < len(to)-1 && strings.EqualFold(from[common], to[common]) {
+		common++
+	}
+	parts := make([]string, 0, len(from)-common+len(to)-common)
+	for i := common; i < len(from); i++ {
+		parts = append(parts, "..")
+	}
+	return path.Join(append(parts, to[common:]...)...)
+}
+
+// Readlink returns where a shortcut or symlink points.
+func (f *Filesystem) Readlink(cancel <-chan struct{}, in *fuse.InHeader) ([]byte, fuse.Status) {
+	inode := f.GetNodeID(in.NodeId)
+	if inode == nil {
+		return nil, fuse.ENOENT
+	}
+	ctx := log.With().
+		Str("op", "Readlink").
+		Uint64("nodeID", in.NodeId).
+		Str("id", inode.ID()).
+		Logger()
+
+	var target string
+	switch {
+	case inode.IsShortcut():
+		target = f.shortcutTarget(inode)
+	case inode.isSymlink():
+		var err error
+		if target, err = f.symlinkTarget(inode); err != nil {
+			ctx.Error().Err(err).Msg("Could not fetch symlink target.")
+			return nil, fuse.EREMOTEIO
+		}
+	default:
+		return nil, fuse.EINVAL
+	}
+	ctx.Trace().Str("target", target).Msg("")
+	return []byte(target), fuse.OK
+}
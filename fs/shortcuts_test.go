@@ -0,0 +1,95 @@
+package fs
+
+import (
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// shortcut makes a shortcut item like the server would return it.
+func shortcut(id string, name string, parentID string, remote *graph.RemoteItem) *graph.DriveItem {
+	now := time.Now()
+	return &graph.DriveItem{
+		ID:         id,
+		Name:       name,
+		ModTime:    &now,
+		Parent:     &graph.DriveItemParent{ID: parentID, DriveID: "my-drive"},
+		RemoteItem: remote,
+	}
+}
+
+// Shortcuts should either be followed to the item they point to or show up as
+// symlinks, depending on where the item is and how we are configured.
+func TestShortcuts(t *testing.T) {
+	t.Parallel()
+	otherDrive := &graph.RemoteItem{
+		ID:     "shortcut-remote-folder",
+		Name:   "Shared folder",
+		WebURL: "https://onedrive.live.com/shared-folder",
+		Parent: &graph.DriveItemParent{DriveID: "someone-elses-drive"},
+		Folder: &graph.Folder{ChildCount: 3},
+	}
+	ownDrive := &graph.RemoteItem{
+		ID:     "shortcut-own-folder",
+		Name:   "Target",
+		Parent: &graph.DriveItemParent{DriveID: "my-drive", Path: "/drive/root:/Documents"},
+		Folder: &graph.Folder{},
+	}
+
+	for _, mode := range []string{ShortcutsFollow, ShortcutsSymlink} {
+		cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_shortcuts_"+mode),
+			Options{Shortcuts: mode})
+		cache.driveID.Store("my-drive")
+		root := cache.GetID(cache.root)
+
+		resolved := cache.resolveShortcut(shortcut("shortcut-"+mode, "Shared", root.ID(), otherDrive))
+		inode := NewInodeDriveItem(resolved)
+		cache.InsertChild(root.ID(), inode)
+		if mode == ShortcutsFollow {
+			assert.Equal(t, otherDrive.ID, inode.ID(), "Shortcut was not followed.")
+			assert.True(t, inode.IsDir(), "Followed shortcut should look like its target.")
+			assert.Equal(t, "Shared", inode.Name(), "Followed shortcut should keep its name.")
+			assert.Equal(t, "/drives/someone-elses-drive/items/"+otherDrive.ID,
+				graph.IDPath(inode.ID()), "Requests were not sent to the other drive.")
+
+			// so is anything inside it, as the server lists it
+			child := NewInodeDriveItem(&graph.DriveItem{
+				ID:     "shortcut-remote-child",
+				Name:   "inside.txt",
+				File:   &graph.File{},
+				Parent: &graph.DriveItemParent{ID: otherDrive.ID, DriveID: "someone-elses-drive"},
+			})
+			cache.InsertChild(inode.ID(), child)
+			assert.Equal(t, "/drives/someone-elses-drive/items/shortcut-remote-child",
+				graph.IDPath(child.ID()), "Requests for children were not sent to the other drive.")
+		} else {
+			assert.Equal(t, uint32(fuse.S_IFLNK), inode.Mode()&syscall.S_IFMT, "Shortcut is not a symlink.")
+			target, status := cache.Readlink(nil, &fuse.InHeader{NodeId: inode.NodeID()})
+			require.Equal(t, fuse.OK, status)
+			assert.Equal(t, otherDrive.WebURL, string(target))
+		}
+
+		// can't follow these without the item showing up twice
+		own := NewInodeDriveItem(cache.resolveShortcut(
+			shortcut("shortcut-own-"+mode, "Target", root.ID(), ownDrive)))
+		cache.InsertChild(root.ID(), own)
+		assert.Equal(t, uint32(fuse.S_IFLNK), own.Mode()&syscall.S_IFMT, "Shortcut is not a symlink.")
+		target, status := cache.Readlink(nil, &fuse.InHeader{NodeId: own.NodeID()})
+		require.Equal(t, fuse.OK, status)
+		assert.Equal(t, "Documents/Target", string(target))
+	}
+}
+
+func TestRelativePath(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "Documents/Target", relativePath("/", "/Documents/Target"))
+	assert.Equal(t, "../c", relativePath("/a/b", "/a/c"))
+	assert.Equal(t, "../../x/y", relativePath("/a/b", "/x/y"))
+	assert.Equal(t, "../a", relativePath("/a", "/a"))
+}
@@ -0,0 +1,109 @@
+package fs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// how many skipped deltas are kept around at most, the oldest go first
+	maxSkippedDeltas = 256
+	// skipped deltas older than this are forgotten, anything this old will have
+	// been picked up by a fresh listing in the meantime
+	skippedDeltaTTL = 10 * time.Minute
+)
+
+// skippedDeltas keeps track of deltas that were skipped because their parent
+// was not in the cache. Items moved into a folder we haven't seen yet would
+// otherwise keep showing up in their old location, since the delta moving them
+// was thrown away.
+type skippedDeltas struct {
+	sync.Mutex
+	entries map[string]skippedDelta // item id -> most recently skipped delta
+}
+
+type skippedDelta struct {
+	parentID string
+	skipped  time.Time
+}
+
+// add remembers that a delta for an item was skipped because its parent was not
+// cached. Only the latest delta for each item is kept.
+func (s *skippedDeltas) add(id string, parentID string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.entries == nil {
+		s.entries = make(map[string]skippedDelta)
+	}
+	s.entries[id] = skippedDelta{parentID: parentID, skipped: time.Now()}
+	if len(s.entries) <= maxSkippedDeltas {
+		return
+	}
+	oldestID := ""
+	var oldest time.Time
+	for id, entry := range s.entries {
+		if oldestID == "" || entry.skipped.Before(oldest) {
+			oldestID, oldest = id, entry.skipped
+		}
+	}
+	delete(s.entries, oldestID)
+}
+
+// forget drops the skipped delta for an item, if any.
+func (s *skippedDeltas) forget(id string) {
+	s.Lock()
+	delete(s.entries, id)
+	s.Unlock()
+}
+
+// empty returns true if there are no skipped deltas waiting for their parent.
+func (s *skippedDeltas) empty() bool {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.entries) == 0
+}
+
+// ready removes and returns the items whose skipped deltas can now be applied
+// because their parent has been cached, as item id -> parent id. Expired entries
+// are dropped.
+func (s *skippedDeltas) ready(cached func(id string) bool) map[string]string {
+	s.Lock()
+	defer s.Unlock()
+	ready := make(map[string]string)
+	for id, entry := range s.entries {
+		if time.Since(entry.skipped) > skippedDeltaTTL {
+			delete(s.entries, id)
+		} else if cached(entry.parentID) {
+			delete(s.entries, id)
+			ready[id] = entry.parentID
+		}
+	}
+	return ready
+}
+
+// applySkippedDeltas applies the skipped deltas of items whose parent is now in
+// the cache. The delta itself may be out of date by now, so the item's current
+// state is fetched from the server and applied instead.
+func (f *Filesystem) applySkippedDeltas() {
+	ready := f.skipped.ready(func(id string) bool {
+		return f.GetID(id) != nil
+	})
+	for id, parentID := range ready {
+		item, err := graph.GetItem(id, f.auth)
+		if err != nil {
+			if graph.IsOffline(err) {
+				// try again once we're back online
+				f.skipped.add(id, parentID)
+			}
+			// otherwise the item is gone, and there's nothing left to apply
+			log.Debug().Err(err).Str("id", id).Msg("Could not re-fetch item for skipped delta.")
+			continue
+		}
+		log.Info().Str("id", id).Str("parentID", parentID).
+			Msg("Parent of skipped delta was cached, applying it.")
+		f.applyDelta(item)
+	}
+}
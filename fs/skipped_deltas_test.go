@@ -0,0 +1,71 @@
+package fs
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSkippedDeltasBounded(t *testing.T) {
+	t.Parallel()
+	var s skippedDeltas
+	for i := 0; i < maxSkippedDeltas+10; i++ {
+		s.add(fmt.Sprintf("item%d", i), "parent")
+	}
+	assert.Len(t, s.entries, maxSkippedDeltas)
+
+	s.forget(fmt.Sprintf("item%d", maxSkippedDeltas+9))
+	ready := s.ready(func(id string) bool { return id == "parent" })
+	assert.Len(t, ready, maxSkippedDeltas-1)
+	assert.True(t, s.empty(), "Applied deltas were not removed.")
+}
+
+// An item moved into a folder we have not cached yet should be moved locally as
+// soon as that folder shows up, instead of staying in its old location until
+// the next delta that mentions it.
+func TestSkippedDeltaAppliedWhenParentCached(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_skipped_delta"), Options{})
+	tests, err := cache.GetPath("/onedriver_tests", auth)
+	require.NoError(t, err)
+
+	outer, err := graph.Mkdir("skipped_delta_outer", tests.ID(), auth)
+	require.NoError(t, err)
+	inner, err := graph.Mkdir("inner", outer.ID, auth)
+	require.NoError(t, err)
+	moved, err := graph.Mkdir("skipped_delta_moved", tests.ID(), auth)
+	require.NoError(t, err)
+
+	// the outer folder and item are cached, the folder inside it is not
+	_, err = cache.GetChildrenID(tests.ID(), auth)
+	require.NoError(t, err)
+	require.NotNil(t, cache.GetID(outer.ID))
+	require.NotNil(t, cache.GetID(moved.ID))
+	require.Nil(t, cache.GetID(inner.ID))
+
+	require.NoError(t, graph.Rename(moved.ID, moved.Name, inner.ID, auth))
+	delta, err := graph.GetItem(moved.ID, auth)
+	require.NoError(t, err)
+	require.NoError(t, cache.applyDelta(delta))
+	assert.Equal(t, tests.ID(), cache.GetID(moved.ID).ParentID(),
+		"Delta should have been skipped, the new parent is not cached.")
+
+	// listing the outer folder caches the new parent, and leaves the skipped
+	// delta to the delta loop
+	_, err = cache.GetChildrenID(outer.ID, auth)
+	require.NoError(t, err)
+	select {
+	case <-cache.deltaWake:
+	default:
+		t.Fatal("Delta loop was not woken up to apply the skipped delta.")
+	}
+	cache.applySkippedDeltas()
+	item := cache.GetID(moved.ID)
+	require.NotNil(t, item)
+	assert.Equal(t, inner.ID, item.ParentID(),
+		"Skipped delta was not applied once its parent was cached.")
+}
@@ -0,0 +1,62 @@
+package fs
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// StartupTask is a non-essential job that needs the server, like creating the
+// trash folder. None of them are needed for the filesystem to work, so they are
+// run in the background once it is serving instead of holding up the mount.
+type StartupTask func(f *Filesystem, auth *graph.Auth) error
+
+// RunStartupTasks runs tasks in the background one after the other. The
+// returned channel is closed once all of them have finished. Local files that
+// never made it to the server are always dealt with first, the tasks are not run
+// if the skipStartupTasks option is set.
+func (f *Filesystem) RunStartupTasks(tasks ...StartupTask) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if !f.IsOffline() {
+			// nothing would ever upload these otherwise, so this isn't optional
+			f.resolveLocalOrphans()
+		}
+		if f.opts.SkipStartupTasks {
+			log.Info().Msg("Skipping startup tasks.")
+			return
+		}
+		for _, task := range tasks {
+			if err := task(f, f.auth); err != nil {
+				log.Error().Err(err).Msg("Startup task failed.")
+			}
+		}
+	}()
+	return done
+}
+
+// CreateTrash creates the .Trash-UID folder used by "gio trash" for user trash
+// if it does not exist (but not in folders other people shared with us).
+func CreateTrash(f *Filesystem, auth *graph.Auth) error {
+	if f.IsOffline() || graph.UsingSharedItem() {
+		return nil
+	}
+	trash := fmt.Sprintf(".Trash-%d", f.uid)
+	if child, _ := f.GetChild(f.root, trash, auth); child != nil {
+		return nil
+	}
+	item, err := graph.Mkdir(trash, f.root, auth)
+	if graph.StatusCode(err) == http.StatusConflict {
+		// the user made one themselves while we were busy, theirs is just as good
+		item, err = graph.GetItemChild(f.root, trash, auth)
+	}
+	if err != nil {
+		return fmt.Errorf("could not create trash folder, trashing items through "+
+			"the file browser may result in errors: %w", err)
+	}
+	f.InsertID(item.ID, NewInodeDriveItem(item))
+	return nil
+}
@@ -0,0 +1,70 @@
+package fs
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The filesystem should be usable while the startup tasks are still running.
+func TestStartupTasksAsync(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_startup_async"), Options{})
+
+	block := make(chan struct{})
+	done := cache.RunStartupTasks(func(f *Filesystem, auth *graph.Auth) error {
+		<-block
+		return nil
+	})
+
+	out := &fuse.EntryOut{}
+	status := cache.Lookup(nil, &fuse.InHeader{NodeId: 1}, "onedriver_tests", out)
+	assert.Equal(t, fuse.OK, status, "Lookup failed while startup tasks were running.")
+	select {
+	case <-done:
+		t.Fatal("Startup tasks finished before they were unblocked.")
+	default:
+	}
+
+	close(block)
+	select {
+	case <-done:
+	case <-time.After(retrySeconds):
+		t.Fatal("Startup tasks never finished.")
+	}
+}
+
+// Startup tasks should not run at all if the user asked us to skip them, but
+// local files that never made it to the server are still dealt with.
+func TestStartupTasksSkip(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_startup_skip"),
+		Options{SkipStartupTasks: true})
+	root := cache.GetID(cache.root)
+	folder := NewInode("startup_skip_folder", 0755|fuse.S_IFDIR, root)
+	cache.InsertChild(cache.root, folder)
+	orphan := NewInode("startup_skip_orphan.txt", 0644|fuse.S_IFREG, folder)
+	cache.InsertChild(folder.ID(), orphan)
+	old := time.Now().Add(-2 * OrphanGracePeriod)
+	orphan.DriveItem.ModTime = &old
+	cache.serializeID(orphan.ID())
+	cache.DeleteID(folder.ID())
+
+	ran := false
+	done := cache.RunStartupTasks(func(f *Filesystem, auth *graph.Auth) error {
+		ran = true
+		return nil
+	})
+	select {
+	case <-done:
+	case <-time.After(retrySeconds):
+		t.Fatal("Skipped startup tasks should finish immediately.")
+	}
+	require.False(t, ran, "Startup task was run despite skipStartupTasks.")
+	assert.Nil(t, cache.GetID(orphan.ID()), "Local orphans were not resolved.")
+}
@@ -0,0 +1,142 @@
+package fs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// StatusFile is where a running filesystem periodically records its status,
+// relative to its cache directory.
+const StatusFile = "status.json"
+
+// maxStatusProblems is how many of the most recent problems are kept.
+const maxStatusProblems = 20
+
+// maxStatusUploadQueue is how many of the next uploads are listed.
+const maxStatusUploadQueue = 100
+
+// StatusProblem is something that went wrong while syncing an item that the
+// user should know about, like a failed upload or a conflict with the server.
+type StatusProblem struct {
+	Time    time.Time `json:"time"`
+	Path    string    `json:"path"`
+	Message string    `json:"message"`
+}
+
+// Status is a snapshot of a running filesystem's state that other processes
+// (like a health check) can read without talking to the filesystem itself.
+type Status struct {
+	Offline      bool      `json:"offline"`
+	OfflineSince time.Time `json:"offlineSince,omitempty"`
+	// LastDelta is when changes were last fetched from the server successfully.
+	LastDelta time.Time `json:"lastDelta,omitempty"`
+	// ReauthRequired is set when the user has to sign in again, as opposed to
+	// the filesystem being offline because of network issues.
+	ReauthRequired bool `json:"reauthRequired,omitempty"`
+	// SyncBroken is why changes from the server keep failing to be fetched,
+	// when it has happened too many times in a row to just be a hiccup.
+	SyncBroken string `json:"syncBroken,omitempty"`
+	// QuotaFull is set while uploads are failing because the drive is full.
+	QuotaFull bool `json:"quotaFull,omitempty"`
+	// PendingUploads is the number of files waiting to be uploaded.
+	PendingUploads int `json:"pendingUploads,omitempty"`
+	// ActiveUploads is how many of the pending uploads are in progress.
+	ActiveUploads int `json:"activeUploads,omitempty"`
+	// UploadQueue is the names of the next pending uploads that are waiting for
+	// their turn, in the order they will be uploaded.
+	UploadQueue []string `json:"uploadQueue,omitempty"`
+	// Inodes is the number of items whose metadata is cached in memory.
+	Inodes int `json:"inodes,omitempty"`
+	// FailedDeltas is the number of items with changes from the server that
+	// could not be applied yet.
+	FailedDeltas int `json:"failedDeltas,omitempty"`
+	// Problems are the most recent sync problems, oldest first.
+	Problems []StatusProblem `json:"problems,omitempty"`
+	// Updated is when the status was last written. The status is rewritten after
+	// every delta fetch, so a stale timestamp means the filesystem is hung or
+	// no longer running.
+	Updated time.Time `json:"updated"`
+}
+
+// CurrentStatus returns a snapshot of the filesystem's status.
+func (f *Filesystem) CurrentStatus() Status {
+	f.RLock()
+	status := Status{Offline: f.offline, Updated: time.Now()}
+	if f.offline {
+		status.OfflineSince = f.offlineSince
+	}
+	status.LastDelta = f.lastDelta
+	status.SyncBroken = f.syncBroken
+	status.QuotaFull = f.quotaFull
+	f.RUnlock()
+	status.ReauthRequired = f.auth.ReauthRequired()
+	status.PendingUploads = f.uploads.PendingUploads()
+	status.ActiveUploads = f.uploads.ActiveUploads()
+	status.UploadQueue = f.uploads.UploadQueue()
+	if len(status.UploadQueue) > maxStatusUploadQueue {
+		status.UploadQueue = status.UploadQueue[:maxStatusUploadQueue]
+	}
+	status.FailedDeltas = f.failedDeltaCount()
+	f.metadata.Range(func(k interface{}, v interface{}) bool {
+		status.Inodes++
+		return true
+	})
+
+	f.problemsM.Lock()
+	status.Problems = append([]StatusProblem(nil), f.problems...)
+	f.problemsM.Unlock()
+	return status
+}
+
+// writeStatus records the filesystem's current status in its cache directory.
+// The file is replaced atomically so readers never see a partial write.
+func (f *Filesystem) writeStatus() error {
+	status := f.CurrentStatus()
+	// keeps concurrent writes from clobbering each other's tmp file
+	f.problemsM.Lock()
+	defer f.problemsM.Unlock()
+
+	contents, _ := json.Marshal(status)
+	path := filepath.Join(f.cacheDir, StatusFile)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, contents, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// reportProblem records a sync problem with an item so it shows up in the
+// filesystem's status. The status is rewritten right away so the problem is
+// visible without waiting for the next delta fetch.
+func (f *Filesystem) reportProblem(path string, message string) {
+	f.problemsM.Lock()
+	f.problems = append(f.problems, StatusProblem{
+		Time:    time.Now(),
+		Path:    path,
+		Message: message,
+	})
+	if len(f.problems) > maxStatusProblems {
+		f.problems = f.problems[len(f.problems)-maxStatusProblems:]
+	}
+	f.problemsM.Unlock()
+	f.emit(EventProblem, path, message)
+	if err := f.writeStatus(); err != nil {
+		log.Error().Err(err).Msg("Could not write status file.")
+	}
+}
+
+// ReadStatus reads the status last written by the filesystem using the given
+// cache directory.
+func ReadStatus(cacheDir string) (*Status, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(cacheDir, StatusFile))
+	if err != nil {
+		return nil, err
+	}
+	status := &Status{}
+	return status, json.Unmarshal(contents, status)
+}
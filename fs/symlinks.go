@@ -0,0 +1,100 @@
+package fs
+
+import (
+	"errors"
+	"regexp"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// OneDrive has no symlinks, so they are stored as small files containing where
+// they point. The server picks mime types by itself, so they are marked as
+// symlinks with "unix-symlink" in their description instead, which is kept the
+// same way modes are (see modes.go). Locally, their mode does.
+var symlinkPattern = regexp.MustCompile(`(?:^|\s)unix-symlink(?:\s|$)`)
+
+// isSymlinkItem returns true for items on the server that are marked as
+// symlinks.
+func isSymlinkItem(item *graph.DriveItem) bool {
+	return item.File != nil && symlinkPattern.MatchString(item.Description)
+}
+
+// isSymlink returns true for symlinks created through onedriver, as opposed to
+// shortcuts shown as symlinks.
+func (i *Inode) isSymlink() bool {
+	return i.Mode()&syscall.S_IFMT == fuse.S_IFLNK && !i.IsShortcut()
+}
+
+// Symlink creates a symlink pointing at pointedTo. It is uploaded like any other
+// new file.
+func (f *Filesystem) Symlink(cancel <-chan struct{}, header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) fuse.Status {
+	if parent := f.GetNodeID(header.NodeId); parent != nil && !modesSupported(parent) {
+		// without a description to mark it, it would come back as a regular file
+		log.Warn().Str("op", "Symlink").Str("path", parent.Path()).Str("name", linkName).
+			Msg("Symlinks can't be stored on this drive, only personal drives support them.")
+		return fuse.ENOTSUP
+	}
+	status := f.Mknod(
+		cancel,
+		&fuse.MknodIn{InHeader: *header, Mode: fuse.S_IFLNK | 0777},
+		linkName,
+		out,
+	)
+	if status != fuse.OK {
+		return status
+	}
+	inode := f.GetNodeID(out.NodeId)
+	if inode == nil {
+		return fuse.EIO
+	}
+
+	ctx := log.With().
+		Str("op", "Symlink").
+		Uint64("nodeID", out.NodeId).
+		Str("id", inode.ID()).
+		Str("path", inode.Path()).
+		Str("target", pointedTo).
+		Logger()
+	if err := f.content.Insert(inode.ID(), []byte(pointedTo)); err != nil {
+		ctx.Error().Err(err).Msg("Could not store symlink target.")
+		return fuse.EIO
+	}
+	inode.Lock()
+	inode.DriveItem.Size = uint64(len(pointedTo))
+	inode.hasChanges = true
+	inode.Unlock()
+	out.Attr = inode.makeAttr(f.uid, f.gid)
+
+	ctx.Debug().Msg("Created symlink.")
+	if err := f.queueUpload(inode); err != nil {
+		ctx.Error().Err(err).Msg("Error creating upload session.")
+	}
+	return fuse.OK
+}
+
+// symlinkTarget returns where a symlink points, downloading it if this is the
+// first time we've seen it.
+func (f *Filesystem) symlinkTarget(inode *Inode) (string, error) {
+	inode.RLock()
+	id := inode.DriveItem.ID
+	size := inode.DriveItem.Size
+	inode.RUnlock()
+	if target := f.content.Get(id); len(target) > 0 || isLocalID(id) {
+		return string(target), nil
+	}
+	if size == 0 {
+		return "", errors.New("symlink has no target")
+	}
+
+	target, _, err := graph.GetItemContent(id, f.auth)
+	if err != nil {
+		return "", err
+	}
+	if err = f.content.Insert(id, target); err != nil {
+		return "", err
+	}
+	return string(target), nil
+}
@@ -0,0 +1,102 @@
+package fs
+
+import (
+	"context"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Symlinks should be created, listed and read back as symlinks.
+func TestSymlink(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_symlink"),
+		Options{ManualSync: true})
+
+	out := fuse.EntryOut{}
+	require.Equal(t, fuse.OK, cache.Symlink(
+		context.Background().Done(),
+		&fuse.InHeader{NodeId: 1},
+		"../somewhere/else.txt",
+		"link",
+		&out,
+	))
+	assert.EqualValues(t, fuse.S_IFLNK, out.Attr.Mode&syscall.S_IFMT)
+	assert.EqualValues(t, len("../somewhere/else.txt"), out.Attr.Size)
+
+	lookup := fuse.EntryOut{}
+	require.Equal(t, fuse.OK, cache.Lookup(
+		context.Background().Done(),
+		&fuse.InHeader{NodeId: 1},
+		"link",
+		&lookup,
+	))
+	assert.Equal(t, out.NodeId, lookup.NodeId)
+	assert.EqualValues(t, fuse.S_IFLNK, lookup.Attr.Mode&syscall.S_IFMT)
+
+	target, status := cache.Readlink(context.Background().Done(), &fuse.InHeader{NodeId: out.NodeId})
+	require.Equal(t, fuse.OK, status)
+	assert.Equal(t, "../somewhere/else.txt", string(target))
+
+	inode := cache.GetNodeID(out.NodeId)
+	require.NotNil(t, inode)
+	assert.Equal(t, "unix-symlink", descriptionWithMode("", inode.Mode()),
+		"Symlinks should be marked as such on the server.")
+}
+
+// Symlinks can't be marked as such on drives without writable descriptions, so
+// they shouldn't be created there.
+func TestSymlinkUnsupported(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_symlink_unsupported"),
+		Options{ManualSync: true})
+	dir := NewInodeDriveItem(&graph.DriveItem{
+		ID:     "symlink-business-dir",
+		Name:   "business",
+		Folder: &graph.Folder{},
+		Parent: &graph.DriveItemParent{ID: cache.root, DriveType: graph.DriveTypeBusiness},
+	})
+	nodeID := cache.InsertChild(cache.root, dir)
+
+	out := fuse.EntryOut{}
+	assert.Equal(t, fuse.ENOTSUP, cache.Symlink(
+		context.Background().Done(),
+		&fuse.InHeader{NodeId: nodeID},
+		"target",
+		"link",
+		&out,
+	))
+	assert.False(t, dir.HasChildren(), "Symlink should not have been created.")
+}
+
+// Files marked as symlinks in their description on the server should show up as
+// symlinks.
+func TestSymlinkFromServer(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	inode := NewInodeDriveItem(&graph.DriveItem{
+		ID:          "symlink-from-server",
+		Name:        "link",
+		ModTime:     &now,
+		Size:        4,
+		Description: "some notes unix-symlink",
+		File:        &graph.File{},
+	})
+	assert.EqualValues(t, fuse.S_IFLNK|0777, inode.Mode())
+	assert.True(t, inode.isSymlink())
+
+	inode = NewInodeDriveItem(&graph.DriveItem{
+		ID:      "regular-file-from-server",
+		Name:    "file",
+		ModTime: &now,
+		File:    &graph.File{},
+	})
+	assert.EqualValues(t, fuse.S_IFREG|0644, inode.Mode())
+	assert.False(t, inode.isSymlink())
+}
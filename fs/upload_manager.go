@@ -2,23 +2,54 @@ package fs
 
 import (
 	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/jstaf/onedriver/fs/graph"
 	"github.com/rs/zerolog/log"
 	bolt "go.etcd.io/bbolt"
 )
 
-const maxUploadsInFlight = 5
+// how many files are uploaded at once, unless configured otherwise
+const defaultMaxParallelUploads = 5
+
+// how many times a failed upload is tried again before giving up on it
+const maxUploadRetries = 5
+
+// how long an upload that failed because the drive is full waits before it is
+// tried again
+const quotaRetryInterval = 10 * time.Minute
+
+const (
+	// UploadOrderOldest uploads files in the order they were saved. This is the
+	// default.
+	UploadOrderOldest = "oldest"
+	// UploadOrderSmallest uploads the smallest files first, so small saves
+	// don't wait behind big uploads.
+	UploadOrderSmallest = "smallest"
+	// UploadOrderNewest uploads the most recently saved files first.
+	UploadOrderNewest = "newest"
+)
 
 var bucketUploads = []byte("uploads")
 
+// errUploadCancelled is what anyone waiting on an upload gets if the upload is
+// cancelled, usually because the item was deleted.
+var errUploadCancelled = errors.New("upload was cancelled")
+
 // UploadManager is used to manage and retry uploads.
 type UploadManager struct {
 	queue         chan *UploadSession
 	deletionQueue chan string
+	sessionsM     sync.RWMutex // sessions are only modified by the uploadLoop
 	sessions      map[string]*UploadSession
-	inFlight      uint8 // number of sessions in flight
+	inFlight      int       // number of sessions in flight
+	throttled     time.Time // no uploads are started until then, the server asked us to wait
 	auth          *graph.Auth
 	fs            *Filesystem
 	db            *bolt.DB
@@ -71,6 +102,8 @@ func (u *UploadManager) uploadLoop(duration time.Duration) {
 			// deduplicate sessions for the same item
 			if old, exists := u.sessions[session.ID]; exists {
 				old.cancel(u.auth)
+				// the new session has the old one's changes too
+				session.waiters = append(session.waiters, old.waiters...)
 			}
 			contents, _ := json.Marshal(session)
 			u.db.Batch(func(tx *bolt.Tx) error {
@@ -79,33 +112,84 @@ func (u *UploadManager) uploadLoop(duration time.Duration) {
 				b, _ := tx.CreateBucketIfNotExists(bucketUploads)
 				return b.Put([]byte(session.ID), contents)
 			})
+			u.sessionsM.Lock()
 			u.sessions[session.ID] = session
+			u.sessionsM.Unlock()
 
 		case cancelID := <-u.deletionQueue: // remove uploads for deleted items
-			u.finishUpload(cancelID)
+			u.finishUpload(cancelID, errUploadCancelled)
 
 		case <-ticker.C: // periodically start uploads, or remove them if done/failed
+			u.sessionsM.RLock()
+			sessions := make([]*UploadSession, 0, len(u.sessions))
 			for _, session := range u.sessions {
+				sessions = append(sessions, session)
+			}
+			u.sessionsM.RUnlock()
+			// waiting uploads are started in this order as slots free up
+			orderSessions(sessions, u.fs.opts.UploadOrder)
+
+			for _, session := range sessions {
 				switch session.getState() {
 				case uploadNotStarted:
 					// max active upload sessions are capped at this limit for faster
 					// uploads of individual files and also to prevent possible server-
 					// side throttling that can cause errors.
-					if u.inFlight < maxUploadsInFlight {
+					now := time.Now()
+					if u.inFlight < u.fs.opts.maxParallelUploads() && !now.Before(u.throttled) &&
+						!now.Before(session.notBefore) {
 						u.inFlight++
-						go session.Upload(u.auth)
+						go startUpload(session, u.auth)
 					}
 
 				case uploadErrored:
-					session.retries++
-					if session.retries > 5 {
+					if wait := graph.RetryAfter(session.error); wait > 0 {
+						// being throttled is not the upload's fault and doesn't count
+						// towards giving up on it, but nothing gets started until the
+						// server is willing to talk to us again
+						log.Warn().Str("id", session.ID).Str("name", session.Name).
+							Dur("wait", wait).Msg("Server is throttling uploads, backing off.")
+						if until := time.Now().Add(wait); until.After(u.throttled) {
+							u.throttled = until
+						}
+					} else if graph.IsQuotaExceeded(session.error) {
+						// retrying won't help until space is freed up, but giving up
+						// would lose the changes, so they wait and stay cached
+						session.notBefore = time.Now().Add(quotaRetryInterval)
+						for _, waiter := range session.waiters {
+							waiter <- session.error
+						}
+						session.waiters = nil
+						path := session.Name
+						if inode := u.fs.GetID(session.ID); inode != nil {
+							path = inode.Path()
+						}
+						u.fs.quotaExceeded(path)
+					} else if graph.StatusCode(session.error) == http.StatusConflict &&
+						session.ConflictBehavior == UploadConflictFail {
+						// the name is taken on the server and we were told to leave
+						// it alone, asking again gets the same answer
+						session.retries = maxUploadRetries + 1
+					} else {
+						session.retries++
+					}
+					u.fs.emit(EventUploadFailed, session.Name, session.Error())
+					if session.retries > maxUploadRetries {
 						log.Error().
 							Str("id", session.ID).
 							Str("name", session.Name).
 							Err(session).
 							Int("retries", session.retries).
 							Msg("Upload session failed too many times, cancelling session.")
-						u.finishUpload(session.ID)
+						path := session.Name
+						if inode := u.fs.GetID(session.ID); inode != nil {
+							path = inode.Path()
+						}
+						u.fs.reportProblem(path, "Upload failed: "+session.Error())
+						u.finishUpload(session.ID, session.error)
+					} else if u.inFlight > 0 {
+						// not in flight again until it gets restarted
+						u.inFlight--
 					}
 
 					log.Warn().
@@ -138,15 +222,23 @@ func (u *UploadManager) uploadLoop(duration time.Duration) {
 
 					// inode will exist at the new ID now, but we check if inode
 					// is nil to see if the item has been deleted since upload start
+					u.fs.recent.add(session.ID, session.ETag, session.QuickXORHash)
+					path := session.Name
 					if inode := u.fs.GetID(session.ID); inode != nil {
 						inode.Lock()
 						inode.DriveItem.ETag = session.ETag
+						if inode.DriveItem.ModTime != nil && inode.DriveItem.ModTime.Equal(session.ModTime) {
+							inode.mtimeSet = false
+						}
 						inode.Unlock()
+						path = inode.Path()
 					}
+					u.fs.emit(EventUpload, path, "")
+					u.fs.quotaRecovered()
 
 					// the old ID is the one that was used to add it to the queue.
 					// cleanup the session.
-					u.finishUpload(session.OldID)
+					u.finishUpload(session.OldID, nil)
 				}
 			}
 		}
@@ -155,12 +247,137 @@ func (u *UploadManager) uploadLoop(duration time.Duration) {
 
 // QueueUpload queues an item for upload.
 func (u *UploadManager) QueueUpload(inode *Inode) error {
+	return u.queueUpload(inode, nil)
+}
+
+// QueueUploadWait queues an item for upload like QueueUpload, but also returns
+// a channel that receives the upload's result once it is finished: nil once the
+// server has the item's content, or the reason the upload gave up.
+func (u *UploadManager) QueueUploadWait(inode *Inode) (<-chan error, error) {
+	done := make(chan error, 1)
+	return done, u.queueUpload(inode, done)
+}
+
+func (u *UploadManager) queueUpload(inode *Inode, done chan error) error {
+	if inode.KeepLocal() {
+		// nothing to wait for, the server never gets a copy
+		if done != nil {
+			done <- nil
+		}
+		return nil
+	}
 	data := u.fs.getInodeContent(inode)
 	session, err := NewUploadSession(inode, data)
-	if err == nil {
-		u.queue <- session
+	if err != nil {
+		return err
+	}
+	if session.ConflictBehavior == "" && isLocalID(session.ID) {
+		// only new files can find their name taken on the server
+		session.ConflictBehavior = u.fs.opts.UploadConflictBehavior
+	}
+	if done != nil {
+		session.waiters = []chan error{done}
+	}
+	session.Queued = time.Now()
+	if mode := inode.Mode(); modesSupported(inode) && (inode.isSymlink() ||
+		u.fs.opts.PreserveModes && mode&syscall.S_IFMT == fuse.S_IFREG) {
+		// symlinks always need theirs, or they come back as regular files
+		session.Mode = mode
+	}
+	u.queue <- session
+	return nil
+}
+
+// HasPendingUpload returns true if an item has an upload that is queued or in
+// progress.
+func (u *UploadManager) HasPendingUpload(id string) bool {
+	u.sessionsM.RLock()
+	defer u.sessionsM.RUnlock()
+	_, exists := u.sessions[id]
+	return exists
+}
+
+// pendingUploadHash returns the QuickXorHash of the content a queued or running
+// upload is sending. ok is false if the item has no upload.
+func (u *UploadManager) pendingUploadHash(id string) (hash string, ok bool) {
+	u.sessionsM.RLock()
+	session, exists := u.sessions[id]
+	u.sessionsM.RUnlock()
+	if !exists {
+		return "", false
 	}
-	return err
+	return session.QuickXORHash, true
+}
+
+// UploadProgress returns how far along the upload of an item is. ok is false if
+// the item has no upload queued or in progress.
+func (u *UploadManager) UploadProgress(id string) (uploaded uint64, total uint64, ok bool) {
+	u.sessionsM.RLock()
+	session, exists := u.sessions[id]
+	u.sessionsM.RUnlock()
+	if !exists {
+		return 0, 0, false
+	}
+	uploaded, total = session.Progress()
+	return uploaded, total, true
+}
+
+// PendingUploads returns the number of uploads that are queued or in progress.
+func (u *UploadManager) PendingUploads() int {
+	u.sessionsM.RLock()
+	defer u.sessionsM.RUnlock()
+	return len(u.sessions)
+}
+
+// UploadQueue returns the names of the files waiting for their turn to upload,
+// in the order they will be uploaded.
+func (u *UploadManager) UploadQueue() []string {
+	u.sessionsM.RLock()
+	sessions := make([]*UploadSession, 0, len(u.sessions))
+	for _, session := range u.sessions {
+		if session.getState() == uploadNotStarted {
+			sessions = append(sessions, session)
+		}
+	}
+	u.sessionsM.RUnlock()
+
+	orderSessions(sessions, u.fs.opts.UploadOrder)
+	names := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		names = append(names, session.Name)
+	}
+	return names
+}
+
+// orderSessions sorts upload sessions in the order they should be started. See
+// the UploadOrder* constants for the possible orders.
+func orderSessions(sessions []*UploadSession, order string) {
+	sort.SliceStable(sessions, func(i, j int) bool {
+		a, b := sessions[i], sessions[j]
+		switch {
+		case order == UploadOrderSmallest && a.Size != b.Size:
+			return a.Size < b.Size
+		case order == UploadOrderNewest && !a.Queued.Equal(b.Queued):
+			return a.Queued.After(b.Queued)
+		case !a.Queued.Equal(b.Queued):
+			return a.Queued.Before(b.Queued)
+		}
+		return a.ID < b.ID
+	})
+}
+
+// ActiveUploads returns the number of files currently being uploaded, as opposed
+// to waiting for their turn.
+func (u *UploadManager) ActiveUploads() int {
+	u.sessionsM.RLock()
+	defer u.sessionsM.RUnlock()
+	active := 0
+	for _, session := range u.sessions {
+		if session.getState() == uploadStarted {
+			active++
+		}
+	}
+	return active
 }
 
 // CancelUpload is used to kill any pending uploads for a session
@@ -170,10 +387,17 @@ func (u *UploadManager) CancelUpload(id string) {
 
 // finishUpload is an internal method that gets called when a session is
 // completed. It cancels the session if one was in progress, and then deletes
-// it from both memory and disk.
-func (u *UploadManager) finishUpload(id string) {
-	if session, exists := u.sessions[id]; exists {
+// it from both memory and disk. Anyone waiting on the session gets err.
+func (u *UploadManager) finishUpload(id string, err error) {
+	u.sessionsM.RLock()
+	session, exists := u.sessions[id]
+	u.sessionsM.RUnlock()
+	if exists {
 		session.cancel(u.auth)
+		for _, waiter := range session.waiters {
+			waiter <- err
+		}
+		session.waiters = nil
 	}
 	u.db.Batch(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(bucketUploads); b != nil {
@@ -184,5 +408,37 @@ func (u *UploadManager) finishUpload(id string) {
 	if u.inFlight > 0 {
 		u.inFlight--
 	}
+	u.sessionsM.Lock()
 	delete(u.sessions, id)
+	u.sessionsM.Unlock()
+}
+
+// quotaExceeded lets the user know once uploads start failing because their
+// OneDrive is full. The changes are kept and uploaded once there is space.
+func (f *Filesystem) quotaExceeded(path string) {
+	f.Lock()
+	alreadyFull := f.quotaFull
+	f.quotaFull = true
+	f.Unlock()
+	if alreadyFull {
+		return
+	}
+	log.Error().Str("path", path).Msg("OneDrive is full, uploads will wait until there is space.")
+	f.emit(EventQuotaFull, path, "")
+	f.reportProblem(path, "OneDrive is full. Changes are kept locally and will be "+
+		"uploaded once there is space again.")
+}
+
+// quotaRecovered clears a full drive once something could be uploaded again.
+func (f *Filesystem) quotaRecovered() {
+	f.Lock()
+	wasFull := f.quotaFull
+	f.quotaFull = false
+	f.Unlock()
+	if wasFull {
+		log.Info().Msg("Uploaded a file again, OneDrive is no longer full.")
+		if err := f.writeStatus(); err != nil {
+			log.Error().Err(err).Msg("Could not write status file.")
+		}
+	}
 }
@@ -6,11 +6,14 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os/exec"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/jstaf/onedriver/fs/graph"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -115,3 +118,292 @@ func TestRepeatedUploads(t *testing.T) {
 		}
 	}
 }
+
+// Reads of a file that is being uploaded should keep working while the upload
+// finishes and the file's local ID is swapped for the one from the server.
+func TestReadDuringIDChange(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_read_during_id_change"), Options{})
+	content := []byte("content that is being uploaded right now")
+	inode := NewInode("read_during_upload.txt", 0644|fuse.S_IFREG, nil)
+	_, err := cache.InsertPath("/read_during_upload.txt", nil, inode)
+	require.NoError(t, err)
+	localID := inode.ID()
+	require.True(t, isLocalID(localID))
+	header := fuse.InHeader{NodeId: inode.NodeID()}
+	require.Equal(t, fuse.OK, cache.Open(nil, &fuse.OpenIn{InHeader: header}, &fuse.OpenOut{}))
+	n, status := cache.Write(nil, &fuse.WriteIn{InHeader: header}, content)
+	require.Equal(t, fuse.OK, status)
+	require.EqualValues(t, len(content), n)
+
+	// keep reading until the upload swaps in the ID from the server
+	done := make(chan struct{})
+	failures := make(chan string, 1)
+	go func() {
+		defer close(failures)
+		buf := make([]byte, 4096)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			result, status := cache.Read(nil, &fuse.ReadIn{InHeader: header, Size: uint32(len(buf))}, buf)
+			if status != fuse.OK {
+				failures <- "read failed: " + status.String()
+				return
+			}
+			data, status := result.Bytes(buf)
+			if status != fuse.OK || !bytes.Equal(content, data) {
+				failures <- fmt.Sprintf("read %q", data)
+				return
+			}
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, cache.MoveID(localID, "read-during-upload-remote-id"))
+	time.Sleep(100 * time.Millisecond)
+	close(done)
+	for failure := range failures {
+		t.Error(failure)
+	}
+
+	assert.False(t, cache.content.HasContent(localID), "Content was left behind under the old ID.")
+	assert.Equal(t, content, cache.content.Get("read-during-upload-remote-id"))
+	cache.Release(nil, &fuse.ReleaseIn{InHeader: header})
+	assert.False(t, cache.content.IsOpen("read-during-upload-remote-id"), "File was never closed.")
+}
+
+// With the smallest-first order, small files queued after a large one should
+// still be uploaded before it.
+func TestUploadOrderSmallest(t *testing.T) {
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_upload_order_smallest"),
+		Options{UploadOrder: UploadOrderSmallest})
+	large := NewInode("large.bin", 0644|fuse.S_IFREG, nil)
+	_, err := cache.InsertPath("/onedriver_tests/large.bin", auth, large)
+	require.NoError(t, err)
+	large.setContent(cache, make([]byte, 1024*1024))
+	inodes := []*Inode{large}
+	ids := map[string]string{large.ID(): "large.bin"}
+	for i := 0; i < defaultMaxParallelUploads; i++ {
+		name := fmt.Sprintf("small%d.txt", i)
+		small := NewInode(name, 0644|fuse.S_IFREG, nil)
+		_, err := cache.InsertPath("/onedriver_tests/"+name, auth, small)
+		require.NoError(t, err)
+		small.setContent(cache, []byte("small"))
+		inodes = append(inodes, small)
+		ids[small.ID()] = name
+	}
+
+	var m sync.Mutex
+	started := make([]string, 0)
+	oldUpload := startUpload
+	defer func() { startUpload = oldUpload }()
+	startUpload = func(session *UploadSession, auth *graph.Auth) error {
+		name, ours := ids[session.OldID]
+		if !ours {
+			return oldUpload(session, auth)
+		}
+		m.Lock()
+		started = append(started, name)
+		m.Unlock()
+		return session.setState(uploadComplete, nil)
+	}
+	for _, inode := range inodes {
+		require.NoError(t, cache.uploads.QueueUpload(inode))
+	}
+
+	assert.Eventually(t, func() bool {
+		m.Lock()
+		defer m.Unlock()
+		return len(started) == len(inodes)
+	}, 20*time.Second, 100*time.Millisecond, "Uploads were not started.")
+	m.Lock()
+	defer m.Unlock()
+	assert.Equal(t, "large.bin", started[len(started)-1],
+		"Large file was uploaded before the small ones: %v", started)
+}
+
+// failUploads makes every upload of inode fail with err instead of reaching the
+// server. The returned function reports the conflict behavior each attempt so
+// far was started with.
+func failUploads(t *testing.T, inode *Inode, err error) func() []string {
+	var m sync.Mutex
+	attempts := make([]string, 0)
+	oldUpload := startUpload
+	t.Cleanup(func() { startUpload = oldUpload })
+	startUpload = func(session *UploadSession, auth *graph.Auth) error {
+		if session.OldID != inode.ID() {
+			return oldUpload(session, auth)
+		}
+		m.Lock()
+		defer m.Unlock()
+		attempts = append(attempts, session.conflictBehavior())
+		return session.setState(uploadErrored, err)
+	}
+	return func() []string {
+		m.Lock()
+		defer m.Unlock()
+		return append([]string(nil), attempts...)
+	}
+}
+
+// uploadResult waits for what an upload queued with QueueUploadWait ended with.
+func uploadResult(t *testing.T, done <-chan error) error {
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("Waiters were never told the upload failed.")
+	}
+	return nil
+}
+
+// When the server throttles an upload and says for how long, no uploads should
+// be started until then, and the throttled upload should not be given up on.
+func TestUploadThrottled(t *testing.T) {
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_upload_throttled"), Options{})
+	inode := NewInode("throttled.txt", 0644|fuse.S_IFREG, nil)
+	_, err := cache.InsertPath("/onedriver_tests/throttled.txt", auth, inode)
+	require.NoError(t, err)
+	inode.setContent(cache, []byte("throttled"))
+
+	attempts := failUploads(t, inode, &graph.Error{
+		StatusCode: http.StatusTooManyRequests,
+		Code:       "activityLimitReached",
+		RetryAfter: time.Hour,
+	})
+	require.NoError(t, cache.uploads.QueueUpload(inode))
+
+	// long enough for the upload loop to notice the failure and try again
+	time.Sleep(7 * time.Second)
+	assert.Len(t, attempts(), 1, "Upload was started again before the server allowed it.")
+	assert.True(t, cache.uploads.HasPendingUpload(inode.ID()), "Throttled upload was given up on.")
+}
+
+// A full drive should not be treated like a broken upload: the changes stay
+// cached and pending until there is space again, and the user is told why.
+func TestUploadQuotaExceeded(t *testing.T) {
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_upload_quota_exceeded"), Options{})
+	inode := NewInode("quota_exceeded.txt", 0644|fuse.S_IFREG, nil)
+	_, err := cache.InsertPath("/onedriver_tests/quota_exceeded.txt", auth, inode)
+	require.NoError(t, err)
+	content := []byte("there is no room for this")
+	inode.setContent(cache, content)
+
+	attempts := failUploads(t, inode, fmt.Errorf("error uploading chunk: %w",
+		graph.ParseError(http.StatusInsufficientStorage,
+			[]byte(`{"error":{"code":"quotaLimitReached","message":"Insufficient Space Available"}}`))))
+	done, err := cache.uploads.QueueUploadWait(inode)
+	require.NoError(t, err)
+	assert.True(t, graph.IsQuotaExceeded(uploadResult(t, done)),
+		"Waiters should be told the drive is full.")
+
+	// long enough for the upload loop to have tried again if it was going to
+	time.Sleep(5 * time.Second)
+	assert.Len(t, attempts(), 1, "Upload was retried right away even though the drive is full.")
+	assert.True(t, cache.uploads.HasPendingUpload(inode.ID()), "Upload was given up on.")
+	assert.Equal(t, content, cache.content.Get(inode.ID()), "Local changes were not kept.")
+
+	status := cache.CurrentStatus()
+	assert.True(t, status.QuotaFull)
+	require.NotEmpty(t, status.Problems)
+	message := status.Problems[len(status.Problems)-1].Message
+	assert.Contains(t, message, "OneDrive is full")
+	assert.NotContains(t, message, "bug")
+}
+
+// With uploadConflictBehavior set to "fail", an upload that finds its name taken
+// on the server should be given up on right away, and the local copy kept.
+func TestUploadConflictFail(t *testing.T) {
+	assert.Error(t, Options{UploadConflictBehavior: "clobber"}.Validate())
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_upload_conflict_fail"),
+		Options{UploadConflictBehavior: UploadConflictFail})
+	inode := NewInode("conflict_fail.txt", 0644|fuse.S_IFREG, nil)
+	_, err := cache.InsertPath("/onedriver_tests/conflict_fail.txt", auth, inode)
+	require.NoError(t, err)
+	content := []byte("someone else got here first")
+	inode.setContent(cache, content)
+
+	attempts := failUploads(t, inode, fmt.Errorf("small upload failed: %w",
+		graph.ParseError(http.StatusConflict,
+			[]byte(`{"error":{"code":"nameAlreadyExists","message":"Name already exists"}}`))))
+	done, err := cache.uploads.QueueUploadWait(inode)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, graph.StatusCode(uploadResult(t, done)))
+
+	assert.Equal(t, []string{UploadConflictFail}, attempts(),
+		"Upload was retried, or the server was not told to fail on conflicts.")
+	assert.Eventually(t, func() bool {
+		return !cache.uploads.HasPendingUpload(inode.ID())
+	}, time.Second, 10*time.Millisecond, "Upload was not given up on.")
+	assert.Equal(t, content, cache.content.Get(inode.ID()), "Local copy was not kept.")
+	status := cache.CurrentStatus()
+	require.NotEmpty(t, status.Problems)
+	assert.Contains(t, status.Problems[len(status.Problems)-1].Message, "Name already exists")
+}
+
+// No more than the configured number of uploads should run at once, and the
+// rest should start as those finish.
+func TestUploadMaxParallel(t *testing.T) {
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_upload_max_parallel"),
+		Options{MaxParallelUploads: 2})
+	inodes := make([]*Inode, 0)
+	ids := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("parallel%d.txt", i)
+		inode := NewInode(name, 0644|fuse.S_IFREG, nil)
+		_, err := cache.InsertPath("/onedriver_tests/"+name, auth, inode)
+		require.NoError(t, err)
+		inode.setContent(cache, []byte(name))
+		inodes = append(inodes, inode)
+		ids[inode.ID()] = true
+	}
+
+	var m sync.Mutex
+	running, most, finished := 0, 0, 0
+	release := make(chan struct{})
+	oldUpload := startUpload
+	defer func() { startUpload = oldUpload }()
+	startUpload = func(session *UploadSession, auth *graph.Auth) error {
+		if !ids[session.OldID] {
+			return oldUpload(session, auth)
+		}
+		m.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		m.Unlock()
+		<-release
+		m.Lock()
+		running--
+		finished++
+		m.Unlock()
+		return session.setState(uploadComplete, nil)
+	}
+	for _, inode := range inodes {
+		require.NoError(t, cache.uploads.QueueUpload(inode))
+	}
+
+	assert.Eventually(t, func() bool {
+		m.Lock()
+		defer m.Unlock()
+		return running == 2
+	}, 10*time.Second, 100*time.Millisecond, "Uploads were not started.")
+	// a few more rounds of the upload loop, nothing else should start
+	time.Sleep(5 * time.Second)
+	m.Lock()
+	assert.Equal(t, 2, running, "More uploads were started than allowed.")
+	m.Unlock()
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		m.Lock()
+		defer m.Unlock()
+		return finished == len(inodes)
+	}, 20*time.Second, 100*time.Millisecond, "Waiting uploads were never started.")
+	m.Lock()
+	defer m.Unlock()
+	assert.Equal(t, 2, most, "More uploads ran at once than allowed.")
+}
@@ -22,10 +22,21 @@ const (
 	// 10MB is the recommended upload size according to the graph API docs
 	uploadChunkSize uint64 = 10 * 1024 * 1024
 
-	// uploads larget than 4MB must use a formal upload session
+	// uploads larger than 4MB must use a formal upload session
 	uploadLargeSize uint64 = 4 * 1024 * 1024
 )
 
+// chunks can take a long time to upload over a slow connection, so there is no
+// timeout on them
+var uploadClient = graph.NewClient(0)
+
+// upload URLs that expire sooner than this are replaced before the next chunk
+// is sent, since a chunk sent to an expired URL is lost
+const uploadURLMargin = 5 * time.Minute
+
+// how many times an upload URL can be replaced before an upload is given up on
+const maxUploadURLRenewals = 10
+
 // upload states
 const (
 	uploadNotStarted = iota
@@ -50,11 +61,20 @@ type UploadSession struct {
 	Data               []byte    `json:"data,omitempty"`
 	QuickXORHash       string    `json:"quickxorhash,omitempty"`
 	ModTime            time.Time `json:"modTime,omitempty"`
+	ConflictBehavior   string    `json:"conflictBehavior,omitempty"`
+	KeepModTime        bool      `json:"keepModTime,omitempty"`
+	Mode               uint32    `json:"mode,omitempty"` // stored on the server if set
+	Queued             time.Time `json:"queued,omitempty"`
 	retries            int
+	renewals           int           // times the upload URL was replaced this attempt
+	urlMargin          time.Duration // uploadURLMargin if 0
+	notBefore          time.Time     // not started again until then
+	waiters            []chan error  // told the result once the upload is finished
 
 	sync.Mutex
 	UploadURL string `json:"uploadUrl"`
 	ETag      string `json:"eTag,omitempty"`
+	progress  uint64 // bytes of the file the server has received so far
 	state     int
 	error     // embedded error tracks errors that killed an upload
 }
@@ -105,13 +125,18 @@ func NewUploadSession(inode *Inode, data *[]byte) (*UploadSession, error) {
 	// create a generic session for all files
 	inode.RLock()
 	session := UploadSession{
-		ID:       inode.DriveItem.ID,
-		OldID:    inode.DriveItem.ID,
-		ParentID: inode.DriveItem.Parent.ID,
-		NodeID:   inode.nodeID,
-		Name:     inode.DriveItem.Name,
-		Data:     *data,
-		ModTime:  *inode.DriveItem.ModTime,
+		ID:          inode.DriveItem.ID,
+		OldID:       inode.DriveItem.ID,
+		ParentID:    inode.DriveItem.Parent.ID,
+		NodeID:      inode.nodeID,
+		Name:        inode.DriveItem.Name,
+		Data:        *data,
+		ModTime:     *inode.DriveItem.ModTime,
+		KeepModTime: inode.mtimeSet,
+	}
+	if inode.conflictBehavior == ConflictRename {
+		// let the server pick a new name if an item with this one already exists
+		session.ConflictBehavior = UploadConflictRename
 	}
 	inode.RUnlock()
 
@@ -140,13 +165,14 @@ func (u *UploadSession) cancel(auth *graph.Auth) {
 // to make things this way because the internal Put func doesn't work all that
 // well when we need to add custom headers. Will return without an error if
 // irrespective of HTTP status (errors are reserved for stuff that prevented
-// the HTTP request at all).
-func (u *UploadSession) uploadChunk(auth *graph.Auth, offset uint64) ([]byte, int, error) {
+// the HTTP request at all). Also returns how long the server asked us to wait
+// with a Retry-After header, if it did.
+func (u *UploadSession) uploadChunk(auth *graph.Auth, offset uint64) ([]byte, int, time.Duration, error) {
 	u.Lock()
 	url := u.UploadURL
 	if url == "" {
 		u.Unlock()
-		return nil, -1, errors.New("UploadSession UploadURL cannot be empty")
+		return nil, -1, 0, errors.New("UploadSession UploadURL cannot be empty")
 	}
 	u.Unlock()
 
@@ -158,31 +184,158 @@ func (u *UploadSession) uploadChunk(auth *graph.Auth, offset uint64) ([]byte, in
 		reqChunkSize = end - offset + 1
 	}
 	if offset > u.Size {
-		return nil, -1, errors.New("offset cannot be larger than DriveItem size")
+		return nil, -1, 0, errors.New("offset cannot be larger than DriveItem size")
 	}
 
 	auth.Refresh()
 
-	client := &http.Client{}
 	request, _ := http.NewRequest(
 		"PUT",
 		url,
-		bytes.NewReader((u.Data)[offset:end]),
+		auth.ThrottleUpload(bytes.NewReader((u.Data)[offset:end])),
 	)
+	// the throttled reader hides the length of the chunk from net/http
+	request.ContentLength = int64(end - offset)
 	// no Authorization header - it will throw a 401 if present
 	request.Header.Add("Content-Length", strconv.Itoa(int(reqChunkSize)))
 	frags := fmt.Sprintf("bytes %d-%d/%d", offset, end-1, u.Size)
 	log.Info().Str("id", u.ID).Msg("Uploading " + frags)
 	request.Header.Add("Content-Range", frags)
 
-	resp, err := client.Do(request)
+	resp, err := uploadClient.Do(request)
 	if err != nil {
 		// this is a serious error, not simply one with a non-200 return code
-		return nil, -1, err
+		return nil, -1, 0, err
 	}
 	defer resp.Body.Close()
 	response, _ := ioutil.ReadAll(resp.Body)
-	return response, resp.StatusCode, nil
+	return response, resp.StatusCode, graph.ParseRetryAfter(resp.Header.Get("Retry-After")), nil
+}
+
+const (
+	// UploadConflictReplace replaces an item on the server with the same name as
+	// an uploaded file. This is the default.
+	UploadConflictReplace = "replace"
+	// UploadConflictRename has the server pick a new name for the uploaded file,
+	// like "name 1.ext".
+	UploadConflictRename = "rename"
+	// UploadConflictFail gives up on the upload and leaves the item on the
+	// server alone.
+	UploadConflictFail = "fail"
+)
+
+// conflictBehavior is what the server should do if an item with the same name
+// already exists, by default it gets replaced.
+func (u *UploadSession) conflictBehavior() string {
+	if u.ConflictBehavior == "" {
+		return UploadConflictReplace
+	}
+	return u.ConflictBehavior
+}
+
+// uploadPath returns the resource an upload should be sent to. Files up to
+// uploadLargeSize are sent with a single PUT (simple is true), larger ones need
+// an upload session to be created first.
+func (u *UploadSession) uploadPath() (path string, simple bool) {
+	if isLocalID(u.ID) {
+		// not on the server yet, so address it by name under its parent
+		path = graph.IDPath(u.ParentID) + ":/" + url.PathEscape(u.Name) + ":"
+	} else {
+		path = graph.IDPath(u.ID)
+	}
+	if u.Size <= uploadLargeSize {
+		path += "/content"
+		if u.ConflictBehavior != "" && isLocalID(u.ID) {
+			path += "?@microsoft.graph.conflictBehavior=" + u.ConflictBehavior
+		}
+		return path, true
+	}
+	return path + "/createUploadSession", false
+}
+
+// createSession creates an upload session on the server for a large upload, the
+// content is sent to the session's UploadURL afterwards.
+func (u *UploadSession) createSession(uploadPath string, auth *graph.Auth) error {
+	sessionPostData, _ := json.Marshal(UploadSessionPost{
+		ConflictBehavior: u.conflictBehavior(),
+		FileSystemInfo: FileSystemInfo{
+			LastModifiedDateTime: u.ModTime,
+		},
+	})
+	resp, err := graph.Post(uploadPath, auth, bytes.NewReader(sessionPostData))
+	if err != nil {
+		return fmt.Errorf("failed to create upload session: %w", err)
+	}
+
+	// populate UploadURL/expiration - we unmarshal into a fresh session here
+	// just in case the API does something silly at a later date and overwrites
+	// a field it shouldn't.
+	tmp := UploadSession{}
+	if err = json.Unmarshal(resp, &tmp); err != nil {
+		return fmt.Errorf("could not unmarshal upload session post response: %w", err)
+	}
+	u.Lock()
+	u.UploadURL = tmp.UploadURL
+	u.ExpirationDateTime = tmp.ExpirationDateTime
+	u.Unlock()
+	return nil
+}
+
+// urlExpiring returns true if the upload URL expires too soon to trust it with
+// another chunk.
+func (u *UploadSession) urlExpiring() bool {
+	u.Lock()
+	defer u.Unlock()
+	margin := u.urlMargin
+	if margin == 0 {
+		margin = uploadURLMargin
+	}
+	return !u.ExpirationDateTime.IsZero() && time.Until(u.ExpirationDateTime) < margin
+}
+
+// renewSession replaces the upload session's URL with a new one. Chunks sent to
+// the old session don't carry over to the new one, so the upload has to start
+// again from the beginning of the file.
+func (u *UploadSession) renewSession(uploadPath string, auth *graph.Auth) error {
+	u.renewals++
+	if u.renewals > maxUploadURLRenewals {
+		return errors.New("upload URL expired too many times")
+	}
+	u.Lock()
+	oldURL := u.UploadURL
+	u.Unlock()
+	if err := u.createSession(uploadPath, auth); err != nil {
+		return err
+	}
+	// dont care about result, the old session is useless to us now
+	go graph.Delete(oldURL, auth)
+	return nil
+}
+
+// refreshExpiration picks up the new expiration time the server sends back
+// after each chunk is received.
+func (u *UploadSession) refreshExpiration(chunkResp []byte) {
+	tmp := UploadSession{}
+	if json.Unmarshal(chunkResp, &tmp) != nil || tmp.ExpirationDateTime.IsZero() {
+		return
+	}
+	u.Lock()
+	u.ExpirationDateTime = tmp.ExpirationDateTime
+	u.Unlock()
+}
+
+func (u *UploadSession) setProgress(uploaded uint64) {
+	u.Lock()
+	u.progress = uploaded
+	u.Unlock()
+}
+
+// Progress returns how many of the file's bytes the server has received so far,
+// and the total number of bytes being uploaded.
+func (u *UploadSession) Progress() (uploaded uint64, total uint64) {
+	u.Lock()
+	defer u.Unlock()
+	return u.progress, u.Size
 }
 
 // Upload copies the file's contents to the server. Should only be called as a
@@ -190,105 +343,106 @@ func (u *UploadSession) uploadChunk(auth *graph.Auth, offset uint64) ([]byte, in
 // field contains errors to be handled if called as a goroutine.
 func (u *UploadSession) Upload(auth *graph.Auth) error {
 	log.Info().Str("id", u.ID).Str("name", u.Name).Msg("Uploading file.")
+	start := time.Now()
 	u.setState(uploadStarted, nil)
+	u.setProgress(0)
 
-	var uploadPath string
 	var resp []byte
-	if u.Size < uploadLargeSize {
+	uploadPath, simple := u.uploadPath()
+	if simple {
 		// Small upload sessions use a simple PUT request, but this does not support
 		// adding file modification times. We don't really care though, because
 		// after some experimentation, the Microsoft API doesn't seem to properly
 		// support these either (this is why we have to use etags).
-		if isLocalID(u.ID) {
-			uploadPath = fmt.Sprintf(
-				"/me/drive/items/%s:/%s:/content",
-				url.PathEscape(u.ParentID),
-				url.PathEscape(u.Name),
-			)
-		} else {
-			uploadPath = fmt.Sprintf(
-				"/me/drive/items/%s/content",
-				url.PathEscape(u.ID),
-			)
-		}
-		// small files handled in this block
 		var err error
-		resp, err = graph.Put(uploadPath, auth, bytes.NewReader(u.Data))
+		resp, err = graph.PutContent(uploadPath, auth, bytes.NewReader(u.Data))
 		if err != nil && strings.Contains(err.Error(), "resourceModified") {
 			// retry the request after a second, likely the server is having issues
 			time.Sleep(time.Second)
-			resp, err = graph.Put(uploadPath, auth, bytes.NewReader(u.Data))
+			resp, err = graph.PutContent(uploadPath, auth, bytes.NewReader(u.Data))
 		}
 		if err != nil {
 			return u.setState(uploadErrored, fmt.Errorf("small upload failed: %w", err))
 		}
 	} else {
-		if isLocalID(u.ID) {
-			uploadPath = fmt.Sprintf(
-				"/me/drive/items/%s:/%s:/createUploadSession",
-				url.PathEscape(u.ParentID),
-				url.PathEscape(u.Name),
-			)
-		} else {
-			uploadPath = fmt.Sprintf(
-				"/me/drive/items/%s/createUploadSession",
-				url.PathEscape(u.ID),
-			)
-		}
-		sessionPostData, _ := json.Marshal(UploadSessionPost{
-			ConflictBehavior: "replace",
-			FileSystemInfo: FileSystemInfo{
-				LastModifiedDateTime: u.ModTime,
-			},
-		})
-		resp, err := graph.Post(uploadPath, auth, bytes.NewReader(sessionPostData))
-		if err != nil {
-			return u.setState(uploadErrored, fmt.Errorf("failed to create upload session: %w", err))
+		// sessions get retried, each attempt gets its own share of new URLs
+		u.renewals = 0
+		if err := u.createSession(uploadPath, auth); err != nil {
+			return u.setState(uploadErrored, err)
 		}
 
-		// populate UploadURL/expiration - we unmarshal into a fresh session here
-		// just in case the API does something silly at a later date and overwrites
-		// a field it shouldn't.
-		tmp := UploadSession{}
-		if err = json.Unmarshal(resp, &tmp); err != nil {
-			return u.setState(uploadErrored,
-				fmt.Errorf("could not unmarshal upload session post response: %w", err))
-		}
-		u.Lock()
-		u.UploadURL = tmp.UploadURL
-		u.ExpirationDateTime = tmp.ExpirationDateTime
-		u.Unlock()
-
 		// api upload session created successfully, now do actual content upload
 		var status int
+		var wait time.Duration
+		var err error
 		nchunks := int(math.Ceil(float64(u.Size) / float64(uploadChunkSize)))
-		for i := 0; i < nchunks; i++ {
-			resp, status, err = u.uploadChunk(auth, uint64(i)*uploadChunkSize)
+		checkExpiry := true
+		for offset := uint64(0); offset < u.Size; {
+			u.setProgress(offset)
+			chunk := int(offset / uploadChunkSize)
+			if checkExpiry && offset > 0 && u.urlExpiring() {
+				log.Info().Str("id", u.ID).Str("name", u.Name).Int("chunk", chunk).
+					Msg("Upload URL is about to expire, replacing it.")
+				if err = u.renewSession(uploadPath, auth); err != nil {
+					return u.setState(uploadErrored, err)
+				}
+				offset = 0
+				// a brand new URL that is already "expiring" means the server
+				// hands out URLs shorter-lived than our margin, renewing again
+				// would never get anywhere
+				checkExpiry = !u.urlExpiring()
+				continue
+			}
+
+			resp, status, wait, err = u.uploadChunk(auth, offset)
 			if err != nil {
 				return u.setState(uploadErrored, fmt.Errorf("failed to perform chunk upload: %w", err))
 			}
 
 			// retry server-side failures with an exponential back-off strategy. Will not
-			// exit this loop unless it receives a non 5xx error or serious failure
-			for backoff := 1; status >= 500; backoff *= 2 {
+			// exit this loop unless it receives a non 5xx error or serious failure.
+			// A full drive stays full no matter how often we ask.
+			// If the server says how long to wait, we wait at least that long.
+			for backoff := time.Second; status >= 500 && status != http.StatusInsufficientStorage; backoff *= 2 {
+				delay := backoff
+				if wait > delay {
+					delay = wait
+				}
 				log.Error().
 					Str("id", u.ID).
 					Str("name", u.Name).
-					Int("chunk", i).
+					Int("chunk", chunk).
 					Int("nchunks", nchunks).
 					Int("status", status).
-					Msgf("The OneDrive server is having issues, retrying chunk upload in %ds.", backoff)
-				time.Sleep(time.Duration(backoff) * time.Second)
-				resp, status, err = u.uploadChunk(auth, uint64(i)*uploadChunkSize)
+					Msgf("The OneDrive server is having issues, retrying chunk upload in %s.", delay)
+				time.Sleep(delay)
+				resp, status, wait, err = u.uploadChunk(auth, offset)
 				if err != nil { // a serious, non 4xx/5xx error
 					return u.setState(uploadErrored, fmt.Errorf("failed to perform chunk upload: %w", err))
 				}
 			}
 
+			if status == http.StatusNotFound {
+				// the upload URL expired anyways, slow links can take longer
+				// than expected to send a chunk
+				log.Warn().Str("id", u.ID).Str("name", u.Name).Int("chunk", chunk).
+					Msg("Upload URL expired mid-upload, replacing it.")
+				if err = u.renewSession(uploadPath, auth); err != nil {
+					return u.setState(uploadErrored, err)
+				}
+				offset = 0
+				continue
+			}
+
 			// handle client-side errors
 			if status >= 400 {
-				return u.setState(uploadErrored, fmt.Errorf("error uploading chunk - HTTP %d: %s", status, string(resp)))
+				// keep the Retry-After so a throttled upload holds off the others
+				graphErr := graph.ParseError(status, resp)
+				graphErr.RetryAfter = wait
+				return u.setState(uploadErrored, fmt.Errorf("error uploading chunk: %w", graphErr))
 			}
+			u.refreshExpiration(resp)
+			offset += uploadChunkSize
 		}
 	}
 
@@ -324,10 +478,38 @@ func (u *UploadSession) Upload(auth *graph.Auth) error {
 	} else if !remote.VerifyChecksum(u.QuickXORHash) {
 		return u.setState(uploadErrored, errors.New("remote checksum did not match"))
 	}
+	if simple && u.KeepModTime {
+		// simple uploads always get the current time as their modtime, so an
+		// explicitly set one has to be put back afterwards
+		patch, _ := json.Marshal(struct {
+			FileSystemInfo `json:"fileSystemInfo"`
+		}{FileSystemInfo{LastModifiedDateTime: u.ModTime}})
+		resp, err := graph.Patch(graph.IDPath(remote.ID), auth, bytes.NewReader(patch))
+		if err != nil {
+			log.Warn().Err(err).Str("id", remote.ID).Str("name", u.Name).
+				Msg("Could not set modification time after upload.")
+		} else {
+			json.Unmarshal(resp, &remote)
+		}
+	}
+	if u.Mode != 0 {
+		if description := descriptionWithMode(remote.Description, u.Mode); description != remote.Description {
+			patch, _ := json.Marshal(struct {
+				Description string `json:"description"`
+			}{description})
+			if _, err := graph.Patch(graph.IDPath(remote.ID), auth, bytes.NewReader(patch)); err != nil {
+				log.Warn().Err(err).Str("id", remote.ID).Str("name", u.Name).
+					Msg("Could not store mode after upload.")
+			}
+		}
+	}
 	// update the UploadSession's ID in the event that we exchange a local for a remote ID
 	u.Lock()
 	u.ID = remote.ID
 	u.ETag = remote.ETag
+	u.progress = u.Size
 	u.Unlock()
+	uploadDuration.Since("", start)
+	uploadedBytes.Add("", float64(u.Size))
 	return u.setState(uploadComplete, nil)
 }
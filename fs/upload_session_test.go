@@ -3,9 +3,12 @@ package fs
 import (
 	"bytes"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -63,6 +66,44 @@ func TestUploadSession(t *testing.T) {
 	}
 }
 
+// Files up to 4MB should be uploaded with a single PUT, without creating an
+// upload session first.
+func TestUploadSessionSimplePut(t *testing.T) {
+	t.Parallel()
+	testDir, err := fs.GetPath("/onedriver_tests", auth)
+	require.NoError(t, err)
+
+	inode := NewInode("uploadSessionSimplePut.bin", 0644, testDir)
+	data := bytes.Repeat([]byte("1MB!"), 256*1024)
+	inode.setContent(fs, data)
+	session, err := NewUploadSession(inode, &data)
+	require.NoError(t, err)
+	path, simple := session.uploadPath()
+	assert.True(t, simple, "A 1MB file should not need an upload session.")
+	assert.True(t, strings.HasSuffix(path, "/content"), "Wrong upload path: %s", path)
+
+	require.NoError(t, session.Upload(auth))
+	assert.Empty(t, session.UploadURL, "An upload session was created.")
+	resp, _, err := graph.GetItemContent(session.ID, auth)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, resp), "Uploaded content did not match.")
+
+	// items already on the server are addressed by id, their name can't be taken
+	session.ConflictBehavior = UploadConflictFail
+	path, _ = session.uploadPath()
+	assert.NotContains(t, path, "conflictBehavior", "Wrong upload path: %s", path)
+
+	// the simple PUT can be used right up to the limit, but not beyond it
+	for size, expected := range map[uint64]bool{
+		uploadLargeSize:     true,
+		uploadLargeSize + 1: false,
+	} {
+		session.Size = size
+		path, simple = session.uploadPath()
+		assert.Equal(t, expected, simple, "Wrong upload type for %d bytes: %s", size, path)
+	}
+}
+
 // TestUploadSessionSmallFS verifies is the same test as TestUploadSessionSmall, but uses
 // the filesystem itself to perform the uploads instead of testing the internal upload
 // functions directly
@@ -145,3 +186,54 @@ func TestUploadSessionLargeFS(t *testing.T) {
 	assert.Equal(t, graph.QuickXORHash(&contents), graph.QuickXORHash(&downloaded),
 		"Downloaded content did not match original content.")
 }
+
+// An upload URL that is about to expire partway through an upload should be
+// replaced, and the upload should still finish with the right content.
+func TestUploadSessionRenewsExpiringURL(t *testing.T) {
+	testDir, err := fs.GetPath("/onedriver_tests", auth)
+	require.NoError(t, err)
+	inode := NewInode("uploadSessionRenewal.bin", 0644, testDir)
+	data := bytes.Repeat([]byte("renew"), int(uploadChunkSize*5/2)/5)
+	inode.setContent(fs, data)
+
+	session, err := NewUploadSession(inode, &data)
+	require.NoError(t, err)
+	// every upload URL is "about to expire" for this session
+	session.urlMargin = 1000 * time.Hour
+	require.NoError(t, session.Upload(auth))
+	assert.Equal(t, 1, session.renewals, "Upload URL should have been replaced once.")
+
+	// trying again gets to replace the URL again instead of adding to the count
+	require.NoError(t, session.Upload(auth))
+	assert.Equal(t, 1, session.renewals, "Renewals should be counted per upload.")
+
+	resp, _, err := graph.GetItemContent(session.ID, auth)
+	require.NoError(t, err)
+	assert.Equal(t, graph.QuickXORHash(&data), graph.QuickXORHash(&resp),
+		"Uploaded content did not match original content.")
+}
+
+// A throttled chunk needs to pass on how long the server wants us to wait, so
+// the upload manager can hold off.
+func TestUploadChunkRetryAfter(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	data := []byte("throttled chunk")
+	session := UploadSession{
+		ID:        "chunkRetryAfter",
+		UploadURL: server.URL,
+		Data:      data,
+		Size:      uint64(len(data)),
+	}
+	// a token that's still good, so nothing gets refreshed
+	chunkAuth := &graph.Auth{ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	_, status, wait, err := session.uploadChunk(chunkAuth, 0)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.Equal(t, 7*time.Second, wait)
+}
@@ -0,0 +1,289 @@
+package fs
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/rs/zerolog/log"
+)
+
+// all of the extended attributes onedriver provides are under this prefix
+const xattrPrefix = "user.onedriver."
+
+// xattrThumbnail is followed by the size of the thumbnail to fetch, e.g.
+// "user.onedriver.thumbnail.small"
+const xattrThumbnail = xattrPrefix + "thumbnail."
+
+// xattrUploadProgress is "uploaded/total" in bytes for files that are being
+// uploaded, like "10485760/26214400". Read-only.
+const xattrUploadProgress = xattrPrefix + "upload_progress"
+
+// xattrCreated is when an item was created, in RFC 3339 format. go-fuse has no
+// way to report a birth time through statx, so this is the only place to get
+// it. Read-only, and not listed so tools copying xattrs don't trip over it.
+const xattrCreated = xattrPrefix + "created"
+
+// Linux refuses to return extended attributes larger than this
+const xattrSizeMax = 64 * 1024
+
+// xattrValue copies an attribute's value to the destination buffer, or reports
+// how big the buffer needs to be if it is too small.
+func xattrValue(value []byte, dest []byte) (uint32, fuse.Status) {
+	if len(value) > xattrSizeMax {
+		return 0, fuse.Status(syscall.E2BIG)
+	}
+	if len(dest) < len(value) {
+		return uint32(len(value)), fuse.ERANGE
+	}
+	return uint32(copy(dest, value)), fuse.OK
+}
+
+// GetXAttr returns the value of one of the extended attributes onedriver
+// provides for an item.
+func (f *Filesystem) GetXAttr(cancel <-chan struct{}, in *fuse.InHeader, attr string, dest []byte) (uint32, fuse.Status) {
+	inode := f.GetNodeID(in.NodeId)
+	if inode == nil {
+		return 0, fuse.ENOENT
+	}
+	if !strings.HasPrefix(attr, xattrPrefix) {
+		return 0, fuse.ENOATTR
+	}
+	log.Trace().
+		Str("op", "GetXAttr").
+		Uint64("nodeID", in.NodeId).
+		Str("id", inode.ID()).
+		Str("path", inode.Path()).
+		Str("attr", attr).
+		Msg("")
+
+	if strings.HasPrefix(attr, xattrThumbnail) {
+		thumbnail, status := f.getThumbnail(inode, strings.TrimPrefix(attr, xattrThumbnail))
+		if status != fuse.OK {
+			return 0, status
+		}
+		return xattrValue(thumbnail, dest)
+	}
+	if attr == xattrDurable {
+		if !inode.Durable() {
+			return 0, fuse.ENOATTR
+		}
+		return xattrValue([]byte("1"), dest)
+	}
+	if attr == xattrFavorite {
+		if !inode.Favorite() {
+			return 0, fuse.ENOATTR
+		}
+		return xattrValue([]byte("1"), dest)
+	}
+	if attr == xattrCreated {
+		created := inode.CreateTime()
+		if created.IsZero() {
+			return 0, fuse.ENOATTR
+		}
+		return xattrValue([]byte(created.Format(time.RFC3339)), dest)
+	}
+	if attr == xattrUploadProgress {
+		uploaded, total, ok := f.uploads.UploadProgress(inode.ID())
+		if !ok {
+			return 0, fuse.ENOATTR
+		}
+		return xattrValue([]byte(fmt.Sprintf("%d/%d", uploaded, total)), dest)
+	}
+	if attr == xattrConflictBehavior {
+		inode.RLock()
+		behavior := inode.conflictBehavior
+		inode.RUnlock()
+		if behavior == "" {
+			return 0, fuse.ENOATTR
+		}
+		return xattrValue([]byte(behavior), dest)
+	}
+	return 0, fuse.ENOATTR
+}
+
+// SetXAttr sets one of the extended attributes users can change, which are kept
+// in the item's local metadata.
+func (f *Filesystem) SetXAttr(cancel <-chan struct{}, in *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
+	inode := f.GetNodeID(in.NodeId)
+	if inode == nil {
+		return fuse.ENOENT
+	}
+	if !strings.HasPrefix(attr, xattrPrefix) {
+		return fuse.Status(syscall.ENOTSUP)
+	} else if attr == xattrSync {
+		f.Sync()
+		return fuse.OK
+	} else if attr == xattrRefresh {
+		if !inode.IsDir() {
+			return fuse.ENOTDIR
+		}
+		if err := f.RefreshChildren(inode.ID()); err != nil {
+			log.Error().Err(err).Str("path", inode.Path()).Msg("Could not refresh directory.")
+			return fuse.EREMOTEIO
+		}
+		return fuse.OK
+	} else if attr == xattrVerify {
+		if inode.IsDir() {
+			return fuse.EISDIR
+		}
+		f.forgetContentHash(inode.ID())
+		return fuse.OK
+	} else if attr == xattrFavorite {
+		favorite, ok := parseDurable(string(data))
+		if !ok {
+			return fuse.EINVAL
+		}
+		return f.setFavorite(inode, favorite)
+	} else if attr != xattrConflictBehavior && attr != xattrDurable {
+		return fuse.EPERM
+	}
+	value := strings.TrimSpace(string(data))
+	durable, validDurable := parseDurable(value)
+	if inode.IsDir() {
+		return fuse.EINVAL
+	} else if attr == xattrConflictBehavior && !validConflictBehavior(value) {
+		return fuse.EINVAL
+	} else if attr == xattrDurable && !validDurable {
+		return fuse.EINVAL
+	}
+	log.Info().
+		Str("op", "SetXAttr").
+		Uint64("nodeID", in.NodeId).
+		Str("id", inode.ID()).
+		Str("path", inode.Path()).
+		Str("attr", attr).
+		Str("value", value).
+		Msg("")
+
+	inode.Lock()
+	if attr == xattrDurable {
+		inode.durable = durable
+	} else {
+		inode.conflictBehavior = value
+	}
+	inode.Unlock()
+	f.serializeID(inode.ID())
+	return fuse.OK
+}
+
+// RemoveXAttr removes one of the extended attributes users can change.
+func (f *Filesystem) RemoveXAttr(cancel <-chan struct{}, in *fuse.InHeader, attr string) fuse.Status {
+	inode := f.GetNodeID(in.NodeId)
+	if inode == nil {
+		return fuse.ENOENT
+	}
+	if !strings.HasPrefix(attr, xattrPrefix) {
+		return fuse.Status(syscall.ENOTSUP)
+	}
+	if attr == xattrFavorite {
+		if !inode.Favorite() {
+			return fuse.ENOATTR
+		}
+		return f.setFavorite(inode, false)
+	}
+	inode.Lock()
+	found := false
+	switch attr {
+	case xattrConflictBehavior:
+		found = inode.conflictBehavior != ""
+		inode.conflictBehavior = ""
+	case xattrDurable:
+		found = inode.durable
+		inode.durable = false
+	default:
+		inode.Unlock()
+		return fuse.EPERM
+	}
+	inode.Unlock()
+	if !found {
+		return fuse.ENOATTR
+	}
+	f.serializeID(inode.ID())
+	return fuse.OK
+}
+
+// ListXAttr lists an item's extended attributes. Attributes that require a
+// round-trip to the server (like thumbnails) are not listed so that tools
+// copying xattrs do not trigger a fetch for every file.
+func (f *Filesystem) ListXAttr(cancel <-chan struct{}, in *fuse.InHeader, dest []byte) (uint32, fuse.Status) {
+	inode := f.GetNodeID(in.NodeId)
+	if inode == nil {
+		return 0, fuse.ENOENT
+	}
+	// names are null-terminated
+	names := ""
+	inode.RLock()
+	if inode.conflictBehavior != "" {
+		names += xattrConflictBehavior + "\x00"
+	}
+	if inode.durable {
+		names += xattrDurable + "\x00"
+	}
+	if inode.DriveItem.Favorite != nil {
+		names += xattrFavorite + "\x00"
+	}
+	id := inode.DriveItem.ID
+	inode.RUnlock()
+	if f.uploads.HasPendingUpload(id) {
+		names += xattrUploadProgress + "\x00"
+	}
+	if names == "" {
+		return 0, fuse.OK
+	}
+	return xattrValue([]byte(names), dest)
+}
+
+// thumbnailID is the key a thumbnail is stored under in the thumbnail cache.
+func thumbnailID(id string, size string) string {
+	return fmt.Sprintf("%s-%s", id, size)
+}
+
+// getThumbnail returns one of an item's server-generated thumbnails, fetching
+// it if it is not already cached.
+func (f *Filesystem) getThumbnail(inode *Inode, size string) ([]byte, fuse.Status) {
+	valid := false
+	for _, s := range graph.ThumbnailSizes {
+		valid = valid || s == size
+	}
+	id := inode.ID()
+	if !valid || inode.IsDir() || isLocalID(id) {
+		return nil, fuse.ENOATTR
+	}
+
+	key := thumbnailID(id, size)
+	if f.thumbnails.HasContent(key) {
+		return f.thumbnails.Get(key), fuse.OK
+	}
+
+	ctx := log.With().
+		Str("id", id).
+		Str("path", inode.Path()).
+		Str("size", size).
+		Logger()
+	thumbnail, err := graph.GetItemThumbnail(id, size, f.auth)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "HTTP 404") {
+			// the server did not generate a thumbnail for this item
+			return nil, fuse.ENOATTR
+		}
+		ctx.Error().Err(err).Msg("Could not fetch thumbnail.")
+		return nil, fuse.EREMOTEIO
+	}
+	ctx.Debug().Msg("Fetched thumbnail.")
+	if err = f.thumbnails.Insert(key, thumbnail); err != nil {
+		ctx.Warn().Err(err).Msg("Could not cache thumbnail.")
+	}
+	return thumbnail, fuse.OK
+}
+
+// purgeThumbnails removes an item's cached thumbnails, for instance after its
+// content changes.
+func (f *Filesystem) purgeThumbnails(id string) {
+	for _, size := range graph.ThumbnailSizes {
+		f.thumbnails.Delete(thumbnailID(id, size))
+	}
+}
@@ -0,0 +1,125 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jstaf/onedriver/fs/graph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Thumbnails should be fetched from the server on request and cached locally.
+func TestThumbnailXAttr(t *testing.T) {
+	t.Parallel()
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for x := 0; x < 256; x++ {
+		for y := 0; y < 256; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+	fname := filepath.Join(TestDir, "thumbnail.png")
+	require.NoError(t, ioutil.WriteFile(fname, buf.Bytes(), 0644))
+
+	var inode *Inode
+	require.Eventually(t, func() bool {
+		inode, _ = fs.GetPath("/onedriver_tests/thumbnail.png", auth)
+		return inode != nil && !isLocalID(inode.ID())
+	}, retrySeconds, time.Second, "Image was never uploaded.")
+
+	// the server generates thumbnails asynchronously after upload
+	var thumbnail []byte
+	assert.Eventually(t, func() bool {
+		size, err := syscall.Getxattr(fname, xattrThumbnail+"small", nil)
+		if err != nil || size == 0 {
+			return false
+		}
+		thumbnail = make([]byte, size)
+		_, err = syscall.Getxattr(fname, xattrThumbnail+"small", thumbnail)
+		return err == nil
+	}, retrySeconds, 2*time.Second, "Could not fetch thumbnail.")
+	assert.True(t, fs.thumbnails.HasContent(thumbnailID(inode.ID(), "small")),
+		"Thumbnail was not cached.")
+
+	_, err := syscall.Getxattr(fname, xattrThumbnail+"gigantic", nil)
+	assert.Equal(t, syscall.ENODATA, err, "Invalid thumbnail size should not exist.")
+}
+
+// Upload progress should only be readable while a file is being uploaded.
+func TestUploadProgressXAttr(t *testing.T) {
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_upload_progress_xattr"), Options{})
+	inode := NewInode("progress.txt", 0644|fuse.S_IFREG, nil)
+	_, err := cache.InsertPath("/onedriver_tests/progress.txt", auth, inode)
+	require.NoError(t, err)
+	inode.setContent(cache, []byte("uploading very slowly"))
+	inode.hasChanges = true
+	header := fuse.InHeader{NodeId: inode.NodeID()}
+
+	_, status := cache.GetXAttr(nil, &header, xattrUploadProgress, nil)
+	assert.Equal(t, fuse.ENOATTR, status, "File without an upload should have no progress.")
+
+	id := inode.ID()
+	release := make(chan struct{})
+	oldUpload := startUpload
+	defer func() { startUpload = oldUpload }()
+	startUpload = func(session *UploadSession, auth *graph.Auth) error {
+		if session.OldID != id {
+			return oldUpload(session, auth)
+		}
+		session.setState(uploadStarted, nil)
+		session.setProgress(5)
+		<-release
+		return session.setState(uploadErrored, errors.New("cancelled by test"))
+	}
+	defer close(release)
+	require.NoError(t, cache.uploads.QueueUpload(inode))
+
+	assert.Eventually(t, func() bool {
+		dest := make([]byte, 64)
+		n, status := cache.GetXAttr(nil, &header, xattrUploadProgress, dest)
+		return status == fuse.OK && string(dest[:n]) == "5/21"
+	}, 10*time.Second, 100*time.Millisecond, "Upload progress was not reported.")
+}
+
+// The creation time the server reports should survive a trip through the
+// metadata cache and be readable from the created xattr.
+func TestCreatedXAttr(t *testing.T) {
+	t.Parallel()
+	cache := NewFilesystem(auth, filepath.Join(testDBLoc, "test_created_xattr"), Options{})
+	var item graph.DriveItem
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"id": "created-xattr",
+		"name": "created.txt",
+		"createdDateTime": "2021-06-01T15:04:05Z",
+		"lastModifiedDateTime": "2022-01-02T03:04:05Z",
+		"file": {}
+	}`), &item))
+	require.NotNil(t, item.CreateTime)
+	inode, err := NewInodeJSON(NewInodeDriveItem(&item).AsJSON())
+	require.NoError(t, err)
+	inode.DriveItem.Parent = &graph.DriveItemParent{ID: cache.root}
+	cache.InsertChild(cache.root, inode)
+	header := &fuse.InHeader{NodeId: inode.NodeID()}
+
+	dest := make([]byte, 64)
+	n, status := cache.GetXAttr(nil, header, xattrCreated, dest)
+	require.Equal(t, fuse.OK, status)
+	assert.Equal(t, "2021-06-01T15:04:05Z", string(dest[:n]))
+	assert.Equal(t, fuse.EPERM, cache.SetXAttr(nil, &fuse.SetXAttrIn{InHeader: *header},
+		xattrCreated, []byte("2000-01-01T00:00:00Z")), "Creation time should be read-only.")
+
+	local := NewInode("new.txt", 0644|fuse.S_IFREG, cache.GetID(cache.root))
+	assert.False(t, local.CreateTime().IsZero(), "New items should be created now.")
+}
@@ -0,0 +1,101 @@
+package ui
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jstaf/onedriver/fs"
+)
+
+// a running mount rewrites its status at least every delta interval, if it
+// hasn't in this long something is wrong with it
+const statusStaleAfter = 2 * time.Minute
+
+// problems older than this no longer affect a mount's icon, but are still
+// listed in its details
+const statusRecentProblems = 24 * time.Hour
+
+// MountStatus is how a mount's health is shown in the launcher.
+type MountStatus struct {
+	// IconName is a themed icon name, empty if there's no status to show.
+	IconName string
+	// Summary is a one-line description of the mount's status.
+	Summary string
+	// Problems are the sync problems the mount reported, newest first.
+	Problems []fs.StatusProblem
+}
+
+// NewMountStatus summarizes a mount's status for display. A nil status means
+// the mount has not reported one.
+func NewMountStatus(status *fs.Status, now time.Time) MountStatus {
+	if status == nil {
+		return MountStatus{Summary: "Status unavailable"}
+	}
+	m := MountStatus{Problems: make([]fs.StatusProblem, 0, len(status.Problems))}
+	recent := 0
+	for i := len(status.Problems) - 1; i >= 0; i-- {
+		problem := status.Problems[i]
+		m.Problems = append(m.Problems, problem)
+		if now.Sub(problem.Time) < statusRecentProblems {
+			recent++
+		}
+	}
+
+	switch {
+	case now.Sub(status.Updated) > statusStaleAfter:
+		m.IconName = "dialog-error-symbolic"
+		m.Summary = "Not responding"
+	case status.ReauthRequired:
+		m.IconName = "dialog-password-symbolic"
+		m.Summary = "Sign-in required"
+	case status.Offline:
+		m.IconName = "network-offline-symbolic"
+		m.Summary = "Offline since " + status.OfflineSince.Local().Format("Jan 2 15:04")
+	case status.QuotaFull:
+		m.IconName = "dialog-warning-symbolic"
+		m.Summary = "OneDrive is full"
+	case recent > 0:
+		m.IconName = "dialog-warning-symbolic"
+		m.Summary = plural(recent, "sync problem", "sync problems")
+	case status.PendingUploads > 0:
+		m.IconName = "emblem-synchronizing-symbolic"
+		m.Summary = "Uploading " + plural(status.PendingUploads, "file", "files")
+	default:
+		m.IconName = "emblem-ok-symbolic"
+		m.Summary = "Up to date"
+	}
+	return m
+}
+
+// GetMountStatus reads the status last reported by a mount. instance is the
+// mount's systemd-escaped name.
+func GetMountStatus(cacheDir, instance string) MountStatus {
+	status, err := fs.ReadStatus(filepath.Join(cacheDir, instance))
+	if err != nil {
+		status = nil
+	}
+	return NewMountStatus(status, time.Now())
+}
+
+// Details describes a mount's status and problems in full.
+func (m MountStatus) Details() string {
+	if len(m.Problems) == 0 {
+		return m.Summary + "\n\nNo sync problems have been reported."
+	}
+	var b strings.Builder
+	b.WriteString(m.Summary + "\n")
+	for _, problem := range m.Problems {
+		fmt.Fprintf(&b, "\n%s  %s\n    %s",
+			problem.Time.Local().Format("Jan 2 15:04"), problem.Path, problem.Message)
+	}
+	return b.String()
+}
+
+func plural(n int, singular string, plural string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, singular)
+	}
+	return fmt.Sprintf("%d %s", n, plural)
+}
@@ -0,0 +1,48 @@
+package ui
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jstaf/onedriver/fs"
+	"github.com/stretchr/testify/assert"
+)
+
+// The status shown for a mount should reflect the worst thing it has reported.
+func TestNewMountStatus(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	problems := []fs.StatusProblem{
+		{Time: now.Add(-time.Minute), Path: "/a.txt", Message: "Upload failed: HTTP 500"},
+		{Time: now, Path: "/b.txt", Message: "Deleted on the server, kept the local copy."},
+	}
+
+	tests := []struct {
+		name   string
+		status *fs.Status
+		icon   string
+	}{
+		{"missing", nil, ""},
+		{"healthy", &fs.Status{Updated: now}, "emblem-ok-symbolic"},
+		{"uploading", &fs.Status{Updated: now, PendingUploads: 3}, "emblem-synchronizing-symbolic"},
+		{"problems", &fs.Status{Updated: now, PendingUploads: 3, Problems: problems}, "dialog-warning-symbolic"},
+		{"old problems", &fs.Status{
+			Updated:  now,
+			Problems: []fs.StatusProblem{{Time: now.Add(-48 * time.Hour)}},
+		}, "emblem-ok-symbolic"},
+		{"offline", &fs.Status{Updated: now, Offline: true, Problems: problems}, "network-offline-symbolic"},
+		{"reauth", &fs.Status{Updated: now, Offline: true, ReauthRequired: true}, "dialog-password-symbolic"},
+		{"stale", &fs.Status{Updated: now.Add(-time.Hour)}, "dialog-error-symbolic"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.icon, NewMountStatus(test.status, now).IconName,
+			"Wrong icon for %s mount.", test.name)
+	}
+
+	status := NewMountStatus(&fs.Status{Updated: now, Problems: problems}, now)
+	assert.Equal(t, "2 sync problems", status.Summary)
+	if assert.Len(t, status.Problems, 2) {
+		assert.Equal(t, "/b.txt", status.Problems[0].Path, "Problems should be newest first.")
+	}
+	assert.Contains(t, status.Details(), "Upload failed: HTTP 500")
+}